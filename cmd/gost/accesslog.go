@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/go-gost/core/logger"
+)
+
+// The handler metadata keys of the access log.
+const (
+	// mdKeyAccessLog is the name of the logger the access log is written to.
+	mdKeyAccessLog = "accessLog"
+	// mdKeyAccessLogFormat is json or a text/template of accessEntry.
+	mdKeyAccessLogFormat = "accessLogFormat"
+)
+
+const (
+	accessLogFormatJSON = "json"
+)
+
+// accessLogger writes the access records to a logger,
+// as the message of the entry marshaled in json format, or rendered by the template.
+type accessLogger struct {
+	logger logger.Logger
+	tmpl   *template.Template
+}
+
+func newAccessLogger(log logger.Logger, format string) (*accessLogger, error) {
+	l := &accessLogger{
+		logger: log,
+	}
+	if format == "" || format == accessLogFormatJSON {
+		return l, nil
+	}
+
+	tmpl, err := template.New("access").
+		Funcs(template.FuncMap{"join": strings.Join}).
+		Parse(format)
+	if err != nil {
+		return nil, err
+	}
+	l.tmpl = tmpl
+	return l, nil
+}
+
+// accessEntry is the snapshot of the record of a connection written to the access log,
+// the fields are the fields of connRecord available to the template.
+type accessEntry struct {
+	Time     time.Time     `json:"time"`
+	SID      string        `json:"sid"`
+	Client   string        `json:"client"`
+	User     string        `json:"user"`
+	Service  string        `json:"service"`
+	Handler  string        `json:"handler"`
+	Target   string        `json:"target"`
+	Chain    string        `json:"chain"`
+	Nodes    []string      `json:"nodes"`
+	BytesIn  int64         `json:"bytesIn"`
+	BytesOut int64         `json:"bytesOut"`
+	Duration time.Duration `json:"duration"`
+	Reason   string        `json:"reason"`
+}
+
+func (l *accessLogger) log(r *connRecord) {
+	// the entry is rendered outside the lock of the record, as the template may be slow.
+	r.mu.Lock()
+	e := accessEntry{
+		Time:     r.Time,
+		SID:      r.SID,
+		Client:   r.Client,
+		User:     r.User,
+		Service:  r.Service,
+		Handler:  r.Handler,
+		Target:   r.Target,
+		Chain:    r.Chain,
+		Nodes:    slices.Clone(r.Nodes),
+		BytesIn:  r.BytesIn,
+		BytesOut: r.BytesOut,
+		Duration: r.Duration,
+		Reason:   r.Reason,
+	}
+	r.mu.Unlock()
+
+	if l.tmpl == nil {
+		b, err := json.Marshal(&e)
+		if err != nil {
+			l.logger.Errorf("access log: %v", err)
+			return
+		}
+		l.logger.Info(string(b))
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := l.tmpl.Execute(&buf, &e); err != nil {
+		l.logger.Errorf("access log: %v", err)
+		return
+	}
+	l.logger.Info(buf.String())
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+	"github.com/go-gost/core/auth"
+	"github.com/go-gost/core/logger"
+	"github.com/go-gost/core/service"
+	"github.com/go-gost/x/api"
+	"github.com/go-gost/x/config"
+	"github.com/go-gost/x/registry"
+)
+
+// uiFS is the web UI, a single page application using the status, connection,
+// event and config APIs by the paths relative to the UI.
+//
+//go:embed ui
+var uiFS embed.FS
+
+// apiService serves the API extensions of gost, the other requests are proxied to
+// the API service of go-gost/x, which listens on a loopback address.
+type apiService struct {
+	s      *http.Server
+	ln     net.Listener
+	api    service.Service
+	cancel context.CancelFunc
+}
+
+func newAPIService(cfg *config.APIConfig, auther auth.Authenticator) (service.Service, error) {
+	xapi, err := api.NewService(
+		"127.0.0.1:0",
+		api.PathPrefixOption(cfg.PathPrefix),
+		api.AccessLogOption(cfg.AccessLog),
+		api.AutherOption(auther),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		xapi.Close()
+		return nil, err
+	}
+
+	gin.SetMode(gin.ReleaseMode)
+
+	r := gin.New()
+	r.Use(gin.Recovery())
+
+	router := r.Group("")
+	if cfg.PathPrefix != "" {
+		router = router.Group(cfg.PathPrefix)
+	}
+	router.Use(cors.New((cors.Config{
+		AllowAllOrigins:     true,
+		AllowMethods:        []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowHeaders:        []string{"*"},
+		AllowPrivateNetwork: true,
+	})))
+	if cfg.AccessLog {
+		router.Use(mwAPILogger())
+	}
+
+	conns := router.Group("/conns")
+	conns.Use(mwAPIBasicAuth(auther))
+	conns.GET("", listConns)
+	conns.DELETE("", killConns)
+	conns.DELETE("/:id", killConn)
+
+	router.GET("/events", mwAPIBasicAuth(auther), streamEvents)
+	router.GET("/status", mwAPIBasicAuth(auther), getStatus)
+	router.GET("/logs", mwAPIBasicAuth(auther), getLogs)
+	router.GET("/schedules", mwAPIBasicAuth(auther), getSchedules)
+
+	quota := router.Group("/quotas")
+	quota.Use(mwAPIBasicAuth(auther))
+	quota.GET("", listQuotas)
+	quota.DELETE("/:quota", resetQuota)
+
+	services := router.Group("/services")
+	services.Use(mwAPIBasicAuth(auther))
+	services.POST("/:service/pause", pauseServiceHandler(true))
+	services.POST("/:service/resume", pauseServiceHandler(false))
+	services.GET("/:service/route", getRoute)
+
+	// the components built by gost are created and updated by gost, the other config requests are proxied.
+	configs := router.Group("/config")
+	configs.Use(mwAPIBasicAuth(auther))
+	configRoutes(configs)
+
+	ui, _ := fs.Sub(uiFS, "ui")
+	router.Group("/ui", mwAPIBasicAuth(auther)).StaticFS("/", http.FS(ui))
+
+	// the preflight requests are also proxied, which are answered by the CORS middleware of the proxied API.
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{
+		Scheme: "http",
+		Host:   xapi.Addr().String(),
+	})
+	configPath := path.Join("/", cfg.PathPrefix, "config")
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		req := resp.Request
+		if req.Method != http.MethodGet && req.Method != http.MethodOptions &&
+			resp.StatusCode == http.StatusOK &&
+			(req.URL.Path == configPath || strings.HasPrefix(req.URL.Path, configPath+"/")) {
+			publishConfigApplied(req)
+		}
+		return nil
+	}
+	r.NoRoute(gin.WrapH(proxy))
+
+	return &apiService{
+		s: &http.Server{
+			Handler: r,
+		},
+		ln:  ln,
+		api: xapi,
+	}, nil
+}
+
+func (s *apiService) Serve() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	go watchServices(ctx, time.Second)
+
+	go s.api.Serve()
+	return s.s.Serve(s.ln)
+}
+
+func (s *apiService) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+func (s *apiService) Close() error {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.api.Close()
+	return s.s.Close()
+}
+
+func mwAPILogger() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		startTime := time.Now()
+		ctx.Next()
+		duration := time.Since(startTime)
+
+		logger.Default().WithFields(map[string]any{
+			"kind":     "api",
+			"method":   ctx.Request.Method,
+			"uri":      ctx.Request.RequestURI,
+			"code":     ctx.Writer.Status(),
+			"client":   ctx.ClientIP(),
+			"duration": duration,
+		}).Infof("| %3d | %13v | %15s | %-7s %s",
+			ctx.Writer.Status(), duration, ctx.ClientIP(), ctx.Request.Method, ctx.Request.RequestURI)
+	}
+}
+
+func mwAPIBasicAuth(auther auth.Authenticator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if auther == nil {
+			return
+		}
+		u, p, _ := c.Request.BasicAuth()
+		if _, ok := auther.Authenticate(c, u, p); !ok {
+			c.Writer.Header().Set("WWW-Authenticate", "Basic")
+			c.AbortWithStatus(http.StatusUnauthorized)
+		}
+	}
+}
+
+func writeAPIError(c *gin.Context, status, code int, msg string) {
+	c.JSON(status, api.NewError(status, code, msg))
+}
+
+// connList is the response of the connection API.
+type connList struct {
+	Count int        `json:"count"`
+	Conns []connInfo `json:"conns"`
+}
+
+func newConnList(recs []*connRecord) connList {
+	list := connList{
+		Count: len(recs),
+		Conns: make([]connInfo, 0, len(recs)),
+	}
+	for _, r := range recs {
+		list.Conns = append(list.Conns, r.info())
+	}
+	return list
+}
+
+// connFilterFromQuery parses the filter from the query parameters service, user and client.
+func connFilterFromQuery(c *gin.Context) (*connFilter, error) {
+	f := &connFilter{
+		Service: strings.TrimSpace(c.Query("service")),
+		User:    strings.TrimSpace(c.Query("user")),
+	}
+	if f.Service != "" && registry.ServiceRegistry().Get(f.Service) == nil {
+		return nil, api.NewError(http.StatusBadRequest, api.ErrCodeNotFound, fmt.Sprintf("service %s not found", f.Service))
+	}
+	if v := strings.TrimSpace(c.Query("client")); v != "" {
+		ipNet, err := parseClientFilter(v)
+		if err != nil {
+			return nil, api.NewError(http.StatusBadRequest, api.ErrCodeInvalid, fmt.Sprintf("invalid client %s", v))
+		}
+		f.Client = ipNet
+	}
+	return f, nil
+}
+
+// listConns lists the active connections of all services, filtered by the query parameters
+// service, user and client, the client is an IP address or a CIDR.
+func listConns(c *gin.Context) {
+	f, err := connFilterFromQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, newConnList(connections.list(f)))
+}
+
+// killConns force-closes the connections matched by the query parameters,
+// at least one filter is required.
+func killConns(c *gin.Context) {
+	f, err := connFilterFromQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+	if f.empty() {
+		writeAPIError(c, http.StatusBadRequest, api.ErrCodeInvalid, "service, user or client is required")
+		return
+	}
+
+	recs := connections.list(f)
+	for _, r := range recs {
+		r.kill()
+	}
+	c.JSON(http.StatusOK, newConnList(recs))
+}
+
+// killConn force-closes the connection by ID.
+func killConn(c *gin.Context) {
+	id := strings.TrimSpace(c.Param("id"))
+	r := connections.get(id)
+	if r == nil {
+		writeAPIError(c, http.StatusBadRequest, api.ErrCodeNotFound, fmt.Sprintf("connection %s not found", id))
+		return
+	}
+
+	r.kill()
+	c.JSON(http.StatusOK, newConnList([]*connRecord{r}))
+}
+
+// getStatus gets the runtime state of the services, chains, hops and nodes in the config,
+// with the connection counts and the total bytes of the services.
+func getStatus(c *gin.Context) {
+	var status *apiStatus
+	config.OnUpdate(func(cfg *config.Config) error {
+		status = buildStatus(cfg)
+		return nil
+	})
+	c.JSON(http.StatusOK, status)
+}
+
+// logList is the response of the log API.
+type logList struct {
+	Count int        `json:"count"`
+	Logs  []logEntry `json:"logs"`
+}
+
+// getLogs gets the latest log entries, at most the query parameter n entries (default 100)
+// after the entry of the query parameter after.
+func getLogs(c *gin.Context) {
+	after, _ := strconv.ParseUint(c.Query("after"), 10, 64)
+	n, _ := strconv.Atoi(c.Query("n"))
+	if n <= 0 {
+		n = 100
+	}
+
+	logs := logTail.tail(after, n)
+	c.JSON(http.StatusOK, logList{
+		Count: len(logs),
+		Logs:  logs,
+	})
+}
+
+// pauseServiceHandler pauses or resumes the service, the new connections of a paused service are closed,
+// the active connections are not affected.
+func pauseServiceHandler(pause bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := strings.TrimSpace(c.Param("service"))
+		if registry.ServiceRegistry().Get(name) == nil {
+			writeAPIError(c, http.StatusBadRequest, api.ErrCodeNotFound, fmt.Sprintf("service %s not found", name))
+			return
+		}
+
+		if pauseService(name, pause) {
+			typ := eventServiceResumed
+			if pause {
+				typ = eventServicePaused
+			}
+			events.publish(typ, map[string]any{"service": name})
+		}
+		c.JSON(http.StatusOK, api.Response{Msg: "OK"})
+	}
+}
+
+// getSchedules returns the states of the schedules.
+func getSchedules(c *gin.Context) {
+	c.JSON(http.StatusOK, map[string]any{
+		"schedules": buildScheduleStatus(),
+	})
+}
+
+// listQuotas returns the usage of the quotas, filtered by the query parameters quota and key.
+func listQuotas(c *gin.Context) {
+	c.JSON(http.StatusOK, map[string]any{
+		"quotas": quotas.Load().list(c.Query("quota"), c.Query("key")),
+	})
+}
+
+// resetQuota resets the usage of the key of the query parameter of the quota, or all keys if it is not set.
+func resetQuota(c *gin.Context) {
+	name := strings.TrimSpace(c.Param("quota"))
+	key := c.Query("key")
+	if !quotas.Load().reset(name, key) {
+		writeAPIError(c, http.StatusBadRequest, api.ErrCodeNotFound, fmt.Sprintf("quota %s not found", name))
+		return
+	}
+	events.publish(eventQuotaReset, map[string]any{
+		"quota": name,
+		"key":   key,
+	})
+	c.JSON(http.StatusOK, api.Response{Msg: "OK"})
+}
+
+// getRoute explains the routing of the test request by the routing table of the service,
+// the request is the query parameters addr (host:port), network (default tcp), user and client.
+func getRoute(c *gin.Context) {
+	name := strings.TrimSpace(c.Param("service"))
+	addr := c.Query("addr")
+	if addr == "" {
+		writeAPIError(c, http.StatusBadRequest, api.ErrCodeInvalid, "addr is required")
+		return
+	}
+	network := c.DefaultQuery("network", "tcp")
+
+	req := newRouteRequest(network, addr, "", c.Query("user"), c.Query("client"))
+	e, ok := explainRoute(c.Request.Context(), name, req)
+	if !ok {
+		writeAPIError(c, http.StatusBadRequest, api.ErrCodeNotFound, fmt.Sprintf("service %s has no routing table", name))
+		return
+	}
+	c.JSON(http.StatusOK, e)
+}
+
+// streamEvents streams the events as Server-Sent Events, filtered by the query parameter types,
+// which is a comma separated list of the event types or the type prefixes such as service.
+// The events after the Last-Event-ID header or the lastEventId query parameter are replayed
+// if they are still in the history.
+func streamEvents(c *gin.Context) {
+	var types []string
+	for _, t := range strings.Split(c.Query("types"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types = append(types, t)
+		}
+	}
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if v := c.Query("lastEventId"); v != "" {
+		lastEventID = v
+	}
+	lastID, _ := strconv.ParseUint(lastEventID, 10, 64)
+
+	sub := events.subscribe(types, lastID)
+	defer events.unsubscribe(sub)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case e := <-sub.ch:
+			if n := sub.dropped.Swap(0); n > 0 {
+				fmt.Fprintf(c.Writer, ": %d events dropped\n\n", n)
+			}
+			data, _ := json.Marshal(e)
+			fmt.Fprintf(c.Writer, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+		case <-ticker.C:
+			fmt.Fprint(c.Writer, ": ping\n\n")
+		case <-c.Request.Context().Done():
+			return
+		}
+		c.Writer.Flush()
+	}
+}
+
+// apiClient is the client of the API used by the subcommands.
+type apiClient struct {
+	url    *url.URL
+	auth   *config.AuthConfig
+	client *http.Client
+}
+
+// newAPIClient creates the client of the API at addr, which is in the form of the -api flag,
+// [user:pass@]host:port[?pathPrefix=/api&authFile=file], optionally with the scheme http or https.
+func newAPIClient(addr string) (*apiClient, error) {
+	addr = strings.TrimSpace(addr)
+	if addr == "" {
+		return nil, errors.New("api: address is required")
+	}
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("api: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("api: unsupported scheme %s", u.Scheme)
+	}
+	if strings.HasPrefix(u.Host, ":") {
+		u.Host = "localhost" + u.Host
+	}
+
+	c := &apiClient{
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		c.auth = &config.AuthConfig{
+			Username: u.User.Username(),
+			Password: password,
+		}
+	}
+	query := u.Query()
+	if v := query.Get("authFile"); v != "" {
+		if c.auth, err = readAuthFile(v); err != nil {
+			return nil, err
+		}
+	}
+
+	c.url = &url.URL{
+		Scheme: u.Scheme,
+		Host:   u.Host,
+		Path:   strings.TrimSuffix(query.Get("pathPrefix"), "/"),
+	}
+	return c, nil
+}
+
+func (c *apiClient) newRequest(ctx context.Context, method, path string, query url.Values) (*http.Request, error) {
+	u := *c.url
+	u.Path += path
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.auth != nil {
+		req.SetBasicAuth(c.auth.Username, c.auth.Password)
+	}
+	return req, nil
+}
+
+// do sends the request to the API and decodes the JSON response into v.
+func (c *apiClient) do(method, path string, query url.Values, v any) error {
+	req, err := c.newRequest(context.Background(), method, path, query)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return apiResponseError(resp, body)
+	}
+
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(body, v)
+}
+
+// stream sends the GET request to the API for a streaming response, such as the event stream,
+// which is not limited by the timeout of the client.
+func (c *apiClient) stream(ctx context.Context, path string, query url.Values, header http.Header) (*http.Response, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, path, query)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	client := *c.client
+	client.Timeout = 0
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return nil, apiResponseError(resp, body)
+	}
+	return resp, nil
+}
+
+func apiResponseError(resp *http.Response, body []byte) error {
+	var e api.Error
+	if json.Unmarshal(body, &e) == nil && e.Msg != "" {
+		return fmt.Errorf("api: %s (%d)", e.Msg, e.Code)
+	}
+	return fmt.Errorf("api: %s", resp.Status)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"net/http"
+	"path"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-gost/core/admission"
+	"github.com/go-gost/core/auth"
+	"github.com/go-gost/core/bypass"
+	"github.com/go-gost/core/chain"
+	"github.com/go-gost/core/hop"
+	"github.com/go-gost/core/hosts"
+	"github.com/go-gost/core/limiter/conn"
+	"github.com/go-gost/core/limiter/rate"
+	"github.com/go-gost/core/limiter/traffic"
+	reg "github.com/go-gost/core/registry"
+	"github.com/go-gost/core/resolver"
+	"github.com/go-gost/x/api"
+	"github.com/go-gost/x/config"
+	"github.com/go-gost/x/registry"
+)
+
+// configKind is a kind of the components of the config API which are built by gost,
+// the requests to create and update them are served by gost in place of go-gost/x,
+// so the components have the same wrappers as the components of the config file.
+// The other requests of the config API are proxied to go-gost/x.
+type configKind[C any, T any] struct {
+	// path is the path of the components under the config API.
+	path     string
+	registry reg.Registry[T]
+	build    func(cfg *C) (T, error)
+	// name returns the name field of the config.
+	name func(cfg *C) *string
+	// list returns the list of the configs of the kind in the global config.
+	list func(c *config.Config) *[]*C
+	// registered is called after the component is registered.
+	registered func(name string, v T)
+}
+
+func (k *configKind[C, T]) routes(router gin.IRoutes) {
+	router.POST(k.path, k.create)
+	router.PUT(path.Join(k.path, ":name"), k.update)
+}
+
+func (k *configKind[C, T]) create(c *gin.Context) {
+	cfg := new(C)
+	c.ShouldBindJSON(cfg)
+
+	name := *k.name(cfg)
+	if name == "" {
+		writeAPIError(c, http.StatusBadRequest, api.ErrCodeInvalid, "object invalid")
+		return
+	}
+
+	v, ok := k.buildComponent(c, cfg)
+	if !ok {
+		return
+	}
+	if err := k.registry.Register(name, v); err != nil {
+		closeComponent(v)
+		writeAPIError(c, http.StatusBadRequest, api.ErrCodeDup, "object duplicated")
+		return
+	}
+
+	config.OnUpdate(func(gc *config.Config) error {
+		list := k.list(gc)
+		*list = append(*list, cfg)
+		return nil
+	})
+	k.applied(c, name, v)
+}
+
+func (k *configKind[C, T]) update(c *gin.Context) {
+	name := c.Param("name")
+	cfg := new(C)
+	c.ShouldBindJSON(cfg)
+
+	if !k.registry.IsRegistered(name) {
+		writeAPIError(c, http.StatusBadRequest, api.ErrCodeNotFound, "object not found")
+		return
+	}
+	*k.name(cfg) = name
+
+	v, ok := k.buildComponent(c, cfg)
+	if !ok {
+		return
+	}
+	k.registry.Unregister(name)
+	if err := k.registry.Register(name, v); err != nil {
+		closeComponent(v)
+		writeAPIError(c, http.StatusBadRequest, api.ErrCodeDup, "object duplicated")
+		return
+	}
+
+	config.OnUpdate(func(gc *config.Config) error {
+		list := k.list(gc)
+		for i, item := range *list {
+			if item != nil && *k.name(item) == name {
+				(*list)[i] = cfg
+				break
+			}
+		}
+		return nil
+	})
+	k.applied(c, name, v)
+}
+
+func (k *configKind[C, T]) buildComponent(c *gin.Context, cfg *C) (v T, ok bool) {
+	v, err := k.build(cfg)
+	if err != nil || any(v) == nil {
+		msg := "object creation failed"
+		if err != nil {
+			msg = err.Error()
+		}
+		writeAPIError(c, http.StatusConflict, api.ErrCodeFailed, msg)
+		return v, false
+	}
+	return v, true
+}
+
+func (k *configKind[C, T]) applied(c *gin.Context, name string, v T) {
+	if k.registered != nil {
+		k.registered(name, v)
+	}
+	publishConfigApplied(c.Request)
+	c.JSON(http.StatusOK, api.Response{Msg: "OK"})
+}
+
+// publishConfigApplied publishes the event of the request applied by the config API.
+func publishConfigApplied(req *http.Request) {
+	events.publish(eventConfigApplied, map[string]any{
+		"method": req.Method,
+		"path":   req.URL.Path,
+	})
+}
+
+// configRoutes adds the routes of the config API served by gost.
+func configRoutes(router gin.IRoutes) {
+	(&configKind[config.AutherConfig, auth.Authenticator]{
+		path:     "/authers",
+		registry: registry.AutherRegistry(),
+		build:    buildAuther,
+		name:     func(cfg *config.AutherConfig) *string { return &cfg.Name },
+		list:     func(c *config.Config) *[]*config.AutherConfig { return &c.Authers },
+	}).routes(router)
+	(&configKind[config.AdmissionConfig, admission.Admission]{
+		path:     "/admissions",
+		registry: registry.AdmissionRegistry(),
+		build:    buildAdmission,
+		name:     func(cfg *config.AdmissionConfig) *string { return &cfg.Name },
+		list:     func(c *config.Config) *[]*config.AdmissionConfig { return &c.Admissions },
+	}).routes(router)
+	(&configKind[config.BypassConfig, bypass.Bypass]{
+		path:     "/bypasses",
+		registry: registry.BypassRegistry(),
+		build:    buildBypass,
+		name:     func(cfg *config.BypassConfig) *string { return &cfg.Name },
+		list:     func(c *config.Config) *[]*config.BypassConfig { return &c.Bypasses },
+	}).routes(router)
+	(&configKind[config.ResolverConfig, resolver.Resolver]{
+		path:     "/resolvers",
+		registry: registry.ResolverRegistry(),
+		build:    buildResolver,
+		name:     func(cfg *config.ResolverConfig) *string { return &cfg.Name },
+		list:     func(c *config.Config) *[]*config.ResolverConfig { return &c.Resolvers },
+	}).routes(router)
+	(&configKind[config.HostsConfig, hosts.HostMapper]{
+		path:     "/hosts",
+		registry: registry.HostsRegistry(),
+		build:    buildHosts,
+		name:     func(cfg *config.HostsConfig) *string { return &cfg.Name },
+		list:     func(c *config.Config) *[]*config.HostsConfig { return &c.Hosts },
+	}).routes(router)
+	(&configKind[config.LimiterConfig, traffic.TrafficLimiter]{
+		path:     "/limiters",
+		registry: registry.TrafficLimiterRegistry(),
+		build:    buildTrafficLimiter,
+		name:     func(cfg *config.LimiterConfig) *string { return &cfg.Name },
+		list:     func(c *config.Config) *[]*config.LimiterConfig { return &c.Limiters },
+	}).routes(router)
+	(&configKind[config.LimiterConfig, conn.ConnLimiter]{
+		path:     "/climiters",
+		registry: registry.ConnLimiterRegistry(),
+		build:    buildConnLimiter,
+		name:     func(cfg *config.LimiterConfig) *string { return &cfg.Name },
+		list:     func(c *config.Config) *[]*config.LimiterConfig { return &c.CLimiters },
+	}).routes(router)
+	(&configKind[config.LimiterConfig, rate.RateLimiter]{
+		path:     "/rlimiters",
+		registry: registry.RateLimiterRegistry(),
+		build:    buildRateLimiter,
+		name:     func(cfg *config.LimiterConfig) *string { return &cfg.Name },
+		list:     func(c *config.Config) *[]*config.LimiterConfig { return &c.RLimiters },
+	}).routes(router)
+	(&configKind[config.HopConfig, hop.Hop]{
+		path:     "/hops",
+		registry: registry.HopRegistry(),
+		build:    buildHop,
+		name:     func(cfg *config.HopConfig) *string { return &cfg.Name },
+		list:     func(c *config.Config) *[]*config.HopConfig { return &c.Hops },
+	}).routes(router)
+	(&configKind[config.ChainConfig, chain.Chainer]{
+		path:     "/chains",
+		registry: registry.ChainRegistry(),
+		build:    buildChain,
+		name:     func(cfg *config.ChainConfig) *string { return &cfg.Name },
+		list:     func(c *config.Config) *[]*config.ChainConfig { return &c.Chains },
+		registered: func(name string, c chain.Chainer) {
+			// the checker of the replaced chain stops by itself.
+			if cw, ok := c.(*chainWrapper); ok {
+				healthChecks.add(newChainHealthChecker(name, cw))
+			}
+		},
+	}).routes(router)
+}
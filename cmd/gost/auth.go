@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-gost/core/auth"
+	"github.com/go-gost/core/logger"
+	"github.com/go-gost/x/config"
+	auth_parser "github.com/go-gost/x/config/parsing/auth"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrInvalidAuthFile = errors.New("invalid auth file")
+)
+
+// parseAuther parses the auther config. The authers which only load users from a file
+// are backed by fileAuther, which accepts the htpasswd file format and re-reads the file on change.
+func parseAuther(cfg *config.AutherConfig) auth.Authenticator {
+	if cfg == nil || cfg.File == nil || cfg.File.Path == "" ||
+		cfg.Plugin != nil || cfg.Redis != nil || cfg.HTTP != nil {
+		return auth_parser.ParseAuther(cfg)
+	}
+
+	auths := make(map[string]string)
+	for _, user := range cfg.Auths {
+		if user.Username == "" {
+			continue
+		}
+		auths[user.Username] = user.Password
+	}
+
+	return newFileAuther(cfg.File.Path, auths, cfg.Reload,
+		logger.Default().WithFields(map[string]any{
+			"kind":   "auther",
+			"auther": cfg.Name,
+		}))
+}
+
+// fileAuther is an Authenticator that authenticates client by the users of a file.
+// The file is checked for changes every period and re-read when it is modified.
+type fileAuther struct {
+	path    string
+	auths   map[string]string
+	users   map[string]string
+	modTime time.Time
+	size    int64
+	mu      sync.RWMutex
+	cancel  context.CancelFunc
+	logger  logger.Logger
+}
+
+func newFileAuther(path string, auths map[string]string, period time.Duration, log logger.Logger) *fileAuther {
+	if period < time.Second {
+		period = time.Second
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &fileAuther{
+		path:   path,
+		auths:  auths,
+		cancel: cancel,
+		logger: log,
+	}
+	if err := p.reload(); err != nil {
+		log.Warnf("reload: %v", err)
+	}
+	go p.watch(ctx, period)
+
+	return p
+}
+
+// Authenticate checks the validity of the provided user-password pair.
+func (p *fileAuther) Authenticate(ctx context.Context, user, password string, opts ...auth.Option) (string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if len(p.users) == 0 {
+		return "", false
+	}
+
+	v, ok := p.users[user]
+	return user, ok && (v == "" || verifyPassword(v, password))
+}
+
+func (p *fileAuther) Close() error {
+	p.cancel()
+	return nil
+}
+
+func (p *fileAuther) watch(ctx context.Context, period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.reload(); err != nil {
+				p.logger.Warnf("reload: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reload re-reads the file if it has been modified since the last read.
+func (p *fileAuther) reload() error {
+	fi, err := os.Stat(p.path)
+	if err != nil {
+		return err
+	}
+
+	p.mu.RLock()
+	modified := p.users == nil || !fi.ModTime().Equal(p.modTime) || fi.Size() != p.size
+	p.mu.RUnlock()
+	if !modified {
+		return nil
+	}
+
+	f, err := os.Open(p.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	m, err := parseAuthFile(f, p.logger)
+	if err != nil {
+		return err
+	}
+
+	users := make(map[string]string, len(p.auths)+len(m))
+	for k, v := range p.auths {
+		users[k] = v
+	}
+	for k, v := range m {
+		users[k] = v
+	}
+
+	p.logger.Debugf("load items %d", len(m))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.users = users
+	p.modTime = fi.ModTime()
+	p.size = fi.Size()
+
+	return nil
+}
+
+// parseAuthFile parses the users from r. Each line is either an htpasswd entry user:password,
+// or a user and a plain password separated by whitespace. The password of an htpasswd entry
+// is a bcrypt hash ($2a$, $2b$ or $2y$), a SHA1 hash ({SHA}) or a plain password.
+// Empty lines and the lines starting with # are ignored. The users without a password
+// and the htpasswd entries with other hashes, such as $apr1$, are skipped and logged to log.
+func parseAuthFile(r io.Reader, log logger.Logger) (map[string]string, error) {
+	users := make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// the htpasswd entry is split on the first colon only, the password may contain spaces.
+		var user, password string
+		var htpasswd bool
+		if i := strings.IndexAny(line, ": \t"); i < 0 || line[i] == ':' {
+			user, password, _ = strings.Cut(line, ":")
+			htpasswd = true
+		} else {
+			user, password = line[:i], strings.TrimSpace(line[i:])
+		}
+
+		switch {
+		case user == "":
+			continue
+		case password == "":
+			log.Warnf("user %s is skipped, the password is empty", user)
+			continue
+		case htpasswd && strings.HasPrefix(password, "$") && !isBcryptHash(password):
+			log.Warnf("user %s is skipped, unsupported password hash", user)
+			continue
+		}
+		users[user] = password
+	}
+
+	return users, scanner.Err()
+}
+
+// readAuthFile reads the first user in the file as the credentials of a client,
+// the password must not be hashed.
+func readAuthFile(path string) (*config.AuthConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		m, err := parseAuthFile(strings.NewReader(line), logger.Default())
+		if err != nil {
+			return nil, err
+		}
+		for user, password := range m {
+			if isBcryptHash(password) || strings.HasPrefix(password, "{SHA}") {
+				return nil, fmt.Errorf("%w: %s, the password of user %s is hashed", ErrInvalidAuthFile, path, user)
+			}
+			return &config.AuthConfig{
+				Username: user,
+				Password: password,
+			}, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, fmt.Errorf("%w: %s, no user found", ErrInvalidAuthFile, path)
+}
+
+func isBcryptHash(s string) bool {
+	return strings.HasPrefix(s, "$2a$") || strings.HasPrefix(s, "$2b$") || strings.HasPrefix(s, "$2y$")
+}
+
+func verifyPassword(hash, password string) bool {
+	switch {
+	case isBcryptHash(hash):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(hash[5:]), []byte(base64.StdEncoding.EncodeToString(sum[:]))) == 1
+	default:
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(password)) == 1
+	}
+}
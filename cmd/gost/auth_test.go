@@ -0,0 +1,55 @@
+package main
+
+import (
+	"maps"
+	"strings"
+	"testing"
+
+	xlogger "github.com/go-gost/x/logger"
+)
+
+func TestParseAuthFile(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		want map[string]string
+	}{
+		{
+			name: "htpasswd and plain entries",
+			file: "# users\n\nalice:$2y$05$abc\nbob:{SHA}xyz\ncarol:pass word\ndave  secret\n",
+			want: map[string]string{
+				"alice": "$2y$05$abc",
+				"bob":   "{SHA}xyz",
+				"carol": "pass word",
+				"dave":  "secret",
+			},
+		},
+		{
+			name: "empty password",
+			file: "alice\nbob:\ncarol:pass\n",
+			want: map[string]string{"carol": "pass"},
+		},
+		{
+			name: "unsupported hash",
+			file: "alice:$apr1$salt$hash\nbob:$plain\ncarol:pass\n",
+			want: map[string]string{"carol": "pass"},
+		},
+		{
+			name: "plain password starting with $",
+			file: "alice $plain\n",
+			want: map[string]string{"alice": "$plain"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseAuthFile(strings.NewReader(tt.file), xlogger.Nop())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"time"
+
+	"github.com/go-gost/core/bypass"
+	"github.com/go-gost/core/chain"
+	"github.com/go-gost/core/hop"
+	"github.com/go-gost/core/logger"
+	"github.com/go-gost/core/metadata"
+	"github.com/go-gost/core/metrics"
+	"github.com/go-gost/core/selector"
+	xchain "github.com/go-gost/x/chain"
+	"github.com/go-gost/x/config"
+	mdx "github.com/go-gost/x/metadata"
+	xmetrics "github.com/go-gost/x/metrics"
+	"github.com/go-gost/x/registry"
+	xs "github.com/go-gost/x/selector"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func init() {
+	chain.DefaultRoute = &routeWrapper{Route: chain.DefaultRoute}
+}
+
+// chainWrapper is a chain with a span per route, which is the parent of
+// the dial, handshake and connect spans of the nodes, the route is also
+// recorded in the record of the connection.
+type chainWrapper struct {
+	chain.Chainer
+	name string
+	// hops are the hops of the chain in order, including the hops inline in the chain config.
+	hops []*chainHop
+}
+
+// errNoNodeAvailable is the error of the route through a hop whose nodes are all marked failed.
+var errNoNodeAvailable = errors.New("no node available")
+
+// chainHop is a hop of the chain, the hop whose nodes are all marked failed is reported in the route state.
+// The route of go-gost/x ends at a hop without a selected node, which would dial the target from the previous hop.
+type chainHop struct {
+	chain string
+	name  string
+	hop.Hop
+}
+
+func (h *chainHop) Select(ctx context.Context, opts ...hop.SelectOption) *chain.Node {
+	st := routeStateFromContext(ctx)
+	if st != nil && st.pins[h] != nil {
+		return st.pins[h]
+	}
+
+	node := h.Hop.Select(ctx, opts...)
+	if st == nil {
+		return node
+	}
+	if node == nil && st.unavailable == "" && h.unavailable(ctx, opts...) {
+		st.unavailable = h.name
+	}
+	if node != nil {
+		if st.selected == nil {
+			st.selected = map[*chainHop]*chain.Node{}
+		}
+		st.selected[h] = node
+	}
+	return node
+}
+
+// unavailable reports whether the nodes of the hop for the target are all filtered out by the maxFails
+// and failTimeout of the selector of the hop. The hop is available if the target is bypassed
+// by the hop or by all of its nodes, the target is sent direct then.
+func (h *chainHop) unavailable(ctx context.Context, opts ...hop.SelectOption) bool {
+	var options hop.SelectOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	var maxFails int
+	var failTimeout time.Duration
+	if cfg := chainHopConfig(h.chain, h.name); cfg != nil {
+		if bp := hopBypass(cfg); bp != nil &&
+			bp.Contains(ctx, options.Network, options.Addr, bypass.WithHostOpton(options.Host)) {
+			return false
+		}
+		if cfg.Selector != nil {
+			maxFails, failTimeout = cfg.Selector.MaxFails, cfg.Selector.FailTimeout
+		}
+	}
+
+	var nodes []*chain.Node
+	for _, node := range hopNodes(h.Hop) {
+		if bp := node.Options().Bypass; bp != nil &&
+			bp.Contains(ctx, options.Network, options.Addr, bypass.WithHostOpton(options.Host)) {
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	// the fail filter keeps the only node.
+	if len(nodes) <= 1 {
+		return false
+	}
+	return len(xs.FailFilter[*chain.Node](maxFails, failTimeout).Filter(ctx, nodes...)) == 0
+}
+
+// chainHopConfig returns the config of the hop of the chain in the global config,
+// which is the config in the hops of the config if the hop of the chain refers to it.
+func chainHopConfig(chainName, hopName string) *config.HopConfig {
+	cfg := config.Global()
+	for _, ch := range cfg.Chains {
+		if ch == nil || ch.Name != chainName {
+			continue
+		}
+		for _, hc := range ch.Hops {
+			if hc == nil || hc.Name != hopName {
+				continue
+			}
+			if len(hc.Nodes) == 0 && hc.Plugin == nil {
+				for _, v := range cfg.Hops {
+					if v != nil && v.Name == hopName {
+						return v
+					}
+				}
+			}
+			return hc
+		}
+	}
+	return nil
+}
+
+// routeState is the state of a route being selected by the chain.
+type routeState struct {
+	// unavailable is the hop without a node available.
+	unavailable string
+	// selected are the nodes selected by the hops.
+	selected map[*chainHop]*chain.Node
+	// pins are the nodes of the hops used in place of the selected nodes, for the racing routes.
+	pins map[*chainHop]*chain.Node
+}
+
+type routeStateKey struct{}
+
+func contextWithRouteState(ctx context.Context, st *routeState) context.Context {
+	return context.WithValue(ctx, routeStateKey{}, st)
+}
+
+func routeStateFromContext(ctx context.Context) *routeState {
+	v, _ := ctx.Value(routeStateKey{}).(*routeState)
+	return v
+}
+
+// registeredChain returns the chain of the name in the chain registry if it is parsed by parseChain,
+// the Get of the registry returns a wrapper looking up the chain by the name on each call.
+func registeredChain(name string) *chainWrapper {
+	c, _ := registry.ChainRegistry().GetAll()[name].(*chainWrapper)
+	return c
+}
+
+// parseChain parses the chain in the same way as the chain parser of go-gost/x,
+// the hops of the chain are kept in the returned chain for the health checks and the status.
+func parseChain(cfg *config.ChainConfig, log logger.Logger) (*chainWrapper, error) {
+	var md metadata.Metadata
+	if cfg.Metadata != nil {
+		md = mdx.NewMetadata(cfg.Metadata)
+	}
+
+	c := xchain.NewChain(cfg.Name,
+		xchain.MetadataChainOption(md),
+		xchain.LoggerChainOption(log.WithFields(map[string]any{
+			"kind":  "chain",
+			"chain": cfg.Name,
+		})),
+	)
+
+	var hops []*chainHop
+	for _, hc := range cfg.Hops {
+		var h hop.Hop
+		if hc.Nodes != nil || hc.Plugin != nil {
+			var err error
+			if h, err = parseHop(hc, log); err != nil {
+				return nil, err
+			}
+		} else {
+			h = registry.HopRegistry().Get(hc.Name)
+		}
+		if h != nil {
+			ch := &chainHop{chain: cfg.Name, name: hc.Name, Hop: h}
+			c.AddHop(ch)
+			hops = append(hops, ch)
+		}
+	}
+
+	return &chainWrapper{Chainer: c, name: cfg.Name, hops: hops}, nil
+}
+
+func (c *chainWrapper) Route(ctx context.Context, network, address string, opts ...chain.RouteOption) chain.Route {
+	st := &routeState{}
+	route := c.Chainer.Route(contextWithRouteState(ctx, st), network, address, opts...)
+	if st.unavailable != "" {
+		// the chain is marked failed as the failed route of go-gost/x, so the chain group selects another chain.
+		if marker := c.Marker(); marker != nil {
+			marker.Mark()
+		}
+		return &routeWrapper{
+			Route: &unavailableRoute{err: fmt.Errorf("chain %s: hop %s: %w", c.name, st.unavailable, errNoNodeAvailable)},
+			chain: c.name,
+		}
+	}
+	if route == nil || len(route.Nodes()) == 0 {
+		// the empty route dials through the default route.
+		return route
+	}
+	if r := c.racingRoute(ctx, st, route, network, address, opts...); r != nil {
+		route = r
+	}
+	return &routeWrapper{
+		Route:  route,
+		chain:  c.name,
+		marker: c.Marker(),
+	}
+}
+
+// racingRoute returns the racing route if the racing is enabled on a selected node of the route,
+// the node is raced with the next node of its hop at the first racing hop with such a node.
+// The nodes of the other hops are the same in the alternative route.
+func (c *chainWrapper) racingRoute(ctx context.Context, st *routeState, route chain.Route, network, address string, opts ...chain.RouteOption) chain.Route {
+	r := &racingRoute{
+		Route:  route,
+		chain:  c.name,
+		marker: c.Marker(),
+	}
+	// the addresses of the first node are raced even if no other node is raced with it.
+	r.delay, _ = nodeRace(route.Nodes()[0])
+
+	for _, h := range c.hops {
+		node := st.selected[h]
+		if node == nil {
+			break
+		}
+		delay, ok := nodeRace(node)
+		if !ok {
+			continue
+		}
+		alt := raceNode(ctx, h, node, network, address)
+		if alt == nil {
+			continue
+		}
+
+		pins := maps.Clone(st.selected)
+		pins[h] = alt
+		altRoute := c.Chainer.Route(contextWithRouteState(ctx, &routeState{pins: pins}), network, address, opts...)
+		if altRoute == nil || len(altRoute.Nodes()) == 0 {
+			break
+		}
+		r.alt, r.altNode, r.delay = altRoute, alt, delay
+		return r
+	}
+
+	if r.delay > 0 {
+		return r
+	}
+	return nil
+}
+
+func (c *chainWrapper) Marker() selector.Marker {
+	if m, ok := c.Chainer.(selector.Markable); ok {
+		return m.Marker()
+	}
+	return nil
+}
+
+func (c *chainWrapper) Metadata() metadata.Metadata {
+	if m, ok := c.Chainer.(metadata.Metadatable); ok {
+		return m.Metadata()
+	}
+	return nil
+}
+
+// unavailableRoute is the route through a chain with a hop without a node available.
+type unavailableRoute struct {
+	err error
+}
+
+func (r *unavailableRoute) Dial(ctx context.Context, network, address string, opts ...chain.DialOption) (net.Conn, error) {
+	return nil, r.err
+}
+
+func (r *unavailableRoute) Bind(ctx context.Context, network, address string, opts ...chain.BindOption) (net.Listener, error) {
+	return nil, r.err
+}
+
+func (r *unavailableRoute) Nodes() []*chain.Node {
+	return nil
+}
+
+// routeWrapper is a route with a span per dial and bind,
+// the route without nodes is the final upstream connect of the direct connections.
+type routeWrapper struct {
+	chain.Route
+	chain string
+	// marker is the marker of the chain, the chain is marked failed by a failed dial
+	// so the chain group selects the next chain on the retry of the router.
+	marker selector.Marker
+}
+
+func (r *routeWrapper) Dial(ctx context.Context, network, address string, opts ...chain.DialOption) (conn net.Conn, err error) {
+	ctx, span := r.start(ctx, "dial", network, address)
+	defer func() { endSpan(span, err) }()
+
+	var fails int64
+	var nodeFails map[selector.Marker]int64
+	if r.marker != nil {
+		fails = r.marker.Count()
+		nodeFails = markerCounts(dialNodes(r.Route))
+	}
+	start := time.Now()
+	conn, err = r.Route.Dial(ctx, network, address, opts...)
+	d := time.Since(start)
+	if r.marker != nil {
+		// the chain is marked failed only if a node of the route is marked failed by the dial, as go-gost/x does,
+		// the target which is not reachable through the route does not fail the chain.
+		// go-gost/x does not mark the chain for the nodes after a multiplexed node or of the racing route.
+		if err == nil {
+			r.marker.Reset()
+		} else if markedSince(nodeFails) && r.marker.Count() <= fails {
+			r.marker.Mark()
+		}
+	}
+	nodes := r.Route.Nodes()
+	if err == nil && len(nodes) > 0 {
+		if v := xmetrics.GetObserver(metricNodeDialDurationObserver,
+			metrics.Labels{"chain": r.chain, "node": nodes[len(nodes)-1].Name}); v != nil {
+			v.Observe(d.Seconds())
+		}
+	}
+	observeNodes(r.chain, nodes)
+	rec := connRecordFromContext(ctx)
+	if rec != nil {
+		r.logFailover(rec, address, err, opts...)
+		rec.setRoute(ctx, r.chain, r.Route.Nodes(), address, err)
+	}
+	recordRoute(r.chain, nodes, err, d)
+	// the target may be a node of a forwarder.
+	var target *chain.Node
+	if rec != nil {
+		if target = rec.selectedNode(address); target != nil {
+			recordForward(rec.Service, target, err, d)
+		}
+	}
+	if err == nil {
+		// the latency of the route is the latency of each node of it for the latency strategies.
+		for _, node := range nodes {
+			observeNodeLatency(node, d)
+		}
+		observeNodeLatency(target, d)
+	}
+	return
+}
+
+// dialNodes returns the nodes of the route, including the nodes of the alternative route of the racing route.
+func dialNodes(route chain.Route) []*chain.Node {
+	nodes := route.Nodes()
+	if r, ok := route.(*racingRoute); ok && r.alt != nil {
+		nodes = append(nodes[:len(nodes):len(nodes)], r.alt.Nodes()...)
+	}
+	return nodes
+}
+
+// markerCounts returns the fail counts of the markers of the nodes.
+func markerCounts(nodes []*chain.Node) map[selector.Marker]int64 {
+	counts := make(map[selector.Marker]int64, len(nodes))
+	for _, node := range nodes {
+		if m := node.Marker(); m != nil {
+			counts[m] = m.Count()
+		}
+	}
+	return counts
+}
+
+// markedSince reports whether a marker is marked since its counts are taken.
+func markedSince(counts map[selector.Marker]int64) bool {
+	for m, n := range counts {
+		if m.Count() > n {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *routeWrapper) Bind(ctx context.Context, network, address string, opts ...chain.BindOption) (ln net.Listener, err error) {
+	ctx, span := r.start(ctx, "bind", network, address)
+	defer func() { endSpan(span, err) }()
+
+	ln, err = r.Route.Bind(ctx, network, address, opts...)
+	observeNodes(r.chain, r.Route.Nodes())
+	if rec := connRecordFromContext(ctx); rec != nil {
+		rec.setRoute(ctx, r.chain, r.Route.Nodes(), address, err)
+	}
+	return
+}
+
+// logFailover logs the chain of the dial, and counts the failover if the previous dial of the connection
+// to the address failed through another chain, which is retried by the router through the chain group.
+func (r *routeWrapper) logFailover(rec *connRecord, address string, err error, opts ...chain.DialOption) {
+	var options chain.DialOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	log := options.Logger
+	if log == nil {
+		log = logger.Default()
+	}
+
+	from, ferr := rec.failedChain(address)
+	if ferr == nil || from == r.chain {
+		if r.chain != "" {
+			log.Debugf("dial %s through chain %s", address, r.chain)
+		}
+		return
+	}
+
+	if v := xmetrics.GetCounter(metricChainFailoversCounter,
+		metrics.Labels{"service": rec.Service, "from": from, "chain": r.chain}); v != nil {
+		v.Inc()
+	}
+	to := r.chain
+	if to == "" {
+		to = "direct"
+	}
+	if err != nil {
+		log.Warnf("failover to %s from chain %s (%v) for %s failed: %v", to, from, ferr, address, err)
+	} else {
+		log.Infof("failover to %s from chain %s (%v) for %s", to, from, ferr, address)
+	}
+}
+
+func (r *routeWrapper) start(ctx context.Context, op string, network, address string) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{
+		attribute.String("network.transport", network),
+		attribute.String("server.address", address),
+	}
+
+	nodes := r.Route.Nodes()
+	if len(nodes) == 0 && r.chain == "" {
+		return tracer.Start(ctx, op+" direct",
+			trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+	}
+
+	path := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		path = append(path, node.Name+"@"+node.Addr)
+	}
+	attrs = append(attrs,
+		attribute.String("gost.chain", r.chain),
+		attribute.String("gost.route.op", op),
+		attribute.StringSlice("gost.route", path),
+	)
+	return tracer.Start(ctx, "route "+r.chain, trace.WithAttributes(attrs...))
+}
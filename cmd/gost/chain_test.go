@@ -0,0 +1,158 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-gost/x/config"
+	"github.com/go-gost/x/registry"
+)
+
+func httpNodeConfig(name, addr string) *config.NodeConfig {
+	return &config.NodeConfig{
+		Name:      name,
+		Addr:      addr,
+		Connector: &config.ConnectorConfig{Type: "http"},
+		Dialer:    &config.DialerConfig{Type: "tcp"},
+	}
+}
+
+// proxyGet gets the url through the HTTP proxy service, it returns the status code, or 0 on error.
+func proxyGet(t *testing.T, service, u string) int {
+	t.Helper()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			Proxy:             http.ProxyURL(&url.URL{Scheme: "http", Host: serviceAddr(t, service)}),
+		},
+	}
+	resp, err := client.Get(u)
+	if err != nil {
+		return 0
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestChainGroupFailover(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer target.Close()
+
+	// the upstream of the broken proxy is not reachable, the proxy is healthy.
+	serveConfig(t, &config.Config{
+		Services: []*config.ServiceConfig{
+			httpServiceConfig("failover-upstream", ""),
+			httpServiceConfig("failover-broken", "failover-dead"),
+		},
+		Chains: []*config.ChainConfig{{
+			Name: "failover-dead",
+			Hops: []*config.HopConfig{{
+				Name:  "failover-dead-hop",
+				Nodes: []*config.NodeConfig{httpNodeConfig("dead", "127.0.0.1:1")},
+			}},
+		}},
+	})
+
+	tests := []struct {
+		name string
+		// first is the node of the first chain of the group.
+		first  string
+		status int
+		// marked is whether the first chain is marked failed.
+		marked bool
+	}{
+		{
+			name:   "node down",
+			first:  "127.0.0.1:1",
+			status: http.StatusOK,
+			marked: true,
+		},
+		{
+			name:   "target unreachable",
+			first:  serviceAddr(t, "failover-broken"),
+			status: http.StatusServiceUnavailable,
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := "failover-proxy-" + strconv.Itoa(i)
+			first, second := service+"-first", service+"-second"
+			svc := httpServiceConfig(service, "")
+			svc.Handler.Retries = 1
+			svc.Handler.ChainGroup = &config.ChainGroupConfig{
+				Chains: []string{first, second},
+				Selector: &config.SelectorConfig{
+					Strategy:    "fifo",
+					MaxFails:    1,
+					FailTimeout: time.Minute,
+				},
+			}
+			serveConfig(t, &config.Config{
+				Services: []*config.ServiceConfig{svc},
+				Chains: []*config.ChainConfig{
+					{
+						Name: first,
+						Hops: []*config.HopConfig{{Name: "hop-0", Nodes: []*config.NodeConfig{httpNodeConfig("node-0", tt.first)}}},
+					},
+					{
+						Name: second,
+						Hops: []*config.HopConfig{{Name: "hop-0", Nodes: []*config.NodeConfig{httpNodeConfig("node-0", serviceAddr(t, "failover-upstream"))}}},
+					},
+				},
+			})
+
+			for i := 0; i < 2; i++ {
+				if status := proxyGet(t, service, target.URL); status != tt.status {
+					t.Fatalf("request %d: got status %d, want %d", i, status, tt.status)
+				}
+			}
+			if marked := registeredChain(first).Marker().Count() > 0; marked != tt.marked {
+				t.Fatalf("got marked %t, want %t", marked, tt.marked)
+			}
+		})
+	}
+}
+
+func TestChainHopBypassedNodes(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer target.Close()
+
+	nodes := []*config.NodeConfig{httpNodeConfig("node-0", "127.0.0.1:1"), httpNodeConfig("node-1", "127.0.0.1:2")}
+	for _, node := range nodes {
+		node.Bypass = "bypassed-nodes"
+	}
+	serveConfig(t, &config.Config{
+		Bypasses: []*config.BypassConfig{{Name: "bypassed-nodes", Matchers: []string{"127.0.0.1"}}},
+		Services: []*config.ServiceConfig{httpServiceConfig("bypassed-proxy", "bypassed-chain")},
+		Chains: []*config.ChainConfig{{
+			Name: "bypassed-chain",
+			Hops: []*config.HopConfig{{Name: "hop-0", Nodes: nodes}},
+		}},
+	})
+	defer registry.BypassRegistry().Unregister("bypassed-nodes")
+
+	// the nodes are marked failed by the targets which are not bypassed.
+	other := strings.Replace(target.URL, "127.0.0.1", "localhost", 1)
+	for i := 0; i < 3; i++ {
+		if status := proxyGet(t, "bypassed-proxy", other); status == http.StatusOK {
+			t.Fatalf("request %d through the failed nodes succeeded", i)
+		}
+	}
+	// the bypassed target is sent direct.
+	if status := proxyGet(t, "bypassed-proxy", target.URL); status != http.StatusOK {
+		t.Fatalf("got status %d", status)
+	}
+}
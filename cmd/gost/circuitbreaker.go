@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-gost/core/chain"
+	"github.com/go-gost/core/logger"
+	"github.com/go-gost/core/metadata"
+	mdutil "github.com/go-gost/core/metadata/util"
+	"github.com/go-gost/core/metrics"
+	mdx "github.com/go-gost/x/metadata"
+	xmetrics "github.com/go-gost/x/metrics"
+)
+
+// The node metadata keys of the circuit breaker of a chain node or a forwarder node.
+const (
+	// mdKeyCircuitBreaker enables the circuit breaker of the node.
+	mdKeyCircuitBreaker = "circuitBreaker"
+	// mdKeyCircuitBreakerWindow is the sliding window of the requests to trip the breaker.
+	mdKeyCircuitBreakerWindow = "circuitBreaker.window"
+	// mdKeyCircuitBreakerMinRequests is the minimum requests in the window to trip the breaker.
+	mdKeyCircuitBreakerMinRequests = "circuitBreaker.minRequests"
+	// mdKeyCircuitBreakerErrorPercent is the percentage of the failed requests in the window to trip the breaker.
+	mdKeyCircuitBreakerErrorPercent = "circuitBreaker.errorPercent"
+	// mdKeyCircuitBreakerLatency is the dial latency over which a request is slow, 0 for no slow requests.
+	mdKeyCircuitBreakerLatency = "circuitBreaker.latency"
+	// mdKeyCircuitBreakerSlowPercent is the percentage of the slow requests in the window to trip the breaker.
+	mdKeyCircuitBreakerSlowPercent = "circuitBreaker.slowPercent"
+	// mdKeyCircuitBreakerCooldown is the time the breaker is open before it is half-open.
+	mdKeyCircuitBreakerCooldown = "circuitBreaker.cooldown"
+	// mdKeyCircuitBreakerProbes is the number of the requests let through in the half-open state,
+	// the breaker is closed once they all succeed.
+	mdKeyCircuitBreakerProbes = "circuitBreaker.probes"
+	// mdKeyCircuitBreakerMaxEjection is the maximum percentage of the nodes of a hop ejected by the breakers.
+	mdKeyCircuitBreakerMaxEjection = "circuitBreaker.maxEjectionPercent"
+)
+
+// The states of the circuit breakers.
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+const (
+	defaultCircuitBreakerWindow       = 30 * time.Second
+	defaultCircuitBreakerMinRequests  = 10
+	defaultCircuitBreakerErrorPercent = 50
+	defaultCircuitBreakerSlowPercent  = 50
+	defaultCircuitBreakerCooldown     = 30 * time.Second
+	defaultCircuitBreakerProbes       = 1
+	defaultCircuitBreakerMaxEjection  = 50
+
+	// circuitBreakerBuckets is the number of the buckets of the sliding window.
+	circuitBreakerBuckets = 10
+)
+
+// nodeEjected is the health of the node ejected by the circuit breaker.
+const nodeEjected = "ejected"
+
+// circuitBreakerKeys are the node metadata keys of the circuit breaker.
+var circuitBreakerKeys = []string{
+	mdKeyCircuitBreaker, mdKeyCircuitBreakerWindow, mdKeyCircuitBreakerMinRequests,
+	mdKeyCircuitBreakerErrorPercent, mdKeyCircuitBreakerLatency, mdKeyCircuitBreakerSlowPercent,
+	mdKeyCircuitBreakerCooldown, mdKeyCircuitBreakerProbes, mdKeyCircuitBreakerMaxEjection,
+}
+
+type circuitBreakerConfig struct {
+	Window       time.Duration
+	MinRequests  int
+	ErrorPercent int
+	Latency      time.Duration
+	SlowPercent  int
+	Cooldown     time.Duration
+	Probes       int
+}
+
+// parseCircuitBreaker parses the circuit breaker from the node metadata, it returns nil if the breaker is not enabled.
+func parseCircuitBreaker(md metadata.Metadata) *circuitBreakerConfig {
+	if !mdutil.GetBool(md, mdKeyCircuitBreaker) {
+		return nil
+	}
+
+	cfg := &circuitBreakerConfig{
+		Window:       mdutil.GetDuration(md, mdKeyCircuitBreakerWindow),
+		MinRequests:  mdutil.GetInt(md, mdKeyCircuitBreakerMinRequests),
+		ErrorPercent: mdutil.GetInt(md, mdKeyCircuitBreakerErrorPercent),
+		Latency:      mdutil.GetDuration(md, mdKeyCircuitBreakerLatency),
+		SlowPercent:  mdutil.GetInt(md, mdKeyCircuitBreakerSlowPercent),
+		Cooldown:     mdutil.GetDuration(md, mdKeyCircuitBreakerCooldown),
+		Probes:       mdutil.GetInt(md, mdKeyCircuitBreakerProbes),
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = defaultCircuitBreakerWindow
+	}
+	if cfg.MinRequests <= 0 {
+		cfg.MinRequests = defaultCircuitBreakerMinRequests
+	}
+	if cfg.ErrorPercent <= 0 || cfg.ErrorPercent > 100 {
+		cfg.ErrorPercent = defaultCircuitBreakerErrorPercent
+	}
+	if cfg.SlowPercent <= 0 || cfg.SlowPercent > 100 {
+		cfg.SlowPercent = defaultCircuitBreakerSlowPercent
+	}
+	if cfg.Cooldown <= 0 {
+		cfg.Cooldown = defaultCircuitBreakerCooldown
+	}
+	if cfg.Probes <= 0 {
+		cfg.Probes = defaultCircuitBreakerProbes
+	}
+	return cfg
+}
+
+// circuitBreakers are the circuit breakers of the nodes by the node marker,
+// the value is nil for the nodes without the breaker.
+var circuitBreakers sync.Map
+
+// breakerOf returns the circuit breaker of the node, or nil if the breaker of the node is not enabled.
+func breakerOf(node *chain.Node) *circuitBreaker {
+	if node == nil || node.Marker() == nil {
+		return nil
+	}
+	if v, ok := circuitBreakers.Load(node.Marker()); ok {
+		return v.(*circuitBreaker)
+	}
+
+	var b *circuitBreaker
+	if cfg := parseCircuitBreaker(node.Metadata()); cfg != nil {
+		b = &circuitBreaker{
+			cfg:     cfg,
+			node:    node.Name,
+			addr:    node.Addr,
+			state:   circuitClosed,
+			buckets: make([]circuitBucket, circuitBreakerBuckets),
+		}
+	}
+	v, _ := circuitBreakers.LoadOrStore(node.Marker(), b)
+	return v.(*circuitBreaker)
+}
+
+// circuitBreaker trips on the error rate or the slow rate of the requests through the node in the sliding window,
+// the tripped (open) node is ejected from the selection until the cooldown passes,
+// then the breaker is half-open and lets the probes through, it is closed if the probes succeed.
+type circuitBreaker struct {
+	cfg  *circuitBreakerConfig
+	node string
+	addr string
+	// chain or service is the first chain or service (of the forwarder) the node is used by.
+	chain   string
+	service string
+
+	mu       sync.Mutex
+	state    string
+	buckets  []circuitBucket
+	openedAt time.Time
+	// probes is the number of the probes let through in the half-open state,
+	// successes is the number of them succeeded.
+	probes    int
+	successes int
+	probeTime time.Time
+}
+
+type circuitBucket struct {
+	start    time.Time
+	total    int
+	failures int
+	slow     int
+}
+
+// circuitStatus is the state of a circuit breaker in the status API.
+type circuitStatus struct {
+	State string `json:"state"`
+	// Requests, ErrorPercent and SlowPercent are of the requests in the sliding window.
+	Requests     int        `json:"requests"`
+	ErrorPercent int        `json:"errorPercent"`
+	SlowPercent  int        `json:"slowPercent"`
+	OpenedAt     *time.Time `json:"openedAt,omitempty"`
+}
+
+func (b *circuitBreaker) bucketSize() time.Duration {
+	return b.cfg.Window / circuitBreakerBuckets
+}
+
+func (b *circuitBreaker) add(now time.Time, failed, slow bool) {
+	size := b.bucketSize()
+	start := now.Truncate(size)
+	bk := &b.buckets[int(start.UnixNano()/int64(size))%len(b.buckets)]
+	if !bk.start.Equal(start) {
+		*bk = circuitBucket{start: start}
+	}
+	bk.total++
+	if failed {
+		bk.failures++
+	}
+	if slow {
+		bk.slow++
+	}
+}
+
+// stats returns the requests, the failed and the slow requests in the window.
+func (b *circuitBreaker) stats(now time.Time) (total, failures, slow int) {
+	for _, bk := range b.buckets {
+		if now.Sub(bk.start) < b.cfg.Window {
+			total += bk.total
+			failures += bk.failures
+			slow += bk.slow
+		}
+	}
+	return
+}
+
+// allow reports whether the node can be selected, the open breaker is half-open once the cooldown passes.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if now.Sub(b.openedAt) < b.cfg.Cooldown {
+			return false
+		}
+		b.setState(circuitHalfOpen, now)
+		return true
+	case circuitHalfOpen:
+		// the probes without the result, which are selected but not used, expire after the cooldown.
+		return b.probes < b.cfg.Probes || now.Sub(b.probeTime) >= b.cfg.Cooldown
+	}
+	return true
+}
+
+// acquire counts the selection of the node as a probe if the breaker is half-open.
+func (b *circuitBreaker) acquire(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != circuitHalfOpen {
+		return
+	}
+	if b.probes >= b.cfg.Probes {
+		b.probes, b.successes = 0, 0
+	}
+	b.probes++
+	b.probeTime = now
+}
+
+// record records the result of a request through the node.
+func (b *circuitBreaker) record(now time.Time, failed bool, latency time.Duration) {
+	slow := b.cfg.Latency > 0 && latency > b.cfg.Latency
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitClosed:
+		b.add(now, failed, slow)
+		total, failures, slows := b.stats(now)
+		if total >= b.cfg.MinRequests &&
+			(failures*100 >= b.cfg.ErrorPercent*total || b.cfg.Latency > 0 && slows*100 >= b.cfg.SlowPercent*total) {
+			b.setState(circuitOpen, now)
+		}
+	case circuitHalfOpen:
+		if failed || slow {
+			b.setState(circuitOpen, now)
+			return
+		}
+		if b.successes++; b.successes >= b.cfg.Probes {
+			b.setState(circuitClosed, now)
+		}
+	}
+}
+
+// setState changes the state of the breaker, the change is logged, published and set to the gauge.
+func (b *circuitBreaker) setState(state string, now time.Time) {
+	if state == b.state {
+		return
+	}
+	total, failures, slow := b.stats(now)
+
+	prev := b.state
+	b.state = state
+	switch state {
+	case circuitOpen:
+		b.openedAt = now
+	case circuitHalfOpen:
+		b.probes, b.successes = 0, 0
+	case circuitClosed:
+		for i := range b.buckets {
+			b.buckets[i] = circuitBucket{}
+		}
+	}
+
+	fields := map[string]any{
+		"kind": "circuitbreaker",
+		"node": b.node,
+	}
+	if b.service != "" {
+		fields["service"] = b.service
+	} else {
+		fields["chain"] = b.chain
+	}
+	log := logger.Default().WithFields(fields)
+	switch {
+	case state == circuitOpen && prev == circuitHalfOpen:
+		log.Warnf("node %s(%s) is ejected again, the probe failed", b.node, b.addr)
+	case state == circuitOpen:
+		log.Warnf("node %s(%s) is ejected, %d failed and %d slow of %d requests", b.node, b.addr, failures, slow, total)
+	default:
+		log.Infof("node %s(%s) circuit is %s", b.node, b.addr, state)
+	}
+
+	if v := xmetrics.GetGauge(metricNodeCircuitGauge,
+		metrics.Labels{"chain": b.chain, "service": b.service, "node": b.node}); v != nil {
+		v.Set(circuitGaugeValue(state))
+	}
+
+	data := map[string]any{
+		"node":     b.node,
+		"addr":     b.addr,
+		"state":    state,
+		"requests": total,
+		"failures": failures,
+		"slow":     slow,
+	}
+	if b.service != "" {
+		data["service"] = b.service
+	} else {
+		data["chain"] = b.chain
+	}
+	events.publish(eventNodeCircuit, data)
+}
+
+func circuitGaugeValue(state string) float64 {
+	switch state {
+	case circuitOpen:
+		return 2
+	case circuitHalfOpen:
+		return 1
+	}
+	return 0
+}
+
+func (b *circuitBreaker) status() *circuitStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if b.state == circuitOpen && now.Sub(b.openedAt) >= b.cfg.Cooldown {
+		b.setState(circuitHalfOpen, now)
+	}
+	total, failures, slow := b.stats(now)
+	st := &circuitStatus{
+		State:    b.state,
+		Requests: total,
+	}
+	if total > 0 {
+		st.ErrorPercent = failures * 100 / total
+		st.SlowPercent = slow * 100 / total
+	}
+	if b.state != circuitClosed {
+		t := b.openedAt
+		st.OpenedAt = &t
+	}
+	return st
+}
+
+func (b *circuitBreaker) setOwner(chainName, service string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.chain == "" && b.service == "" {
+		b.chain, b.service = chainName, service
+	}
+}
+
+// recordRoute records the result of a dial through the route in the breakers of the nodes,
+// the node failed is the first node marked failed by the route, the nodes before it succeeded.
+// The failure of the last node to connect to the target is not a failure of the node.
+func recordRoute(chainName string, nodes []*chain.Node, err error, latency time.Duration) {
+	now := time.Now()
+	for _, node := range nodes {
+		b := breakerOf(node)
+		failed := err != nil && node.Marker() != nil && node.Marker().Count() > 0
+		if b != nil {
+			b.setOwner(chainName, "")
+			b.record(now, failed, latency)
+		}
+		if failed {
+			return
+		}
+	}
+}
+
+// recordForward records the result of a dial to the forwarder node of the service.
+func recordForward(service string, node *chain.Node, err error, latency time.Duration) {
+	if b := breakerOf(node); b != nil {
+		b.setOwner("", service)
+		b.record(time.Now(), err != nil, latency)
+	}
+}
+
+// circuitFilter filters the nodes ejected by the circuit breakers,
+// at most the maxEjectionPercent of the nodes and never all the nodes are ejected,
+// the nodes ejected earliest are kept beyond the limit.
+type circuitFilter struct{}
+
+func (f circuitFilter) Filter(ctx context.Context, vs ...*chain.Node) []*chain.Node {
+	if len(vs) <= 1 {
+		return vs
+	}
+
+	now := time.Now()
+	var ejected []*chain.Node
+	maxPercent := defaultCircuitBreakerMaxEjection
+	for _, node := range vs {
+		if md := node.Metadata(); md != nil && md.IsExists(mdKeyCircuitBreakerMaxEjection) {
+			maxPercent = mdutil.GetInt(md, mdKeyCircuitBreakerMaxEjection)
+		}
+		if b := breakerOf(node); b != nil && !b.allow(now) {
+			ejected = append(ejected, node)
+		}
+	}
+	if len(ejected) == 0 {
+		return vs
+	}
+
+	max := len(vs) * maxPercent / 100
+	if max >= len(vs) {
+		max = len(vs) - 1
+	}
+	if n := len(ejected) - max; n > 0 {
+		sort.SliceStable(ejected, func(i, j int) bool {
+			return breakerOf(ejected[i]).openedTime().Before(breakerOf(ejected[j]).openedTime())
+		})
+		ejected = ejected[n:]
+	}
+
+	var l []*chain.Node
+	for _, node := range vs {
+		if !containsNode(ejected, node) {
+			l = append(l, node)
+		}
+	}
+	return l
+}
+
+func containsNode(nodes []*chain.Node, node *chain.Node) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *circuitBreaker) openedTime() time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.openedAt
+}
+
+// hasCircuitBreaker reports whether the circuit breaker is enabled in any of the node metadata.
+func hasCircuitBreaker(mds ...map[string]any) bool {
+	for _, m := range mds {
+		if m != nil && mdutil.GetBool(mdx.NewMetadata(m), mdKeyCircuitBreaker) {
+			return true
+		}
+	}
+	return false
+}
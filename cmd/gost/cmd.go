@@ -6,11 +6,13 @@ import (
 	"fmt"
 	"net/url"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	mdutil "github.com/go-gost/core/metadata/util"
+	"github.com/go-gost/core/recorder"
 	"github.com/go-gost/x/config"
 	"github.com/go-gost/x/limiter/conn"
 	"github.com/go-gost/x/limiter/traffic"
@@ -72,6 +74,14 @@ func buildConfigFromCmd(services, nodes stringList) (*config.Config, error) {
 		mc := nodeConfig.Connector.Metadata
 		md := mdx.NewMetadata(mc)
 
+		if err := parseNodeOptions(cfg, namePrefix, nodes, mc); err != nil {
+			return nil, err
+		}
+		for _, node := range nodes {
+			node.Metadata = nodeMetadata(hopNodeKeys, mc, node.Metadata)
+		}
+		deleteNodeMetadata(hopNodeKeys, mc)
+
 		hopConfig := &config.HopConfig{
 			Name:     fmt.Sprintf("%shop-%d", namePrefix, i),
 			Selector: parseSelector(mc),
@@ -96,6 +106,10 @@ func buildConfigFromCmd(services, nodes stringList) (*config.Config, error) {
 			cfg.Bypasses = append(cfg.Bypasses, bypassCfg)
 			delete(mc, "bypass")
 		}
+		if v := mdutil.GetString(md, "bypasses"); v != "" {
+			hopConfig.Bypasses = splitList(v)
+			delete(mc, "bypasses")
+		}
 		if v := mdutil.GetString(md, "resolver"); v != "" {
 			resolverCfg := &config.ResolverConfig{
 				Name: fmt.Sprintf("%sresolver-%d", namePrefix, len(cfg.Resolvers)),
@@ -148,6 +162,27 @@ func buildConfigFromCmd(services, nodes stringList) (*config.Config, error) {
 			delete(mc, "so_mark")
 		}
 
+		if v := mdutil.GetString(md, "recorder"); v != "" {
+			record := mdutil.GetString(md, "recorder.record")
+			if record == "" {
+				record = recorderHopNodeDialAddress
+			}
+			var recorders []any
+			for _, name := range splitList(v) {
+				recorders = append(recorders, map[string]any{
+					"name":   name,
+					"record": record,
+				})
+			}
+			mc[mdKeyRecorders] = recorders
+		}
+		delete(mc, "recorder")
+		delete(mc, "recorder.record")
+
+		if err := parseNodeLimiters(cfg, namePrefix, hopConfig.Name, nodes, mc); err != nil {
+			return nil, err
+		}
+
 		chain.Hops = append(chain.Hops, hopConfig)
 	}
 
@@ -177,6 +212,19 @@ func buildConfigFromCmd(services, nodes stringList) (*config.Config, error) {
 			service.Handler.Retries = v
 			delete(mh, "retries")
 		}
+		if v := mdutil.GetString(md, "authFile"); v != "" {
+			if service.Handler.Auth != nil || service.Handler.Auther != "" ||
+				service.Listener.Auth != nil || service.Listener.Auther != "" {
+				return nil, fmt.Errorf("%s: auth and authFile can not be used together", service.Name)
+			}
+			auther := authFileAuther(cfg, namePrefix, v)
+			if service.Listener.Type == "ssh" || service.Listener.Type == "sshd" {
+				service.Listener.Auther = auther
+			} else {
+				service.Handler.Auther = auther
+			}
+			delete(mh, "authFile")
+		}
 		if v := mdutil.GetString(md, "admission"); v != "" {
 			admCfg := &config.AdmissionConfig{
 				Name: fmt.Sprintf("%sadmission-%d", namePrefix, len(cfg.Admissions)),
@@ -260,6 +308,9 @@ func buildConfigFromCmd(services, nodes stringList) (*config.Config, error) {
 		cin := mdutil.GetString(md, "limiter.conn.in")
 		cout := mdutil.GetString(md, "limiter.conn.out")
 		if in != "" || cin != "" || out != "" || cout != "" {
+			if service.Limiter != "" {
+				return nil, fmt.Errorf("%s: limiter and limiter.* can not be used together", service.Name)
+			}
 			limiter := &config.LimiterConfig{
 				Name: fmt.Sprintf("%slimiter-%d", namePrefix, len(cfg.Limiters)),
 			}
@@ -303,39 +354,205 @@ func buildConfigFromCmd(services, nodes stringList) (*config.Config, error) {
 	return cfg, nil
 }
 
-func buildServiceConfig(url *url.URL) (*config.ServiceConfig, error) {
-	namePrefix := ""
-	if v := os.Getenv("_GOST_ID"); v != "" {
-		namePrefix = fmt.Sprintf("go-%s@", v)
+// parseNodeOptions applies the per-node options in the form of node-<index>.<option>=<value>
+// from the metadata m to the nodes of a hop, the options are removed from m.
+func parseNodeOptions(cfg *config.Config, namePrefix string, nodes []*config.NodeConfig, m map[string]any) error {
+	for k, v := range m {
+		ss := strings.SplitN(k, ".", 2)
+		if len(ss) != 2 || !strings.HasPrefix(ss[0], "node-") {
+			continue
+		}
+		index, err := strconv.Atoi(strings.TrimPrefix(ss[0], "node-"))
+		if err != nil {
+			continue
+		}
+		if index < 0 || index >= len(nodes) {
+			return fmt.Errorf("%w: %s, node-%d does not exist", ErrInvalidNode, k, index)
+		}
+		delete(m, k)
+
+		node := nodes[index]
+		value := fmt.Sprint(v)
+		switch option := ss[1]; option {
+		case "weight", "backup", "maxFails", "failTimeout":
+			// selector labels read from the node metadata.
+			if node.Metadata == nil {
+				node.Metadata = map[string]any{}
+			}
+			node.Metadata[option] = value
+		case "bypass":
+			bypassCfg := &config.BypassConfig{
+				Name: fmt.Sprintf("%sbypass-%d", namePrefix, len(cfg.Bypasses)),
+			}
+			if strings.HasPrefix(value, "~") {
+				bypassCfg.Whitelist = true
+				value = value[1:]
+			}
+			bypassCfg.Matchers = splitList(value)
+			node.Bypass = bypassCfg.Name
+			cfg.Bypasses = append(cfg.Bypasses, bypassCfg)
+		case "interface":
+			node.Interface = value
+		case "so_mark":
+			mark, err := strconv.Atoi(value)
+			if err != nil || mark <= 0 {
+				return fmt.Errorf("%w: %s=%s", ErrInvalidNode, k, value)
+			}
+			node.SockOpts = &config.SockOptsConfig{
+				Mark: mark,
+			}
+		case "auth":
+			auth, err := parseAuthFromCmd(value)
+			if err != nil {
+				return err
+			}
+			// the connector and dialer configs are shared by all nodes of the hop.
+			connector := *node.Connector
+			dialer := *node.Dialer
+			if dialer.Type == "ssh" || dialer.Type == "sshd" {
+				dialer.Auth = auth
+			} else {
+				connector.Auth = auth
+			}
+			node.Connector = &connector
+			node.Dialer = &dialer
+		default:
+			if !slices.Contains(hopNodeKeys, option) {
+				return fmt.Errorf("%w: unknown node option %s", ErrInvalidNode, k)
+			}
+			// health checks, circuit breakers and racing dials read from the node metadata.
+			if node.Metadata == nil {
+				node.Metadata = map[string]any{}
+			}
+			node.Metadata[option] = value
+		}
 	}
 
-	var handler, listener string
-	schemes := strings.Split(url.Scheme, "+")
-	if len(schemes) == 1 {
-		handler = schemes[0]
-		listener = schemes[0]
+	return nil
+}
+
+// healthCheckKeys are the node metadata keys of the health check.
+var healthCheckKeys = []string{
+	mdKeyHealthCheck, mdKeyHealthCheckInterval, mdKeyHealthCheckTimeout, mdKeyHealthCheckHealthy,
+	mdKeyHealthCheckUnhealthy, mdKeyHealthCheckURL, mdKeyHealthCheckTarget,
+}
+
+// nodeCheckKeys are the node metadata keys of the health check and the circuit breaker,
+// which are set for all nodes of a hop or a forwarder by the parameters without the node-<index> prefix.
+var nodeCheckKeys = append(append([]string{}, healthCheckKeys...), circuitBreakerKeys...)
+
+// hopNodeKeys are the node metadata keys set for all nodes of a hop of a chain,
+// the racing dials only apply to the hops of the chains.
+var hopNodeKeys = append(append([]string{}, nodeCheckKeys...), raceKeys...)
+
+// nodeMetadata adds the parameters of the keys in m to the node metadata nm,
+// the parameters set for the node are kept.
+func nodeMetadata(keys []string, m map[string]any, nm map[string]any) map[string]any {
+	for _, k := range keys {
+		v, ok := m[k]
+		if !ok {
+			continue
+		}
+		if nm == nil {
+			nm = map[string]any{}
+		}
+		if _, ok := nm[k]; !ok {
+			nm[k] = v
+		}
 	}
-	if len(schemes) == 2 {
-		handler = schemes[0]
-		listener = schemes[1]
+	return nm
+}
+
+func deleteNodeMetadata(keys []string, m map[string]any) {
+	for _, k := range keys {
+		delete(m, k)
 	}
+}
 
-	svc := &config.ServiceConfig{
-		Addr: url.Host,
+// parseNodeLimiters creates a traffic limiter and a connection limiter for each node of a hop
+// from the limiter.* and climiter options in the metadata m, the options are removed from m.
+// A non-numeric climiter option is kept as the name of a predefined connection limiter.
+func parseNodeLimiters(cfg *config.Config, namePrefix string, hop string, nodes []*config.NodeConfig, m map[string]any) error {
+	md := mdx.NewMetadata(m)
+
+	in := mdutil.GetString(md, "limiter.in")
+	out := mdutil.GetString(md, "limiter.out")
+	cin := mdutil.GetString(md, "limiter.conn.in")
+	cout := mdutil.GetString(md, "limiter.conn.out")
+	var limits []string
+	if in != "" || out != "" {
+		limits = append(limits, fmt.Sprintf("%s %s %s", traffic.GlobalLimitKey, in, out))
+	}
+	if cin != "" || cout != "" {
+		limits = append(limits, fmt.Sprintf("%s %s %s", traffic.ConnLimitKey, cin, cout))
+	}
+	if len(limits) > 0 && mdutil.GetString(md, mdKeyLimiter) != "" {
+		return fmt.Errorf("%s: limiter and limiter.* can not be used together", hop)
 	}
+	delete(m, "limiter.in")
+	delete(m, "limiter.out")
+	delete(m, "limiter.conn.in")
+	delete(m, "limiter.conn.out")
 
-	if h := registry.HandlerRegistry().Get(handler); h == nil {
-		handler = "auto"
+	climit, _ := strconv.Atoi(mdutil.GetString(md, mdKeyCLimiter))
+	if climit > 0 {
+		delete(m, mdKeyCLimiter)
 	}
-	if ln := registry.ListenerRegistry().Get(listener); ln == nil {
-		listener = "tcp"
-		if handler == "ssu" {
-			listener = "udp"
+
+	if len(limits) == 0 && climit <= 0 {
+		return nil
+	}
+
+	for _, node := range nodes {
+		// the metadata is shared by all nodes of the hop.
+		nm := make(map[string]any, len(m)+2)
+		for k, v := range m {
+			nm[k] = v
+		}
+
+		if len(limits) > 0 {
+			limiter := &config.LimiterConfig{
+				Name:   fmt.Sprintf("%slimiter-%d", namePrefix, len(cfg.Limiters)),
+				Limits: limits,
+			}
+			cfg.Limiters = append(cfg.Limiters, limiter)
+			nm[mdKeyLimiter] = limiter.Name
+		}
+		if climit > 0 {
+			limiter := &config.LimiterConfig{
+				Name:   fmt.Sprintf("%sclimiter-%d", namePrefix, len(cfg.CLimiters)),
+				Limits: []string{fmt.Sprintf("%s %d", conn.GlobalLimitKey, climit)},
+			}
+			cfg.CLimiters = append(cfg.CLimiters, limiter)
+			nm[mdKeyCLimiter] = limiter.Name
 		}
+
+		connector := *node.Connector
+		dialer := *node.Dialer
+		connector.Metadata = nm
+		dialer.Metadata = nm
+		node.Connector = &connector
+		node.Dialer = &dialer
+	}
+
+	return nil
+}
+
+func buildServiceConfig(url *url.URL) (*config.ServiceConfig, error) {
+	namePrefix := ""
+	if v := os.Getenv("_GOST_ID"); v != "" {
+		namePrefix = fmt.Sprintf("go-%s@", v)
+	}
+
+	remotes := strings.Trim(url.EscapedPath(), "/")
+	handler, listener := parseServiceScheme(url.Scheme, remotes != "")
+
+	svc := &config.ServiceConfig{
+		Addr: url.Host,
 	}
 
 	// forward mode
-	if remotes := strings.Trim(url.EscapedPath(), "/"); remotes != "" {
+	if remotes != "" {
 		svc.Forwarder = &config.ForwarderConfig{
 			// Targets: strings.Split(remotes, ","),
 		}
@@ -346,17 +563,6 @@ func buildServiceConfig(url *url.URL) (*config.ServiceConfig, error) {
 					Addr: addr,
 				})
 		}
-		if handler != "relay" {
-			if listener == "tcp" || listener == "udp" ||
-				listener == "rtcp" || listener == "rudp" ||
-				listener == "tun" || listener == "tap" ||
-				listener == "dns" || listener == "unix" ||
-				listener == "serial" {
-				handler = listener
-			} else {
-				handler = "forward"
-			}
-		}
 	}
 
 	var auth *config.AuthConfig
@@ -384,6 +590,38 @@ func buildServiceConfig(url *url.URL) (*config.ServiceConfig, error) {
 	}
 	delete(m, "auth")
 
+	// named references to the components defined in the configuration file.
+	auther := mdutil.GetString(md, "auther")
+	delete(m, "auther")
+
+	svc.Limiter = mdutil.GetString(md, "limiter")
+	delete(m, "limiter")
+
+	observer := mdutil.GetString(md, "observer")
+	svc.Observer = observer
+	delete(m, "observer")
+
+	svc.Admissions = splitList(mdutil.GetString(md, "admissions"))
+	delete(m, "admissions")
+
+	svc.Bypasses = splitList(mdutil.GetString(md, "bypasses"))
+	delete(m, "bypasses")
+
+	if v := mdutil.GetString(md, "recorder"); v != "" {
+		record := mdutil.GetString(md, "recorder.record")
+		if record == "" {
+			record = recorder.RecorderServiceRouterDialAddress
+		}
+		for _, name := range splitList(v) {
+			svc.Recorders = append(svc.Recorders, &config.RecorderObject{
+				Name:   name,
+				Record: record,
+			})
+		}
+	}
+	delete(m, "recorder")
+	delete(m, "recorder.record")
+
 	tlsConfig := &config.TLSConfig{
 		CertFile: mdutil.GetString(md, "certFile", "cert"),
 		KeyFile:  mdutil.GetString(md, "keyFile", "key"),
@@ -407,11 +645,17 @@ func buildServiceConfig(url *url.URL) (*config.ServiceConfig, error) {
 
 	if svc.Forwarder != nil {
 		svc.Forwarder.Selector = parseSelector(m)
+		for _, node := range svc.Forwarder.Nodes {
+			node.Metadata = nodeMetadata(nodeCheckKeys, m, node.Metadata)
+		}
+		deleteNodeMetadata(nodeCheckKeys, m)
 	}
 
 	svc.Handler = &config.HandlerConfig{
 		Type:     handler,
 		Auth:     auth,
+		Auther:   auther,
+		Observer: observer,
 		Metadata: m,
 	}
 	svc.Listener = &config.ListenerConfig{
@@ -424,38 +668,21 @@ func buildServiceConfig(url *url.URL) (*config.ServiceConfig, error) {
 
 	if svc.Listener.Type == "ssh" || svc.Listener.Type == "sshd" {
 		svc.Handler.Auth = nil
+		svc.Handler.Auther = ""
 		svc.Listener.Auth = auth
+		svc.Listener.Auther = auther
 	}
 
 	return svc, nil
 }
 
 func buildNodeConfig(url *url.URL) (*config.NodeConfig, error) {
-	var connector, dialer string
-	schemes := strings.Split(url.Scheme, "+")
-	if len(schemes) == 1 {
-		connector = schemes[0]
-		dialer = schemes[0]
-	}
-	if len(schemes) == 2 {
-		connector = schemes[0]
-		dialer = schemes[1]
-	}
+	connector, dialer := parseNodeScheme(url.Scheme)
 
 	node := &config.NodeConfig{
 		Addr: url.Host,
 	}
 
-	if c := registry.ConnectorRegistry().Get(connector); c == nil {
-		connector = "http"
-	}
-	if d := registry.DialerRegistry().Get(dialer); d == nil {
-		dialer = "tcp"
-		if connector == "ssu" {
-			dialer = "udp"
-		}
-	}
-
 	var auth *config.AuthConfig
 	if url.User != nil {
 		auth = &config.AuthConfig{
@@ -481,6 +708,18 @@ func buildNodeConfig(url *url.URL) (*config.NodeConfig, error) {
 	}
 	delete(m, "auth")
 
+	if v := mdutil.GetString(md, "authFile"); v != "" {
+		if auth != nil {
+			return nil, fmt.Errorf("%w: auth and authFile can not be used together", ErrInvalidNode)
+		}
+		au, err := readAuthFile(v)
+		if err != nil {
+			return nil, err
+		}
+		auth = au
+	}
+	delete(m, "authFile")
+
 	tlsConfig := &config.TLSConfig{
 		CertFile:   mdutil.GetString(md, "certFile", "cert"),
 		KeyFile:    mdutil.GetString(md, "keyFile", "key"),
@@ -524,6 +763,168 @@ func buildNodeConfig(url *url.URL) (*config.NodeConfig, error) {
 	return node, nil
 }
 
+// parseServiceScheme resolves the handler and listener types from the scheme of a service URL,
+// forward indicates that the service URL has forward targets.
+func parseServiceScheme(scheme string, forward bool) (handler, listener string) {
+	schemes := strings.Split(scheme, "+")
+	if len(schemes) == 1 {
+		handler = schemes[0]
+		listener = schemes[0]
+	}
+	if len(schemes) == 2 {
+		handler = schemes[0]
+		listener = schemes[1]
+	}
+
+	if h := registry.HandlerRegistry().Get(handler); h == nil {
+		handler = "auto"
+	}
+	if ln := registry.ListenerRegistry().Get(listener); ln == nil {
+		listener = "tcp"
+		if handler == "ssu" {
+			listener = "udp"
+		}
+	}
+
+	if forward && handler != "relay" {
+		if listener == "tcp" || listener == "udp" ||
+			listener == "rtcp" || listener == "rudp" ||
+			listener == "tun" || listener == "tap" ||
+			listener == "dns" || listener == "unix" ||
+			listener == "serial" {
+			handler = listener
+		} else {
+			handler = "forward"
+		}
+	}
+	return
+}
+
+// parseNodeScheme resolves the connector and dialer types from the scheme of a node URL.
+func parseNodeScheme(scheme string) (connector, dialer string) {
+	schemes := strings.Split(scheme, "+")
+	if len(schemes) == 1 {
+		connector = schemes[0]
+		dialer = schemes[0]
+	}
+	if len(schemes) == 2 {
+		connector = schemes[0]
+		dialer = schemes[1]
+	}
+
+	if c := registry.ConnectorRegistry().Get(connector); c == nil {
+		connector = "http"
+	}
+	if d := registry.DialerRegistry().Get(dialer); d == nil {
+		dialer = "tcp"
+		if connector == "ssu" {
+			dialer = "udp"
+		}
+	}
+	return
+}
+
+// validateCmdConfig checks that the components referenced by name in the command line
+// configuration cmdCfg are defined in the merged configuration cfg.
+func validateCmdConfig(cmdCfg, cfg *config.Config) error {
+	if cmdCfg == nil || cfg == nil {
+		return nil
+	}
+
+	names := map[string]map[string]bool{}
+	add := func(kind, name string) {
+		if names[kind] == nil {
+			names[kind] = map[string]bool{}
+		}
+		names[kind][name] = true
+	}
+	for _, v := range cfg.Authers {
+		add("auther", v.Name)
+	}
+	for _, v := range cfg.Admissions {
+		add("admission", v.Name)
+	}
+	for _, v := range cfg.Bypasses {
+		add("bypass", v.Name)
+	}
+	for _, v := range cfg.Limiters {
+		add("limiter", v.Name)
+	}
+	for _, v := range cfg.CLimiters {
+		add("climiter", v.Name)
+	}
+	for _, v := range cfg.Recorders {
+		add("recorder", v.Name)
+	}
+	for _, v := range cfg.Observers {
+		add("observer", v.Name)
+	}
+	for _, v := range cfg.Ingresses {
+		add("ingress", v.Name)
+	}
+	for _, v := range cfg.Routers {
+		add("router", v.Name)
+	}
+
+	check := func(owner, kind string, refs ...string) error {
+		for _, name := range refs {
+			if name != "" && !names[kind][name] {
+				return fmt.Errorf("%s: %s %s is not defined", owner, kind, name)
+			}
+		}
+		return nil
+	}
+
+	for _, svc := range cmdCfg.Services {
+		var recorders []string
+		for _, r := range svc.Recorders {
+			recorders = append(recorders, r.Name)
+		}
+		md := mdx.NewMetadata(svc.Metadata)
+		for _, err := range []error{
+			check(svc.Name, "auther", svc.Handler.Auther, svc.Listener.Auther),
+			check(svc.Name, "admission", svc.Admissions...),
+			check(svc.Name, "bypass", svc.Bypasses...),
+			check(svc.Name, "limiter", svc.Limiter),
+			check(svc.Name, "observer", svc.Observer),
+			check(svc.Name, "recorder", recorders...),
+			check(svc.Name, "ingress", mdutil.GetString(md, "ingress")),
+			check(svc.Name, "router", mdutil.GetString(md, "router")),
+		} {
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, chain := range cmdCfg.Chains {
+		for _, hop := range chain.Hops {
+			if err := check(hop.Name, "bypass", hop.Bypasses...); err != nil {
+				return err
+			}
+			for _, node := range hop.Nodes {
+				md := mdx.NewMetadata(node.Dialer.Metadata)
+				var recorders []string
+				if md != nil {
+					for _, r := range parseNodeRecorders(md.Get(mdKeyRecorders)) {
+						recorders = append(recorders, r.Name)
+					}
+				}
+				for _, err := range []error{
+					check(node.Name, "limiter", mdutil.GetString(md, mdKeyLimiter)),
+					check(node.Name, "climiter", mdutil.GetString(md, mdKeyCLimiter)),
+					check(node.Name, "recorder", recorders...),
+				} {
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
 func normCmd(s string) (*url.URL, error) {
 	s = strings.TrimSpace(s)
 	if s == "" {
@@ -545,6 +946,18 @@ func normCmd(s string) (*url.URL, error) {
 	return url, nil
 }
 
+// authFileAuther adds an auther which loads the users from the auth file to cfg, and returns its name.
+func authFileAuther(cfg *config.Config, namePrefix string, file string) string {
+	autherCfg := &config.AutherConfig{
+		Name: fmt.Sprintf("%sauther-%d", namePrefix, len(cfg.Authers)),
+		File: &config.FileLoader{
+			Path: file,
+		},
+	}
+	cfg.Authers = append(cfg.Authers, autherCfg)
+	return autherCfg.Name
+}
+
 func parseAuthFromCmd(sa string) (*config.AuthConfig, error) {
 	v, err := base64.StdEncoding.DecodeString(sa)
 	if err != nil {
@@ -564,6 +977,16 @@ func parseAuthFromCmd(sa string) (*config.AuthConfig, error) {
 	}, nil
 }
 
+// splitList splits the comma-separated list s, the empty items are omitted.
+func splitList(s string) (list []string) {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return
+}
+
 func parseSelector(m map[string]any) *config.SelectorConfig {
 	md := mdx.NewMetadata(m)
 	strategy := mdutil.GetString(md, "strategy")
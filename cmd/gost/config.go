@@ -1,16 +1,20 @@
 package main
 
 import (
+	"github.com/go-gost/core/admission"
+	"github.com/go-gost/core/auth"
+	"github.com/go-gost/core/bypass"
+	"github.com/go-gost/core/chain"
+	"github.com/go-gost/core/hop"
+	"github.com/go-gost/core/hosts"
+	"github.com/go-gost/core/limiter/conn"
+	"github.com/go-gost/core/limiter/rate"
+	"github.com/go-gost/core/limiter/traffic"
 	"github.com/go-gost/core/logger"
+	"github.com/go-gost/core/resolver"
 	"github.com/go-gost/core/service"
-	"github.com/go-gost/x/api"
 	"github.com/go-gost/x/config"
-	admission_parser "github.com/go-gost/x/config/parsing/admission"
 	auth_parser "github.com/go-gost/x/config/parsing/auth"
-	bypass_parser "github.com/go-gost/x/config/parsing/bypass"
-	chain_parser "github.com/go-gost/x/config/parsing/chain"
-	hop_parser "github.com/go-gost/x/config/parsing/hop"
-	hosts_parser "github.com/go-gost/x/config/parsing/hosts"
 	ingress_parser "github.com/go-gost/x/config/parsing/ingress"
 	limiter_parser "github.com/go-gost/x/config/parsing/limiter"
 	logger_parser "github.com/go-gost/x/config/parsing/logger"
@@ -29,6 +33,27 @@ func buildService(cfg *config.Config) (services []service.Service) {
 		return
 	}
 
+	buildComponents(cfg)
+
+	log := logger.Default()
+	for _, svcCfg := range cfg.Services {
+		svc, err := service_parser.ParseService(svcCfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if svc != nil {
+			if err := registry.ServiceRegistry().Register(svcCfg.Name, svc); err != nil {
+				log.Fatal(err)
+			}
+		}
+		services = append(services, svc)
+	}
+
+	return
+}
+
+// buildComponents registers the components in cfg other than the services.
+func buildComponents(cfg *config.Config) {
 	log := logger.Default()
 
 	for _, loggerCfg := range cfg.Loggers {
@@ -40,7 +65,7 @@ func buildService(cfg *config.Config) (services []service.Service) {
 	}
 
 	for _, autherCfg := range cfg.Authers {
-		if auther := auth_parser.ParseAuther(autherCfg); auther != nil {
+		if auther, _ := buildAuther(autherCfg); auther != nil {
 			if err := registry.AutherRegistry().Register(autherCfg.Name, auther); err != nil {
 				log.Fatal(err)
 			}
@@ -48,7 +73,7 @@ func buildService(cfg *config.Config) (services []service.Service) {
 	}
 
 	for _, admissionCfg := range cfg.Admissions {
-		if adm := admission_parser.ParseAdmission(admissionCfg); adm != nil {
+		if adm, _ := buildAdmission(admissionCfg); adm != nil {
 			if err := registry.AdmissionRegistry().Register(admissionCfg.Name, adm); err != nil {
 				log.Fatal(err)
 			}
@@ -56,7 +81,7 @@ func buildService(cfg *config.Config) (services []service.Service) {
 	}
 
 	for _, bypassCfg := range cfg.Bypasses {
-		if bp := bypass_parser.ParseBypass(bypassCfg); bp != nil {
+		if bp, _ := buildBypass(bypassCfg); bp != nil {
 			if err := registry.BypassRegistry().Register(bypassCfg.Name, bp); err != nil {
 				log.Fatal(err)
 			}
@@ -64,7 +89,7 @@ func buildService(cfg *config.Config) (services []service.Service) {
 	}
 
 	for _, resolverCfg := range cfg.Resolvers {
-		r, err := resolver_parser.ParseResolver(resolverCfg)
+		r, err := buildResolver(resolverCfg)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -76,7 +101,7 @@ func buildService(cfg *config.Config) (services []service.Service) {
 	}
 
 	for _, hostsCfg := range cfg.Hosts {
-		if h := hosts_parser.ParseHostMapper(hostsCfg); h != nil {
+		if h, _ := buildHosts(hostsCfg); h != nil {
 			if err := registry.HostsRegistry().Register(hostsCfg.Name, h); err != nil {
 				log.Fatal(err)
 			}
@@ -123,28 +148,28 @@ func buildService(cfg *config.Config) (services []service.Service) {
 	}
 
 	for _, limiterCfg := range cfg.Limiters {
-		if h := limiter_parser.ParseTrafficLimiter(limiterCfg); h != nil {
+		if h, _ := buildTrafficLimiter(limiterCfg); h != nil {
 			if err := registry.TrafficLimiterRegistry().Register(limiterCfg.Name, h); err != nil {
 				log.Fatal(err)
 			}
 		}
 	}
 	for _, limiterCfg := range cfg.CLimiters {
-		if h := limiter_parser.ParseConnLimiter(limiterCfg); h != nil {
+		if h, _ := buildConnLimiter(limiterCfg); h != nil {
 			if err := registry.ConnLimiterRegistry().Register(limiterCfg.Name, h); err != nil {
 				log.Fatal(err)
 			}
 		}
 	}
 	for _, limiterCfg := range cfg.RLimiters {
-		if h := limiter_parser.ParseRateLimiter(limiterCfg); h != nil {
+		if h, _ := buildRateLimiter(limiterCfg); h != nil {
 			if err := registry.RateLimiterRegistry().Register(limiterCfg.Name, h); err != nil {
 				log.Fatal(err)
 			}
 		}
 	}
 	for _, hopCfg := range cfg.Hops {
-		hop, err := hop_parser.ParseHop(hopCfg, log)
+		hop, err := buildHop(hopCfg)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -155,7 +180,10 @@ func buildService(cfg *config.Config) (services []service.Service) {
 		}
 	}
 	for _, chainCfg := range cfg.Chains {
-		c, err := chain_parser.ParseChain(chainCfg, log)
+		if chainCfg == nil {
+			continue
+		}
+		c, err := buildChain(chainCfg)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -165,21 +193,80 @@ func buildService(cfg *config.Config) (services []service.Service) {
 			}
 		}
 	}
+}
 
-	for _, svcCfg := range cfg.Services {
-		svc, err := service_parser.ParseService(svcCfg)
-		if err != nil {
-			log.Fatal(err)
-		}
-		if svc != nil {
-			if err := registry.ServiceRegistry().Register(svcCfg.Name, svc); err != nil {
-				log.Fatal(err)
-			}
-		}
-		services = append(services, svc)
+// The builders of the components which are built by gost in place of the parsers of go-gost/x,
+// for both the config file and the config API. A nil component is not registered.
+
+func buildAuther(cfg *config.AutherConfig) (auth.Authenticator, error) {
+	return parseAuther(cfg), nil
+}
+
+func buildAdmission(cfg *config.AdmissionConfig) (admission.Admission, error) {
+	adm := parseAdmission(cfg)
+	if adm == nil {
+		return nil, nil
 	}
+	adm = &eventAdmission{Admission: adm, name: cfg.Name}
+	return scheduleAdmission(cfg.Name, adm), nil
+}
 
-	return
+func buildBypass(cfg *config.BypassConfig) (bypass.Bypass, error) {
+	bp := parseBypass(cfg)
+	if bp == nil {
+		return nil, nil
+	}
+	return scheduleBypass(cfg.Name, bp), nil
+}
+
+func buildResolver(cfg *config.ResolverConfig) (resolver.Resolver, error) {
+	r, err := resolver_parser.ParseResolver(cfg)
+	if r == nil || err != nil {
+		return nil, err
+	}
+	return &tracingResolver{Resolver: r, name: cfg.Name}, nil
+}
+
+func buildHosts(cfg *config.HostsConfig) (hosts.HostMapper, error) {
+	return parseHostMapper(cfg), nil
+}
+
+func buildTrafficLimiter(cfg *config.LimiterConfig) (traffic.TrafficLimiter, error) {
+	l := parseTrafficLimiter(cfg)
+	if l == nil {
+		return nil, nil
+	}
+	return scheduleTrafficLimiter(cfg.Name, l), nil
+}
+
+func buildConnLimiter(cfg *config.LimiterConfig) (conn.ConnLimiter, error) {
+	l := limiter_parser.ParseConnLimiter(cfg)
+	if l == nil {
+		return nil, nil
+	}
+	l = &eventConnLimiter{ConnLimiter: l, name: cfg.Name}
+	return scheduleConnLimiter(cfg.Name, l), nil
+}
+
+func buildRateLimiter(cfg *config.LimiterConfig) (rate.RateLimiter, error) {
+	l := limiter_parser.ParseRateLimiter(cfg)
+	if l == nil {
+		return nil, nil
+	}
+	l = &eventRateLimiter{RateLimiter: l, name: cfg.Name}
+	return scheduleRateLimiter(cfg.Name, l), nil
+}
+
+func buildHop(cfg *config.HopConfig) (hop.Hop, error) {
+	return parseHop(cfg, logger.Default())
+}
+
+func buildChain(cfg *config.ChainConfig) (chain.Chainer, error) {
+	c, err := parseChain(cfg, logger.Default())
+	if c == nil || err != nil {
+		return nil, err
+	}
+	return c, nil
 }
 
 func buildAPIService(cfg *config.APIConfig) (service.Service, error) {
@@ -187,12 +274,7 @@ func buildAPIService(cfg *config.APIConfig) (service.Service, error) {
 	if cfg.Auther != "" {
 		auther = registry.AutherRegistry().Get(cfg.Auther)
 	}
-	return api.NewService(
-		cfg.Addr,
-		api.PathPrefixOption(cfg.PathPrefix),
-		api.AccessLogOption(cfg.AccessLog),
-		api.AutherOption(auther),
-	)
+	return newAPIService(cfg, auther)
 }
 
 func buildMetricsService(cfg *config.MetricsConfig) (service.Service, error) {
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/go-gost/core/bypass"
+	"github.com/go-gost/core/chain"
+	"github.com/go-gost/core/metadata"
+	ctxvalue "github.com/go-gost/x/ctx"
+	"github.com/rs/xid"
+	"golang.org/x/time/rate"
+)
+
+var (
+	errUnsupported = errors.New("unsupported operation")
+)
+
+// connections is the table of the connections being handled by the services.
+var connections = &connTable{
+	conns:   make(map[string]*connRecord),
+	clients: make(map[string]*connRecord),
+	closed:  make(map[string]*serviceTraffic),
+}
+
+// connRecord is the record of a handled connection, it is in the connection table while
+// the connection is handled and is written to the access log as an accessEntry when it is closed.
+type connRecord struct {
+	Time    time.Time
+	SID     string
+	Client  string
+	User    string
+	Service string
+	Handler string
+	// Target is the address the client requested.
+	Target string
+	// Chain and Nodes are the route of the last dial or bind to the target.
+	Chain string
+	Nodes []string
+	// BytesIn is the number of bytes read from the client, BytesOut is written to the client.
+	BytesIn  int64
+	BytesOut int64
+	Duration time.Duration
+	// Reason is the error the connection is closed with, or closed.
+	Reason string
+
+	conn net.Conn
+	// ctx is cancelled once the connection is killed or closed, it cancels the waits of the throttled connection.
+	ctx      context.Context
+	cancel   context.CancelFunc
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+	killed   atomic.Bool
+	// throttle is the limiter of the exhausted quota of the connection,
+	// quotaBytes is the bytes of the connection its quotas are checked again at, 0 if there is no such quota.
+	throttle   atomic.Pointer[rate.Limiter]
+	quotaBytes atomic.Int64
+	dialErr    error
+	dialAddr   string
+	// selected are the nodes selected for the connection by the strategies counting the active connections.
+	selected []*chain.Node
+	mu       sync.Mutex
+}
+
+func newConnRecord(ctx context.Context, conn net.Conn, service, handler string) *connRecord {
+	sid := string(ctxvalue.SidFromContext(ctx))
+	if sid == "" {
+		sid = xid.New().String()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &connRecord{
+		Time:    time.Now(),
+		SID:     sid,
+		Client:  conn.RemoteAddr().String(),
+		Service: service,
+		Handler: handler,
+		Nodes:   []string{},
+		conn:    conn,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// setTarget sets the first target address requested by the client.
+func (r *connRecord) setTarget(ctx context.Context, addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.Target == "" {
+		r.Target = addr
+	}
+	r.setUser(ctx)
+}
+
+func (r *connRecord) setRoute(ctx context.Context, chainName string, nodes []*chain.Node, address string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Chain = chainName
+	r.dialAddr = address
+	r.Nodes = make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		r.Nodes = append(r.Nodes, node.Name)
+	}
+	r.dialErr = err
+	r.setUser(ctx)
+}
+
+// failedChain returns the chain of the last dial or bind if it failed to the address,
+// the dials to the same address through another chain are the failovers.
+func (r *connRecord) failedChain(address string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.dialErr == nil || r.dialAddr != address {
+		return "", nil
+	}
+	return r.Chain, r.dialErr
+}
+
+// useNode counts the connection as an active connection of the node until the nodes are released.
+func (r *connRecord) useNode(node *chain.Node) {
+	nodeLoadOf(node).active.Add(1)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.selected = append(r.selected, node)
+}
+
+// releaseNodes releases the nodes used by the connection.
+func (r *connRecord) releaseNodes() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, node := range r.selected {
+		nodeLoadOf(node).active.Add(-1)
+	}
+	r.selected = nil
+}
+
+// selectedNode returns the last node selected for the connection with the address.
+func (r *connRecord) selectedNode(addr string) *chain.Node {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := len(r.selected) - 1; i >= 0; i-- {
+		if r.selected[i].Addr == addr {
+			return r.selected[i]
+		}
+	}
+	return nil
+}
+
+// setUser sets the user authenticated by the handler, which is saved in ctx as the client ID.
+func (r *connRecord) setUser(ctx context.Context) {
+	if v := ctxvalue.ClientIDFromContext(ctx); v != "" {
+		r.User = string(v)
+	}
+}
+
+// kill force-closes the client connection, the handler returns with the closed connection.
+func (r *connRecord) kill() error {
+	r.killed.Store(true)
+	r.cancel()
+	return r.conn.Close()
+}
+
+func (r *connRecord) done(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.BytesIn = r.bytesIn.Load()
+	r.BytesOut = r.bytesOut.Load()
+	r.Duration = time.Since(r.Time)
+
+	switch {
+	case r.killed.Load():
+		r.Reason = "killed"
+	case err != nil:
+		r.Reason = err.Error()
+	case r.dialErr != nil:
+		r.Reason = r.dialErr.Error()
+	default:
+		r.Reason = "closed"
+	}
+}
+
+// info returns the current state of the connection with the live byte counters.
+func (r *connRecord) info() connInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return connInfo{
+		ID:        r.SID,
+		Service:   r.Service,
+		Handler:   r.Handler,
+		Client:    r.Client,
+		User:      r.User,
+		Target:    r.Target,
+		Chain:     r.Chain,
+		Nodes:     append([]string{}, r.Nodes...),
+		StartTime: r.Time,
+		BytesIn:   r.bytesIn.Load(),
+		BytesOut:  r.bytesOut.Load(),
+	}
+}
+
+// connInfo is a connection in the connection list of the API.
+type connInfo struct {
+	ID      string `json:"id"`
+	Service string `json:"service"`
+	Handler string `json:"handler"`
+	Client  string `json:"client"`
+	User    string `json:"user,omitempty"`
+	Target  string `json:"target,omitempty"`
+	// Chain and Nodes are the route to the target, empty for the direct connections.
+	Chain     string    `json:"chain,omitempty"`
+	Nodes     []string  `json:"nodes,omitempty"`
+	StartTime time.Time `json:"startTime"`
+	BytesIn   int64     `json:"bytesIn"`
+	BytesOut  int64     `json:"bytesOut"`
+}
+
+type connRecordKey struct{}
+
+func contextWithConnRecord(ctx context.Context, rec *connRecord) context.Context {
+	return context.WithValue(ctx, connRecordKey{}, rec)
+}
+
+func connRecordFromContext(ctx context.Context) *connRecord {
+	v, _ := ctx.Value(connRecordKey{}).(*connRecord)
+	return v
+}
+
+// connFilter matches the connections by the service, the user and the client address.
+// The empty fields match any connection.
+type connFilter struct {
+	Service string
+	User    string
+	Client  *net.IPNet
+}
+
+func (f *connFilter) empty() bool {
+	return f.Service == "" && f.User == "" && f.Client == nil
+}
+
+func (f *connFilter) match(r *connRecord) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if f.Service != "" && f.Service != r.Service {
+		return false
+	}
+	if f.User != "" && f.User != r.User {
+		return false
+	}
+	if f.Client != nil {
+		host, _, _ := net.SplitHostPort(r.Client)
+		if ip := net.ParseIP(host); ip == nil || !f.Client.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseClientFilter parses the client filter in CIDR notation or as a single IP address.
+func parseClientFilter(s string) (*net.IPNet, error) {
+	if _, ipNet, err := net.ParseCIDR(s); err == nil {
+		return ipNet, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, &net.ParseError{Type: "CIDR address", Text: s}
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+type connTable struct {
+	conns map[string]*connRecord
+	// clients are the latest connections by client address.
+	clients map[string]*connRecord
+	// closed is the traffic of the closed connections by service.
+	closed map[string]*serviceTraffic
+	mu     sync.RWMutex
+}
+
+// serviceTraffic is the traffic of the connections of a service.
+type serviceTraffic struct {
+	Conns    int   `json:"conns"`
+	BytesIn  int64 `json:"bytesIn"`
+	BytesOut int64 `json:"bytesOut"`
+}
+
+func (t *connTable) add(r *connRecord) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.conns[r.SID] = r
+	t.clients[r.Client] = r
+}
+
+func (t *connTable) remove(r *connRecord) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conns[r.SID] == r {
+		delete(t.conns, r.SID)
+		if t.clients[r.Client] == r {
+			delete(t.clients, r.Client)
+		}
+
+		st := t.closed[r.Service]
+		if st == nil {
+			st = &serviceTraffic{}
+			t.closed[r.Service] = st
+		}
+		st.BytesIn += r.bytesIn.Load()
+		st.BytesOut += r.bytesOut.Load()
+	}
+}
+
+// traffic returns the number of the active connections and the total bytes of the connections by service.
+func (t *connTable) traffic() map[string]serviceTraffic {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	m := make(map[string]serviceTraffic, len(t.closed))
+	for service, st := range t.closed {
+		m[service] = serviceTraffic{BytesIn: st.BytesIn, BytesOut: st.BytesOut}
+	}
+	for _, r := range t.conns {
+		st := m[r.Service]
+		st.Conns++
+		st.BytesIn += r.bytesIn.Load()
+		st.BytesOut += r.bytesOut.Load()
+		m[r.Service] = st
+	}
+	return m
+}
+
+func (t *connTable) get(id string) *connRecord {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.conns[id]
+}
+
+// client returns the latest connection of the client address.
+func (t *connTable) client(addr string) *connRecord {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.clients[addr]
+}
+
+// list returns the connections matched by the filter in the order of the start time.
+func (t *connTable) list(f *connFilter) []*connRecord {
+	t.mu.RLock()
+	recs := make([]*connRecord, 0, len(t.conns))
+	for _, r := range t.conns {
+		recs = append(recs, r)
+	}
+	t.mu.RUnlock()
+
+	var matched []*connRecord
+	for _, r := range recs {
+		if f == nil || f.match(r) {
+			matched = append(matched, r)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].Time.Before(matched[j].Time)
+	})
+	return matched
+}
+
+// connBypass records the target address checked by the handler in the record of the connection,
+// the target is bypassed if the connection is blocked by an exhausted quota.
+type connBypass struct {
+	bypass.Bypass
+}
+
+func (p *connBypass) Contains(ctx context.Context, network, addr string, opts ...bypass.Option) bool {
+	if rec := connRecordFromContext(ctx); rec != nil {
+		rec.setTarget(ctx, addr)
+		// the quotas of the user are checked once the user is known.
+		if !quotas.Load().admit(rec) {
+			return true
+		}
+	}
+	return p.Bypass.Contains(ctx, network, addr, opts...)
+}
+
+// recordConn counts the bytes of a client connection in the connection record.
+type recordConn struct {
+	net.Conn
+	rec *connRecord
+}
+
+func wrapRecordConn(c net.Conn, rec *connRecord) net.Conn {
+	conn := &recordConn{
+		Conn: c,
+		rec:  rec,
+	}
+	if pc, ok := c.(net.PacketConn); ok {
+		return &recordPacketConn{
+			recordConn: conn,
+			pc:         pc,
+		}
+	}
+	return conn
+}
+
+func (c *recordConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	c.rec.bytesIn.Add(int64(n))
+	c.rec.quota(n)
+	return
+}
+
+func (c *recordConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	c.rec.bytesOut.Add(int64(n))
+	c.rec.quota(n)
+	return
+}
+
+func (c *recordConn) SyscallConn() (rc syscall.RawConn, err error) {
+	if sc, ok := c.Conn.(syscall.Conn); ok {
+		return sc.SyscallConn()
+	}
+	return nil, errUnsupported
+}
+
+func (c *recordConn) Metadata() metadata.Metadata {
+	if md, ok := c.Conn.(metadata.Metadatable); ok {
+		return md.Metadata()
+	}
+	return nil
+}
+
+type recordPacketConn struct {
+	*recordConn
+	pc net.PacketConn
+}
+
+func (c *recordPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	n, addr, err = c.pc.ReadFrom(p)
+	c.rec.bytesIn.Add(int64(n))
+	c.rec.quota(n)
+	return
+}
+
+func (c *recordPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	n, err = c.pc.WriteTo(p, addr)
+	c.rec.bytesOut.Add(int64(n))
+	c.rec.quota(n)
+	return
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// connsCmd lists the active connections of a running gost by the API,
+// or force-closes the connections by ID or by the filters with -kill.
+func connsCmd(args []string) int {
+	var (
+		addr     string
+		service  string
+		user     string
+		client   string
+		kill     bool
+		jsonMode bool
+	)
+	fs := flag.NewFlagSet("conns", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: gost conns [-api addr] [-service name] [-user name] [-client cidr] [-json] [-kill [id...]]")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&addr, "api", os.Getenv("GOST_API"), "api service address, [user:pass@]host:port[?pathPrefix=/api]")
+	fs.StringVar(&service, "service", "", "filter by service name")
+	fs.StringVar(&user, "user", "", "filter by user")
+	fs.StringVar(&client, "client", "", "filter by client IP or CIDR")
+	fs.BoolVar(&kill, "kill", false, "close the connections of the IDs, or matched by the filters")
+	fs.BoolVar(&jsonMode, "json", false, "print the connections in json format")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 0 && !kill {
+		fs.Usage()
+		return 2
+	}
+
+	c, err := newAPIClient(addr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	query := url.Values{}
+	for k, v := range map[string]string{"service": service, "user": user, "client": client} {
+		if v != "" {
+			query.Set(k, v)
+		}
+	}
+
+	var list connList
+	switch {
+	case kill && fs.NArg() > 0:
+		for _, id := range fs.Args() {
+			var l connList
+			if err := c.do(http.MethodDelete, "/conns/"+url.PathEscape(id), nil, &l); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			list.Conns = append(list.Conns, l.Conns...)
+		}
+		list.Count = len(list.Conns)
+	case kill:
+		err = c.do(http.MethodDelete, "/conns", query, &list)
+	default:
+		err = c.do(http.MethodGet, "/conns", query, &list)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if jsonMode {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(list)
+		return 0
+	}
+
+	printConns(list.Conns)
+	if kill {
+		fmt.Fprintf(os.Stdout, "%d connections closed\n", list.Count)
+	}
+	return 0
+}
+
+func printConns(conns []connInfo) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSERVICE\tHANDLER\tCLIENT\tUSER\tTARGET\tROUTE\tAGE\tIN\tOUT")
+	for _, c := range conns {
+		route := "-"
+		if c.Chain != "" {
+			route = c.Chain + ":" + strings.Join(c.Nodes, ">")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			c.ID, c.Service, c.Handler, c.Client, orDash(c.User), orDash(c.Target), route,
+			time.Since(c.StartTime).Truncate(time.Second), formatBytes(c.BytesIn), formatBytes(c.BytesOut))
+	}
+	w.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// formatBytes formats n in the binary units.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
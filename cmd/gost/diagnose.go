@@ -0,0 +1,631 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-gost/core/bypass"
+	"github.com/go-gost/core/chain"
+	"github.com/go-gost/core/hop"
+	"github.com/go-gost/core/logger"
+	"github.com/go-gost/x/config"
+	hop_parser "github.com/go-gost/x/config/parsing/hop"
+	xlogger "github.com/go-gost/x/logger"
+	"github.com/go-gost/x/registry"
+)
+
+const defaultDiagnoseTarget = "example.com:80"
+
+// The steps of the diagnosis of a chain node.
+const (
+	diagStepResolve   = "resolve"
+	diagStepDial      = "dial"
+	diagStepHandshake = "handshake"
+	diagStepConnect   = "connect"
+)
+
+// diagReport is the report of gost diagnose.
+type diagReport struct {
+	Time   time.Time `json:"time"`
+	Target string    `json:"target"`
+	// Resolvers are the resolutions of the target host through the configured resolvers.
+	Resolvers []diagResolve `json:"resolvers,omitempty"`
+	Chains    []diagChain   `json:"chains"`
+	OK        bool          `json:"ok"`
+}
+
+type diagResolve struct {
+	Resolver  string   `json:"resolver"`
+	Host      string   `json:"host"`
+	Addrs     []string `json:"addrs,omitempty"`
+	LatencyMs float64  `json:"latencyMs"`
+	Error     string   `json:"error,omitempty"`
+}
+
+type diagChain struct {
+	Name string    `json:"name"`
+	Hops []diagHop `json:"hops"`
+	// Route is the nodes of the working route through the chain to the target.
+	Route []string `json:"route,omitempty"`
+	// Direct is set if the target is sent direct by the bypass of a hop, the hops after are not used.
+	Direct bool `json:"direct,omitempty"`
+	// Target is the connection to the target through the route.
+	Target *diagStep `json:"target,omitempty"`
+	OK     bool      `json:"ok"`
+}
+
+type diagHop struct {
+	Name string `json:"name"`
+	// Bypassed is set if the bypass of the hop matches the target.
+	Bypassed bool       `json:"bypassed,omitempty"`
+	Nodes    []diagNode `json:"nodes"`
+	// Skipped is the reason the hop is not checked.
+	Skipped string `json:"skipped,omitempty"`
+}
+
+type diagNode struct {
+	Name      string `json:"name"`
+	Addr      string `json:"addr"`
+	Dialer    string `json:"dialer,omitempty"`
+	Connector string `json:"connector,omitempty"`
+	// Bypassed is set if the bypass of the node matches the target, the node is not selected for the target.
+	Bypassed bool       `json:"bypassed,omitempty"`
+	Steps    []diagStep `json:"steps"`
+	TLS      *diagTLS   `json:"tls,omitempty"`
+	// Auth is the outcome of the authentication of the connector, none, ok or failed.
+	Auth string `json:"auth"`
+	OK   bool   `json:"ok"`
+}
+
+type diagStep struct {
+	Step      string  `json:"step"`
+	Addr      string  `json:"addr,omitempty"`
+	LatencyMs float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"`
+	// Reason is the class of the error, the same as the reason label of the handshake error metric.
+	Reason string `json:"reason,omitempty"`
+}
+
+type diagTLS struct {
+	Version     string    `json:"version"`
+	CipherSuite string    `json:"cipherSuite"`
+	ServerName  string    `json:"serverName,omitempty"`
+	ALPN        string    `json:"alpn,omitempty"`
+	Subject     string    `json:"subject,omitempty"`
+	Issuer      string    `json:"issuer,omitempty"`
+	NotAfter    time.Time `json:"notAfter,omitempty"`
+	// Verified is whether the certificate of the peer is verified.
+	Verified bool `json:"verified"`
+}
+
+// diagnoseCmd checks the chains in the config by dialing the hops in order through the real
+// dialers and connectors, and reports the result of each step.
+func diagnoseCmd(args []string) int {
+	var (
+		file      string
+		nodes     stringList
+		chainName string
+		target    string
+		timeout   time.Duration
+		jsonMode  bool
+		output    string
+		debug     bool
+	)
+	fs := flag.NewFlagSet("diagnose", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: gost diagnose [-C file] [-F node]... [-chain name] [-target host:port] [-json] [-o file]")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&file, "C", "", "configuration file")
+	fs.Var(&nodes, "F", "chain node list, checked as the chain chain-0")
+	fs.StringVar(&chainName, "chain", "", "check the chain only")
+	fs.StringVar(&target, "target", defaultDiagnoseTarget, "test target connected through the chains, host:port")
+	fs.DurationVar(&timeout, "timeout", 10*time.Second, "timeout of each step")
+	fs.BoolVar(&jsonMode, "json", false, "print the report in json format")
+	fs.StringVar(&output, "o", "", "also write the report in json format to the file")
+	fs.BoolVar(&debug, "D", false, "debug mode")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	// the errors are in the report.
+	level := logger.FatalLevel
+	if debug {
+		level = logger.DebugLevel
+	}
+	logger.SetDefault(xlogger.NewLogger(xlogger.LevelOption(level)))
+
+	cfg, err := readConfig(file)
+	if err == nil && file == "" && len(nodes) == 0 {
+		err = cfg.Load()
+	}
+	if err == nil && len(nodes) > 0 {
+		var cmdCfg *config.Config
+		if cmdCfg, err = buildConfigFromCmd(nil, nodes); err == nil {
+			// the nodes may define the components they use, such as the bypasses and limiters.
+			cfg = (&program{}).mergeConfig(cfg, cmdCfg)
+			err = validateCmdConfig(cmdCfg, cfg)
+		}
+	}
+	if err == nil {
+		if _, _, err = net.SplitHostPort(target); err != nil {
+			err = fmt.Errorf("invalid target %s: %w", target, err)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	buildComponents(cfg)
+
+	d := &diagnoser{
+		cfg:     cfg,
+		target:  target,
+		timeout: timeout,
+	}
+	report := d.run(chainName)
+
+	if output != "" {
+		if err := writeDiagReport(output, report); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	if jsonMode {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		printDiagReport(os.Stdout, report)
+	}
+
+	if !report.OK {
+		return 1
+	}
+	return 0
+}
+
+type diagnoser struct {
+	cfg     *config.Config
+	target  string
+	timeout time.Duration
+}
+
+func (d *diagnoser) run(chainName string) *diagReport {
+	report := &diagReport{
+		Time:   time.Now(),
+		Target: d.target,
+		Chains: []diagChain{},
+		OK:     true,
+	}
+
+	host, _, _ := net.SplitHostPort(d.target)
+	if net.ParseIP(host) == nil {
+		for _, c := range d.cfg.Resolvers {
+			r := registry.ResolverRegistry().Get(c.Name)
+			if r == nil {
+				continue
+			}
+			res := diagResolve{Resolver: c.Name, Host: host}
+			ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+			start := time.Now()
+			ips, err := r.Resolve(ctx, "ip", host)
+			cancel()
+			res.LatencyMs = latencyMs(start)
+			if err != nil {
+				res.Error = err.Error()
+			}
+			for _, ip := range ips {
+				res.Addrs = append(res.Addrs, ip.String())
+			}
+			report.Resolvers = append(report.Resolvers, res)
+		}
+	}
+
+	for _, c := range d.cfg.Chains {
+		if c == nil || (chainName != "" && c.Name != chainName) {
+			continue
+		}
+		ch := d.diagnoseChain(c)
+		report.Chains = append(report.Chains, ch)
+		if !ch.OK {
+			report.OK = false
+		}
+	}
+	return report
+}
+
+// diagnoseChain checks the hops of the chain in order, each node of a hop is checked through
+// the route of the first working nodes of the previous hops.
+func (d *diagnoser) diagnoseChain(cfg *config.ChainConfig) diagChain {
+	ch := diagChain{Name: cfg.Name, Hops: []diagHop{}}
+
+	var route []*chain.Node
+	var skipped string
+	for _, hc := range cfg.Hops {
+		if hc == nil {
+			continue
+		}
+		if len(hc.Nodes) == 0 && hc.Plugin == nil {
+			// the hop is a reference to a hop in the hop registry.
+			for _, v := range d.cfg.Hops {
+				if v != nil && v.Name == hc.Name {
+					hc = v
+					break
+				}
+			}
+		}
+
+		h := diagHop{Name: hc.Name, Nodes: []diagNode{}}
+		if ch.Direct {
+			h.Skipped = "the target is sent direct by a previous hop"
+			ch.Hops = append(ch.Hops, h)
+			continue
+		}
+		if skipped != "" {
+			h.Skipped = skipped
+			ch.Hops = append(ch.Hops, h)
+			continue
+		}
+
+		nodes, err := d.hopNodes(hc)
+		if err != nil {
+			h.Skipped = err.Error()
+			skipped = fmt.Sprintf("hop %s is not available", hc.Name)
+			ch.Hops = append(ch.Hops, h)
+			continue
+		}
+		if bp := hopBypass(hc); bp != nil && bp.Contains(context.Background(), "tcp", d.target) {
+			h.Bypassed = true
+			ch.Direct = true
+		}
+
+		var next *chain.Node
+		for _, node := range nodes {
+			dn := d.diagnoseNode(route, node, nodeConfig(hc, node.Name))
+			if dn.OK && next == nil && !dn.Bypassed {
+				next = node
+			}
+			h.Nodes = append(h.Nodes, dn)
+		}
+		ch.Hops = append(ch.Hops, h)
+
+		if ch.Direct {
+			continue
+		}
+		if next == nil {
+			skipped = fmt.Sprintf("no working node in hop %s", hc.Name)
+			continue
+		}
+		route = append(route, next)
+	}
+
+	if skipped != "" {
+		return ch
+	}
+	for _, node := range route {
+		ch.Route = append(ch.Route, node.Name)
+	}
+
+	// the connection to the target through the route.
+	step := diagStep{Step: diagStepConnect, Addr: d.target}
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	start := time.Now()
+	var conn net.Conn
+	var err error
+	if len(route) == 0 {
+		conn, err = chain.DefaultRoute.Dial(ctx, "tcp", d.target)
+	} else {
+		conn, err = connectRoute(ctx, route, nil)
+		if err == nil {
+			var cc net.Conn
+			if cc, err = route[len(route)-1].Options().Transport.Connect(ctx, conn, "tcp", d.target); err == nil {
+				conn = cc
+			} else {
+				conn.Close()
+			}
+		}
+	}
+	step.LatencyMs = latencyMs(start)
+	if err != nil {
+		step.Error, step.Reason = err.Error(), errorReason(err)
+	} else {
+		conn.Close()
+	}
+	ch.Target = &step
+	ch.OK = err == nil
+	return ch
+}
+
+// diagnoseNode checks the node through the route, the connector of the node is checked by
+// the connection to the target.
+func (d *diagnoser) diagnoseNode(route []*chain.Node, node *chain.Node, cfg *config.NodeConfig) diagNode {
+	dn := diagNode{
+		Name:  node.Name,
+		Addr:  node.Addr,
+		Steps: []diagStep{},
+		Auth:  "none",
+	}
+	if cfg != nil {
+		if cfg.Dialer != nil {
+			dn.Dialer = cfg.Dialer.Type
+		}
+		if cfg.Connector != nil {
+			dn.Connector = cfg.Connector.Type
+			if cfg.Connector.Auth != nil {
+				dn.Auth = "unknown"
+			}
+		}
+	}
+	if bp := node.Options().Bypass; bp != nil && bp.Contains(context.Background(), "tcp", d.target) {
+		dn.Bypassed = true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+
+	conn, err := connectRoute(ctx, append(route[:len(route):len(route)], node), &dn)
+	if err != nil {
+		return dn
+	}
+	defer conn.Close()
+
+	step := diagStep{Step: diagStepConnect, Addr: d.target}
+	start := time.Now()
+	cc, err := node.Options().Transport.Connect(ctx, conn, "tcp", d.target)
+	step.LatencyMs = latencyMs(start)
+	if err != nil {
+		step.Error, step.Reason = err.Error(), errorReason(err)
+		if dn.Auth != "none" && step.Reason == "auth" {
+			dn.Auth = "failed"
+		}
+	} else {
+		cc.Close()
+		if dn.Auth != "none" {
+			dn.Auth = "ok"
+		}
+	}
+	dn.Steps = append(dn.Steps, step)
+	dn.OK = err == nil
+	return dn
+}
+
+// connectRoute establishes the connection to the last node of the route in the same way as the routes of the chains,
+// the steps of the last node are recorded in dn if it is not nil.
+func connectRoute(ctx context.Context, route []*chain.Node, dn *diagNode) (conn net.Conn, err error) {
+	last := len(route) - 1
+	record := func(i int, step diagStep, start time.Time, err error) {
+		if dn == nil || i != last {
+			return
+		}
+		step.LatencyMs = latencyMs(start)
+		if err != nil {
+			step.Error, step.Reason = err.Error(), errorReason(err)
+		}
+		dn.Steps = append(dn.Steps, step)
+	}
+
+	for i, node := range route {
+		start := time.Now()
+		addr, err := chain.Resolve(ctx, "ip", node.Addr, node.Options().Resolver, node.Options().HostMapper, logger.Default())
+		record(i, diagStep{Step: diagStepResolve, Addr: node.Addr}, start, err)
+		if err != nil {
+			if conn != nil {
+				conn.Close()
+			}
+			return nil, err
+		}
+
+		start = time.Now()
+		var cc net.Conn
+		if i == 0 {
+			cc, err = node.Options().Transport.Dial(ctx, addr)
+			record(i, diagStep{Step: diagStepDial, Addr: addr}, start, err)
+		} else {
+			cc, err = route[i-1].Options().Transport.Connect(ctx, conn, "tcp", addr)
+			record(i, diagStep{Step: diagStepConnect, Addr: addr}, start, err)
+		}
+		if err != nil {
+			if conn != nil {
+				conn.Close()
+			}
+			return nil, err
+		}
+
+		start = time.Now()
+		conn, err = node.Options().Transport.Handshake(ctx, cc)
+		record(i, diagStep{Step: diagStepHandshake}, start, err)
+		if err != nil {
+			cc.Close()
+			return nil, err
+		}
+		if dn != nil && i == last {
+			dn.TLS = connTLS(conn)
+		}
+	}
+	return conn, nil
+}
+
+// hopNodes returns the nodes of the hop in the hop registry, or parsed from the inline hop config.
+func (d *diagnoser) hopNodes(cfg *config.HopConfig) ([]*chain.Node, error) {
+	h := registry.HopRegistry().Get(cfg.Name)
+	if h == nil || len(cfg.Nodes) > 0 {
+		var err error
+		if h, err = hop_parser.ParseHop(cfg, logger.Default()); err != nil {
+			return nil, err
+		}
+	}
+	nl, ok := h.(hop.NodeList)
+	if !ok {
+		return nil, fmt.Errorf("the nodes of hop %s are not available", cfg.Name)
+	}
+	nodes := nl.Nodes()
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("hop %s has no nodes", cfg.Name)
+	}
+	return nodes, nil
+}
+
+func hopBypass(cfg *config.HopConfig) bypass.Bypass {
+	var bypasses []bypass.Bypass
+	for _, name := range append([]string{cfg.Bypass}, cfg.Bypasses...) {
+		if bp := registry.BypassRegistry().Get(name); name != "" && bp != nil {
+			bypasses = append(bypasses, bp)
+		}
+	}
+	if len(bypasses) == 0 {
+		return nil
+	}
+	return bypass.BypassGroup(bypasses...)
+}
+
+func nodeConfig(cfg *config.HopConfig, name string) *config.NodeConfig {
+	for _, c := range cfg.Nodes {
+		if c != nil && c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// connTLS returns the details of the TLS connection, it returns nil if the TLS connection,
+// if any, is not exposed by the dialer.
+func connTLS(conn net.Conn) *diagTLS {
+	c, ok := conn.(interface{ ConnectionState() tls.ConnectionState })
+	if !ok {
+		return nil
+	}
+	st := c.ConnectionState()
+	t := &diagTLS{
+		Version:     tls.VersionName(st.Version),
+		CipherSuite: tls.CipherSuiteName(st.CipherSuite),
+		ServerName:  st.ServerName,
+		ALPN:        st.NegotiatedProtocol,
+		Verified:    len(st.VerifiedChains) > 0,
+	}
+	if len(st.PeerCertificates) > 0 {
+		cert := st.PeerCertificates[0]
+		t.Subject = cert.Subject.String()
+		t.Issuer = cert.Issuer.String()
+		t.NotAfter = cert.NotAfter
+	}
+	return t
+}
+
+func latencyMs(start time.Time) float64 {
+	return float64(time.Since(start).Microseconds()) / 1000
+}
+
+func writeDiagReport(file string, report *diagReport) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+func printDiagReport(w io.Writer, report *diagReport) {
+	fmt.Fprintf(w, "target: %s\n", report.Target)
+
+	if len(report.Resolvers) > 0 {
+		fmt.Fprintln(w, "\nresolvers:")
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		for _, r := range report.Resolvers {
+			result := strings.Join(r.Addrs, ",")
+			switch {
+			case r.Error != "":
+				result = "FAIL " + r.Error
+			case result == "":
+				result = "no address"
+			}
+			fmt.Fprintf(tw, "  %s\t%s\t%.1fms\t%s\n", r.Resolver, r.Host, r.LatencyMs, result)
+		}
+		tw.Flush()
+	}
+
+	for _, c := range report.Chains {
+		fmt.Fprintf(w, "\nchain %s\n", c.Name)
+		for _, h := range c.Hops {
+			fmt.Fprintf(w, "  hop %s", h.Name)
+			if h.Bypassed {
+				fmt.Fprint(w, " (bypass matches the target, the target is sent direct)")
+			}
+			fmt.Fprintln(w)
+			if h.Skipped != "" {
+				fmt.Fprintf(w, "    skipped: %s\n", h.Skipped)
+				continue
+			}
+			for _, n := range h.Nodes {
+				status := "OK"
+				if !n.OK {
+					status = "FAIL"
+				}
+				fmt.Fprintf(w, "    node %s %s [%s/%s] %s", n.Name, n.Addr, orDash(n.Connector), orDash(n.Dialer), status)
+				if n.Bypassed {
+					fmt.Fprint(w, " (bypass matches the target, the node is not selected)")
+				}
+				fmt.Fprintln(w)
+
+				tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+				for _, s := range n.Steps {
+					result := "ok"
+					if s.Error != "" {
+						result = fmt.Sprintf("FAIL (%s) %s", s.Reason, s.Error)
+					}
+					fmt.Fprintf(tw, "      %s\t%s\t%.1fms\t%s\n", s.Step, orDash(s.Addr), s.LatencyMs, result)
+				}
+				tw.Flush()
+				if t := n.TLS; t != nil {
+					fmt.Fprintf(w, "      tls: %s %s alpn=%s verified=%t\n", t.Version, t.CipherSuite, orDash(t.ALPN), t.Verified)
+					if t.Subject != "" {
+						fmt.Fprintf(w, "      cert: %s, issuer %s, expires %s\n", t.Subject, t.Issuer, t.NotAfter.Format(time.DateOnly))
+					}
+				}
+				fmt.Fprintf(w, "      auth: %s\n", n.Auth)
+			}
+		}
+
+		switch {
+		case c.Target == nil:
+			fmt.Fprintln(w, "  result: FAIL, no working route")
+		case c.Target.Error != "":
+			fmt.Fprintf(w, "  result: FAIL, connect %s via %s: (%s) %s\n",
+				c.Target.Addr, routeString(c), c.Target.Reason, c.Target.Error)
+		default:
+			fmt.Fprintf(w, "  result: OK, connect %s via %s in %.1fms\n", c.Target.Addr, routeString(c), c.Target.LatencyMs)
+		}
+	}
+
+	if len(report.Chains) == 0 {
+		fmt.Fprintln(w, "\nno chains")
+	}
+}
+
+func routeString(c diagChain) string {
+	s := strings.Join(c.Route, " > ")
+	if c.Direct {
+		if s != "" {
+			s += " > "
+		}
+		s += "direct"
+	}
+	if s == "" {
+		s = "direct"
+	}
+	return s
+}
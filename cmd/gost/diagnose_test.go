@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-gost/x/config"
+)
+
+func TestDiagnose(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer target.Close()
+
+	authService := httpServiceConfig("diagnose-auth", "")
+	authService.Handler.Auth = &config.AuthConfig{Username: "user", Password: "pass"}
+	serveConfig(t, &config.Config{
+		Services: []*config.ServiceConfig{httpServiceConfig("diagnose-proxy", ""), authService},
+	})
+
+	// the address of a closed port.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := ln.Addr().String()
+	ln.Close()
+
+	node := func(name, addr string, auth *config.AuthConfig) *config.NodeConfig {
+		return &config.NodeConfig{
+			Name:      name,
+			Addr:      addr,
+			Connector: &config.ConnectorConfig{Type: "http", Auth: auth},
+			Dialer:    &config.DialerConfig{Type: "tcp"},
+		}
+	}
+	proxy := serviceAddr(t, "diagnose-proxy")
+	authProxy := serviceAddr(t, "diagnose-auth")
+
+	tests := []struct {
+		name  string
+		hops  [][]*config.NodeConfig
+		ok    bool
+		route []string
+		// nodes is the expected outcome of each node, the auth outcome or fail if the node is not working.
+		nodes map[string]string
+		// skipped is the hop which is not checked.
+		skipped string
+	}{
+		{
+			name: "single hop",
+			hops: [][]*config.NodeConfig{
+				{node("proxy", proxy, nil)},
+			},
+			ok:    true,
+			route: []string{"proxy"},
+			nodes: map[string]string{"proxy": "none"},
+		},
+		{
+			name: "the first working node is used",
+			hops: [][]*config.NodeConfig{
+				{node("closed", closed, nil), node("proxy", proxy, nil)},
+				{node("auth", authProxy, &config.AuthConfig{Username: "user", Password: "pass"})},
+			},
+			ok:    true,
+			route: []string{"proxy", "auth"},
+			nodes: map[string]string{"closed": "fail", "proxy": "none", "auth": "ok"},
+		},
+		{
+			name: "auth failed",
+			hops: [][]*config.NodeConfig{
+				{node("proxy", proxy, nil)},
+				{node("auth", authProxy, &config.AuthConfig{Username: "user", Password: "wrong"})},
+			},
+			nodes: map[string]string{"proxy": "none", "auth": "failed"},
+		},
+		{
+			name: "no working node",
+			hops: [][]*config.NodeConfig{
+				{node("closed", closed, nil)},
+				{node("proxy", proxy, nil)},
+			},
+			nodes:   map[string]string{"closed": "fail"},
+			skipped: "hop-1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &config.ChainConfig{Name: "diagnose-chain"}
+			for i, nodes := range tt.hops {
+				c.Hops = append(c.Hops, &config.HopConfig{
+					Name:  "hop-" + strconv.Itoa(i),
+					Nodes: nodes,
+				})
+			}
+			d := &diagnoser{
+				cfg:     &config.Config{Chains: []*config.ChainConfig{c}},
+				target:  strings.TrimPrefix(target.URL, "http://"),
+				timeout: 5 * time.Second,
+			}
+			report := d.run("")
+
+			if report.OK != tt.ok || len(report.Chains) != 1 {
+				t.Fatalf("got ok %t, chains %d", report.OK, len(report.Chains))
+			}
+			ch := report.Chains[0]
+			if strings.Join(ch.Route, ",") != strings.Join(tt.route, ",") {
+				t.Errorf("got route %q, want %q", ch.Route, tt.route)
+			}
+			for _, h := range ch.Hops {
+				if (h.Name == tt.skipped) != (h.Skipped != "") {
+					t.Errorf("hop %s: skipped %q", h.Name, h.Skipped)
+				}
+				for _, n := range h.Nodes {
+					got := n.Auth
+					if !n.OK && got != "failed" {
+						got = "fail"
+					}
+					if want := tt.nodes[n.Name]; got != want {
+						t.Errorf("node %s: got %s, want %s, steps %+v", n.Name, got, want, n.Steps)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	net_dialer "github.com/go-gost/core/common/net/dialer"
+	"github.com/go-gost/core/dialer"
+	limiter_conn "github.com/go-gost/core/limiter/conn"
+	limiter_traffic "github.com/go-gost/core/limiter/traffic"
+	"github.com/go-gost/core/logger"
+	"github.com/go-gost/core/metadata"
+	mdutil "github.com/go-gost/core/metadata/util"
+	"github.com/go-gost/core/recorder"
+	"github.com/go-gost/x/config"
+	climiter "github.com/go-gost/x/limiter/conn/wrapper"
+	limiter "github.com/go-gost/x/limiter/traffic/wrapper"
+	mdx "github.com/go-gost/x/metadata"
+	"github.com/go-gost/x/registry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The dialer metadata keys of the components applied to the connections to a chain node.
+const (
+	mdKeyLimiter   = "limiter"
+	mdKeyCLimiter  = "climiter"
+	mdKeyRecorders = "recorders"
+)
+
+const (
+	recorderHopNodeDialAddress      = "recorder.hop.node.dial.address"
+	recorderHopNodeDialAddressError = "recorder.hop.node.dial.address.error"
+)
+
+var (
+	ErrConnLimit = errors.New("connection limit exceeded")
+)
+
+func init() {
+	for name, newDialer := range registry.DialerRegistry().GetAll() {
+		registry.DialerRegistry().Unregister(name)
+		registry.DialerRegistry().Register(name, wrapDialer(name, newDialer))
+	}
+}
+
+// wrapDialer wraps the dialers created by newDialer with the node components support.
+func wrapDialer(kind string, newDialer registry.NewDialer) registry.NewDialer {
+	return func(opts ...dialer.Option) dialer.Dialer {
+		var options dialer.Options
+		for _, opt := range opts {
+			opt(&options)
+		}
+		log := options.Logger
+		if log == nil {
+			log = logger.Default()
+		}
+
+		return &nodeDialer{
+			Dialer: newDialer(opts...),
+			kind:   kind,
+			logger: log,
+		}
+	}
+}
+
+// nodeDialer is a dialer of a chain node with the traffic limiter,
+// connection limiter and recorders set in the dialer metadata,
+// and the spans of the dial and handshake.
+type nodeDialer struct {
+	dialer.Dialer
+	kind      string
+	limiter   limiter_traffic.TrafficLimiter
+	climiter  limiter_conn.ConnLimiter
+	recorders []recorder.RecorderObject
+	logger    logger.Logger
+}
+
+func (d *nodeDialer) Init(md metadata.Metadata) error {
+	if v := mdutil.GetString(md, mdKeyLimiter); v != "" {
+		d.limiter = registry.TrafficLimiterRegistry().Get(v)
+	}
+	if v := mdutil.GetString(md, mdKeyCLimiter); v != "" {
+		d.climiter = registry.ConnLimiterRegistry().Get(v)
+	}
+	if md != nil {
+		for _, r := range parseNodeRecorders(md.Get(mdKeyRecorders)) {
+			d.recorders = append(d.recorders, recorder.RecorderObject{
+				Recorder: registry.RecorderRegistry().Get(r.Name),
+				Record:   r.Record,
+			})
+		}
+	}
+
+	return d.Dialer.Init(md)
+}
+
+func (d *nodeDialer) Dial(ctx context.Context, addr string, opts ...dialer.DialOption) (conn net.Conn, err error) {
+	ctx, span := tracer.Start(ctx, "dial "+d.kind,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("gost.dialer", d.kind),
+			attribute.String("server.address", addr),
+		))
+	defer func() { endSpan(span, err) }()
+
+	host := addr
+	if h, _, _ := net.SplitHostPort(addr); h != "" {
+		host = h
+	}
+
+	// the addresses of the node are raced if it is the first node of a racing route.
+	he := happyEyeballsFromContext(ctx)
+	if he != nil && !he.match(addr) {
+		he = nil
+	}
+
+	if d.limiter != nil || d.climiter != nil || he != nil {
+		var options dialer.DialOptions
+		for _, opt := range opts {
+			opt(&options)
+		}
+
+		netd := &net_dialer.NetDialer{}
+		if options.NetDialer != nil {
+			*netd = *options.NetDialer
+		}
+		nd := *netd
+		dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return d.dial(ctx, &nd, network, addr)
+		}
+		netd.DialFunc = dial
+		if he != nil {
+			netd.DialFunc = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				if !strings.HasPrefix(network, "tcp") {
+					return dial(ctx, network, addr)
+				}
+				return he.dial(ctx, network, dial)
+			}
+		}
+		opts = append(opts, dialer.NetDialerDialOption(netd))
+	}
+
+	conn, err = d.Dialer.Dial(ctx, addr, opts...)
+	if err != nil {
+		d.record(ctx, recorderHopNodeDialAddressError, []byte(host))
+		return nil, err
+	}
+	d.record(ctx, recorderHopNodeDialAddress, []byte(host))
+	return conn, nil
+}
+
+// dial establishes the underlying connection to the node,
+// the limiters only apply to the stream connections.
+func (d *nodeDialer) dial(ctx context.Context, netd *net_dialer.NetDialer, network, addr string) (net.Conn, error) {
+	if !strings.HasPrefix(network, "tcp") {
+		return netd.Dial(ctx, network, addr)
+	}
+
+	var lim limiter_conn.Limiter
+	if d.climiter != nil {
+		host, _, _ := net.SplitHostPort(addr)
+		if lim = d.climiter.Limiter(host); lim != nil && !lim.Allow(1) {
+			return nil, ErrConnLimit
+		}
+	}
+
+	conn, err := netd.Dial(ctx, network, addr)
+	if err != nil {
+		if lim != nil {
+			lim.Allow(-1)
+		}
+		return nil, err
+	}
+
+	if lim != nil {
+		conn = climiter.WrapConn(lim, conn)
+	}
+	return limiter.WrapConn(d.limiter, conn), nil
+}
+
+func (d *nodeDialer) Handshake(ctx context.Context, conn net.Conn, opts ...dialer.HandshakeOption) (cc net.Conn, err error) {
+	hs, ok := d.Dialer.(dialer.Handshaker)
+	if !ok {
+		return conn, nil
+	}
+
+	ctx, span := tracer.Start(ctx, "handshake "+d.kind,
+		trace.WithAttributes(attribute.String("gost.dialer", d.kind)))
+	defer func() {
+		if err != nil {
+			observeHandshakeError("dialer", d.kind, err)
+		}
+		endSpan(span, err)
+	}()
+
+	return hs.Handshake(ctx, conn, opts...)
+}
+
+func (d *nodeDialer) Multiplex() bool {
+	if mux, ok := d.Dialer.(dialer.Multiplexer); ok {
+		return mux.Multiplex()
+	}
+	return false
+}
+
+func (d *nodeDialer) record(ctx context.Context, name string, data []byte) {
+	for _, rec := range d.recorders {
+		if rec.Record != name {
+			continue
+		}
+		if err := rec.Recorder.Record(ctx, data); err != nil {
+			d.logger.Errorf("record %s: %v", name, err)
+		}
+	}
+}
+
+// parseNodeRecorders parses the recorders in the form of [{name: <recorder>, record: <record>}]
+// from the dialer metadata, the record defaults to the node dial address.
+func parseNodeRecorders(v any) (recorders []*config.RecorderObject) {
+	var objs []map[string]any
+	switch vv := v.(type) {
+	case []map[string]any:
+		objs = vv
+	case []any:
+		for _, obj := range vv {
+			if m, _ := obj.(map[string]any); m != nil {
+				objs = append(objs, m)
+			}
+		}
+	}
+
+	for _, obj := range objs {
+		md := mdx.NewMetadata(obj)
+		name := mdutil.GetString(md, "name")
+		if name == "" {
+			continue
+		}
+		record := mdutil.GetString(md, "record")
+		if record == "" {
+			record = recorderHopNodeDialAddress
+		}
+		recorders = append(recorders, &config.RecorderObject{
+			Name:   name,
+			Record: record,
+		})
+	}
+	return
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-gost/core/admission"
+	"github.com/go-gost/core/auth"
+	"github.com/go-gost/core/chain"
+	"github.com/go-gost/core/limiter/conn"
+	"github.com/go-gost/core/limiter/rate"
+	"github.com/go-gost/core/metrics"
+	"github.com/go-gost/core/service"
+	ctxvalue "github.com/go-gost/x/ctx"
+	xmetrics "github.com/go-gost/x/metrics"
+	"github.com/go-gost/x/registry"
+	xservice "github.com/go-gost/x/service"
+)
+
+// eventVersion is the version of the event schema, which is increased on the incompatible changes
+// of the event types or their data. New types and new data fields are added in the same version.
+const eventVersion = 1
+
+// The event types of the API event stream, and the data fields of each type.
+const (
+	// eventServiceStarted is sent when a service is ready: service, addr.
+	eventServiceStarted = "service.started"
+	// eventServiceFailed is sent when a service fails to accept connections: service, addr.
+	eventServiceFailed = "service.failed"
+	// eventServiceRestarted is sent when a service recovers from the failure, or is replaced
+	// by the config API: service, addr, reason (recovered or replaced).
+	eventServiceRestarted = "service.restarted"
+	// eventServiceStopped is sent when a service is closed or removed: service.
+	eventServiceStopped = "service.stopped"
+	// eventServicePaused is sent when a service is paused by the API: service.
+	eventServicePaused = "service.paused"
+	// eventServiceResumed is sent when a paused service is resumed by the API: service.
+	eventServiceResumed = "service.resumed"
+	// eventNodeFailed is sent when a dial through a node fails and the node is marked failed,
+	// the selectors skip the node once fails reaches the maxFails of the selector: chain, node, addr, fails.
+	eventNodeFailed = "node.failed"
+	// eventNodeRecovered is sent when the fail marks of a node are reset by a successful dial: chain, node, addr.
+	eventNodeRecovered = "node.recovered"
+	// eventNodeHealth is sent when the health of a node changes by the active health check:
+	// chain or service (of the forwarder), hop, node, addr, health (healthy or unhealthy), error.
+	eventNodeHealth = "node.health"
+	// eventNodeCircuit is sent when the state of the circuit breaker of a node changes: chain or service
+	// (of the forwarder), node, addr, state (open, half-open or closed), requests, failures, slow.
+	eventNodeCircuit = "node.circuit"
+	// eventConfigApplied is sent when a change through the config API succeeds: method, path.
+	eventConfigApplied = "config.applied"
+	// eventAuthFailed is sent when a client fails the authentication of a handler: service, handler, client, user.
+	eventAuthFailed = "auth.failed"
+	// eventAdmissionRejected is sent when an admission rejects a client: admission, client.
+	eventAdmissionRejected = "admission.rejected"
+	// eventLimiterThrottled is sent when a request is rejected by a rate limiter or a connection limiter:
+	// limiter (rate or conn), name, key.
+	eventLimiterThrottled = "limiter.throttled"
+	// eventScheduleChanged is sent when a schedule becomes active or inactive: schedule, active.
+	eventScheduleChanged = "schedule.changed"
+	// eventQuotaExhausted is sent when a user or client exhausts a quota: quota, key.
+	eventQuotaExhausted = "quota.exhausted"
+	// eventQuotaReset is sent when the usage of a quota is reset by the API: quota, key (empty for all keys).
+	eventQuotaReset = "quota.reset"
+)
+
+const (
+	// eventHistorySize is the number of the latest events replayed to the subscribers reconnecting with the last event ID.
+	eventHistorySize = 256
+	// eventQueueSize is the number of the pending events of a subscriber, the events are dropped when the queue is full.
+	eventQueueSize = 64
+)
+
+// events is the event bus of the API event stream.
+var events = &eventBus{
+	subs: make(map[*eventSub]struct{}),
+}
+
+type event struct {
+	Version int            `json:"version"`
+	ID      uint64         `json:"id"`
+	Type    string         `json:"type"`
+	Time    time.Time      `json:"time"`
+	Data    map[string]any `json:"data,omitempty"`
+}
+
+type eventBus struct {
+	seq     uint64
+	history []*event
+	subs    map[*eventSub]struct{}
+	mu      sync.Mutex
+}
+
+func (b *eventBus) publish(typ string, data map[string]any) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	e := &event{
+		Version: eventVersion,
+		ID:      b.seq,
+		Type:    typ,
+		Time:    time.Now(),
+		Data:    data,
+	}
+
+	if len(b.history) == eventHistorySize {
+		copy(b.history, b.history[1:])
+		b.history = b.history[:eventHistorySize-1]
+	}
+	b.history = append(b.history, e)
+
+	for sub := range b.subs {
+		sub.send(e)
+	}
+}
+
+// subscribe subscribes to the events of the types, the events after lastID in the history are sent first.
+func (b *eventBus) subscribe(types []string, lastID uint64) *eventSub {
+	sub := &eventSub{
+		ch:    make(chan *event, eventQueueSize+eventHistorySize),
+		types: types,
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if lastID > 0 {
+		for _, e := range b.history {
+			if e.ID > lastID {
+				sub.send(e)
+			}
+		}
+	}
+	b.subs[sub] = struct{}{}
+
+	return sub
+}
+
+func (b *eventBus) unsubscribe(sub *eventSub) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.subs, sub)
+}
+
+type eventSub struct {
+	ch chan *event
+	// types are the event types or the type prefixes such as service, empty for all types.
+	types   []string
+	dropped atomic.Uint64
+}
+
+func (s *eventSub) send(e *event) {
+	if !s.match(e.Type) {
+		return
+	}
+	select {
+	case s.ch <- e:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+func (s *eventSub) match(typ string) bool {
+	if len(s.types) == 0 {
+		return true
+	}
+	for _, t := range s.types {
+		if t == typ || strings.HasPrefix(typ, t+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// watchServices polls the services in the service registry and publishes the changes of their states,
+// which covers the services created by the config API.
+func watchServices(ctx context.Context, period time.Duration) {
+	type serviceState struct {
+		svc   service.Service
+		state xservice.State
+	}
+	states := make(map[string]serviceState)
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		services := registry.ServiceRegistry().GetAll()
+		for name, svc := range services {
+			st := serviceState{svc: svc, state: xservice.StateReady}
+			if s, ok := svc.(interface{ Status() *xservice.Status }); ok {
+				st.state = s.Status().State()
+			}
+			data := map[string]any{
+				"service": name,
+				"addr":    svc.Addr().String(),
+			}
+
+			prev, ok := states[name]
+			switch {
+			case ok && prev.svc != svc:
+				data["reason"] = "replaced"
+				events.publish(eventServiceRestarted, data)
+			case ok && prev.state == st.state:
+			case st.state == xservice.StateFailed:
+				events.publish(eventServiceFailed, data)
+			case st.state == xservice.StateReady && prev.state == xservice.StateFailed:
+				data["reason"] = "recovered"
+				events.publish(eventServiceRestarted, data)
+			case st.state == xservice.StateReady:
+				events.publish(eventServiceStarted, data)
+			case st.state == xservice.StateClosed:
+				events.publish(eventServiceStopped, map[string]any{"service": name})
+			}
+			states[name] = st
+		}
+		for name, st := range states {
+			if _, ok := services[name]; !ok {
+				if st.state != xservice.StateClosed {
+					events.publish(eventServiceStopped, map[string]any{"service": name})
+				}
+				delete(states, name)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// failedNodes are the fail markers of the nodes which are marked failed.
+var failedNodes sync.Map
+
+// observeNodes publishes and counts the changes of the fail marks of the nodes after a dial or bind through the route,
+// the nodes are also tracked for the status API.
+func observeNodes(chainName string, nodes []*chain.Node) {
+	trackNodes(chainName, nodes)
+	for _, node := range nodes {
+		marker := node.Marker()
+		if marker == nil {
+			continue
+		}
+		if fails := marker.Count(); fails > 0 {
+			if _, loaded := failedNodes.LoadOrStore(marker, struct{}{}); !loaded {
+				if v := xmetrics.GetCounter(metricNodeFailuresCounter,
+					metrics.Labels{"chain": chainName, "node": node.Name}); v != nil {
+					v.Inc()
+				}
+				events.publish(eventNodeFailed, map[string]any{
+					"chain": chainName,
+					"node":  node.Name,
+					"addr":  node.Addr,
+					"fails": fails,
+				})
+			}
+		} else if _, loaded := failedNodes.LoadAndDelete(marker); loaded {
+			if v := xmetrics.GetCounter(metricNodeRecoveriesCounter,
+				metrics.Labels{"chain": chainName, "node": node.Name}); v != nil {
+				v.Inc()
+			}
+			events.publish(eventNodeRecovered, map[string]any{
+				"chain": chainName,
+				"node":  node.Name,
+				"addr":  node.Addr,
+			})
+		}
+	}
+}
+
+// eventAuther publishes the authentication failures of a handler.
+type eventAuther struct {
+	auth.Authenticator
+	service string
+	handler string
+}
+
+func (p *eventAuther) Authenticate(ctx context.Context, user, password string, opts ...auth.Option) (string, bool) {
+	id, ok := p.Authenticator.Authenticate(ctx, user, password, opts...)
+	if !ok {
+		events.publish(eventAuthFailed, map[string]any{
+			"service": p.service,
+			"handler": p.handler,
+			"client":  string(ctxvalue.ClientAddrFromContext(ctx)),
+			"user":    user,
+		})
+		return id, ok
+	}
+
+	// the quotas of the user are checked once the user is known, the user is rejected by an exhausted quota.
+	if rec := connRecordFromContext(ctx); rec != nil && id != "" {
+		rec.mu.Lock()
+		rec.User = id
+		rec.mu.Unlock()
+		if !quotas.Load().admit(rec) {
+			return "", false
+		}
+	}
+	return id, ok
+}
+
+// eventAdmission publishes the rejections of an admission.
+type eventAdmission struct {
+	admission.Admission
+	name string
+}
+
+func (p *eventAdmission) Admit(ctx context.Context, addr string, opts ...admission.Option) bool {
+	if p.Admission.Admit(ctx, addr, opts...) {
+		return true
+	}
+	events.publish(eventAdmissionRejected, map[string]any{
+		"admission": p.name,
+		"client":    addr,
+	})
+	return false
+}
+
+func (p *eventAdmission) Close() error {
+	return closeComponent(p.Admission)
+}
+
+// eventRateLimiter publishes the requests rejected by a rate limiter.
+type eventRateLimiter struct {
+	rate.RateLimiter
+	name string
+}
+
+func (p *eventRateLimiter) Limiter(key string) rate.Limiter {
+	lim := p.RateLimiter.Limiter(key)
+	if lim == nil {
+		return nil
+	}
+	return &eventLimiter[float64]{limiter: lim, kind: "rate", name: p.name, key: key}
+}
+
+// eventConnLimiter publishes the connections rejected by a connection limiter.
+type eventConnLimiter struct {
+	conn.ConnLimiter
+	name string
+}
+
+func (p *eventConnLimiter) Limiter(key string) conn.Limiter {
+	lim := p.ConnLimiter.Limiter(key)
+	if lim == nil {
+		return nil
+	}
+	return &eventLimiter[int]{limiter: lim, kind: "conn", name: p.name, key: key}
+}
+
+type eventLimiter[T int | float64] struct {
+	limiter interface {
+		Allow(n int) bool
+		Limit() T
+	}
+	kind string
+	name string
+	key  string
+}
+
+func (l *eventLimiter[T]) Allow(n int) bool {
+	if l.limiter.Allow(n) {
+		return true
+	}
+	if n > 0 {
+		events.publish(eventLimiterThrottled, map[string]any{
+			"limiter": l.kind,
+			"name":    l.name,
+			"key":     l.key,
+		})
+	}
+	return false
+}
+
+func (l *eventLimiter[T]) Limit() T {
+	return l.limiter.Limit()
+}
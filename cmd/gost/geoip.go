@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-gost/core/logger"
+	"github.com/go-gost/x/config"
+	"github.com/go-gost/x/registry"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoIPConfig is the configuration of the GeoIP databases used by the geoip: and asn: matchers and the routing rules.
+type GeoIPConfig struct {
+	// File is the MaxMind-format (mmdb) country or city database, such as GeoLite2-Country.mmdb.
+	File string `yaml:",omitempty" json:"file,omitempty"`
+	// ASN is the MaxMind-format ASN database, such as GeoLite2-ASN.mmdb.
+	ASN string `yaml:"asn,omitempty" json:"asn,omitempty"`
+	// Reload is the period to check the files for changes, default is 1m.
+	Reload time.Duration `yaml:",omitempty" json:"reload,omitempty"`
+}
+
+const (
+	defaultGeoIPReload = time.Minute
+	// geoipCacheSize is the maximum number of the cached lookups, the cache is cleared once it is full.
+	geoipCacheSize = 65536
+	// resolveCacheTTL is how long the addresses of the domains resolved for the matching are cached.
+	resolveCacheTTL = time.Minute
+)
+
+// The prefixes of the GeoIP matchers of the bypasses and admissions.
+const (
+	geoipMatcherCountry = "geoip:"
+	geoipMatcherASN     = "asn:"
+)
+
+// geoip is the GeoIP databases set by the configuration, it is nil if no database is set.
+var geoip atomic.Pointer[geoipDatabases]
+
+// geoipDatabases are the country and ASN databases with the cache of the lookups,
+// the cache is cleared when a database is reloaded.
+type geoipDatabases struct {
+	countryDB *geoipDB
+	asnDB     *geoipDB
+	cache     map[netip.Addr]geoipRecord
+	mu        sync.Mutex
+}
+
+// geoipRecord is the result of the lookups of an IP.
+type geoipRecord struct {
+	Country string `json:"country,omitempty"`
+	ASN     uint   `json:"asn,omitempty"`
+	Org     string `json:"org,omitempty"`
+}
+
+// setGeoIP opens the GeoIP databases of cfg as the databases of the matchers and the routing rules.
+func setGeoIP(cfg *GeoIPConfig, log logger.Logger) error {
+	if old := geoip.Swap(nil); old != nil {
+		old.Close()
+	}
+	if cfg == nil || (cfg.File == "" && cfg.ASN == "") {
+		return nil
+	}
+
+	period := cfg.Reload
+	if period <= 0 {
+		period = defaultGeoIPReload
+	}
+	if period < time.Second {
+		period = time.Second
+	}
+
+	dbs := &geoipDatabases{}
+	var err error
+	if cfg.File != "" {
+		if dbs.countryDB, err = openGeoIPDB(cfg.File, period, dbs.clear, log); err != nil {
+			return err
+		}
+	}
+	if cfg.ASN != "" {
+		if dbs.asnDB, err = openGeoIPDB(cfg.ASN, period, dbs.clear, log); err != nil {
+			dbs.Close()
+			return err
+		}
+	}
+
+	geoip.Store(dbs)
+	return nil
+}
+
+// lookup returns the country and ASN of ip.
+func (dbs *geoipDatabases) lookup(ip netip.Addr) (rec geoipRecord) {
+	if dbs == nil || !ip.IsValid() {
+		return
+	}
+	ip = ip.Unmap()
+
+	dbs.mu.Lock()
+	rec, ok := dbs.cache[ip]
+	dbs.mu.Unlock()
+	if ok {
+		return
+	}
+
+	var country struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+		RegisteredCountry struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"registered_country"`
+	}
+	if dbs.countryDB.lookup(ip, &country) {
+		rec.Country = country.Country.ISOCode
+		if rec.Country == "" {
+			rec.Country = country.RegisteredCountry.ISOCode
+		}
+	}
+	var asn struct {
+		Number uint   `maxminddb:"autonomous_system_number"`
+		Org    string `maxminddb:"autonomous_system_organization"`
+	}
+	if dbs.asnDB.lookup(ip, &asn) {
+		rec.ASN, rec.Org = asn.Number, asn.Org
+	}
+
+	dbs.mu.Lock()
+	defer dbs.mu.Unlock()
+	if dbs.cache == nil || len(dbs.cache) >= geoipCacheSize {
+		dbs.cache = make(map[netip.Addr]geoipRecord)
+	}
+	dbs.cache[ip] = rec
+	return
+}
+
+// country returns the ISO 3166-1 code of the country of ip, or an empty string if it is not found.
+func (dbs *geoipDatabases) country(ip netip.Addr) string {
+	return dbs.lookup(ip).Country
+}
+
+func (dbs *geoipDatabases) clear() {
+	dbs.mu.Lock()
+	defer dbs.mu.Unlock()
+	dbs.cache = nil
+}
+
+func (dbs *geoipDatabases) Close() error {
+	if dbs.countryDB != nil {
+		dbs.countryDB.Close()
+	}
+	if dbs.asnDB != nil {
+		dbs.asnDB.Close()
+	}
+	return nil
+}
+
+// geoipDB is a MaxMind-format database, the file is checked for changes every period and re-opened when it is modified.
+type geoipDB struct {
+	path     string
+	reader   *maxminddb.Reader
+	modTime  time.Time
+	size     int64
+	onReload func()
+	mu       sync.RWMutex
+	cancel   context.CancelFunc
+	logger   logger.Logger
+}
+
+func openGeoIPDB(path string, period time.Duration, onReload func(), log logger.Logger) (*geoipDB, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	db := &geoipDB{
+		path:     path,
+		onReload: onReload,
+		cancel:   cancel,
+		logger:   log,
+	}
+	if err := db.reload(); err != nil {
+		cancel()
+		return nil, err
+	}
+	go db.watch(ctx, period)
+
+	return db, nil
+}
+
+// lookup decodes the record of ip into v, it reports whether the record is found.
+func (db *geoipDB) lookup(ip netip.Addr, v any) bool {
+	if db == nil {
+		return false
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.reader == nil {
+		return false
+	}
+	_, ok, err := db.reader.LookupNetwork(ip.AsSlice(), v)
+	if err != nil {
+		db.logger.Debugf("geoip %s: %v", ip, err)
+		return false
+	}
+	return ok
+}
+
+func (db *geoipDB) Close() error {
+	db.cancel()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.reader != nil {
+		return db.reader.Close()
+	}
+	return nil
+}
+
+func (db *geoipDB) watch(ctx context.Context, period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := db.reload(); err != nil {
+				db.logger.Warnf("geoip reload: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reload re-opens the database if the file has been modified since the last open,
+// the database opened before is kept if the file fails to open.
+func (db *geoipDB) reload() error {
+	fi, err := os.Stat(db.path)
+	if err != nil {
+		return err
+	}
+
+	db.mu.RLock()
+	modified := db.reader == nil || !fi.ModTime().Equal(db.modTime) || fi.Size() != db.size
+	db.mu.RUnlock()
+	if !modified {
+		return nil
+	}
+
+	b, err := os.ReadFile(db.path)
+	if err != nil {
+		return err
+	}
+	reader, err := maxminddb.FromBytes(b)
+	if err != nil {
+		return err
+	}
+
+	db.logger.Debugf("geoip %s: %s, built at %s", db.path, reader.Metadata.DatabaseType,
+		time.Unix(int64(reader.Metadata.BuildEpoch), 0).UTC().Format(time.RFC3339))
+
+	db.mu.Lock()
+	db.reader = reader
+	db.modTime = fi.ModTime()
+	db.size = fi.Size()
+	db.mu.Unlock()
+
+	if db.onReload != nil {
+		db.onReload()
+	}
+	return nil
+}
+
+// geoipMatcher matches the IPs by the countries and ASNs of the geoip: and asn: matchers.
+type geoipMatcher struct {
+	countries []string
+	asns      []uint
+}
+
+// splitGeoIPMatchers splits the geoip: and asn: matchers out of the matchers,
+// the matcher is nil if there is no such matcher.
+func splitGeoIPMatchers(matchers []string) (*geoipMatcher, []string) {
+	var m geoipMatcher
+	var others []string
+	for _, s := range matchers {
+		s = strings.TrimSpace(s)
+		switch {
+		case hasPrefixFold(s, geoipMatcherCountry):
+			m.countries = append(m.countries, strings.ToUpper(s[len(geoipMatcherCountry):]))
+		case hasPrefixFold(s, geoipMatcherASN):
+			v := strings.TrimPrefix(strings.ToUpper(s[len(geoipMatcherASN):]), "AS")
+			if n, err := strconv.ParseUint(v, 10, 32); err == nil {
+				m.asns = append(m.asns, uint(n))
+			} else {
+				logger.Default().Warnf("invalid matcher %s", s)
+			}
+		default:
+			others = append(others, s)
+		}
+	}
+	if len(m.countries) == 0 && len(m.asns) == 0 {
+		return nil, matchers
+	}
+	return &m, others
+}
+
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// match reports whether the host of addr is in the countries or ASNs, the domain is resolved by resolveHost.
+func (m *geoipMatcher) match(ctx context.Context, addr string) bool {
+	dbs := geoip.Load()
+	if m == nil || dbs == nil || addr == "" {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		if ip = resolveHost(ctx, host); !ip.IsValid() {
+			return false
+		}
+	}
+
+	rec := dbs.lookup(ip)
+	for _, c := range m.countries {
+		if c == rec.Country {
+			return true
+		}
+	}
+	for _, n := range m.asns {
+		if n == rec.ASN {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvedHosts caches the addresses of the domains resolved for the matching,
+// by the hosts and the resolver they are resolved by.
+var resolvedHosts = &resolveCache{}
+
+type resolveKey struct {
+	hosts    string
+	resolver string
+	host     string
+}
+
+type resolvedHost struct {
+	ip      netip.Addr
+	expires time.Time
+}
+
+type resolveCache struct {
+	hosts map[resolveKey]resolvedHost
+	mu    sync.Mutex
+}
+
+func (c *resolveCache) get(key resolveKey) (netip.Addr, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.hosts[key]
+	if !ok || time.Now().After(v.expires) {
+		return netip.Addr{}, false
+	}
+	return v.ip, true
+}
+
+func (c *resolveCache) set(key resolveKey, ip netip.Addr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.hosts == nil || len(c.hosts) >= geoipCacheSize {
+		c.hosts = make(map[resolveKey]resolvedHost)
+	}
+	c.hosts[key] = resolvedHost{ip: ip, expires: time.Now().Add(resolveCacheTTL)}
+}
+
+// resolveHost resolves the domain by the hosts and the resolver of the service of the connection
+// as the router of the service does, or by the system resolver if the service has neither.
+// The results, including the failures, are cached for resolveCacheTTL.
+func resolveHost(ctx context.Context, host string) netip.Addr {
+	if host == "" {
+		return netip.Addr{}
+	}
+
+	key := resolveKey{host: host}
+	if rec := connRecordFromContext(ctx); rec != nil {
+		for _, svc := range config.Global().Services {
+			if svc != nil && svc.Name == rec.Service {
+				key.hosts, key.resolver = svc.Hosts, svc.Resolver
+				break
+			}
+		}
+	}
+	if ip, ok := resolvedHosts.get(key); ok {
+		return ip
+	}
+
+	var ips []net.IP
+	if key.hosts != "" {
+		ips, _ = registry.HostsRegistry().Get(key.hosts).Lookup(ctx, "ip", host)
+	}
+	if len(ips) == 0 {
+		if key.resolver != "" {
+			ips, _ = registry.ResolverRegistry().Get(key.resolver).Resolve(ctx, "ip", host)
+		} else if addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host); err == nil {
+			for _, addr := range addrs {
+				ips = append(ips, addr.AsSlice())
+			}
+		}
+	}
+
+	var ip netip.Addr
+	if len(ips) > 0 {
+		ip, _ = netip.AddrFromSlice(ips[0])
+		ip = ip.Unmap()
+	}
+	resolvedHosts.set(key, ip)
+	return ip
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/go-gost/x/config"
+	xhosts "github.com/go-gost/x/hosts"
+	xlogger "github.com/go-gost/x/logger"
+	"github.com/go-gost/x/registry"
+)
+
+func TestResolveHost(t *testing.T) {
+	hm := xhosts.NewHostMapper(
+		xhosts.MappingsOption([]xhosts.Mapping{
+			{Hostname: "geoip.test", IP: net.ParseIP("10.1.2.3")},
+		}),
+		xhosts.LoggerOption(xlogger.Nop()),
+	)
+	if err := registry.HostsRegistry().Register("resolve-hosts", hm); err != nil {
+		t.Fatal(err)
+	}
+	defer registry.HostsRegistry().Unregister("resolve-hosts")
+
+	global := config.Global()
+	config.Set(&config.Config{
+		Services: []*config.ServiceConfig{{Name: "resolve-service", Hosts: "resolve-hosts"}},
+	})
+	defer config.Set(global)
+
+	want := netip.MustParseAddr("10.1.2.3")
+	ctx := contextWithConnRecord(context.Background(), &connRecord{Service: "resolve-service"})
+	if ip := resolveHost(ctx, "geoip.test"); ip != want {
+		t.Errorf("got %v, want %v by the hosts of the service", ip, want)
+	}
+	if ip := resolveHost(context.Background(), "geoip.test"); ip.IsValid() {
+		t.Errorf("got %v by the system resolver", ip)
+	}
+
+	// the result is cached.
+	registry.HostsRegistry().Unregister("resolve-hosts")
+	if ip := resolveHost(ctx, "geoip.test"); ip != want {
+		t.Errorf("got %v, want the cached %v", ip, want)
+	}
+}
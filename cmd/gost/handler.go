@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/go-gost/core/chain"
+	"github.com/go-gost/core/handler"
+	"github.com/go-gost/core/hop"
+	"github.com/go-gost/core/logger"
+	"github.com/go-gost/core/metadata"
+	mdutil "github.com/go-gost/core/metadata/util"
+	"github.com/go-gost/x/registry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func init() {
+	for name, newHandler := range registry.HandlerRegistry().GetAll() {
+		registry.HandlerRegistry().Unregister(name)
+		registry.HandlerRegistry().Register(name, wrapHandler(name, newHandler))
+	}
+}
+
+// wrapHandler wraps the handlers created by newHandler with the span,
+// the connection table entry and the access log of the handled connections,
+// the authentication failures are published as events.
+func wrapHandler(kind string, newHandler registry.NewHandler) registry.NewHandler {
+	return func(opts ...handler.Option) handler.Handler {
+		var options handler.Options
+		for _, opt := range opts {
+			opt(&options)
+		}
+		if options.Bypass != nil {
+			opts = append(opts, handler.BypassOption(&connBypass{Bypass: options.Bypass}))
+		}
+		if options.Auther != nil {
+			opts = append(opts, handler.AutherOption(&eventAuther{
+				Authenticator: options.Auther,
+				service:       options.Service,
+				handler:       kind,
+			}))
+		}
+		log := options.Logger
+		if log == nil {
+			log = logger.Default()
+		}
+
+		h := &serviceHandler{
+			Handler: newHandler(opts...),
+			kind:    kind,
+			service: options.Service,
+			router:  options.Router,
+			logger:  log,
+		}
+		if _, ok := h.Handler.(handler.Forwarder); ok {
+			return &forwardHandler{serviceHandler: h}
+		}
+		return h
+	}
+}
+
+type serviceHandler struct {
+	handler.Handler
+	kind      string
+	service   string
+	router    *chain.Router
+	accessLog *accessLogger
+	routes    *routeTable
+	logger    logger.Logger
+}
+
+func (h *serviceHandler) Init(md metadata.Metadata) (err error) {
+	if name := mdutil.GetString(md, mdKeyAccessLog); name != "" {
+		lg := registry.LoggerRegistry().Get(name)
+		if lg == nil {
+			return fmt.Errorf("access log: logger %s not found", name)
+		}
+		if h.accessLog, err = newAccessLogger(lg, mdutil.GetString(md, mdKeyAccessLogFormat)); err != nil {
+			return err
+		}
+	}
+	if v := mdutil.GetString(md, mdKeyRoutes); v != "" && h.router != nil {
+		if h.routes, err = newRouteTable(h.service, v, mdutil.GetDuration(md, mdKeyRoutesReload), h.logger); err != nil {
+			return fmt.Errorf("routes: %w", err)
+		}
+		// the routing table routes the connections in place of the chain of the service.
+		opts := h.router.Options()
+		opts.Chain = &routingChain{chain: opts.Chain, table: h.routes}
+		routeTables.Store(h.service, h.routes)
+	}
+
+	return h.Handler.Init(md)
+}
+
+func (h *serviceHandler) Handle(ctx context.Context, conn net.Conn, opts ...handler.HandleOption) (err error) {
+	if servicePaused(h.service) {
+		h.logger.Debugf("service %s is paused, connection from %s is closed", h.service, conn.RemoteAddr())
+		return conn.Close()
+	}
+	if serviceOffSchedule(h.service) {
+		h.logger.Debugf("service %s is off schedule, connection from %s is closed", h.service, conn.RemoteAddr())
+		return conn.Close()
+	}
+	if quota, ok := quotas.Load().blocked(h.service, conn.RemoteAddr().String()); ok {
+		h.logger.Debugf("quota %s is exhausted, connection from %s is closed", quota, conn.RemoteAddr())
+		return conn.Close()
+	}
+
+	ctx, span := tracer.Start(ctx, "accept",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("gost.service", h.service),
+			attribute.String("client.address", conn.RemoteAddr().String()),
+			attribute.String("server.address", conn.LocalAddr().String()),
+		))
+	defer func() { endSpan(span, err) }()
+
+	ctx, hspan := tracer.Start(ctx, "handle "+h.kind,
+		trace.WithAttributes(attribute.String("gost.handler", h.kind)))
+	defer func() { endSpan(hspan, err) }()
+
+	rec := newConnRecord(ctx, conn, h.service, h.kind)
+	ctx = contextWithConnRecord(ctx, rec)
+	// the sshd handler relies on the concrete types of the connections.
+	if h.kind != "sshd" {
+		conn = wrapRecordConn(conn, rec)
+	}
+	connections.add(rec)
+	defer func() {
+		rec.cancel()
+		connections.remove(rec)
+		quotas.Load().done(rec)
+		rec.releaseNodes()
+		observeUserTransfer(rec)
+		if h.accessLog != nil {
+			rec.done(err)
+			h.accessLog.log(rec)
+		}
+	}()
+
+	return h.Handler.Handle(ctx, conn, opts...)
+}
+
+func (h *serviceHandler) Close() error {
+	if h.routes != nil {
+		h.routes.Close()
+		routeTables.CompareAndDelete(h.service, h.routes)
+	}
+	if closer, ok := h.Handler.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+type forwardHandler struct {
+	*serviceHandler
+	// checker is the health checker of the forwarder nodes.
+	checker *healthChecker
+}
+
+func (h *forwardHandler) Forward(hop hop.Hop) {
+	if hop != nil {
+		hop = &forwardHop{Hop: hop, service: h.service, logger: h.logger}
+	}
+	h.Handler.(handler.Forwarder).Forward(hop)
+
+	if h.checker != nil {
+		healthChecks.remove(h.checker)
+	}
+	h.checker = newForwardHealthChecker(h.service, hop)
+	healthChecks.add(h.checker)
+}
+
+func (h *forwardHandler) Close() error {
+	if h.checker != nil {
+		healthChecks.remove(h.checker)
+	}
+	return h.serviceHandler.Close()
+}
+
+// pausedServices are the names of the services paused by the API,
+// the new connections of a paused service are closed once accepted.
+var pausedServices sync.Map
+
+// pauseService pauses or resumes the service, it reports whether the state is changed.
+func pauseService(name string, pause bool) bool {
+	if pause {
+		_, loaded := pausedServices.LoadOrStore(name, struct{}{})
+		return !loaded
+	}
+	_, loaded := pausedServices.LoadAndDelete(name)
+	return loaded
+}
+
+func servicePaused(name string) bool {
+	_, ok := pausedServices.Load(name)
+	return ok
+}
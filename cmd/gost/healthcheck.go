@@ -0,0 +1,699 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-gost/core/chain"
+	"github.com/go-gost/core/hop"
+	"github.com/go-gost/core/logger"
+	"github.com/go-gost/core/metadata"
+	mdutil "github.com/go-gost/core/metadata/util"
+	"github.com/go-gost/core/metrics"
+	"github.com/go-gost/x/config"
+	xmetrics "github.com/go-gost/x/metrics"
+	"github.com/go-gost/x/registry"
+)
+
+// The node metadata keys of the active health check of a chain node or a forwarder node.
+const (
+	// mdKeyHealthCheck is the type of the check, tcp, handshake or http.
+	mdKeyHealthCheck          = "healthCheck"
+	mdKeyHealthCheckInterval  = "healthCheck.interval"
+	mdKeyHealthCheckTimeout   = "healthCheck.timeout"
+	mdKeyHealthCheckHealthy   = "healthCheck.healthy"
+	mdKeyHealthCheckUnhealthy = "healthCheck.unhealthy"
+	mdKeyHealthCheckURL       = "healthCheck.url"
+	mdKeyHealthCheckTarget    = "healthCheck.target"
+)
+
+// The types of the health checks.
+const (
+	// healthCheckTCP checks the connection to the node, through the previous hops for a chain node.
+	healthCheckTCP = "tcp"
+	// healthCheckHandshake checks the handshake of the dialer and the connect of the connector
+	// to the target of the check for a chain node, or the TLS handshake for a forwarder node with TLS.
+	healthCheckHandshake = "handshake"
+	// healthCheckHTTP checks a GET request of the URL of the check through the chain node,
+	// or to the forwarder node, the response status must be less than 400.
+	healthCheckHTTP = "http"
+)
+
+const (
+	defaultHealthCheckInterval  = 10 * time.Second
+	defaultHealthCheckTimeout   = 5 * time.Second
+	defaultHealthCheckHealthy   = 2
+	defaultHealthCheckUnhealthy = 3
+
+	// healthCheckTick is the period the checkers look for the due checks and refresh the fail marks.
+	healthCheckTick = time.Second
+)
+
+// nodeUnhealthy is the health of the node which fails the health check.
+const nodeUnhealthy = "unhealthy"
+
+// errHealthCheckSkipped is the check of a chain node which is not done as the previous hops are not available,
+// it counts neither as a success nor as a failure.
+var errHealthCheckSkipped = errors.New("previous hops are not available")
+
+type healthCheckConfig struct {
+	Type      string
+	Interval  time.Duration
+	Timeout   time.Duration
+	Healthy   int
+	Unhealthy int
+	URL       string
+	Target    string
+}
+
+// parseHealthCheck parses the health check from the node metadata, it returns nil if the node is not checked.
+func parseHealthCheck(md metadata.Metadata) (*healthCheckConfig, error) {
+	typ := strings.ToLower(mdutil.GetString(md, mdKeyHealthCheck))
+	if typ == "" {
+		return nil, nil
+	}
+	switch typ {
+	case healthCheckTCP, healthCheckHandshake, healthCheckHTTP:
+	default:
+		return nil, fmt.Errorf("unknown health check type %s", typ)
+	}
+
+	cfg := &healthCheckConfig{
+		Type:      typ,
+		Interval:  mdutil.GetDuration(md, mdKeyHealthCheckInterval),
+		Timeout:   mdutil.GetDuration(md, mdKeyHealthCheckTimeout),
+		Healthy:   mdutil.GetInt(md, mdKeyHealthCheckHealthy),
+		Unhealthy: mdutil.GetInt(md, mdKeyHealthCheckUnhealthy),
+		URL:       mdutil.GetString(md, mdKeyHealthCheckURL),
+		Target:    mdutil.GetString(md, mdKeyHealthCheckTarget),
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultHealthCheckInterval
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultHealthCheckTimeout
+	}
+	if cfg.Healthy <= 0 {
+		cfg.Healthy = defaultHealthCheckHealthy
+	}
+	if cfg.Unhealthy <= 0 {
+		cfg.Unhealthy = defaultHealthCheckUnhealthy
+	}
+	if typ == healthCheckHTTP {
+		if cfg.URL == "" {
+			cfg.URL = "/"
+		}
+		if _, err := url.Parse(cfg.URL); err != nil {
+			return nil, fmt.Errorf("invalid health check url %s: %w", cfg.URL, err)
+		}
+	}
+	return cfg, nil
+}
+
+// healthKey identifies a checked node, by the chain or the service of the forwarder, the hop and the node name.
+// The nodes reloaded by the hop loaders are new objects, the state of the checks is kept by the names.
+type healthKey struct {
+	chain   string
+	service string
+	hop     string
+	node    string
+}
+
+// nodeHealth is the state of the health check of a node.
+type nodeHealth struct {
+	// Type is the type of the check.
+	Type string `json:"type"`
+	// State is healthy, unhealthy or unknown before the thresholds are reached the first time.
+	State     string    `json:"state"`
+	Time      time.Time `json:"time,omitempty"`
+	LatencyMs float64   `json:"latencyMs,omitempty"`
+	Error     string    `json:"error,omitempty"`
+
+	successes int
+	failures  int
+	running   bool
+}
+
+// nodeHealths are the states of the checked nodes by healthKey.
+var nodeHealths sync.Map
+
+// healthOf returns a copy of the state of the check of the node, or nil if the node is not checked.
+func healthOf(key healthKey) *nodeHealth {
+	v, ok := nodeHealths.Load(key)
+	if !ok {
+		return nil
+	}
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	h := *v.(*nodeHealth)
+	return &h
+}
+
+// healthMu guards the states in nodeHealths.
+var healthMu sync.Mutex
+
+// healthChecks are the running health checkers of the chains and the forwarders.
+var healthChecks = &healthCheckGroup{
+	checkers: make(map[string]*healthChecker),
+}
+
+type healthCheckGroup struct {
+	checkers map[string]*healthChecker
+	// ctx is set once the checks are started, the checkers added after are started immediately.
+	ctx context.Context
+	mu  sync.Mutex
+}
+
+// start starts the checkers added by the forwarders, and a checker for each chain in the chain registry.
+func (g *healthCheckGroup) start(ctx context.Context) {
+	for name, c := range registry.ChainRegistry().GetAll() {
+		if cw, ok := c.(*chainWrapper); ok {
+			g.add(newChainHealthChecker(name, cw))
+		}
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.ctx = ctx
+	for _, c := range g.checkers {
+		c.start(ctx)
+	}
+}
+
+// add adds the checker, the checker with the same key is replaced.
+func (g *healthCheckGroup) add(c *healthChecker) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if old := g.checkers[c.key()]; old != nil {
+		old.stop()
+	}
+	g.checkers[c.key()] = c
+	if g.ctx != nil {
+		c.start(g.ctx)
+	}
+}
+
+func (g *healthCheckGroup) remove(c *healthChecker) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.checkers[c.key()] == c {
+		delete(g.checkers, c.key())
+	}
+	c.stop()
+}
+
+// forwarder returns the checker of the forwarder of the service.
+func (g *healthCheckGroup) forwarder(service string) *healthChecker {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.checkers[(&healthChecker{service: service}).key()]
+}
+
+// checkHop is a hop checked by a health checker.
+type checkHop struct {
+	name  string
+	nodes []*chain.Node
+}
+
+// healthChecker checks the nodes with the health check in the node metadata, of the hops of a chain or the forwarder of a service.
+// The nodes of a chain are checked in the same way as the routes of the chain, through the healthy nodes of the previous hops.
+// An unhealthy node is marked failed, which is skipped by the selector of the hop once the fails reach the maxFails of the selector.
+type healthChecker struct {
+	// chain is the name of the checked chain, or service is the name of the service of the checked forwarder.
+	chain   string
+	service string
+	// hops returns the hops to check, it returns false if the checker should stop.
+	hops   func() ([]checkHop, bool)
+	logger logger.Logger
+	cancel context.CancelFunc
+	mu     sync.Mutex
+}
+
+func newChainHealthChecker(name string, c *chainWrapper) *healthChecker {
+	return &healthChecker{
+		chain: name,
+		hops: func() ([]checkHop, bool) {
+			// the checker stops once the chain is removed or replaced.
+			if registeredChain(name) != c {
+				return nil, false
+			}
+			hops := make([]checkHop, 0, len(c.hops))
+			for _, h := range c.hops {
+				hops = append(hops, checkHop{name: h.name, nodes: hopNodes(h.Hop)})
+			}
+			return hops, true
+		},
+		logger: logger.Default().WithFields(map[string]any{
+			"kind":  "healthcheck",
+			"chain": name,
+		}),
+	}
+}
+
+func newForwardHealthChecker(service string, h hop.Hop) *healthChecker {
+	return &healthChecker{
+		service: service,
+		hops: func() ([]checkHop, bool) {
+			return []checkHop{{nodes: hopNodes(h)}}, true
+		},
+		logger: logger.Default().WithFields(map[string]any{
+			"kind":    "healthcheck",
+			"service": service,
+		}),
+	}
+}
+
+func hopNodes(h hop.Hop) []*chain.Node {
+	if nl, ok := h.(hop.NodeList); ok {
+		return nl.Nodes()
+	}
+	return nil
+}
+
+func (c *healthChecker) key() string {
+	if c.service != "" {
+		return "service/" + c.service
+	}
+	return "chain/" + c.chain
+}
+
+func (c *healthChecker) start(ctx context.Context) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cancel != nil {
+		return
+	}
+	ctx, c.cancel = context.WithCancel(ctx)
+	go c.run(ctx)
+}
+
+func (c *healthChecker) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cancel != nil {
+		c.cancel()
+	}
+	// the checker is not started again once stopped.
+	c.cancel = func() {}
+}
+
+func (c *healthChecker) run(ctx context.Context) {
+	ticker := time.NewTicker(healthCheckTick)
+	defer ticker.Stop()
+
+	for {
+		hops, ok := c.hops()
+		if !ok {
+			healthChecks.remove(c)
+			return
+		}
+		c.check(ctx, hops)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// check starts the due checks of the nodes, and refreshes the fail marks of the unhealthy nodes.
+func (c *healthChecker) check(ctx context.Context, hops []checkHop) {
+	var prefix []*chain.Node
+	for _, h := range hops {
+		var next *chain.Node
+		for _, node := range h.nodes {
+			key := c.nodeKey(h.name, node.Name)
+			hc, err := parseHealthCheck(node.Metadata())
+			if err != nil {
+				if _, loaded := nodeHealths.LoadOrStore(key, &nodeHealth{State: nodeUnknown, Error: err.Error()}); !loaded {
+					c.logger.Errorf("node %s: %v", node.Name, err)
+				}
+			} else if hc == nil {
+				nodeHealths.Delete(key)
+			}
+			if hc == nil {
+				if next == nil {
+					next = node
+				}
+				continue
+			}
+
+			v, _ := nodeHealths.LoadOrStore(key, &nodeHealth{Type: hc.Type, State: nodeUnknown})
+			st := v.(*nodeHealth)
+
+			healthMu.Lock()
+			state := st.State
+			due := !st.running && time.Since(st.Time) >= hc.Interval
+			if due {
+				st.running = true
+			}
+			healthMu.Unlock()
+
+			if state == nodeUnhealthy {
+				c.markUnhealthy(h.name, node)
+			} else if next == nil {
+				next = node
+			}
+			if due {
+				go c.probe(ctx, append([]*chain.Node(nil), prefix...), h.name, node, hc, st)
+			}
+		}
+		if c.service != "" {
+			continue
+		}
+		if next == nil {
+			// the nodes of the next hops can not be checked without a route through this hop.
+			prefix = nil
+			break
+		}
+		prefix = append(prefix, next)
+	}
+}
+
+func (c *healthChecker) nodeKey(hopName, node string) healthKey {
+	return healthKey{chain: c.chain, service: c.service, hop: hopName, node: node}
+}
+
+func (c *healthChecker) probe(ctx context.Context, prefix []*chain.Node, hopName string, node *chain.Node, hc *healthCheckConfig, st *nodeHealth) {
+	ctx, cancel := context.WithTimeout(ctx, hc.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	var err error
+	if c.service != "" {
+		err = probeForwardNode(ctx, node, hc)
+	} else {
+		err = probeChainNode(ctx, prefix, node, hc)
+	}
+	latency := time.Since(start)
+
+	healthMu.Lock()
+	st.running = false
+	st.Type = hc.Type
+	st.Time = time.Now()
+	if errors.Is(err, errHealthCheckSkipped) || errors.Is(ctx.Err(), context.Canceled) {
+		healthMu.Unlock()
+		return
+	}
+	st.LatencyMs = float64(latency.Microseconds()) / 1000
+	prev := st.State
+	if err == nil {
+		observeNodeLatency(node, latency)
+		st.Error = ""
+		st.successes++
+		st.failures = 0
+		if st.State != nodeHealthy && st.successes >= hc.Healthy {
+			st.State = nodeHealthy
+		}
+	} else {
+		st.Error = err.Error()
+		st.failures++
+		st.successes = 0
+		if st.State != nodeUnhealthy && st.failures >= hc.Unhealthy {
+			st.State = nodeUnhealthy
+		}
+	}
+	state := st.State
+	healthMu.Unlock()
+
+	labels := metrics.Labels{"chain": c.chain, "service": c.service, "hop": hopName, "node": node.Name}
+	if v := xmetrics.GetGauge(metricNodeHealthGauge, labels); v != nil && state != nodeUnknown {
+		if state == nodeHealthy {
+			v.Set(1)
+		} else {
+			v.Set(0)
+		}
+	}
+
+	if state == prev {
+		if err != nil {
+			c.logger.Debugf("node %s(%s) %s check: %v", node.Name, node.Addr, hc.Type, err)
+		}
+		return
+	}
+
+	data := map[string]any{
+		"hop":    hopName,
+		"node":   node.Name,
+		"addr":   node.Addr,
+		"health": state,
+	}
+	if c.service != "" {
+		data["service"] = c.service
+	} else {
+		data["chain"] = c.chain
+	}
+	if err != nil {
+		data["error"] = err.Error()
+	}
+	events.publish(eventNodeHealth, data)
+
+	switch state {
+	case nodeUnhealthy:
+		c.logger.Warnf("node %s(%s) is unhealthy: %v", node.Name, node.Addr, err)
+		c.markUnhealthy(hopName, node)
+	case nodeHealthy:
+		c.logger.Infof("node %s(%s) is healthy", node.Name, node.Addr)
+		if prev == nodeUnhealthy {
+			if m := node.Marker(); m != nil {
+				m.Reset()
+			}
+		}
+	}
+}
+
+// markUnhealthy marks the node failed until the fails reach the maxFails of the selector,
+// the mark is refreshed before the failTimeout of the selector.
+func (c *healthChecker) markUnhealthy(hopName string, node *chain.Node) {
+	m := node.Marker()
+	if m == nil {
+		return
+	}
+
+	maxFails, failTimeout := c.selector(hopName)
+	if md := node.Metadata(); md != nil {
+		if md.IsExists("maxFails") {
+			maxFails = mdutil.GetInt(md, "maxFails")
+		}
+		if md.IsExists("failTimeout") {
+			failTimeout = mdutil.GetDuration(md, "failTimeout")
+		}
+	}
+	if maxFails <= 0 {
+		maxFails = 1
+	}
+	if failTimeout <= 0 {
+		failTimeout = 10 * time.Second
+	}
+
+	for m.Count() < int64(maxFails) {
+		m.Mark()
+	}
+	if time.Since(m.Time()) >= failTimeout/2 {
+		m.Mark()
+	}
+}
+
+// selector returns the maxFails and failTimeout of the selector of the hop in the config.
+func (c *healthChecker) selector(hopName string) (maxFails int, failTimeout time.Duration) {
+	cfg := config.Global()
+
+	var sel *config.SelectorConfig
+	if c.service != "" {
+		for _, svc := range cfg.Services {
+			if svc != nil && svc.Name == c.service && svc.Forwarder != nil {
+				sel = svc.Forwarder.Selector
+			}
+		}
+	} else if hc := chainHopConfig(c.chain, hopName); hc != nil {
+		sel = hc.Selector
+	}
+
+	if sel == nil {
+		return 0, 0
+	}
+	return sel.MaxFails, sel.FailTimeout
+}
+
+// probeChainNode checks the chain node through the route of the prefix nodes.
+func probeChainNode(ctx context.Context, prefix []*chain.Node, node *chain.Node, hc *healthCheckConfig) error {
+	var conn net.Conn
+	if len(prefix) > 0 {
+		var err error
+		if conn, err = connectRoute(ctx, prefix, nil); err != nil {
+			return errHealthCheckSkipped
+		}
+	}
+
+	addr, err := chain.Resolve(ctx, "ip", node.Addr, node.Options().Resolver, node.Options().HostMapper, logger.Default())
+	if err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	tr := node.Options().Transport
+	var cc net.Conn
+	if conn == nil {
+		cc, err = tr.Dial(ctx, addr)
+	} else if cc, err = prefix[len(prefix)-1].Options().Transport.Connect(ctx, conn, "tcp", addr); err != nil {
+		conn.Close()
+	}
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+	if hc.Type == healthCheckTCP {
+		return nil
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		cc.SetDeadline(deadline)
+	}
+	if cc, err = tr.Handshake(ctx, cc); err != nil {
+		return err
+	}
+	defer cc.Close()
+
+	target := hc.Target
+	var u *url.URL
+	if hc.Type == healthCheckHTTP {
+		u, _ = url.Parse(hc.URL)
+		if u.Host != "" {
+			target = u.Host
+			if u.Port() == "" {
+				target = net.JoinHostPort(u.Hostname(), defaultPort(u.Scheme))
+			}
+		}
+	}
+	if target == "" {
+		// the node connects to itself.
+		target = node.Addr
+	}
+	tc, err := tr.Connect(ctx, cc, "tcp", target)
+	if err != nil {
+		return err
+	}
+	defer tc.Close()
+	if hc.Type == healthCheckHandshake {
+		return nil
+	}
+
+	if u.Host == "" {
+		u.Host = target
+	}
+	if u.Scheme == "" {
+		u.Scheme = "http"
+	}
+	return probeHTTP(ctx, tc, u, "")
+}
+
+// probeForwardNode checks the forwarder node directly.
+func probeForwardNode(ctx context.Context, node *chain.Node, hc *healthCheckConfig) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", node.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if hc.Type == healthCheckTCP {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	opts := node.Options()
+	if opts.TLS != nil {
+		serverName := opts.TLS.ServerName
+		if serverName == "" {
+			serverName, _, _ = net.SplitHostPort(node.Addr)
+		}
+		tc := tls.Client(conn, &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: !opts.TLS.Secure,
+		})
+		if err := tc.HandshakeContext(ctx); err != nil {
+			return err
+		}
+		conn = tc
+	}
+	if hc.Type == healthCheckHandshake {
+		return nil
+	}
+
+	u, _ := url.Parse(hc.URL)
+	if u.Host == "" {
+		u.Host = node.Addr
+	}
+	// the TLS connection to the node, if any, is established above.
+	u.Scheme = "http"
+	host := opts.Host
+	if opts.HTTP != nil && opts.HTTP.Host != "" {
+		host = opts.HTTP.Host
+	}
+	return probeHTTP(ctx, conn, u, host)
+}
+
+// probeHTTP sends a GET request of u on the connection, the response status must be less than 400.
+func probeHTTP(ctx context.Context, conn net.Conn, u *url.URL, host string) error {
+	if u.Scheme == "https" {
+		tc := tls.Client(conn, &tls.Config{
+			ServerName: u.Hostname(),
+			// the check is for the health of the node, not the identity of the target.
+			InsecureSkipVerify: true,
+		})
+		if err := tc.HandshakeContext(ctx); err != nil {
+			return err
+		}
+		conn = tc
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if host != "" {
+		req.Host = host
+	}
+	req.Header.Set("User-Agent", "gost-healthcheck")
+	req.Close = true
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("http status %s", resp.Status)
+	}
+	return nil
+}
+
+func defaultPort(scheme string) string {
+	if scheme == "https" {
+		return "443"
+	}
+	return "80"
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+)
+
+// logTailSize is the number of the latest log entries kept for the log API.
+const logTailSize = 500
+
+// logTail is the latest log entries of the default logger, which is written by
+// a JSON logger in the group of the default logger when the API service is enabled.
+var logTail = &logBuffer{}
+
+type logEntry struct {
+	ID uint64 `json:"id"`
+	// Entry is the log entry in JSON, with the fields time, level, msg and the fields of the logger.
+	Entry json.RawMessage `json:"entry"`
+}
+
+type logBuffer struct {
+	seq     uint64
+	entries []logEntry
+	mu      sync.Mutex
+}
+
+// Write adds a log entry, each write of the logger is an entry.
+func (b *logBuffer) Write(p []byte) (int, error) {
+	entry := bytes.TrimSpace(p)
+	if !json.Valid(entry) {
+		return len(p), nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	if len(b.entries) == logTailSize {
+		copy(b.entries, b.entries[1:])
+		b.entries = b.entries[:logTailSize-1]
+	}
+	b.entries = append(b.entries, logEntry{
+		ID:    b.seq,
+		Entry: bytes.Clone(entry),
+	})
+	return len(p), nil
+}
+
+// tail returns at most n latest entries after the entry of the ID.
+func (b *logBuffer) tail(after uint64, n int) []logEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	i := len(b.entries)
+	for i > 0 && b.entries[i-1].ID > after && len(b.entries)-i < n {
+		i--
+	}
+	return append([]logEntry{}, b.entries[i:]...)
+}
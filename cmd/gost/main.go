@@ -69,7 +69,27 @@ func worker(id int, args []string, ctx *context.Context, ret *int) {
 	}
 }
 
+// subcommands are dispatched by the first argument before the flags are parsed.
+var subcommands = map[string]func(args []string) int{
+	"config":   configCmd,
+	"conns":    connsCmd,
+	"diagnose": diagnoseCmd,
+	"top":      topCmd,
+}
+
 func init() {
+	if len(os.Args) > 1 {
+		if cmd := subcommands[os.Args[1]]; cmd != nil {
+			os.Exit(cmd(os.Args[2:]))
+		}
+	}
+
+	logger.SetDefault(xlogger.NewLogger())
+}
+
+// parseFlags parses the command line flags, it is called by main rather than init,
+// so the flags of the tests are not parsed as the flags of gost.
+func parseFlags() {
 	var printVersion bool
 
 	flag.Var(&services, "L", "service list")
@@ -87,11 +107,11 @@ func init() {
 			version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
 		os.Exit(0)
 	}
-
-	logger.SetDefault(xlogger.NewLogger())
 }
 
 func main() {
+	parseFlags()
+
 	p := &program{}
 	if err := svc.Run(p); err != nil {
 		log.Fatal(err)
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"io"
+
+	"github.com/go-gost/core/admission"
+	"github.com/go-gost/core/bypass"
+	"github.com/go-gost/x/config"
+	admission_parser "github.com/go-gost/x/config/parsing/admission"
+	bypass_parser "github.com/go-gost/x/config/parsing/bypass"
+)
+
+// addrMatcher matches the addresses of a bypass or an admission in addition to the matchers of go-gost/x.
+type addrMatcher interface {
+	match(ctx context.Context, addr string) bool
+}
+
+// parseBypass parses the bypass as go-gost/x does, with the geoip: and asn: matchers.
+// The file and the HTTP URL of the bypass are loaded as rule lists.
+func parseBypass(cfg *config.BypassConfig) bypass.Bypass {
+	if cfg == nil || cfg.Plugin != nil {
+		return bypass_parser.ParseBypass(cfg)
+	}
+
+	geo, matchers := splitGeoIPMatchers(cfg.Matchers)
+	lists := parseRuleLists("bypass", cfg.Name, cfg.File, cfg.HTTP, cfg.Reload)
+	if geo == nil && len(lists) == 0 {
+		return bypass_parser.ParseBypass(cfg)
+	}
+
+	c := *cfg
+	c.Matchers, c.File, c.HTTP = matchers, nil, nil
+	bp := bypass_parser.ParseBypass(&c)
+	if bp == nil {
+		return nil
+	}
+	return &matcherBypass{
+		Bypass:    bp,
+		matchers:  addrMatchers(geo, lists),
+		whitelist: cfg.Whitelist || cfg.Reverse,
+	}
+}
+
+// parseAdmission parses the admission as go-gost/x does, with the geoip: and asn: matchers.
+// The file and the HTTP URL of the admission are loaded as rule lists.
+func parseAdmission(cfg *config.AdmissionConfig) admission.Admission {
+	if cfg == nil || cfg.Plugin != nil {
+		return admission_parser.ParseAdmission(cfg)
+	}
+
+	geo, matchers := splitGeoIPMatchers(cfg.Matchers)
+	lists := parseRuleLists("admission", cfg.Name, cfg.File, cfg.HTTP, cfg.Reload)
+	if geo == nil && len(lists) == 0 {
+		return admission_parser.ParseAdmission(cfg)
+	}
+
+	c := *cfg
+	c.Matchers, c.File, c.HTTP = matchers, nil, nil
+	p := admission_parser.ParseAdmission(&c)
+	if p == nil {
+		return nil
+	}
+	return &matcherAdmission{
+		Admission: p,
+		matchers:  addrMatchers(geo, lists),
+		whitelist: cfg.Whitelist || cfg.Reverse,
+	}
+}
+
+func addrMatchers(geo *geoipMatcher, lists []*ruleList) (matchers []addrMatcher) {
+	if geo != nil {
+		matchers = append(matchers, geo)
+	}
+	for _, l := range lists {
+		matchers = append(matchers, l)
+	}
+	return
+}
+
+func matchAny(ctx context.Context, matchers []addrMatcher, addr string) bool {
+	for _, m := range matchers {
+		if m.match(ctx, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func closeMatchers(v any, matchers []addrMatcher) error {
+	for _, m := range matchers {
+		if c, ok := m.(io.Closer); ok {
+			c.Close()
+		}
+	}
+	return closeComponent(v)
+}
+
+// matcherBypass is the bypass with the geoip: and asn: matchers and the rule lists,
+// the other matchers are matched by the bypass of go-gost/x.
+type matcherBypass struct {
+	bypass.Bypass
+	matchers  []addrMatcher
+	whitelist bool
+}
+
+func (bp *matcherBypass) Contains(ctx context.Context, network, addr string, opts ...bypass.Option) bool {
+	// the bypass of go-gost/x inverts the result of the whitelist.
+	matched := bp.Bypass.Contains(ctx, network, addr, opts...) != bp.whitelist
+	if !matched && addr != "" {
+		matched = matchAny(ctx, bp.matchers, addr)
+	}
+	return matched != bp.whitelist
+}
+
+func (bp *matcherBypass) Close() error {
+	return closeMatchers(bp.Bypass, bp.matchers)
+}
+
+// matcherAdmission is the admission with the geoip: and asn: matchers and the rule lists,
+// the other matchers are matched by the admission of go-gost/x.
+type matcherAdmission struct {
+	admission.Admission
+	matchers  []addrMatcher
+	whitelist bool
+}
+
+func (p *matcherAdmission) Admit(ctx context.Context, addr string, opts ...admission.Option) bool {
+	// the admission of go-gost/x denies the matched addresses unless it is a whitelist.
+	matched := p.Admission.Admit(ctx, addr, opts...) == p.whitelist
+	if !matched && addr != "" {
+		matched = matchAny(ctx, p.matchers, addr)
+	}
+	return matched == p.whitelist
+}
+
+func (p *matcherAdmission) Close() error {
+	return closeMatchers(p.Admission, p.matchers)
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/go-gost/core/metrics"
+	xmetrics "github.com/go-gost/x/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricsExtConfig is the part of the metrics configuration which is not covered by config.MetricsConfig,
+// it is read from the same metrics section.
+type MetricsExtConfig struct {
+	// UserMetrics enables the transfer byte counters per authenticated user,
+	// the number of the users adds to the cardinality of the metrics.
+	UserMetrics bool `yaml:"userMetrics,omitempty" json:"userMetrics,omitempty"`
+	// MaxLabelValues is the max number of the label value combinations of each metric,
+	// the requests beyond are counted with the label values of _other. Default is 1000, -1 is unlimited.
+	MaxLabelValues int `yaml:"maxLabelValues,omitempty" json:"maxLabelValues,omitempty"`
+	// Push pushes the metrics to a remote endpoint periodically, in addition to or instead of the scraping by addr.
+	Push *MetricsPushConfig `yaml:",omitempty" json:"push,omitempty"`
+}
+
+const (
+	defaultMaxLabelValues = 1000
+	// otherLabelValue replaces the label values beyond the limit of a metric.
+	otherLabelValue = "_other"
+)
+
+// The metrics in addition to the metrics of go-gost/x.
+const (
+	// Chain node dial duration histogram of the routes through the node, from the dial of the
+	// first node to the connection to the target. Labels: host, chain, node.
+	metricNodeDialDurationObserver metrics.MetricName = "gost_chain_node_dial_duration_seconds"
+	// Total times a chain node is marked failed. Labels: host, chain, node.
+	metricNodeFailuresCounter metrics.MetricName = "gost_chain_node_failures_total"
+	// Total times a failed chain node recovers. Labels: host, chain, node.
+	metricNodeRecoveriesCounter metrics.MetricName = "gost_chain_node_recoveries_total"
+	// Total dials retried through another chain of the chain group of the service after the dial
+	// through the previous chain failed. Labels: host, service, from, chain.
+	metricChainFailoversCounter metrics.MetricName = "gost_chain_failovers_total"
+	// Health of the node by the active health check, 1 for healthy and 0 for unhealthy.
+	// Labels: host, chain, service (of the forwarder), hop, node.
+	metricNodeHealthGauge metrics.MetricName = "gost_node_health"
+	// State of the circuit breaker of the node, 0 for closed, 1 for half-open and 2 for open.
+	// Labels: host, chain, service (of the forwarder), node.
+	metricNodeCircuitGauge metrics.MetricName = "gost_node_circuit_state"
+	// Total input bytes of the authenticated user. Labels: host, service, user.
+	metricUserTransferInputBytesCounter metrics.MetricName = "gost_user_transfer_input_bytes_total"
+	// Total output bytes of the authenticated user. Labels: host, service, user.
+	metricUserTransferOutputBytesCounter metrics.MetricName = "gost_user_transfer_output_bytes_total"
+	// Total handshake errors with the chain nodes. Labels: host, kind, type, reason.
+	metricHandshakeErrorsCounter metrics.MetricName = "gost_handshake_errors_total"
+	// Resolver duration histogram. Labels: host, resolver.
+	metricResolverDurationObserver metrics.MetricName = "gost_resolver_duration_seconds"
+	// Total addresses matched by the rule list of a bypass, admission or hosts. Labels: host, kind, name, list.
+	metricRuleListHitsCounter metrics.MetricName = "gost_rule_list_hits_total"
+	// Number of the rules of the rule list loaded last. Labels: host, kind, name, list.
+	metricRuleListRulesGauge metrics.MetricName = "gost_rule_list_rules"
+	// Total requests of the metrics whose label values are beyond the limit. Labels: host, metric.
+	metricLabelOverflowCounter metrics.MetricName = "gost_metric_label_overflow_total"
+)
+
+// extMetrics is the prometheus metrics of go-gost/x with the additional metrics,
+// the label values of all metrics are limited by the label guard.
+type extMetrics struct {
+	metrics.Metrics
+	host        string
+	userMetrics bool
+	counters    map[metrics.MetricName]*prometheus.CounterVec
+	gauges      map[metrics.MetricName]*prometheus.GaugeVec
+	histograms  map[metrics.MetricName]*prometheus.HistogramVec
+	guard       *labelGuard
+}
+
+func newMetrics(cfg *MetricsExtConfig) metrics.Metrics {
+	if cfg == nil {
+		cfg = &MetricsExtConfig{}
+	}
+	maxLabelValues := cfg.MaxLabelValues
+	if maxLabelValues == 0 {
+		maxLabelValues = defaultMaxLabelValues
+	}
+
+	host, _ := os.Hostname()
+	m := &extMetrics{
+		Metrics:     xmetrics.NewMetrics(),
+		host:        host,
+		userMetrics: cfg.UserMetrics,
+		counters: map[metrics.MetricName]*prometheus.CounterVec{
+			metricNodeFailuresCounter: prometheus.NewCounterVec(
+				prometheus.CounterOpts{
+					Name: string(metricNodeFailuresCounter),
+					Help: "Total times a chain node is marked failed",
+				},
+				[]string{"host", "chain", "node"}),
+			metricNodeRecoveriesCounter: prometheus.NewCounterVec(
+				prometheus.CounterOpts{
+					Name: string(metricNodeRecoveriesCounter),
+					Help: "Total times a failed chain node recovers",
+				},
+				[]string{"host", "chain", "node"}),
+			metricChainFailoversCounter: prometheus.NewCounterVec(
+				prometheus.CounterOpts{
+					Name: string(metricChainFailoversCounter),
+					Help: "Total dials retried through another chain after the dial through the previous chain failed",
+				},
+				[]string{"host", "service", "from", "chain"}),
+			metricHandshakeErrorsCounter: prometheus.NewCounterVec(
+				prometheus.CounterOpts{
+					Name: string(metricHandshakeErrorsCounter),
+					Help: "Total handshake errors with the chain nodes",
+				},
+				[]string{"host", "kind", "type", "reason"}),
+			metricRuleListHitsCounter: prometheus.NewCounterVec(
+				prometheus.CounterOpts{
+					Name: string(metricRuleListHitsCounter),
+					Help: "Total addresses matched by the rule list",
+				},
+				[]string{"host", "kind", "name", "list"}),
+			metricLabelOverflowCounter: prometheus.NewCounterVec(
+				prometheus.CounterOpts{
+					Name: string(metricLabelOverflowCounter),
+					Help: "Total requests of the metrics whose label values are beyond the limit",
+				},
+				[]string{"host", "metric"}),
+		},
+		gauges: map[metrics.MetricName]*prometheus.GaugeVec{
+			metricNodeHealthGauge: prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Name: string(metricNodeHealthGauge),
+					Help: "Health of the node by the active health check",
+				},
+				[]string{"host", "chain", "service", "hop", "node"}),
+			metricNodeCircuitGauge: prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Name: string(metricNodeCircuitGauge),
+					Help: "State of the circuit breaker of the node",
+				},
+				[]string{"host", "chain", "service", "node"}),
+			metricRuleListRulesGauge: prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Name: string(metricRuleListRulesGauge),
+					Help: "Number of the rules of the rule list",
+				},
+				[]string{"host", "kind", "name", "list"}),
+		},
+		histograms: map[metrics.MetricName]*prometheus.HistogramVec{
+			metricNodeDialDurationObserver: prometheus.NewHistogramVec(
+				prometheus.HistogramOpts{
+					Name: string(metricNodeDialDurationObserver),
+					Help: "Distribution of chain node dial latencies",
+					Buckets: []float64{
+						.01, .05, .1, .25, .5, 1, 1.5, 2, 5, 10, 15, 30, 60,
+					},
+				},
+				[]string{"host", "chain", "node"}),
+			metricResolverDurationObserver: prometheus.NewHistogramVec(
+				prometheus.HistogramOpts{
+					Name: string(metricResolverDurationObserver),
+					Help: "Distribution of resolver latencies",
+					Buckets: []float64{
+						.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10,
+					},
+				},
+				[]string{"host", "resolver"}),
+		},
+		guard: &labelGuard{
+			max:  maxLabelValues,
+			seen: make(map[metrics.MetricName]map[string]struct{}),
+		},
+	}
+	if cfg.UserMetrics {
+		m.counters[metricUserTransferInputBytesCounter] = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: string(metricUserTransferInputBytesCounter),
+				Help: "Total input data transfer size in bytes of the authenticated user",
+			},
+			[]string{"host", "service", "user"})
+		m.counters[metricUserTransferOutputBytesCounter] = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: string(metricUserTransferOutputBytesCounter),
+				Help: "Total output data transfer size in bytes of the authenticated user",
+			},
+			[]string{"host", "service", "user"})
+	}
+
+	for k := range m.counters {
+		prometheus.MustRegister(m.counters[k])
+	}
+	for k := range m.gauges {
+		prometheus.MustRegister(m.gauges[k])
+	}
+	for k := range m.histograms {
+		prometheus.MustRegister(m.histograms[k])
+	}
+
+	return m
+}
+
+func (m *extMetrics) Counter(name metrics.MetricName, labels metrics.Labels) metrics.Counter {
+	labels = m.limit(name, labels)
+	v, ok := m.counters[name]
+	if !ok {
+		return m.Metrics.Counter(name, labels)
+	}
+	labels["host"] = m.host
+	return v.With(prometheus.Labels(labels))
+}
+
+func (m *extMetrics) Gauge(name metrics.MetricName, labels metrics.Labels) metrics.Gauge {
+	labels = m.limit(name, labels)
+	v, ok := m.gauges[name]
+	if !ok {
+		return m.Metrics.Gauge(name, labels)
+	}
+	labels["host"] = m.host
+	return v.With(prometheus.Labels(labels))
+}
+
+func (m *extMetrics) Observer(name metrics.MetricName, labels metrics.Labels) metrics.Observer {
+	labels = m.limit(name, labels)
+	v, ok := m.histograms[name]
+	if !ok {
+		return m.Metrics.Observer(name, labels)
+	}
+	labels["host"] = m.host
+	return v.With(prometheus.Labels(labels))
+}
+
+// limit returns the labels with the values of _other if the label values of the metric are beyond the limit.
+func (m *extMetrics) limit(name metrics.MetricName, labels metrics.Labels) metrics.Labels {
+	if labels == nil {
+		return metrics.Labels{}
+	}
+	// the unknown metrics are not recorded, their label values must not take the room of the guard.
+	if !m.known(name) {
+		return labels
+	}
+	if name == metricLabelOverflowCounter || m.guard.allow(name, labels) {
+		return labels
+	}
+
+	m.counters[metricLabelOverflowCounter].With(prometheus.Labels{
+		"host":   m.host,
+		"metric": string(name),
+	}).Inc()
+
+	other := make(metrics.Labels, len(labels))
+	for k := range labels {
+		other[k] = otherLabelValue
+	}
+	return other
+}
+
+// xMetricNames are the metrics of go-gost/x.
+var xMetricNames = map[metrics.MetricName]bool{
+	xmetrics.MetricServicesGauge:                     true,
+	xmetrics.MetricServiceRequestsCounter:            true,
+	xmetrics.MetricServiceRequestsInFlightGauge:      true,
+	xmetrics.MetricServiceRequestsDurationObserver:   true,
+	xmetrics.MetricServiceTransferInputBytesCounter:  true,
+	xmetrics.MetricServiceTransferOutputBytesCounter: true,
+	xmetrics.MetricNodeConnectDurationObserver:       true,
+	xmetrics.MetricServiceHandlerErrorsCounter:       true,
+	xmetrics.MetricChainErrorsCounter:                true,
+}
+
+// known reports whether the metric is one of the metrics of go-gost/x or the additional metrics.
+func (m *extMetrics) known(name metrics.MetricName) bool {
+	if xMetricNames[name] {
+		return true
+	}
+	_, counter := m.counters[name]
+	_, gauge := m.gauges[name]
+	_, histogram := m.histograms[name]
+	return counter || gauge || histogram
+}
+
+// labelGuard limits the number of the label value combinations of each metric.
+type labelGuard struct {
+	max  int
+	seen map[metrics.MetricName]map[string]struct{}
+	mu   sync.Mutex
+}
+
+func (g *labelGuard) allow(name metrics.MetricName, labels metrics.Labels) bool {
+	if g.max < 0 || len(labels) == 0 {
+		return true
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		if k != "host" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	for _, k := range keys {
+		sb.WriteString(k)
+		sb.WriteByte('=')
+		sb.WriteString(labels[k])
+		sb.WriteByte(',')
+	}
+	key := sb.String()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	values := g.seen[name]
+	if values == nil {
+		values = make(map[string]struct{})
+		g.seen[name] = values
+	}
+	if _, ok := values[key]; ok {
+		return true
+	}
+	if len(values) >= g.max {
+		return false
+	}
+	values[key] = struct{}{}
+	return true
+}
+
+// observeUserTransfer adds the bytes of the connection to the transfer counters of the authenticated user.
+func observeUserTransfer(rec *connRecord) {
+	rec.mu.Lock()
+	service, user := rec.Service, rec.User
+	rec.mu.Unlock()
+	if user == "" {
+		return
+	}
+
+	labels := metrics.Labels{"service": service, "user": user}
+	if v := xmetrics.GetCounter(metricUserTransferInputBytesCounter, labels); v != nil {
+		v.Add(float64(rec.bytesIn.Load()))
+	}
+	labels = metrics.Labels{"service": service, "user": user}
+	if v := xmetrics.GetCounter(metricUserTransferOutputBytesCounter, labels); v != nil {
+		v.Add(float64(rec.bytesOut.Load()))
+	}
+}
+
+// observeHandshakeError counts the handshake error with a chain node by the reason.
+func observeHandshakeError(kind, typ string, err error) {
+	if v := xmetrics.GetCounter(metricHandshakeErrorsCounter, metrics.Labels{
+		"kind":   kind,
+		"type":   typ,
+		"reason": errorReason(err),
+	}); v != nil {
+		v.Inc()
+	}
+}
+
+// errorReason classifies err into a small set of reasons for the metric labels.
+func errorReason(err error) string {
+	var netErr net.Error
+	var recordErr tls.RecordHeaderError
+	var certErr *tls.CertificateVerificationError
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE), errors.Is(err, net.ErrClosed):
+		return "reset"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case errors.As(err, &recordErr), errors.As(err, &certErr), strings.Contains(err.Error(), "tls:"):
+		return "tls"
+	case strings.Contains(strings.ToLower(err.Error()), "auth"):
+		return "auth"
+	default:
+		return "other"
+	}
+}
@@ -0,0 +1,628 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-gost/core/logger"
+	"github.com/go-gost/x/config"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// MetricsPushConfig is the configuration of pushing the metrics to a remote endpoint,
+// for the hosts which can not be scraped.
+type MetricsPushConfig struct {
+	// Type is the protocol of the endpoint, one of remote-write (Prometheus remote write),
+	// pushgateway (Prometheus Pushgateway) or otlp (OTLP/HTTP metrics).
+	Type string `yaml:",omitempty" json:"type,omitempty"`
+	// URL is the URL of the endpoint, the path of pushgateway is appended to it,
+	// and /v1/metrics is used for otlp if the URL has no path.
+	URL string `yaml:",omitempty" json:"url,omitempty"`
+	// Interval is the period of pushing the metrics, default is 15s.
+	Interval time.Duration `yaml:",omitempty" json:"interval,omitempty"`
+	// Timeout is the timeout of each request, default is 10s.
+	Timeout time.Duration      `yaml:",omitempty" json:"timeout,omitempty"`
+	Auth    *config.AuthConfig `yaml:",omitempty" json:"auth,omitempty"`
+	// Headers are the additional request headers, e.g. Authorization: Bearer <token>.
+	Headers map[string]string `yaml:",omitempty" json:"headers,omitempty"`
+	// Job is the job name of pushgateway, default is gost.
+	Job string `yaml:",omitempty" json:"job,omitempty"`
+	// BatchSize is the max number of the series in a request of remote-write and otlp, default is 500.
+	BatchSize int `yaml:"batchSize,omitempty" json:"batchSize,omitempty"`
+	// BufferSize is the max number of the requests buffered while the endpoint is unavailable,
+	// the oldest requests are dropped when the buffer is full, default is 1000.
+	BufferSize int `yaml:"bufferSize,omitempty" json:"bufferSize,omitempty"`
+}
+
+const (
+	metricsPushRemoteWrite = "remote-write"
+	metricsPushPushgateway = "pushgateway"
+	metricsPushOTLP        = "otlp"
+)
+
+const (
+	defaultMetricsPushInterval   = 15 * time.Second
+	defaultMetricsPushTimeout    = 10 * time.Second
+	defaultMetricsPushBatchSize  = 500
+	defaultMetricsPushBufferSize = 1000
+
+	metricsPushMinBackoff = time.Second
+	metricsPushMaxBackoff = 5 * time.Minute
+)
+
+var (
+	errMetricsPushRejected = errors.New("rejected")
+)
+
+// pushRequest is a request to the push endpoint.
+type pushRequest struct {
+	method string
+	url    string
+	header http.Header
+	body   []byte
+}
+
+// metricsEncoder encodes the gathered metric families into the requests to the push endpoint.
+type metricsEncoder interface {
+	encode(mfs []*dto.MetricFamily, ts time.Time) ([]*pushRequest, error)
+}
+
+// metricsPusher gathers the metrics every interval, and sends them to the endpoint
+// in the order they are gathered. The requests are buffered while the endpoint is unavailable,
+// and retried with the exponential backoff.
+type metricsPusher struct {
+	cfg      *MetricsPushConfig
+	gatherer prometheus.Gatherer
+	encoder  metricsEncoder
+	// latestOnly keeps only the latest request in the buffer, as pushgateway only holds the latest metrics.
+	latestOnly bool
+	client     *http.Client
+	queue      []*pushRequest
+	notify     chan struct{}
+	mu         sync.Mutex
+	logger     logger.Logger
+}
+
+func newMetricsPusher(cfg *MetricsPushConfig, log logger.Logger) (*metricsPusher, error) {
+	c := *cfg
+	if c.Interval <= 0 {
+		c.Interval = defaultMetricsPushInterval
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultMetricsPushTimeout
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = defaultMetricsPushBatchSize
+	}
+	if c.BufferSize <= 0 {
+		c.BufferSize = defaultMetricsPushBufferSize
+	}
+
+	u, err := url.Parse(c.URL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("metrics push: invalid url %q", c.URL)
+	}
+
+	p := &metricsPusher{
+		cfg:      &c,
+		gatherer: prometheus.DefaultGatherer,
+		client: &http.Client{
+			Timeout: c.Timeout,
+		},
+		notify: make(chan struct{}, 1),
+		logger: log,
+	}
+
+	switch c.Type {
+	case metricsPushRemoteWrite:
+		p.encoder = &remoteWriteEncoder{url: u.String(), batchSize: c.BatchSize}
+	case metricsPushPushgateway:
+		job := c.Job
+		if job == "" {
+			job = "gost"
+		}
+		instance, _ := os.Hostname()
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/metrics/job/" + url.PathEscape(job)
+		if instance != "" {
+			u.Path += "/instance/" + url.PathEscape(instance)
+		}
+		p.encoder = &pushgatewayEncoder{url: u.String()}
+		p.latestOnly = true
+	case metricsPushOTLP:
+		if u.Path == "" || u.Path == "/" {
+			u.Path = "/v1/metrics"
+		}
+		p.encoder = newOTLPMetricsEncoder(u.String(), c.BatchSize)
+	default:
+		return nil, fmt.Errorf("metrics push: unknown type %q", c.Type)
+	}
+
+	return p, nil
+}
+
+func (p *metricsPusher) run(ctx context.Context) {
+	go p.send(ctx)
+
+	ticker := time.NewTicker(p.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.gather()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *metricsPusher) gather() {
+	mfs, err := p.gatherer.Gather()
+	if err != nil {
+		p.logger.Warnf("metrics push: gather: %v", err)
+	}
+	if len(mfs) == 0 {
+		return
+	}
+
+	reqs, err := p.encoder.encode(mfs, time.Now())
+	if err != nil {
+		p.logger.Errorf("metrics push: %v", err)
+		return
+	}
+
+	p.mu.Lock()
+	if p.latestOnly {
+		p.queue = p.queue[:0]
+	}
+	p.queue = append(p.queue, reqs...)
+	if n := len(p.queue) - p.cfg.BufferSize; n > 0 {
+		p.logger.Warnf("metrics push: buffer is full, %d requests dropped", n)
+		p.queue = append(p.queue[:0], p.queue[n:]...)
+	}
+	p.mu.Unlock()
+
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
+
+// send sends the buffered requests in order, the failed request is retried with the exponential backoff.
+func (p *metricsPusher) send(ctx context.Context) {
+	backoff := time.Duration(0)
+	for {
+		if backoff > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+		} else {
+			select {
+			case <-p.notify:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		for {
+			p.mu.Lock()
+			if len(p.queue) == 0 {
+				p.mu.Unlock()
+				backoff = 0
+				break
+			}
+			req := p.queue[0]
+			p.mu.Unlock()
+
+			err := p.do(ctx, req)
+			if err != nil && !errors.Is(err, errMetricsPushRejected) {
+				backoff = min(max(backoff*2, metricsPushMinBackoff), metricsPushMaxBackoff)
+				p.logger.Warnf("metrics push: %v, retrying in %v", err, backoff)
+				break
+			}
+			if err != nil {
+				p.logger.Errorf("metrics push: %v", err)
+			}
+
+			backoff = 0
+			p.mu.Lock()
+			if len(p.queue) > 0 && p.queue[0] == req {
+				p.queue = p.queue[1:]
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+// do sends the request, the errors of the requests which are rejected by the endpoint
+// and should not be retried are errMetricsPushRejected.
+func (p *metricsPusher) do(ctx context.Context, r *pushRequest) error {
+	req, err := http.NewRequestWithContext(ctx, r.method, r.url, bytes.NewReader(r.body))
+	if err != nil {
+		return err
+	}
+	for k, v := range r.header {
+		req.Header[k] = v
+	}
+	for k, v := range p.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	if auth := p.cfg.Auth; auth != nil {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("%s %s: %s %s", r.method, r.url, resp.Status, bytes.TrimSpace(msg))
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests &&
+		resp.StatusCode != http.StatusRequestTimeout {
+		return fmt.Errorf("%w: %v", errMetricsPushRejected, err)
+	}
+	return err
+}
+
+// pushgatewayEncoder encodes the metrics in the text format to replace the metrics of the group.
+type pushgatewayEncoder struct {
+	url string
+}
+
+func (e *pushgatewayEncoder) encode(mfs []*dto.MetricFamily, ts time.Time) ([]*pushRequest, error) {
+	var buf bytes.Buffer
+	enc := expfmt.NewEncoder(&buf, expfmt.FmtText)
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			return nil, err
+		}
+	}
+
+	return []*pushRequest{{
+		method: http.MethodPut,
+		url:    e.url,
+		header: http.Header{"Content-Type": []string{string(expfmt.FmtText)}},
+		body:   buf.Bytes(),
+	}}, nil
+}
+
+// remoteWriteEncoder encodes the metrics in the Prometheus remote write 1.0 protocol,
+// a snappy compressed WriteRequest protobuf message.
+type remoteWriteEncoder struct {
+	url       string
+	batchSize int
+}
+
+type promSample struct {
+	labels [][2]string
+	value  float64
+}
+
+func (e *remoteWriteEncoder) encode(mfs []*dto.MetricFamily, ts time.Time) ([]*pushRequest, error) {
+	var samples []promSample
+	for _, mf := range mfs {
+		samples = appendPromSamples(samples, mf)
+	}
+
+	var reqs []*pushRequest
+	for len(samples) > 0 {
+		n := min(len(samples), e.batchSize)
+
+		var b []byte
+		for _, s := range samples[:n] {
+			b = protowire.AppendTag(b, 1, protowire.BytesType)
+			b = protowire.AppendBytes(b, encodeTimeSeries(s, ts.UnixMilli()))
+		}
+		samples = samples[n:]
+
+		reqs = append(reqs, &pushRequest{
+			method: http.MethodPost,
+			url:    e.url,
+			header: http.Header{
+				"Content-Type":                      []string{"application/x-protobuf"},
+				"Content-Encoding":                  []string{"snappy"},
+				"X-Prometheus-Remote-Write-Version": []string{"0.1.0"},
+			},
+			body: snappy.Encode(nil, b),
+		})
+	}
+	return reqs, nil
+}
+
+// encodeTimeSeries encodes the TimeSeries message of a single sample.
+func encodeTimeSeries(s promSample, ts int64) []byte {
+	var b []byte
+	for _, l := range s.labels {
+		var lb []byte
+		lb = protowire.AppendTag(lb, 1, protowire.BytesType)
+		lb = protowire.AppendString(lb, l[0])
+		lb = protowire.AppendTag(lb, 2, protowire.BytesType)
+		lb = protowire.AppendString(lb, l[1])
+
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, lb)
+	}
+
+	var sb []byte
+	sb = protowire.AppendTag(sb, 1, protowire.Fixed64Type)
+	sb = protowire.AppendFixed64(sb, math.Float64bits(s.value))
+	sb = protowire.AppendTag(sb, 2, protowire.VarintType)
+	sb = protowire.AppendVarint(sb, uint64(ts))
+
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendBytes(b, sb)
+	return b
+}
+
+// appendPromSamples flattens the metric family into the samples of the Prometheus data model,
+// the labels of each sample are sorted by name.
+func appendPromSamples(samples []promSample, mf *dto.MetricFamily) []promSample {
+	name := mf.GetName()
+	add := func(m *dto.Metric, name string, value float64, extra ...string) {
+		labels := [][2]string{{"__name__", name}}
+		for _, lp := range m.GetLabel() {
+			labels = append(labels, [2]string{lp.GetName(), lp.GetValue()})
+		}
+		for i := 0; i+1 < len(extra); i += 2 {
+			labels = append(labels, [2]string{extra[i], extra[i+1]})
+		}
+		sort.Slice(labels, func(i, j int) bool { return labels[i][0] < labels[j][0] })
+		samples = append(samples, promSample{labels: labels, value: value})
+	}
+
+	for _, m := range mf.GetMetric() {
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			add(m, name, m.GetCounter().GetValue())
+		case dto.MetricType_GAUGE:
+			add(m, name, m.GetGauge().GetValue())
+		case dto.MetricType_UNTYPED:
+			add(m, name, m.GetUntyped().GetValue())
+		case dto.MetricType_SUMMARY:
+			s := m.GetSummary()
+			for _, q := range s.GetQuantile() {
+				add(m, name, q.GetValue(), "quantile", formatFloat(q.GetQuantile()))
+			}
+			add(m, name+"_sum", s.GetSampleSum())
+			add(m, name+"_count", float64(s.GetSampleCount()))
+		case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+			h := m.GetHistogram()
+			for _, b := range h.GetBucket() {
+				add(m, name+"_bucket", float64(b.GetCumulativeCount()), "le", formatFloat(b.GetUpperBound()))
+			}
+			add(m, name+"_bucket", float64(h.GetSampleCount()), "le", "+Inf")
+			add(m, name+"_sum", h.GetSampleSum())
+			add(m, name+"_count", float64(h.GetSampleCount()))
+		}
+	}
+	return samples
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// otlpMetricsEncoder encodes the metrics in the OTLP/HTTP protobuf ExportMetricsServiceRequest message,
+// the counters are the cumulative monotonic sums since the start of the process.
+type otlpMetricsEncoder struct {
+	url       string
+	batchSize int
+	resource  *resourcepb.Resource
+	startTime time.Time
+}
+
+func newOTLPMetricsEncoder(url string, batchSize int) *otlpMetricsEncoder {
+	host, _ := os.Hostname()
+	return &otlpMetricsEncoder{
+		url:       url,
+		batchSize: batchSize,
+		resource: &resourcepb.Resource{
+			Attributes: []*commonpb.KeyValue{
+				otlpAttr("service.name", "gost"),
+				otlpAttr("service.version", version),
+				otlpAttr("host.name", host),
+			},
+		},
+		startTime: time.Now(),
+	}
+}
+
+func (e *otlpMetricsEncoder) encode(mfs []*dto.MetricFamily, ts time.Time) ([]*pushRequest, error) {
+	now := uint64(ts.UnixNano())
+	start := uint64(e.startTime.UnixNano())
+
+	var reqs []*pushRequest
+	var metrics []*metricspb.Metric
+	points := 0
+	flush := func() error {
+		if len(metrics) == 0 {
+			return nil
+		}
+		body, err := proto.Marshal(&colmetricspb.ExportMetricsServiceRequest{
+			ResourceMetrics: []*metricspb.ResourceMetrics{{
+				Resource: e.resource,
+				ScopeMetrics: []*metricspb.ScopeMetrics{{
+					Scope:   &commonpb.InstrumentationScope{Name: tracerName, Version: version},
+					Metrics: metrics,
+				}},
+			}},
+		})
+		if err != nil {
+			return err
+		}
+		reqs = append(reqs, &pushRequest{
+			method: http.MethodPost,
+			url:    e.url,
+			header: http.Header{"Content-Type": []string{"application/x-protobuf"}},
+			body:   body,
+		})
+		metrics, points = nil, 0
+		return nil
+	}
+
+	for _, mf := range mfs {
+		for _, ms := range chunk(mf.GetMetric(), e.batchSize) {
+			if points+len(ms) > e.batchSize {
+				if err := flush(); err != nil {
+					return nil, err
+				}
+			}
+			if m := otlpMetric(mf, ms, start, now); m != nil {
+				metrics = append(metrics, m)
+				points += len(ms)
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return reqs, nil
+}
+
+func chunk[T any](s []T, size int) (chunks [][]T) {
+	for len(s) > size {
+		chunks = append(chunks, s[:size])
+		s = s[size:]
+	}
+	if len(s) > 0 {
+		chunks = append(chunks, s)
+	}
+	return
+}
+
+func otlpMetric(mf *dto.MetricFamily, ms []*dto.Metric, start, now uint64) *metricspb.Metric {
+	m := &metricspb.Metric{
+		Name:        mf.GetName(),
+		Description: mf.GetHelp(),
+	}
+
+	switch mf.GetType() {
+	case dto.MetricType_COUNTER:
+		sum := &metricspb.Sum{
+			AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+			IsMonotonic:            true,
+		}
+		for _, v := range ms {
+			sum.DataPoints = append(sum.DataPoints, otlpNumber(v, v.GetCounter().GetValue(), start, now))
+		}
+		m.Data = &metricspb.Metric_Sum{Sum: sum}
+	case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+		gauge := &metricspb.Gauge{}
+		for _, v := range ms {
+			value := v.GetGauge().GetValue()
+			if mf.GetType() == dto.MetricType_UNTYPED {
+				value = v.GetUntyped().GetValue()
+			}
+			gauge.DataPoints = append(gauge.DataPoints, otlpNumber(v, value, start, now))
+		}
+		m.Data = &metricspb.Metric_Gauge{Gauge: gauge}
+	case dto.MetricType_SUMMARY:
+		summary := &metricspb.Summary{}
+		for _, v := range ms {
+			s := v.GetSummary()
+			dp := &metricspb.SummaryDataPoint{
+				Attributes:        otlpLabels(v),
+				StartTimeUnixNano: start,
+				TimeUnixNano:      now,
+				Count:             s.GetSampleCount(),
+				Sum:               s.GetSampleSum(),
+			}
+			for _, q := range s.GetQuantile() {
+				dp.QuantileValues = append(dp.QuantileValues, &metricspb.SummaryDataPoint_ValueAtQuantile{
+					Quantile: q.GetQuantile(),
+					Value:    q.GetValue(),
+				})
+			}
+			summary.DataPoints = append(summary.DataPoints, dp)
+		}
+		m.Data = &metricspb.Metric_Summary{Summary: summary}
+	case dto.MetricType_HISTOGRAM:
+		histogram := &metricspb.Histogram{
+			AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+		}
+		for _, v := range ms {
+			h := v.GetHistogram()
+			sum := h.GetSampleSum()
+			dp := &metricspb.HistogramDataPoint{
+				Attributes:        otlpLabels(v),
+				StartTimeUnixNano: start,
+				TimeUnixNano:      now,
+				Count:             h.GetSampleCount(),
+				Sum:               &sum,
+			}
+			// the buckets of prometheus are cumulative, the ones of OTLP are not.
+			var prev uint64
+			for _, b := range h.GetBucket() {
+				if math.IsInf(b.GetUpperBound(), 1) {
+					continue
+				}
+				dp.ExplicitBounds = append(dp.ExplicitBounds, b.GetUpperBound())
+				dp.BucketCounts = append(dp.BucketCounts, b.GetCumulativeCount()-prev)
+				prev = b.GetCumulativeCount()
+			}
+			dp.BucketCounts = append(dp.BucketCounts, h.GetSampleCount()-prev)
+			histogram.DataPoints = append(histogram.DataPoints, dp)
+		}
+		m.Data = &metricspb.Metric_Histogram{Histogram: histogram}
+	default:
+		return nil
+	}
+	return m
+}
+
+func otlpNumber(m *dto.Metric, value float64, start, now uint64) *metricspb.NumberDataPoint {
+	return &metricspb.NumberDataPoint{
+		Attributes:        otlpLabels(m),
+		StartTimeUnixNano: start,
+		TimeUnixNano:      now,
+		Value:             &metricspb.NumberDataPoint_AsDouble{AsDouble: value},
+	}
+}
+
+func otlpLabels(m *dto.Metric) []*commonpb.KeyValue {
+	attrs := make([]*commonpb.KeyValue, 0, len(m.GetLabel()))
+	for _, lp := range m.GetLabel() {
+		attrs = append(attrs, otlpAttr(lp.GetName(), lp.GetValue()))
+	}
+	return attrs
+}
+
+func otlpAttr(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{
+		Key:   key,
+		Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}},
+	}
+}
@@ -1,39 +1,41 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/go-gost/core/logger"
 	mdutil "github.com/go-gost/core/metadata/util"
 	"github.com/go-gost/x/config"
 	"github.com/go-gost/x/config/parsing"
 	logger_parser "github.com/go-gost/x/config/parsing/logger"
+	xlogger "github.com/go-gost/x/logger"
 	xmd "github.com/go-gost/x/metadata"
 	xmetrics "github.com/go-gost/x/metrics"
 	"github.com/go-gost/x/registry"
 	"github.com/judwhite/go-svc"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
 )
 
 type program struct {
+	ext              *ExtConfig
+	shutdownTracing  func(context.Context) error
+	stopMetricsPush  context.CancelFunc
+	stopHealthChecks context.CancelFunc
 }
 
 func (p *program) Init(env svc.Environment) error {
-	cfg := &config.Config{}
-	if cfgFile != "" {
-		cfgFile = strings.TrimSpace(cfgFile)
-		if strings.HasPrefix(cfgFile, "{") && strings.HasSuffix(cfgFile, "}") {
-			if err := json.Unmarshal([]byte(cfgFile), cfg); err != nil {
-				return err
-			}
-		} else {
-			if err := cfg.ReadFile(cfgFile); err != nil {
-				logger.Default().Error(err)
-				return err
-			}
-		}
+	cfg, err := readConfig(cfgFile)
+	if err != nil {
+		logger.Default().Error(err)
+		return err
 	}
 
 	cmdCfg, err := buildConfigFromCmd(services, nodes)
@@ -41,6 +43,9 @@ func (p *program) Init(env svc.Environment) error {
 		return err
 	}
 	cfg = p.mergeConfig(cfg, cmdCfg)
+	if err := validateCmdConfig(cmdCfg, cfg); err != nil {
+		return err
+	}
 
 	if len(cfg.Services) == 0 && apiAddr == "" && cfg.API == nil {
 		if err := cfg.Load(); err != nil {
@@ -48,6 +53,12 @@ func (p *program) Init(env svc.Environment) error {
 		}
 	}
 
+	p.ext, err = readExtConfig(cfgFile)
+	if err != nil {
+		logger.Default().Error(err)
+		return err
+	}
+
 	if v := os.Getenv("GOST_API"); v != "" {
 		cfg.API = &config.APIConfig{
 			Addr: v,
@@ -68,6 +79,17 @@ func (p *program) Init(env svc.Environment) error {
 			Addr: v,
 		}
 	}
+	if v := os.Getenv("GOST_GEOIP"); v != "" {
+		p.ext.GeoIP = &GeoIPConfig{
+			File: v,
+		}
+	}
+	if v := os.Getenv("GOST_GEOIP_ASN"); v != "" {
+		if p.ext.GeoIP == nil {
+			p.ext.GeoIP = &GeoIPConfig{}
+		}
+		p.ext.GeoIP.ASN = v
+	}
 
 	if apiAddr != "" {
 		cfg.API = &config.APIConfig{
@@ -92,6 +114,12 @@ func (p *program) Init(env svc.Environment) error {
 			md := xmd.NewMetadata(m)
 			cfg.API.PathPrefix = mdutil.GetString(md, "pathPrefix")
 			cfg.API.AccessLog = mdutil.GetBool(md, "accesslog")
+			if v := mdutil.GetString(md, "authFile"); v != "" {
+				if cfg.API.Auth != nil {
+					return errors.New("api: auth and authFile can not be used together")
+				}
+				cfg.API.Auther = authFileAuther(cfg, "", v)
+			}
 		}
 	}
 	if debug {
@@ -122,6 +150,16 @@ func (p *program) Init(env svc.Environment) error {
 			}
 			md := xmd.NewMetadata(m)
 			cfg.Metrics.Path = mdutil.GetString(md, "path")
+			p.ext.Metrics = &MetricsExtConfig{
+				UserMetrics:    mdutil.GetBool(md, "userMetrics"),
+				MaxLabelValues: mdutil.GetInt(md, "maxLabelValues"),
+			}
+			if v := mdutil.GetString(md, "authFile"); v != "" {
+				if cfg.Metrics.Auth != nil {
+					return errors.New("metrics: auth and authFile can not be used together")
+				}
+				cfg.Metrics.Auther = authFileAuther(cfg, "", v)
+			}
 		}
 	}
 
@@ -130,9 +168,16 @@ func (p *program) Init(env svc.Environment) error {
 		logCfg = &config.LogConfig{}
 	}
 	logger.SetDefault(logger_parser.ParseLogger(&config.LoggerConfig{Log: logCfg}))
+	if cfg.API != nil {
+		// the latest log entries are also kept for the log API.
+		logger.SetDefault(logger.LoggerGroup(logger.Default(), xlogger.NewLogger(
+			xlogger.OutputOption(logTail),
+			xlogger.LevelOption(logger.LogLevel(logCfg.Level)),
+		)))
+	}
 
 	if outputFormat != "" {
-		if err := cfg.Write(os.Stdout, outputFormat); err != nil {
+		if err := writeConfig(os.Stdout, cfg, p.ext, outputFormat); err != nil {
 			return err
 		}
 		os.Exit(0)
@@ -145,10 +190,152 @@ func (p *program) Init(env svc.Environment) error {
 	return nil
 }
 
+// readConfig reads the configuration from file,
+// or parses it directly if the value is an inline JSON object.
+func readConfig(file string) (*config.Config, error) {
+	cfg := &config.Config{}
+	if file == "" {
+		return cfg, nil
+	}
+
+	file = strings.TrimSpace(file)
+	if strings.HasPrefix(file, "{") && strings.HasSuffix(file, "}") {
+		if err := json.Unmarshal([]byte(file), cfg); err != nil {
+			return nil, err
+		}
+		return cfg, nil
+	}
+
+	if err := cfg.ReadFile(file); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// ExtConfig is the part of the configuration which is not covered by config.Config,
+// it is read from the same configuration file.
+type ExtConfig struct {
+	Tracing   *TracingConfig    `yaml:",omitempty" json:"tracing,omitempty"`
+	GeoIP     *GeoIPConfig      `yaml:"geoip,omitempty" json:"geoip,omitempty"`
+	Schedules []*ScheduleConfig `yaml:",omitempty" json:"schedules,omitempty"`
+	Quota     *QuotaConfig      `yaml:",omitempty" json:"quota,omitempty"`
+	// Metrics is read from the metrics section of config.Config.
+	Metrics *MetricsExtConfig `yaml:"-" json:"-"`
+}
+
+// readExtConfig reads the extended configuration from file or the inline JSON object,
+// the file must have been read by readConfig or config.Config.Load before.
+func readExtConfig(file string) (*ExtConfig, error) {
+	cfg := &ExtConfig{}
+
+	file = strings.TrimSpace(file)
+	if strings.HasPrefix(file, "{") && strings.HasSuffix(file, "}") {
+		var v struct {
+			*ExtConfig
+			Metrics *MetricsExtConfig `json:"metrics"`
+		}
+		v.ExtConfig = cfg
+		if err := json.Unmarshal([]byte(file), &v); err != nil {
+			return nil, err
+		}
+		cfg.Metrics = v.Metrics
+		return cfg, nil
+	}
+
+	if err := viper.Unmarshal(cfg); err != nil {
+		return nil, err
+	}
+	if viper.IsSet("metrics") {
+		if err := viper.UnmarshalKey("metrics", &cfg.Metrics); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// writeConfig writes cfg along with the extended configuration in the format of json or yaml.
+func writeConfig(w io.Writer, cfg *config.Config, ext *ExtConfig, format string) error {
+	if ext == nil {
+		return cfg.Write(w, format)
+	}
+
+	c := struct {
+		*config.Config `yaml:",inline"`
+		*ExtConfig     `yaml:",inline"`
+	}{cfg, ext}
+
+	// the extended metrics are merged into the metrics section.
+	var metrics any
+	if cfg.Metrics != nil && ext.Metrics != nil {
+		metrics = struct {
+			*config.MetricsConfig `yaml:",inline"`
+			*MetricsExtConfig     `yaml:",inline"`
+		}{cfg.Metrics, ext.Metrics}
+	}
+
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if metrics != nil {
+			// the metrics field shadows the one of the embedded config.Config.
+			return enc.Encode(struct {
+				*config.Config
+				*ExtConfig
+				Metrics any `json:"metrics"`
+			}{cfg, ext, metrics})
+		}
+		return enc.Encode(c)
+	default:
+		var node yaml.Node
+		if err := node.Encode(c); err != nil {
+			return err
+		}
+		if metrics != nil {
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == "metrics" {
+					if err := node.Content[i+1].Encode(metrics); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		enc := yaml.NewEncoder(w)
+		defer enc.Close()
+		enc.SetIndent(2)
+		return enc.Encode(&node)
+	}
+}
+
 func (p *program) Start() error {
 	log := logger.Default()
 	cfg := config.Global()
 
+	if p.ext != nil && p.ext.Tracing != nil {
+		shutdown, err := initTracing(p.ext.Tracing)
+		if err != nil {
+			return err
+		}
+		p.shutdownTracing = shutdown
+		log.Info("tracing to ", p.ext.Tracing.Endpoint)
+	}
+	if p.ext != nil && p.ext.GeoIP != nil {
+		if err := setGeoIP(p.ext.GeoIP, log.WithFields(map[string]any{"kind": "geoip"})); err != nil {
+			return err
+		}
+	}
+	if p.ext != nil && len(p.ext.Schedules) > 0 {
+		if err := setSchedules(p.ext.Schedules, cfg, log.WithFields(map[string]any{"kind": "schedule"})); err != nil {
+			return err
+		}
+	}
+	if p.ext != nil && p.ext.Quota != nil {
+		if err := setQuotas(p.ext.Quota, log.WithFields(map[string]any{"kind": "quota"})); err != nil {
+			return err
+		}
+	}
+
 	if cfg.API != nil {
 		s, err := buildAPIService(cfg.API)
 		if err != nil {
@@ -172,7 +359,7 @@ func (p *program) Start() error {
 	}
 
 	if cfg.Metrics != nil {
-		xmetrics.Init(xmetrics.NewMetrics())
+		xmetrics.Init(newMetrics(p.ext.Metrics))
 		if cfg.Metrics.Addr != "" {
 			s, err := buildMetricsService(cfg.Metrics)
 			if err != nil {
@@ -184,6 +371,16 @@ func (p *program) Start() error {
 				log.Fatal(s.Serve())
 			}()
 		}
+		if c := p.ext.Metrics; c != nil && c.Push != nil {
+			pusher, err := newMetricsPusher(c.Push, log.WithFields(map[string]any{"kind": "metrics"}))
+			if err != nil {
+				log.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			p.stopMetricsPush = cancel
+			go pusher.run(ctx)
+			log.Infof("metrics push to %s (%s)", c.Push.URL, c.Push.Type)
+		}
 	}
 
 	for _, svc := range buildService(cfg) {
@@ -193,6 +390,10 @@ func (p *program) Start() error {
 		}()
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	p.stopHealthChecks = cancel
+	healthChecks.start(ctx)
+
 	return nil
 }
 
@@ -201,6 +402,26 @@ func (p *program) Stop() error {
 		srv.Close()
 		logger.Default().Debugf("service %s shutdown", name)
 	}
+
+	if p.stopHealthChecks != nil {
+		p.stopHealthChecks()
+	}
+	if p.stopMetricsPush != nil {
+		p.stopMetricsPush()
+	}
+	if q := quotas.Swap(nil); q != nil {
+		if err := q.Close(); err != nil {
+			logger.Default().Error(err)
+		}
+	}
+
+	if p.shutdownTracing != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := p.shutdownTracing(ctx); err != nil {
+			logger.Default().Error(err)
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,692 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/go-gost/core/logger"
+	"golang.org/x/time/rate"
+)
+
+var (
+	ErrInvalidQuota = errors.New("invalid quota")
+)
+
+// QuotaConfig is the configuration of the quotas of the users and the clients.
+type QuotaConfig struct {
+	// File is the file the usage is saved to, so that the usage survives restarts.
+	// The usage is kept in memory only if it is not set.
+	File string `yaml:",omitempty" json:"file,omitempty"`
+	// Interval is the period to save the usage to the file, default is 1m.
+	Interval time.Duration      `yaml:",omitempty" json:"interval,omitempty"`
+	Rules    []*QuotaRuleConfig `yaml:",omitempty" json:"rules,omitempty"`
+}
+
+// QuotaRuleConfig is a quota of the bytes and the connection time of each user or client in a period.
+type QuotaRuleConfig struct {
+	Name string `json:"name"`
+	// Services are the services the quota applies to, default is all services.
+	Services []string `yaml:",omitempty" json:"services,omitempty"`
+	// Key is what the usage is accounted by, user (default) for the authenticated users, or client for the client IPs.
+	Key string `yaml:",omitempty" json:"key,omitempty"`
+	// Keys are the users, or the client IPs and CIDRs, the quota applies to, default is all of them.
+	Keys []string `yaml:",omitempty" json:"keys,omitempty"`
+	// Bytes is the max number of the input and output bytes in the period, such as 50GB.
+	Bytes string `yaml:",omitempty" json:"bytes,omitempty"`
+	// Time is the max total time of the connections in the period.
+	Time time.Duration `yaml:",omitempty" json:"time,omitempty"`
+	// Reset is the period the usage is reset, monthly (default), weekly, daily or never.
+	Reset string `yaml:",omitempty" json:"reset,omitempty"`
+	// ResetDay is the day of the month the monthly usage is reset, 1 to 28, default is 1.
+	ResetDay int `yaml:"resetDay,omitempty" json:"resetDay,omitempty"`
+	// Timezone is the IANA time zone of the periods, default is the local time zone.
+	Timezone string `yaml:",omitempty" json:"timezone,omitempty"`
+	// Action is applied to the connections once the quota is exhausted, block (default) closes the connections,
+	// throttle limits the connections of the user or client to Rate in total.
+	Action string `yaml:",omitempty" json:"action,omitempty"`
+	// Rate is the bytes per second of the throttled connections, such as 64KB.
+	Rate string `yaml:",omitempty" json:"rate,omitempty"`
+}
+
+const (
+	defaultQuotaInterval = time.Minute
+	// quotaAccountInterval is the period the connections are accounted and the quotas are enforced.
+	quotaAccountInterval = time.Second
+)
+
+const (
+	quotaKeyUser   = "user"
+	quotaKeyClient = "client"
+
+	quotaResetMonthly = "monthly"
+	quotaResetWeekly  = "weekly"
+	quotaResetDaily   = "daily"
+	quotaResetNever   = "never"
+
+	quotaActionBlock    = "block"
+	quotaActionThrottle = "throttle"
+)
+
+// quotas are the quotas set by the configuration, it is nil if there is no quota.
+var quotas atomic.Pointer[quotaManager]
+
+// setQuotas sets the quotas, the usage saved in the file is restored.
+func setQuotas(cfg *QuotaConfig, log logger.Logger) error {
+	if old := quotas.Swap(nil); old != nil {
+		old.Close()
+	}
+	if cfg == nil || len(cfg.Rules) == 0 {
+		return nil
+	}
+
+	m := &quotaManager{
+		file:   cfg.File,
+		usage:  make(map[string]map[string]*quotaUsage),
+		conns:  make(map[*connRecord]map[string]*connQuota),
+		logger: log,
+	}
+	for _, rc := range cfg.Rules {
+		if rc == nil {
+			continue
+		}
+		r, err := parseQuotaRule(rc)
+		if err != nil {
+			return err
+		}
+		m.rules = append(m.rules, r)
+		m.usage[r.name] = make(map[string]*quotaUsage)
+	}
+	if err := m.load(); err != nil {
+		return err
+	}
+
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = defaultQuotaInterval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+	quotas.Store(m)
+	go m.run(ctx, interval)
+
+	return nil
+}
+
+func parseQuotaRule(cfg *QuotaRuleConfig) (*quotaRule, error) {
+	r := &quotaRule{
+		name:     cfg.Name,
+		key:      cfg.Key,
+		time:     cfg.Time,
+		reset:    cfg.Reset,
+		resetDay: cfg.ResetDay,
+		action:   cfg.Action,
+		loc:      time.Local,
+	}
+	invalid := func(format string, a ...any) error {
+		return fmt.Errorf("%w: %s: %s", ErrInvalidQuota, cfg.Name, fmt.Sprintf(format, a...))
+	}
+
+	if cfg.Name == "" {
+		return nil, invalid("name is required")
+	}
+	if len(cfg.Services) > 0 {
+		r.services = make(map[string]bool)
+		for _, s := range cfg.Services {
+			r.services[s] = true
+		}
+	}
+
+	switch r.key {
+	case "":
+		r.key = quotaKeyUser
+	case quotaKeyUser, quotaKeyClient:
+	default:
+		return nil, invalid("invalid key %s", cfg.Key)
+	}
+	for _, k := range cfg.Keys {
+		if r.key == quotaKeyUser {
+			r.users = append(r.users, k)
+			continue
+		}
+		prefix, err := parsePrefix(k)
+		if err != nil {
+			return nil, invalid("%v", err)
+		}
+		r.clients = append(r.clients, prefix)
+	}
+
+	if cfg.Bytes != "" {
+		v, err := units.ParseBase2Bytes(cfg.Bytes)
+		if err != nil || v <= 0 {
+			return nil, invalid("invalid bytes %s", cfg.Bytes)
+		}
+		r.bytes = int64(v)
+	}
+	if r.bytes <= 0 && r.time <= 0 {
+		return nil, invalid("bytes or time is required")
+	}
+
+	switch r.reset {
+	case "":
+		r.reset = quotaResetMonthly
+	case quotaResetMonthly, quotaResetWeekly, quotaResetDaily, quotaResetNever:
+	default:
+		return nil, invalid("invalid reset %s", cfg.Reset)
+	}
+	if r.resetDay == 0 {
+		r.resetDay = 1
+	}
+	if r.resetDay < 1 || r.resetDay > 28 {
+		return nil, invalid("invalid reset day %d", cfg.ResetDay)
+	}
+	if cfg.Timezone != "" {
+		loc, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, invalid("%v", err)
+		}
+		r.loc = loc
+	}
+
+	switch r.action {
+	case "":
+		r.action = quotaActionBlock
+	case quotaActionBlock:
+	case quotaActionThrottle:
+		v, err := units.ParseBase2Bytes(cfg.Rate)
+		if err != nil || v <= 0 {
+			return nil, invalid("invalid rate %s", cfg.Rate)
+		}
+		r.rate = int(v)
+	default:
+		return nil, invalid("invalid action %s", cfg.Action)
+	}
+
+	return r, nil
+}
+
+type quotaRule struct {
+	name     string
+	services map[string]bool
+	key      string
+	users    []string
+	clients  []netip.Prefix
+	bytes    int64
+	time     time.Duration
+	reset    string
+	resetDay int
+	loc      *time.Location
+	action   string
+	rate     int
+}
+
+// keyOf returns the key of the connection the usage is accounted by, it returns false if the quota does not apply.
+func (r *quotaRule) keyOf(service, user, client string) (string, bool) {
+	if r.services != nil && !r.services[service] {
+		return "", false
+	}
+
+	if r.key == quotaKeyUser {
+		if user == "" || (len(r.users) > 0 && !slices.Contains(r.users, user)) {
+			return "", false
+		}
+		return user, true
+	}
+
+	host, _, err := net.SplitHostPort(client)
+	if err != nil {
+		host = client
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return "", false
+	}
+	ip = ip.Unmap()
+	if len(r.clients) > 0 && !prefixesContain(r.clients, ip) {
+		return "", false
+	}
+	return ip.String(), true
+}
+
+// period returns the start of the period of t.
+func (r *quotaRule) period(t time.Time) time.Time {
+	t = t.In(r.loc)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, r.loc)
+	switch r.reset {
+	case quotaResetDaily:
+		return day
+	case quotaResetWeekly:
+		// the weeks start on Monday.
+		return day.AddDate(0, 0, -(int(t.Weekday())+6)%7)
+	case quotaResetNever:
+		return time.Time{}
+	default:
+		p := time.Date(t.Year(), t.Month(), r.resetDay, 0, 0, 0, 0, r.loc)
+		if t.Before(p) {
+			p = p.AddDate(0, -1, 0)
+		}
+		return p
+	}
+}
+
+func (r *quotaRule) exhausted(u *quotaUsage) bool {
+	return r.bytes > 0 && u.Bytes >= r.bytes || r.time > 0 && u.Time >= r.time
+}
+
+// quotaUsage is the usage of a user or client in the current period of a quota.
+type quotaUsage struct {
+	Bytes  int64         `json:"bytes"`
+	Time   time.Duration `json:"time"`
+	Period time.Time     `json:"period"`
+
+	// exhausted is whether the exhausted quota is reported, it is recomputed once the usage is loaded.
+	exhausted bool
+	// limiter is the limiter of the throttled connections of the user or client.
+	limiter *rate.Limiter
+}
+
+// connQuota is the part of the connection accounted in the usage of a quota.
+type connQuota struct {
+	bytes int64
+	time  time.Time
+}
+
+// quotaManager accounts the usage of the connections and enforces the quotas every second.
+type quotaManager struct {
+	rules []*quotaRule
+	file  string
+	// usage is the usage by the quota and the key.
+	usage map[string]map[string]*quotaUsage
+	// conns are the parts of the connections accounted by the quota.
+	conns  map[*connRecord]map[string]*connQuota
+	dirty  bool
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	logger logger.Logger
+}
+
+func (m *quotaManager) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(quotaAccountInterval)
+	defer ticker.Stop()
+
+	saved := time.Now()
+	for {
+		select {
+		case now := <-ticker.C:
+			m.account(now)
+			if now.Sub(saved) >= interval {
+				saved = now
+				if err := m.save(); err != nil {
+					m.logger.Warnf("save: %v", err)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// account adds the bytes and the time of the connections since the last accounting to the usage,
+// the connections of the exhausted quotas are closed or throttled.
+func (m *quotaManager) account(now time.Time) {
+	recs := connections.list(nil)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	active := make(map[*connRecord]bool, len(recs))
+	for _, rec := range recs {
+		active[rec] = true
+		m.enforce(rec, now)
+	}
+	for rec := range m.conns {
+		if !active[rec] {
+			delete(m.conns, rec)
+		}
+	}
+}
+
+// check accounts the connection which reaches the bytes of its quotas, it is closed if a quota is exhausted.
+func (m *quotaManager) check(rec *connRecord) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.enforce(rec, time.Now())
+}
+
+// admit accounts the connection once the user is known, it reports whether the request is allowed by the quotas.
+func (m *quotaManager) admit(rec *connRecord) bool {
+	if m == nil {
+		return true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if quota := m.accountConn(rec, time.Now()); quota != "" {
+		m.logger.Debugf("quota %s is exhausted, the request of connection %s is rejected", quota, rec.SID)
+		return false
+	}
+	return true
+}
+
+// enforce accounts the connection and closes it if a quota is exhausted, m.mu must be held.
+func (m *quotaManager) enforce(rec *connRecord, now time.Time) {
+	if quota := m.accountConn(rec, now); quota != "" {
+		m.logger.Debugf("quota %s is exhausted, connection %s is closed", quota, rec.SID)
+		rec.kill()
+	}
+}
+
+// accountConn adds the usage of the connection since the last accounting, it returns the exhausted quota
+// which blocks the connection. The connection is throttled by the exhausted quota of the throttle action,
+// and is checked again once it reaches the bytes left of its quotas.
+func (m *quotaManager) accountConn(rec *connRecord, now time.Time) (blocked string) {
+	rec.mu.Lock()
+	service, user, client := rec.Service, rec.User, rec.Client
+	rec.mu.Unlock()
+
+	cqs := m.conns[rec]
+	if cqs == nil {
+		cqs = make(map[string]*connQuota)
+		m.conns[rec] = cqs
+	}
+	total := rec.bytesIn.Load() + rec.bytesOut.Load()
+
+	var throttle *rate.Limiter
+	var left int64
+	for _, r := range m.rules {
+		key, ok := r.keyOf(service, user, client)
+		if !ok {
+			continue
+		}
+		// the connection is accounted from its start once the key of the quota is known,
+		// such as the bytes before the user is authenticated.
+		cq := cqs[r.name]
+		if cq == nil {
+			cq = &connQuota{time: rec.Time}
+			cqs[r.name] = cq
+		}
+
+		u := m.get(r, key, now)
+		u.Bytes += total - cq.bytes
+		u.Time += now.Sub(cq.time)
+		cq.bytes, cq.time = total, now
+		m.dirty = true
+		if !r.exhausted(u) {
+			if r.bytes > 0 && (left == 0 || r.bytes-u.Bytes < left) {
+				left = r.bytes - u.Bytes
+			}
+			continue
+		}
+		if !u.exhausted {
+			u.exhausted = true
+			m.logger.Infof("quota %s of %s is exhausted", r.name, key)
+			events.publish(eventQuotaExhausted, map[string]any{
+				"quota": r.name,
+				"key":   key,
+			})
+		}
+		if r.action == quotaActionThrottle {
+			if u.limiter == nil {
+				u.limiter = rate.NewLimiter(rate.Limit(r.rate), r.rate)
+			}
+			if throttle == nil {
+				throttle = u.limiter
+			}
+		} else if blocked == "" {
+			blocked = r.name
+		}
+	}
+	rec.throttle.Store(throttle)
+	if left > 0 {
+		rec.quotaBytes.Store(total + left)
+	} else {
+		rec.quotaBytes.Store(0)
+	}
+	return
+}
+
+// get returns the usage of the key in the current period, the usage of the previous period is reset.
+func (m *quotaManager) get(r *quotaRule, key string, now time.Time) *quotaUsage {
+	period := r.period(now)
+	u := m.usage[r.name][key]
+	if u == nil {
+		u = &quotaUsage{Period: period}
+		m.usage[r.name][key] = u
+	} else if !u.Period.Equal(period) {
+		m.logger.Debugf("quota %s of %s is reset for the period from %s", r.name, key, period.Format(time.RFC3339))
+		*u = quotaUsage{Period: period}
+	}
+	return u
+}
+
+// done accounts the rest of the closed connection.
+func (m *quotaManager) done(rec *connRecord) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.accountConn(rec, time.Now())
+	delete(m.conns, rec)
+}
+
+// blocked returns the quota which blocks the new connection of the client, the user is not known yet,
+// the quotas of the user are checked by admit once the user is authenticated.
+func (m *quotaManager) blocked(service, client string) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for _, r := range m.rules {
+		if r.action != quotaActionBlock {
+			continue
+		}
+		key, ok := r.keyOf(service, "", client)
+		if !ok {
+			continue
+		}
+		if u := m.usage[r.name][key]; u != nil && r.period(now).Equal(u.Period) && r.exhausted(u) {
+			return r.name, true
+		}
+	}
+	return "", false
+}
+
+type quotaStatus struct {
+	Quota     string        `json:"quota"`
+	Key       string        `json:"key"`
+	Bytes     int64         `json:"bytes"`
+	Time      time.Duration `json:"time"`
+	MaxBytes  int64         `json:"maxBytes,omitempty"`
+	MaxTime   time.Duration `json:"maxTime,omitempty"`
+	Period    *time.Time    `json:"period,omitempty"`
+	Exhausted bool          `json:"exhausted"`
+}
+
+// list returns the usage of the quota and the key, or all of them if they are empty.
+func (m *quotaManager) list(quota, key string) []quotaStatus {
+	statuses := []quotaStatus{}
+	if m == nil {
+		return statuses
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for _, r := range m.rules {
+		if quota != "" && r.name != quota {
+			continue
+		}
+		for k := range m.usage[r.name] {
+			if key != "" && k != key {
+				continue
+			}
+			u := m.get(r, k, now)
+			st := quotaStatus{
+				Quota:     r.name,
+				Key:       k,
+				Bytes:     u.Bytes,
+				Time:      u.Time,
+				MaxBytes:  r.bytes,
+				MaxTime:   r.time,
+				Exhausted: r.exhausted(u),
+			}
+			if !u.Period.IsZero() {
+				period := u.Period
+				st.Period = &period
+			}
+			statuses = append(statuses, st)
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Quota != statuses[j].Quota {
+			return statuses[i].Quota < statuses[j].Quota
+		}
+		return statuses[i].Key < statuses[j].Key
+	})
+	return statuses
+}
+
+// reset resets the usage of the key of the quota, or all keys if key is empty. It returns false if the quota does not exist.
+func (m *quotaManager) reset(quota, key string) bool {
+	if m == nil {
+		return false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	usage, ok := m.usage[quota]
+	if !ok {
+		return false
+	}
+	for k := range usage {
+		if key == "" || k == key {
+			delete(usage, k)
+		}
+	}
+	m.dirty = true
+	return true
+}
+
+type quotaFile struct {
+	Quotas map[string]map[string]*quotaUsage `json:"quotas"`
+}
+
+// load restores the usage saved in the file, the usage of the quotas not in the configuration is dropped.
+func (m *quotaManager) load() error {
+	if m.file == "" {
+		return nil
+	}
+
+	b, err := os.ReadFile(m.file)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	var f quotaFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return fmt.Errorf("%s: %w", m.file, err)
+	}
+	n := 0
+	for _, r := range m.rules {
+		for k, u := range f.Quotas[r.name] {
+			if u == nil {
+				continue
+			}
+			// the exhausted quota is not reported again.
+			u.exhausted = r.exhausted(u)
+			m.usage[r.name][k] = u
+			n++
+		}
+	}
+	m.logger.Debugf("load items %d", n)
+	return nil
+}
+
+// save writes the usage to the file if it is changed since the last save.
+func (m *quotaManager) save() error {
+	if m.file == "" {
+		return nil
+	}
+
+	m.mu.Lock()
+	if !m.dirty {
+		m.mu.Unlock()
+		return nil
+	}
+	b, err := json.MarshalIndent(&quotaFile{Quotas: m.usage}, "", "  ")
+	m.dirty = false
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// the file is replaced at once, so that it is never left half-written.
+	tmp, err := os.CreateTemp(filepath.Dir(m.file), filepath.Base(m.file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), m.file)
+}
+
+// Close stops the accounting and saves the usage.
+func (m *quotaManager) Close() error {
+	m.cancel()
+	m.account(time.Now())
+	return m.save()
+}
+
+// quota checks the quotas of the connection once it reaches the bytes left of the quotas,
+// and throttles the connection by the limiter of the exhausted quota until the connection is killed or closed.
+func (r *connRecord) quota(n int) {
+	if v := r.quotaBytes.Load(); v > 0 && r.bytesIn.Load()+r.bytesOut.Load() >= v {
+		quotas.Load().check(r)
+	}
+
+	l := r.throttle.Load()
+	if l == nil {
+		return
+	}
+	for n > 0 {
+		k := min(n, l.Burst())
+		if l.WaitN(r.ctx, k) != nil {
+			return
+		}
+		n -= k
+	}
+}
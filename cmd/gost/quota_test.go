@@ -0,0 +1,173 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	xlogger "github.com/go-gost/x/logger"
+)
+
+func TestQuotaRulePeriod(t *testing.T) {
+	date := func(year int, month time.Month, day, hour, min int) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name     string
+		reset    string
+		resetDay int
+		t        time.Time
+		want     time.Time
+	}{
+		{name: "daily", reset: quotaResetDaily, t: date(2024, 1, 3, 15, 0), want: date(2024, 1, 3, 0, 0)},
+		{name: "weekly", reset: quotaResetWeekly, t: date(2024, 1, 3, 15, 0), want: date(2024, 1, 1, 0, 0)},
+		{name: "weekly on monday", reset: quotaResetWeekly, t: date(2024, 1, 8, 0, 0), want: date(2024, 1, 8, 0, 0)},
+		{name: "weekly on sunday", reset: quotaResetWeekly, t: date(2024, 1, 7, 23, 59), want: date(2024, 1, 1, 0, 0)},
+		{name: "weekly across the year", reset: quotaResetWeekly, t: date(2025, 1, 1, 12, 0), want: date(2024, 12, 30, 0, 0)},
+		{name: "monthly", t: date(2024, 3, 15, 12, 0), want: date(2024, 3, 1, 0, 0)},
+		{name: "monthly on the first day", t: date(2024, 3, 1, 0, 0), want: date(2024, 3, 1, 0, 0)},
+		{name: "monthly before the reset day", reset: quotaResetMonthly, resetDay: 15, t: date(2024, 3, 14, 23, 59), want: date(2024, 2, 15, 0, 0)},
+		{name: "monthly on the reset day", reset: quotaResetMonthly, resetDay: 15, t: date(2024, 3, 15, 0, 0), want: date(2024, 3, 15, 0, 0)},
+		{name: "monthly across the year", reset: quotaResetMonthly, resetDay: 28, t: date(2024, 1, 10, 0, 0), want: date(2023, 12, 28, 0, 0)},
+		{name: "never", reset: quotaResetNever, t: date(2024, 3, 15, 12, 0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := parseQuotaRule(&QuotaRuleConfig{
+				Name:     "period",
+				Bytes:    "1GB",
+				Reset:    tt.reset,
+				ResetDay: tt.resetDay,
+				Timezone: "UTC",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := r.period(tt.t); !got.Equal(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuotaAccountConn(t *testing.T) {
+	tests := []struct {
+		name string
+		rule QuotaRuleConfig
+		// preAuth is the bytes of the connection before the user is authenticated, bytes is the bytes after.
+		preAuth, bytes int64
+		// key is the key the usage is accounted by, the usage is not accounted if it is empty.
+		key        string
+		usage      int64
+		blocked    bool
+		throttled  bool
+		quotaBytes int64
+	}{
+		{
+			name:       "pre-auth bytes are carried over",
+			rule:       QuotaRuleConfig{Bytes: "1KB"},
+			preAuth:    100,
+			bytes:      50,
+			key:        "alice",
+			usage:      150,
+			quotaBytes: 1024,
+		},
+		{
+			name:       "client",
+			rule:       QuotaRuleConfig{Key: quotaKeyClient, Bytes: "1KB"},
+			preAuth:    100,
+			bytes:      50,
+			key:        "10.0.0.1",
+			usage:      150,
+			quotaBytes: 1024,
+		},
+		{
+			name:    "other user",
+			rule:    QuotaRuleConfig{Keys: []string{"bob"}, Bytes: "1KB"},
+			preAuth: 100,
+			bytes:   50,
+		},
+		{
+			name:    "other service",
+			rule:    QuotaRuleConfig{Services: []string{"other"}, Bytes: "1KB"},
+			preAuth: 100,
+			bytes:   50,
+		},
+		{
+			name:    "exhausted by the pre-auth bytes",
+			rule:    QuotaRuleConfig{Bytes: "100B"},
+			preAuth: 100,
+			key:     "alice",
+			usage:   100,
+			blocked: true,
+		},
+		{
+			name:    "exhausted by time",
+			rule:    QuotaRuleConfig{Time: time.Second},
+			bytes:   50,
+			key:     "alice",
+			usage:   50,
+			blocked: true,
+		},
+		{
+			name:      "throttled",
+			rule:      QuotaRuleConfig{Bytes: "100B", Action: quotaActionThrottle, Rate: "1KB"},
+			preAuth:   100,
+			bytes:     50,
+			key:       "alice",
+			usage:     150,
+			throttled: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.rule.Name = "account"
+			r, err := parseQuotaRule(&tt.rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := &quotaManager{
+				rules:  []*quotaRule{r},
+				usage:  map[string]map[string]*quotaUsage{r.name: {}},
+				conns:  make(map[*connRecord]map[string]*connQuota),
+				logger: xlogger.Nop(),
+			}
+
+			start := time.Now()
+			rec := &connRecord{Time: start, Service: "quota-service", Client: "10.0.0.1:10000"}
+			rec.bytesIn.Store(tt.preAuth)
+			m.accountConn(rec, start.Add(time.Second))
+
+			rec.User = "alice"
+			rec.bytesOut.Store(tt.bytes)
+			blocked := m.accountConn(rec, start.Add(2*time.Second))
+			// the connection is accounted once.
+			m.accountConn(rec, start.Add(2*time.Second))
+
+			u := m.usage[r.name][tt.key]
+			if tt.key == "" {
+				if len(m.usage[r.name]) > 0 {
+					t.Fatalf("got usage %v", m.usage[r.name])
+				}
+				return
+			}
+			if u == nil {
+				t.Fatalf("no usage of %s", tt.key)
+			}
+			if u.Bytes != tt.usage || u.Time != 2*time.Second {
+				t.Errorf("got usage %d bytes %s, want %d bytes 2s", u.Bytes, u.Time, tt.usage)
+			}
+			if (blocked != "") != tt.blocked {
+				t.Errorf("got blocked %q", blocked)
+			}
+			if (rec.throttle.Load() != nil) != tt.throttled {
+				t.Errorf("got throttled %t", rec.throttle.Load() != nil)
+			}
+			if v := rec.quotaBytes.Load(); v != tt.quotaBytes {
+				t.Errorf("got quota bytes %d, want %d", v, tt.quotaBytes)
+			}
+		})
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-gost/core/chain"
+	"github.com/go-gost/core/logger"
+	mdutil "github.com/go-gost/core/metadata/util"
+	"github.com/go-gost/core/selector"
+)
+
+// The node metadata keys of the racing dials of a chain hop.
+const (
+	// mdKeyRace enables the racing dials of the hop, the next node of the hop is dialed
+	// if the selected node does not complete the dial and the handshake in the delay,
+	// the addresses of the node hostname are also raced in the way of happy eyeballs (RFC 8305).
+	mdKeyRace = "race"
+	// mdKeyRaceDelay is the delay before the next node or address is dialed.
+	mdKeyRaceDelay = "race.delay"
+)
+
+// defaultRaceDelay is the connection attempt delay recommended by RFC 8305.
+const defaultRaceDelay = 250 * time.Millisecond
+
+// raceKeys are the node metadata keys of the racing dials.
+var raceKeys = []string{mdKeyRace, mdKeyRaceDelay}
+
+// nodeRace returns the delay of the racing dials of the node, it returns false if the racing is not enabled.
+func nodeRace(node *chain.Node) (time.Duration, bool) {
+	if node == nil {
+		return 0, false
+	}
+	md := node.Metadata()
+	if !mdutil.GetBool(md, mdKeyRace) {
+		return 0, false
+	}
+	delay := mdutil.GetDuration(md, mdKeyRaceDelay)
+	if delay <= 0 {
+		delay = defaultRaceDelay
+	}
+	return delay, true
+}
+
+// raceNode returns the node raced with the selected node of the hop, which is the next node of the hop
+// not marked failed, ejected or bypassed, with the same host, protocol and path as the selected node.
+// The backup nodes are not raced.
+func raceNode(ctx context.Context, h *chainHop, selected *chain.Node, network, address string) *chain.Node {
+	nodes := hopNodes(h.Hop)
+	i := slices.IndexFunc(nodes, func(node *chain.Node) bool {
+		return node == selected || node.Marker() == selected.Marker()
+	})
+	if i < 0 {
+		return nil
+	}
+
+	so := selected.Options()
+	for n := 1; n < len(nodes); n++ {
+		node := nodes[(i+n)%len(nodes)]
+		opts := node.Options()
+		if opts.Host != so.Host || opts.Protocol != so.Protocol || opts.Path != so.Path {
+			continue
+		}
+		if node.Marker() != nil && node.Marker().Count() > 0 {
+			continue
+		}
+		if mdutil.GetBool(node.Metadata(), "backup") {
+			continue
+		}
+		if b := breakerOf(node); b != nil && b.status().State != circuitClosed {
+			continue
+		}
+		if opts.Bypass != nil && opts.Bypass.Contains(ctx, network, address) {
+			continue
+		}
+		return node
+	}
+	return nil
+}
+
+// racingRoute is the route through the selected node of a racing hop, the alternative route through
+// the next node of the hop is dialed if the route does not complete the dial in the delay.
+// The bind is not raced.
+type racingRoute struct {
+	chain.Route
+	chain string
+	// alt is the route through the node raced with the selected node, it is nil if there is no such node.
+	alt     chain.Route
+	altNode *chain.Node
+	delay   time.Duration
+	// marker is the marker of the chain, which is marked by the failed routes of go-gost/x.
+	marker selector.Marker
+	// won is the route of the dial, the alternative route if it won the race.
+	won chain.Route
+}
+
+func (r *racingRoute) Dial(ctx context.Context, network, address string, opts ...chain.DialOption) (net.Conn, error) {
+	var options chain.DialOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	log := options.Logger
+	if log == nil {
+		log = logger.Default()
+	}
+
+	routes := []chain.Route{r.Route}
+	if r.alt != nil {
+		routes = append(routes, r.alt)
+	}
+	durations := make([]time.Duration, len(routes))
+
+	i, conn, err := race(len(routes), r.delay, func(i int) (net.Conn, error) {
+		start := time.Now()
+		conn, err := routes[i].Dial(contextWithHappyEyeballs(ctx, routes[i], log), network, address, opts...)
+		durations[i] = time.Since(start)
+		return conn, err
+	}, func(i int, err error) {
+		// the route of the dial is recorded by the routeWrapper.
+		recordRoute(r.chain, routes[i].Nodes(), err, durations[i])
+		if err != nil && r.marker != nil {
+			r.marker.Reset()
+		}
+	})
+	r.won = routes[i]
+	if err == nil && i > 0 {
+		log.Debugf("dial %s: node %s won the race against node %s", address, r.altNode.Name, nodeNames(r.Route.Nodes()))
+		if rec := connRecordFromContext(ctx); rec != nil {
+			rec.useNode(r.altNode)
+		}
+	}
+	return conn, err
+}
+
+func (r *racingRoute) Nodes() []*chain.Node {
+	if r.won != nil {
+		return r.won.Nodes()
+	}
+	return r.Route.Nodes()
+}
+
+func nodeNames(nodes []*chain.Node) string {
+	names := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		names = append(names, node.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+// race starts the n attempts one after another with the delay in between, the next attempt is started
+// at once if all the started attempts failed. The first successful attempt wins the race,
+// the first attempt is returned if all of them fail.
+// If the race is won, the other started attempts are passed to lose once they complete, with the connections closed.
+func race(n int, delay time.Duration, attempt func(i int) (net.Conn, error), lose func(i int, err error)) (int, net.Conn, error) {
+	if n == 1 {
+		conn, err := attempt(0)
+		return 0, conn, err
+	}
+
+	type result struct {
+		i    int
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, n)
+	start := func(i int) {
+		go func() {
+			conn, err := attempt(i)
+			results <- result{i: i, conn: conn, err: err}
+		}()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var failed []result
+	started := 1
+	start(0)
+	for {
+		select {
+		case <-timer.C:
+			if started < n {
+				start(started)
+				started++
+				timer.Reset(delay)
+			}
+		case res := <-results:
+			if res.err != nil {
+				failed = append(failed, res)
+				if len(failed) < started {
+					continue
+				}
+				if started == n {
+					first := slices.IndexFunc(failed, func(f result) bool { return f.i == 0 })
+					return 0, nil, failed[first].err
+				}
+				start(started)
+				started++
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(delay)
+				continue
+			}
+
+			pending := started - len(failed) - 1
+			go func() {
+				for _, f := range failed {
+					if lose != nil {
+						lose(f.i, f.err)
+					}
+				}
+				for ; pending > 0; pending-- {
+					r := <-results
+					if r.conn != nil {
+						r.conn.Close()
+					}
+					if lose != nil {
+						lose(r.i, r.err)
+					}
+				}
+			}()
+			return res.i, res.conn, nil
+		}
+	}
+}
+
+// happyEyeballs are the addresses of the hostname of a racing node, which are raced by the dialer of the node.
+type happyEyeballs struct {
+	// addr is the address of the node.
+	addr   string
+	addrs  []string
+	delay  time.Duration
+	logger logger.Logger
+}
+
+type happyEyeballsKey struct{}
+
+// contextWithHappyEyeballs resolves the hostname of the first node of the route to race its addresses,
+// if the racing is enabled on the node. The other nodes are dialed by the previous nodes.
+func contextWithHappyEyeballs(ctx context.Context, route chain.Route, log logger.Logger) context.Context {
+	nodes := route.Nodes()
+	if len(nodes) == 0 {
+		return ctx
+	}
+	node := nodes[0]
+	delay, ok := nodeRace(node)
+	if !ok {
+		return ctx
+	}
+	addrs := resolveNodeAddrs(ctx, node, log)
+	if len(addrs) < 2 {
+		return ctx
+	}
+	return context.WithValue(ctx, happyEyeballsKey{}, &happyEyeballs{
+		addr:   node.Addr,
+		addrs:  addrs,
+		delay:  delay,
+		logger: log,
+	})
+}
+
+func happyEyeballsFromContext(ctx context.Context) *happyEyeballs {
+	v, _ := ctx.Value(happyEyeballsKey{}).(*happyEyeballs)
+	return v
+}
+
+// resolveNodeAddrs resolves the hostname of the node by the hosts and the resolver of the node as the route does,
+// or by the system resolver, the addresses are sorted in the order of RFC 8305.
+func resolveNodeAddrs(ctx context.Context, node *chain.Node, log logger.Logger) []string {
+	host, port, err := net.SplitHostPort(node.Addr)
+	if err != nil || host == "" || net.ParseIP(host) != nil {
+		return nil
+	}
+
+	var ips []net.IP
+	if hm := node.Options().HostMapper; hm != nil {
+		ips, _ = hm.Lookup(ctx, "ip", host)
+	}
+	if len(ips) == 0 {
+		if r := node.Options().Resolver; r != nil {
+			ips, _ = r.Resolve(ctx, "ip", host)
+		} else {
+			addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+			if err != nil {
+				log.Debugf("resolve %s: %v", host, err)
+			}
+			for _, addr := range addrs {
+				ips = append(ips, addr.IP)
+			}
+		}
+	}
+
+	// the IPv6 and IPv4 addresses are interleaved, starting with IPv6.
+	var v4, v6 []string
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, net.JoinHostPort(ip.String(), port))
+		} else {
+			v6 = append(v6, net.JoinHostPort(ip.String(), port))
+		}
+	}
+	addrs := make([]string, 0, len(ips))
+	for len(v4) > 0 || len(v6) > 0 {
+		if len(v6) > 0 {
+			addrs, v6 = append(addrs, v6[0]), v6[1:]
+		}
+		if len(v4) > 0 {
+			addrs, v4 = append(addrs, v4[0]), v4[1:]
+		}
+	}
+	return addrs
+}
+
+// match reports whether the dialer dials the node, by the hostname or one of its addresses.
+func (h *happyEyeballs) match(addr string) bool {
+	return addr == h.addr || slices.Contains(h.addrs, addr)
+}
+
+// dial races the addresses, the losers are cancelled.
+func (h *happyEyeballs) dial(ctx context.Context, network string, dial func(ctx context.Context, network, addr string) (net.Conn, error)) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	i, conn, err := race(len(h.addrs), h.delay, func(i int) (net.Conn, error) {
+		return dial(ctx, network, h.addrs[i])
+	}, nil)
+	if err == nil && i > 0 {
+		h.logger.Debugf("dial %s: %s won the race", h.addr, h.addrs[i])
+	}
+	return conn, err
+}
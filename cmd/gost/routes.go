@@ -0,0 +1,574 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-gost/core/chain"
+	"github.com/go-gost/core/logger"
+	ctxvalue "github.com/go-gost/x/ctx"
+	"github.com/go-gost/x/registry"
+	"gopkg.in/yaml.v3"
+)
+
+// The handler metadata keys of the routing table of a service.
+const (
+	// mdKeyRoutes is the file of the routing rules of the service, in yaml or json.
+	mdKeyRoutes = "routes"
+	// mdKeyRoutesReload is the period to check the file of the routing rules for changes.
+	mdKeyRoutesReload = "routes.reload"
+)
+
+const defaultRoutesReload = 5 * time.Second
+
+// The actions of the routing rules.
+const (
+	// routeActionChain routes the connection through the chain of the rule.
+	routeActionChain = "chain"
+	// routeActionDirect connects to the destination directly.
+	routeActionDirect = "direct"
+	// routeActionReject rejects the connection.
+	routeActionReject = "reject"
+	// routeActionDefault is the action without a matched rule, the connection is routed through the chain of the service.
+	routeActionDefault = "default"
+)
+
+var (
+	ErrRouteRejected = errors.New("rejected by the routing rule")
+	ErrInvalidRoute  = errors.New("invalid routing rule")
+)
+
+// routeTables are the routing tables by the service name.
+var routeTables sync.Map
+
+// RouteRuleConfig is a rule of the routing table, the connections matching all the conditions of the rule
+// are routed by the action of the rule, a condition matches if any of its values matches.
+// The rule without conditions matches all the connections.
+type RouteRuleConfig struct {
+	Name string `yaml:",omitempty" json:"name,omitempty"`
+	// Domains are the destination domains, an exact domain, a suffix such as .example.com
+	// which also matches example.com, a wildcard such as *.example.com, or a regexp with the prefix regexp:.
+	Domains []string `yaml:",omitempty" json:"domains,omitempty"`
+	// CIDRs are the destination IPs or CIDRs, the destination domain is resolved to match them.
+	CIDRs []string `yaml:"cidrs,omitempty" json:"cidrs,omitempty"`
+	// Ports are the destination ports or port ranges such as 8000-9000.
+	Ports []string `yaml:",omitempty" json:"ports,omitempty"`
+	// GeoIP are the ISO 3166-1 codes of the countries of the destination IP, looked up in the GeoIP database.
+	GeoIP []string `yaml:"geoip,omitempty" json:"geoip,omitempty"`
+	// Users are the authenticated users.
+	Users []string `yaml:",omitempty" json:"users,omitempty"`
+	// Clients are the client IPs or CIDRs.
+	Clients []string `yaml:",omitempty" json:"clients,omitempty"`
+	// Action is chain, direct or reject, it is chain if Chain is set.
+	Action string `yaml:",omitempty" json:"action,omitempty"`
+	Chain  string `yaml:",omitempty" json:"chain,omitempty"`
+}
+
+// RoutesConfig is the file of the routing rules.
+type RoutesConfig struct {
+	Rules []*RouteRuleConfig `yaml:",omitempty" json:"rules,omitempty"`
+}
+
+type routeRule struct {
+	index   int
+	name    string
+	domains []func(host string) bool
+	cidrs   []netip.Prefix
+	ports   [][2]int
+	geoip   []string
+	users   []string
+	clients []netip.Prefix
+	action  string
+	chain   string
+}
+
+// parseRouteRule parses the rule at the index of the routing table.
+func parseRouteRule(index int, cfg *RouteRuleConfig) (*routeRule, error) {
+	r := &routeRule{
+		index:  index,
+		name:   cfg.Name,
+		action: strings.ToLower(cfg.Action),
+		chain:  cfg.Chain,
+	}
+	if r.name == "" {
+		r.name = fmt.Sprintf("rule-%d", index)
+	}
+	if r.action == "" && r.chain != "" {
+		r.action = routeActionChain
+	}
+	switch r.action {
+	case routeActionChain:
+		if r.chain == "" {
+			return nil, fmt.Errorf("%w: %s: no chain", ErrInvalidRoute, r.name)
+		}
+	case routeActionDirect, routeActionReject:
+	default:
+		return nil, fmt.Errorf("%w: %s: unknown action %q", ErrInvalidRoute, r.name, cfg.Action)
+	}
+
+	for _, s := range cfg.Domains {
+		m, err := parseDomainMatcher(s)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidRoute, r.name, err)
+		}
+		r.domains = append(r.domains, m)
+	}
+	for _, s := range cfg.CIDRs {
+		p, err := parsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidRoute, r.name, err)
+		}
+		r.cidrs = append(r.cidrs, p)
+	}
+	for _, s := range cfg.Ports {
+		pr, err := parsePortRange(s)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidRoute, r.name, err)
+		}
+		r.ports = append(r.ports, pr)
+	}
+	for _, s := range cfg.GeoIP {
+		r.geoip = append(r.geoip, strings.ToUpper(strings.TrimSpace(s)))
+	}
+	r.users = cfg.Users
+	for _, s := range cfg.Clients {
+		p, err := parsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidRoute, r.name, err)
+		}
+		r.clients = append(r.clients, p)
+	}
+	return r, nil
+}
+
+// parseDomainMatcher parses the domain pattern of a rule.
+func parseDomainMatcher(s string) (func(host string) bool, error) {
+	s = strings.TrimSpace(s)
+	if expr, ok := strings.CutPrefix(s, "regexp:"); ok {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	}
+
+	s = strings.ToLower(strings.TrimSuffix(s, "."))
+	if s == "" {
+		return nil, errors.New("empty domain")
+	}
+	if strings.ContainsAny(s, "*?[") {
+		if _, err := path.Match(s, ""); err != nil {
+			return nil, fmt.Errorf("domain %s: %v", s, err)
+		}
+		return func(host string) bool {
+			ok, _ := path.Match(s, host)
+			return ok
+		}, nil
+	}
+	if s[0] == '.' {
+		return func(host string) bool {
+			return host == s[1:] || strings.HasSuffix(host, s)
+		}, nil
+	}
+	return func(host string) bool {
+		return host == s
+	}, nil
+}
+
+// parsePrefix parses an IP or a CIDR.
+func parsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		return p.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+}
+
+// parsePortRange parses a port or a port range in the form of min-max.
+func parsePortRange(s string) (pr [2]int, err error) {
+	lo, hi, ok := strings.Cut(strings.TrimSpace(s), "-")
+	if pr[0], err = strconv.Atoi(lo); err != nil {
+		return pr, fmt.Errorf("port %s: %v", s, err)
+	}
+	pr[1] = pr[0]
+	if ok {
+		if pr[1], err = strconv.Atoi(hi); err != nil {
+			return pr, fmt.Errorf("port %s: %v", s, err)
+		}
+	}
+	if pr[0] < 0 || pr[1] > 65535 || pr[0] > pr[1] {
+		return pr, fmt.Errorf("port %s: out of range", s)
+	}
+	return pr, nil
+}
+
+// routeRequest is the connection matched against the rules.
+type routeRequest struct {
+	Network string `json:"network"`
+	// Host is the destination domain, it is empty if the destination is an IP.
+	Host string `json:"host,omitempty"`
+	Port int    `json:"port"`
+	// IP is the destination IP, the domain is resolved once a rule with the IP conditions is matched against.
+	IP      string `json:"ip,omitempty"`
+	Country string `json:"country,omitempty"`
+	User    string `json:"user,omitempty"`
+	Client  string `json:"client,omitempty"`
+
+	ip       netip.Addr
+	client   netip.Addr
+	resolved bool
+}
+
+// newRouteRequest creates the request to the address, host is the address requested by the client
+// if address is the IP resolved by the resolver of the service.
+func newRouteRequest(network, address, host, user, client string) *routeRequest {
+	req := &routeRequest{
+		Network: network,
+		User:    user,
+	}
+	if host == "" {
+		host = address
+	}
+	h, port, err := net.SplitHostPort(host)
+	if err != nil {
+		h = host
+	}
+	req.Port, _ = strconv.Atoi(port)
+	if ip, err := netip.ParseAddr(h); err == nil {
+		req.ip, req.resolved = ip.Unmap(), true
+	} else {
+		req.Host = strings.ToLower(strings.TrimSuffix(h, "."))
+		if h, _, err := net.SplitHostPort(address); err == nil {
+			if ip, err := netip.ParseAddr(h); err == nil {
+				req.ip, req.resolved = ip.Unmap(), true
+			}
+		}
+	}
+
+	if h, _, err := net.SplitHostPort(client); err == nil {
+		client = h
+	}
+	if ip, err := netip.ParseAddr(client); err == nil {
+		req.client = ip.Unmap()
+		req.Client = req.client.String()
+	}
+	return req
+}
+
+// resolve resolves the destination domain by resolveHost.
+func (req *routeRequest) resolve(ctx context.Context) netip.Addr {
+	if !req.resolved {
+		req.resolved = true
+		req.ip = resolveHost(ctx, req.Host)
+	}
+	if req.ip.IsValid() {
+		req.IP = req.ip.String()
+	}
+	return req.ip
+}
+
+func (r *routeRule) match(ctx context.Context, req *routeRequest) bool {
+	if len(r.users) > 0 && !slices.Contains(r.users, req.User) {
+		return false
+	}
+	if len(r.clients) > 0 && !prefixesContain(r.clients, req.client) {
+		return false
+	}
+	if len(r.ports) > 0 {
+		ok := false
+		for _, pr := range r.ports {
+			if req.Port >= pr[0] && req.Port <= pr[1] {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(r.domains) > 0 {
+		if req.Host == "" {
+			return false
+		}
+		ok := false
+		for _, m := range r.domains {
+			if m(req.Host) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(r.cidrs) > 0 && !prefixesContain(r.cidrs, req.resolve(ctx)) {
+		return false
+	}
+	if len(r.geoip) > 0 {
+		ip := req.resolve(ctx)
+		if !ip.IsValid() {
+			return false
+		}
+		if req.Country == "" {
+			req.Country = geoip.Load().country(ip)
+		}
+		if !slices.Contains(r.geoip, req.Country) {
+			return false
+		}
+	}
+	return true
+}
+
+func prefixesContain(prefixes []netip.Prefix, ip netip.Addr) bool {
+	if !ip.IsValid() {
+		return false
+	}
+	for _, p := range prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// routeTable is the routing table of a service loaded from a file,
+// the file is checked for changes every period and re-read when it is modified.
+// The rules loaded before are kept if the file fails to load.
+type routeTable struct {
+	service string
+	path    string
+	rules   []*routeRule
+	modTime time.Time
+	size    int64
+	mu      sync.RWMutex
+	cancel  context.CancelFunc
+	logger  logger.Logger
+}
+
+func newRouteTable(service, path string, period time.Duration, log logger.Logger) (*routeTable, error) {
+	if period <= 0 {
+		period = defaultRoutesReload
+	}
+	if period < time.Second {
+		period = time.Second
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &routeTable{
+		service: service,
+		path:    path,
+		cancel:  cancel,
+		logger:  log,
+	}
+	if err := t.reload(); err != nil {
+		cancel()
+		return nil, err
+	}
+	go t.watch(ctx, period)
+
+	return t, nil
+}
+
+func (t *routeTable) Close() error {
+	t.cancel()
+	return nil
+}
+
+func (t *routeTable) watch(ctx context.Context, period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.reload(); err != nil {
+				t.logger.Warnf("routes reload: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reload re-reads the file if it has been modified since the last read.
+func (t *routeTable) reload() error {
+	fi, err := os.Stat(t.path)
+	if err != nil {
+		return err
+	}
+
+	t.mu.RLock()
+	modified := t.rules == nil || !fi.ModTime().Equal(t.modTime) || fi.Size() != t.size
+	t.mu.RUnlock()
+	if !modified {
+		return nil
+	}
+
+	b, err := os.ReadFile(t.path)
+	if err != nil {
+		return err
+	}
+	if t.rules != nil {
+		// the invalid file is reported once until it is modified again.
+		t.mu.Lock()
+		t.modTime, t.size = fi.ModTime(), fi.Size()
+		t.mu.Unlock()
+	}
+
+	var cfg RoutesConfig
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return fmt.Errorf("%s: %w", t.path, err)
+	}
+
+	rules := []*routeRule{}
+	for i, rc := range cfg.Rules {
+		if rc == nil {
+			continue
+		}
+		r, err := parseRouteRule(i, rc)
+		if err != nil {
+			return fmt.Errorf("%s: %w", t.path, err)
+		}
+		if r.action == routeActionChain && !registry.ChainRegistry().IsRegistered(r.chain) {
+			t.logger.Warnf("routes: %s: chain %s not found, the connections of the rule are rejected", r.name, r.chain)
+		}
+		if len(r.geoip) > 0 && geoip.Load() == nil {
+			t.logger.Warnf("routes: %s: no GeoIP database, the rule never matches", r.name)
+		}
+		rules = append(rules, r)
+	}
+
+	t.logger.Debugf("load routes %d", len(rules))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.rules = rules
+	t.modTime = fi.ModTime()
+	t.size = fi.Size()
+
+	return nil
+}
+
+// match returns the first rule matching the request, or nil if no rule matches.
+func (t *routeTable) match(ctx context.Context, req *routeRequest) *routeRule {
+	t.mu.RLock()
+	rules := t.rules
+	t.mu.RUnlock()
+
+	for _, r := range rules {
+		if r.match(ctx, req) {
+			return r
+		}
+	}
+	return nil
+}
+
+// routingChain is the chain of a service with the routing table, the connections are routed
+// by the action of the matched rule, or through the chain of the service if no rule matches.
+type routingChain struct {
+	// chain is the chain of the service, it is nil if the service connects directly.
+	chain chain.Chainer
+	table *routeTable
+}
+
+func (c *routingChain) Route(ctx context.Context, network, address string, opts ...chain.RouteOption) chain.Route {
+	var options chain.RouteOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	var user, client string
+	if rec := connRecordFromContext(ctx); rec != nil {
+		user, client = rec.User, rec.Client
+	}
+	if v := ctxvalue.ClientIDFromContext(ctx); v != "" {
+		user = string(v)
+	}
+	if v := ctxvalue.ClientAddrFromContext(ctx); v != "" {
+		client = string(v)
+	}
+
+	req := newRouteRequest(network, address, options.Host, user, client)
+	rule := c.table.match(ctx, req)
+	if rule == nil {
+		if c.chain == nil {
+			return nil
+		}
+		return c.chain.Route(ctx, network, address, opts...)
+	}
+
+	if rule.action == routeActionChain {
+		c.table.logger.Debugf("route %s/%s by rule %s: chain %s", address, network, rule.name, rule.chain)
+	} else {
+		c.table.logger.Debugf("route %s/%s by rule %s: %s", address, network, rule.name, rule.action)
+	}
+	switch rule.action {
+	case routeActionDirect:
+		return nil
+	case routeActionReject:
+		return &routeWrapper{
+			Route: &unavailableRoute{err: fmt.Errorf("route %s: %w", rule.name, ErrRouteRejected)},
+		}
+	default:
+		// the Get of the registry returns a wrapper of the chain even if it is not registered,
+		// whose route is nil and would send the connection direct.
+		if !registry.ChainRegistry().IsRegistered(rule.chain) {
+			return &routeWrapper{
+				Route: &unavailableRoute{err: fmt.Errorf("route %s: chain %s not found", rule.name, rule.chain)},
+				chain: rule.chain,
+			}
+		}
+		return registry.ChainRegistry().Get(rule.chain).Route(ctx, network, address, opts...)
+	}
+}
+
+// routeExplain is the response of the route API, the rule matching the test request.
+type routeExplain struct {
+	Service string        `json:"service"`
+	Request *routeRequest `json:"request"`
+	// Rule and Index are the name and index of the matched rule, Index is -1 if no rule matches.
+	Rule   string `json:"rule,omitempty"`
+	Index  int    `json:"index"`
+	Action string `json:"action"`
+	Chain  string `json:"chain,omitempty"`
+}
+
+// explainRoute matches the test request against the routing table of the service.
+func explainRoute(ctx context.Context, service string, req *routeRequest) (*routeExplain, bool) {
+	v, ok := routeTables.Load(service)
+	if !ok {
+		return nil, false
+	}
+
+	e := &routeExplain{
+		Service: service,
+		Request: req,
+		Index:   -1,
+		Action:  routeActionDefault,
+	}
+	if rule := v.(*routeTable).match(ctx, req); rule != nil {
+		e.Rule, e.Index, e.Action, e.Chain = rule.name, rule.index, rule.action, rule.chain
+	}
+	// the IP conditions may not be matched against.
+	if req.ip.IsValid() {
+		req.IP = req.ip.String()
+	}
+	return e, true
+}
@@ -0,0 +1,612 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-gost/core/hosts"
+	"github.com/go-gost/core/logger"
+	"github.com/go-gost/core/metrics"
+	"github.com/go-gost/x/config"
+	hosts_parser "github.com/go-gost/x/config/parsing/hosts"
+	xmetrics "github.com/go-gost/x/metrics"
+)
+
+const (
+	// defaultRuleListHTTPReload is the period to refresh the rule lists of the HTTP URLs if the reload period is not set.
+	defaultRuleListHTTPReload  = time.Hour
+	defaultRuleListHTTPTimeout = 30 * time.Second
+	// maxRuleListSize is the max size of a rule list.
+	maxRuleListSize = 256 << 20
+)
+
+var (
+	ErrRuleListTooLarge = errors.New("rule list too large")
+	ErrEmptyRuleList    = errors.New("no rules in the rule list")
+)
+
+// parseHostMapper parses the hosts as go-gost/x does, the file and the HTTP URL of the hosts are loaded as rule lists.
+func parseHostMapper(cfg *config.HostsConfig) hosts.HostMapper {
+	if cfg == nil || cfg.Plugin != nil {
+		return hosts_parser.ParseHostMapper(cfg)
+	}
+
+	lists := parseRuleLists("hosts", cfg.Name, cfg.File, cfg.HTTP, cfg.Reload)
+	if len(lists) == 0 {
+		return hosts_parser.ParseHostMapper(cfg)
+	}
+
+	c := *cfg
+	c.File, c.HTTP = nil, nil
+	h := hosts_parser.ParseHostMapper(&c)
+	if h == nil {
+		return nil
+	}
+	return &listHostMapper{
+		HostMapper: h,
+		lists:      lists,
+	}
+}
+
+func parseRuleLists(kind, name string, file *config.FileLoader, h *config.HTTPLoader, period time.Duration) (lists []*ruleList) {
+	log := logger.Default().WithFields(map[string]any{
+		"kind": kind,
+		kind:   name,
+	})
+	if file != nil && file.Path != "" {
+		lists = append(lists, newRuleList(kind, name, file.Path, "", 0, period, log))
+	}
+	if h != nil && h.URL != "" {
+		lists = append(lists, newRuleList(kind, name, "", h.URL, h.Timeout, period, log))
+	}
+	return
+}
+
+// listHostMapper is the hosts with the rule lists, the mappings of go-gost/x take precedence over the rule lists.
+type listHostMapper struct {
+	hosts.HostMapper
+	lists []*ruleList
+}
+
+func (h *listHostMapper) Lookup(ctx context.Context, network, host string, opts ...hosts.Option) ([]net.IP, bool) {
+	if ips, ok := h.HostMapper.Lookup(ctx, network, host, opts...); len(ips) > 0 {
+		return ips, ok
+	}
+
+	for _, l := range h.lists {
+		ips := l.lookup(host)
+		if len(ips) == 0 {
+			continue
+		}
+
+		var v []net.IP
+		for _, ip := range ips {
+			switch {
+			case network == "ip4" && ip.To4() == nil,
+				network == "ip6" && ip.To4() != nil:
+			default:
+				v = append(v, ip)
+			}
+		}
+		if len(v) > 0 {
+			l.logger.Debugf("host mapper: %s/%s -> %s", host, network, v)
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+func (h *listHostMapper) Close() error {
+	for _, l := range h.lists {
+		l.Close()
+	}
+	return closeComponent(h.HostMapper)
+}
+
+// ruleList is a list of the rules loaded from a file or an HTTP URL, in one of the formats
+// of the plain domain, IP and CIDR lists, the hosts file, the AdGuard and the dnsmasq configuration.
+// The file is checked for changes every period, the HTTP URL is refreshed every period with the ETag.
+// The rules loaded last are kept if the list fails to load.
+type ruleList struct {
+	kind    string
+	name    string
+	path    string
+	url     string
+	client  *http.Client
+	rules   atomic.Pointer[ruleSet]
+	modTime time.Time
+	size    int64
+	etag    string
+	lastMod string
+	cancel  context.CancelFunc
+	logger  logger.Logger
+}
+
+func newRuleList(kind, name, path, url string, timeout, period time.Duration, log logger.Logger) *ruleList {
+	if url != "" {
+		if period <= 0 {
+			period = defaultRuleListHTTPReload
+		}
+		if timeout <= 0 {
+			timeout = defaultRuleListHTTPTimeout
+		}
+	}
+	if period < time.Second {
+		period = time.Second
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &ruleList{
+		kind:   kind,
+		name:   name,
+		path:   path,
+		url:    url,
+		cancel: cancel,
+		logger: log,
+	}
+	if url != "" {
+		l.client = &http.Client{Timeout: timeout}
+	}
+	if err := l.reload(ctx); err != nil {
+		log.Warnf("reload %s: %v", l.source(), err)
+	}
+	go l.watch(ctx, period)
+
+	return l
+}
+
+// source is the file or the URL of the list.
+func (l *ruleList) source() string {
+	if l.url != "" {
+		return l.url
+	}
+	return l.path
+}
+
+func (l *ruleList) match(ctx context.Context, addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if rules := l.rules.Load(); rules != nil && rules.match(host) {
+		l.logger.Debugf("%s matched by %s", addr, l.source())
+		l.hit()
+		return true
+	}
+	return false
+}
+
+// lookup returns the IPs of the host mapped by the list.
+func (l *ruleList) lookup(host string) []net.IP {
+	rules := l.rules.Load()
+	if rules == nil {
+		return nil
+	}
+	ips, _ := rules.domains.lookup(host)
+	if len(ips) > 0 {
+		l.hit()
+	}
+	return ips
+}
+
+func (l *ruleList) hit() {
+	if v := xmetrics.GetCounter(metricRuleListHitsCounter, metrics.Labels{
+		"kind": l.kind,
+		"name": l.name,
+		"list": l.source(),
+	}); v != nil {
+		v.Inc()
+	}
+}
+
+func (l *ruleList) Close() error {
+	l.cancel()
+	return nil
+}
+
+func (l *ruleList) watch(ctx context.Context, period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := l.reload(ctx); err != nil {
+				l.logger.Warnf("reload %s: %v", l.source(), err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reload re-reads the file if it has been modified since the last read,
+// or fetches the URL if it has been modified since the last fetch.
+func (l *ruleList) reload(ctx context.Context) error {
+	var rules *ruleSet
+	var err error
+	if l.url != "" {
+		rules, err = l.fetch(ctx)
+	} else {
+		rules, err = l.read()
+	}
+	if err != nil || rules == nil {
+		return err
+	}
+
+	l.rules.Store(rules)
+	l.logger.Debugf("load items %d from %s", rules.size, l.source())
+	if v := xmetrics.GetGauge(metricRuleListRulesGauge, metrics.Labels{
+		"kind": l.kind,
+		"name": l.name,
+		"list": l.source(),
+	}); v != nil {
+		v.Set(float64(rules.size))
+	}
+	return nil
+}
+
+// read returns the rules of the file, or nil if the file is not modified.
+func (l *ruleList) read() (*ruleSet, error) {
+	fi, err := os.Stat(l.path)
+	if err != nil {
+		return nil, err
+	}
+	if l.rules.Load() != nil && fi.ModTime().Equal(l.modTime) && fi.Size() == l.size {
+		return nil, nil
+	}
+
+	f, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// the file is not re-read until it is modified again, even if it is invalid.
+	l.modTime, l.size = fi.ModTime(), fi.Size()
+	return parseRuleList(f, l.logger)
+}
+
+// fetch returns the rules of the URL, or nil if the list is not modified.
+func (l *ruleList) fetch(ctx context.Context) (*ruleSet, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, l.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if l.rules.Load() != nil {
+		if l.etag != "" {
+			req.Header.Set("If-None-Match", l.etag)
+		}
+		if l.lastMod != "" {
+			req.Header.Set("If-Modified-Since", l.lastMod)
+		}
+	}
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+
+	rules, err := parseRuleList(resp.Body, l.logger)
+	if err != nil {
+		return nil, err
+	}
+	l.etag, l.lastMod = resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	return rules, nil
+}
+
+// parseRuleList parses the rules of r line by line, the format of each line is detected from the line:
+//
+//	example.com                    the domain
+//	.example.com                   the domain and its subdomains
+//	*.example.com                  the subdomains, or other wildcard patterns such as ads*.example.com
+//	192.168.0.1, 10.0.0.0/8        the IP and the CIDR
+//	0.0.0.0 example.com            the hosts file, the hostnames are mapped to the IP
+//	||example.com^                 the AdGuard rule of the domain and its subdomains
+//	address=/example.com/0.0.0.0   the dnsmasq configuration of the domain and its subdomains,
+//	                               also server=, local=, ipset= and nftset=
+//
+// The lines starting with # or ! are comments. The AdGuard exception rules (@@) and the lines of other formats are ignored.
+func parseRuleList(r io.Reader, log logger.Logger) (*ruleSet, error) {
+	rules := &ruleSet{}
+
+	lr := &io.LimitedReader{R: r, N: maxRuleListSize + 1}
+	scanner := bufio.NewScanner(lr)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	var lines, invalid int
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' || strings.HasPrefix(line, "@@") {
+			continue
+		}
+		lines++
+		if !rules.add(line) {
+			invalid++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if lr.N <= 0 {
+		return nil, ErrRuleListTooLarge
+	}
+	if invalid > 0 {
+		log.Debugf("%d of %d lines ignored", invalid, lines)
+	}
+	if lines > 0 && rules.size == 0 {
+		// it is more likely an error page than a list.
+		return nil, ErrEmptyRuleList
+	}
+	return rules, nil
+}
+
+// ruleSet is the rules of a rule list.
+type ruleSet struct {
+	domains  domainTrie
+	patterns []string
+	ips      ipTrie
+	size     int
+}
+
+// add adds the rules of the line, it reports whether the line is valid.
+func (s *ruleSet) add(line string) bool {
+	// AdGuard: ||example.com^$modifiers
+	if strings.HasPrefix(line, "||") {
+		v, _, _ := strings.Cut(line[2:], "$")
+		v = strings.TrimSuffix(v, "|")
+		if !strings.HasSuffix(v, "^") {
+			return false
+		}
+		return s.addDomain(strings.TrimSuffix(v, "^"), true, true, nil)
+	}
+
+	// dnsmasq: address=/example.com/example.org/0.0.0.0
+	if k, v, ok := strings.Cut(line, "="); ok && strings.HasPrefix(v, "/") {
+		switch k {
+		case "address", "server", "local", "ipset", "nftset":
+		default:
+			return false
+		}
+		parts := strings.Split(v[1:], "/")
+		var ips []net.IP
+		if ip := net.ParseIP(parts[len(parts)-1]); ip != nil && k == "address" {
+			ips = append(ips, ip)
+		}
+		n := 0
+		for _, domain := range parts[:len(parts)-1] {
+			if domain != "" && domain != "#" && s.addDomain(domain, true, true, ips) {
+				n++
+			}
+		}
+		return n > 0
+	}
+
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	switch len(fields) {
+	case 0:
+		return true
+	case 1:
+	default:
+		// hosts file: 127.0.0.1 example.com www.example.com
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			return false
+		}
+		n := 0
+		for _, host := range fields[1:] {
+			if net.ParseIP(host) == nil && s.addDomain(host, true, false, []net.IP{ip}) {
+				n++
+			}
+		}
+		return n > 0
+	}
+
+	v := fields[0]
+	if prefix, err := netip.ParsePrefix(v); err == nil {
+		s.ips.insert(prefix)
+		s.size++
+		return true
+	}
+	if ip, err := netip.ParseAddr(v); err == nil {
+		s.ips.insert(netip.PrefixFrom(ip, ip.BitLen()))
+		s.size++
+		return true
+	}
+	switch {
+	case strings.HasPrefix(v, "*.") && !strings.ContainsAny(v[2:], "*?["):
+		return s.addDomain(v[2:], false, true, nil)
+	case strings.ContainsAny(v, "*?["):
+		v = strings.ToLower(v)
+		if _, err := path.Match(v, ""); err != nil {
+			return false
+		}
+		s.patterns = append(s.patterns, v)
+		s.size++
+		return true
+	case strings.HasPrefix(v, "."):
+		return s.addDomain(v[1:], true, true, nil)
+	default:
+		return s.addDomain(v, true, false, nil)
+	}
+}
+
+func (s *ruleSet) addDomain(domain string, exact, sub bool, ips []net.IP) bool {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	if !validDomain(domain) {
+		return false
+	}
+	s.domains.insert(domain, exact, sub, ips)
+	s.size++
+	return true
+}
+
+func validDomain(domain string) bool {
+	if domain == "" {
+		return false
+	}
+	for _, c := range domain {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '.', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// match reports whether the host, an IP or a domain, is in the rules.
+func (s *ruleSet) match(host string) bool {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return s.ips.contains(ip)
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if _, ok := s.domains.lookup(host); ok {
+		return true
+	}
+	for _, pattern := range s.patterns {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// domainTrie is the trie of the domains by the labels from the right.
+type domainTrie struct {
+	root domainNode
+}
+
+type domainNode struct {
+	children map[string]*domainNode
+	// exact matches the domain, sub matches its subdomains.
+	exact, sub bool
+	// ips are the IPs the domain is mapped to by the hosts rules.
+	ips []net.IP
+}
+
+func (t *domainTrie) insert(domain string, exact, sub bool, ips []net.IP) {
+	n := &t.root
+	for s := domain; s != ""; {
+		label := s
+		if i := strings.LastIndexByte(s, '.'); i >= 0 {
+			label, s = s[i+1:], s[:i]
+		} else {
+			s = ""
+		}
+		child := n.children[label]
+		if child == nil {
+			if n.children == nil {
+				n.children = make(map[string]*domainNode)
+			}
+			child = &domainNode{}
+			n.children[label] = child
+		}
+		n = child
+	}
+	n.exact = n.exact || exact
+	n.sub = n.sub || sub
+	n.ips = append(n.ips, ips...)
+}
+
+// lookup returns the IPs of the most specific rule of the host, and whether there is such a rule.
+func (t *domainTrie) lookup(host string) ([]net.IP, bool) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "" {
+		return nil, false
+	}
+
+	var match *domainNode
+	n := &t.root
+	for s := host; ; {
+		i := strings.LastIndexByte(s, '.')
+		if n = n.children[s[i+1:]]; n == nil {
+			break
+		}
+		if i < 0 {
+			if n.exact {
+				match = n
+			}
+			break
+		}
+		if n.sub {
+			match = n
+		}
+		s = s[:i]
+	}
+	if match == nil {
+		return nil, false
+	}
+	return match.ips, true
+}
+
+// ipTrie is the binary trie of the CIDRs, the IPv4 addresses are stored as the IPv4-mapped IPv6 addresses.
+type ipTrie struct {
+	root ipNode
+}
+
+type ipNode struct {
+	children [2]*ipNode
+	// end marks the end of a CIDR, the nodes below are covered by the CIDR.
+	end bool
+}
+
+func (t *ipTrie) insert(prefix netip.Prefix) {
+	prefix = prefix.Masked()
+	bits := prefix.Bits()
+	if prefix.Addr().Is4() {
+		bits += 96
+	}
+	b := prefix.Addr().As16()
+
+	n := &t.root
+	for i := 0; i < bits; i++ {
+		if n.end {
+			return
+		}
+		bit := b[i/8] >> (7 - i%8) & 1
+		if n.children[bit] == nil {
+			n.children[bit] = &ipNode{}
+		}
+		n = n.children[bit]
+	}
+	n.end = true
+	n.children = [2]*ipNode{}
+}
+
+func (t *ipTrie) contains(ip netip.Addr) bool {
+	b := ip.As16()
+
+	n := &t.root
+	for i := 0; i < 128 && n != nil; i++ {
+		if n.end {
+			return true
+		}
+		n = n.children[b[i/8]>>(7-i%8)&1]
+	}
+	return n != nil && n.end
+}
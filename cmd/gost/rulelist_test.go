@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+
+	xlogger "github.com/go-gost/x/logger"
+)
+
+func TestDomainTrie(t *testing.T) {
+	var trie domainTrie
+	trie.insert("example.com", true, false, nil)
+	trie.insert("sub.example.org", false, true, nil)
+	trie.insert("example.net", true, true, []net.IP{net.ParseIP("10.0.0.1")})
+	trie.insert("www.example.net", true, false, []net.IP{net.ParseIP("10.0.0.2")})
+
+	tests := []struct {
+		host string
+		ok   bool
+		// ip is the IP of the most specific rule.
+		ip string
+	}{
+		{host: "example.com", ok: true},
+		{host: "EXAMPLE.com.", ok: true},
+		{host: "www.example.com"},
+		{host: "com"},
+		{host: "sub.example.org"},
+		{host: "a.sub.example.org", ok: true},
+		{host: "a.b.sub.example.org", ok: true},
+		{host: "example.org"},
+		{host: "example.net", ok: true, ip: "10.0.0.1"},
+		{host: "a.example.net", ok: true, ip: "10.0.0.1"},
+		{host: "www.example.net", ok: true, ip: "10.0.0.2"},
+		// the rule of www.example.net does not match its subdomains.
+		{host: "a.www.example.net", ok: true, ip: "10.0.0.1"},
+		{host: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			ips, ok := trie.lookup(tt.host)
+			if ok != tt.ok {
+				t.Fatalf("got %t, want %t", ok, tt.ok)
+			}
+			var ip string
+			if len(ips) > 0 {
+				ip = ips[0].String()
+			}
+			if ip != tt.ip {
+				t.Errorf("got ip %q, want %q", ip, tt.ip)
+			}
+		})
+	}
+}
+
+func TestIPTrie(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefixes []string
+		ip       string
+		want     bool
+	}{
+		{name: "address", prefixes: []string{"192.168.0.1/32"}, ip: "192.168.0.1", want: true},
+		{name: "other address", prefixes: []string{"192.168.0.1/32"}, ip: "192.168.0.2"},
+		{name: "cidr", prefixes: []string{"10.0.0.0/8"}, ip: "10.255.0.1", want: true},
+		{name: "unmasked cidr", prefixes: []string{"10.1.2.3/8"}, ip: "10.0.0.1", want: true},
+		{name: "outside cidr", prefixes: []string{"10.0.0.0/8"}, ip: "11.0.0.1"},
+		{name: "ipv4-mapped address", prefixes: []string{"10.0.0.0/8"}, ip: "::ffff:10.0.0.1", want: true},
+		{name: "ipv6", prefixes: []string{"2001:db8::/32"}, ip: "2001:db8::1", want: true},
+		{name: "ipv6 outside", prefixes: []string{"2001:db8::/32"}, ip: "2001:db9::1"},
+		{name: "ipv4 all does not cover ipv6", prefixes: []string{"0.0.0.0/0"}, ip: "2001:db8::1"},
+		{name: "ipv4 all", prefixes: []string{"0.0.0.0/0"}, ip: "1.2.3.4", want: true},
+		{name: "wider cidr inserted last", prefixes: []string{"10.1.0.0/16", "10.0.0.0/8"}, ip: "10.2.0.1", want: true},
+		{name: "narrower cidr inserted last", prefixes: []string{"10.0.0.0/8", "10.1.0.0/16"}, ip: "10.2.0.1", want: true},
+		{name: "empty", ip: "10.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var trie ipTrie
+			for _, s := range tt.prefixes {
+				trie.insert(netip.MustParsePrefix(s))
+			}
+			if got := trie.contains(netip.MustParseAddr(tt.ip)); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRuleList(t *testing.T) {
+	tests := []struct {
+		name  string
+		list  string
+		match []string
+		miss  []string
+		// ips are the IPs the hosts are mapped to.
+		ips map[string]string
+		err error
+	}{
+		{
+			name:  "domains",
+			list:  "# comment\nexample.com\n.example.org\n*.example.net\n",
+			match: []string{"example.com", "example.org", "www.example.org", "www.example.net"},
+			miss:  []string{"www.example.com", "example.net"},
+		},
+		{
+			name:  "patterns",
+			list:  "ads*.example.com\n",
+			match: []string{"ads1.example.com"},
+			miss:  []string{"www.example.com"},
+		},
+		{
+			name:  "ips",
+			list:  "192.168.0.1\n10.0.0.0/8 # private\n",
+			match: []string{"192.168.0.1", "10.1.1.1"},
+			miss:  []string{"192.168.0.2"},
+		},
+		{
+			name:  "hosts file",
+			list:  "127.0.0.1 localhost\n10.0.0.1 example.com www.example.com\n",
+			match: []string{"example.com", "www.example.com"},
+			miss:  []string{"a.example.com", "10.0.0.1"},
+			ips:   map[string]string{"www.example.com": "10.0.0.1"},
+		},
+		{
+			name:  "adguard",
+			list:  "! comment\n[Adblock Plus 2.0]\n||example.com^\n||example.org^$important\n@@||example.net^\n",
+			match: []string{"example.com", "www.example.com", "example.org"},
+			miss:  []string{"example.net"},
+		},
+		{
+			name:  "dnsmasq",
+			list:  "address=/example.com/example.org/10.0.0.1\nserver=/example.net/8.8.8.8\n",
+			match: []string{"www.example.com", "example.org", "example.net"},
+			ips:   map[string]string{"www.example.com": "10.0.0.1"},
+		},
+		{
+			name:  "invalid lines are ignored",
+			list:  "example.com\n<html>\nfoo=/bar\n",
+			match: []string{"example.com"},
+		},
+		{
+			name: "no valid line",
+			list: "<html>\n<body>not found</body>\n",
+			err:  ErrEmptyRuleList,
+		},
+		{
+			name: "empty",
+			list: "# nothing\n",
+			miss: []string{"example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := parseRuleList(strings.NewReader(tt.list), xlogger.Nop())
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			for _, host := range tt.match {
+				if !rules.match(host) {
+					t.Errorf("%s is not matched", host)
+				}
+			}
+			for _, host := range tt.miss {
+				if rules.match(host) {
+					t.Errorf("%s is matched", host)
+				}
+			}
+			for host, want := range tt.ips {
+				ips, _ := rules.domains.lookup(host)
+				if len(ips) == 0 || ips[0].String() != want {
+					t.Errorf("%s: got ips %v, want %s", host, ips, want)
+				}
+			}
+		})
+	}
+}
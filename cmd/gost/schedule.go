@@ -0,0 +1,648 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-gost/core/admission"
+	"github.com/go-gost/core/bypass"
+	"github.com/go-gost/core/limiter/conn"
+	"github.com/go-gost/core/limiter/rate"
+	"github.com/go-gost/core/limiter/traffic"
+	"github.com/go-gost/core/logger"
+	"github.com/go-gost/x/config"
+	"github.com/go-gost/x/registry"
+)
+
+var (
+	ErrInvalidSchedule = errors.New("invalid schedule")
+)
+
+// ScheduleConfig is a schedule of the weekly windows in a timezone. The services, admissions, bypasses
+// and limiters bound to the schedule are switched in-process when the schedule becomes active or inactive.
+type ScheduleConfig struct {
+	Name string `json:"name"`
+	// Timezone is the IANA time zone of the windows, such as Europe/Berlin, default is the local time zone.
+	Timezone string                  `yaml:",omitempty" json:"timezone,omitempty"`
+	Windows  []*ScheduleWindowConfig `yaml:",omitempty" json:"windows,omitempty"`
+	// Services are enabled only while the schedule is active,
+	// the new connections of a service are closed while all of its schedules are inactive.
+	Services []string `yaml:",omitempty" json:"services,omitempty"`
+	// Admissions and Bypasses are applied only while the schedule is active.
+	Admissions []string `yaml:",omitempty" json:"admissions,omitempty"`
+	Bypasses   []string `yaml:",omitempty" json:"bypasses,omitempty"`
+	// Limiters, CLimiters and RLimiters replace the limiters of the keys with the limiters of the values
+	// while the schedule is active, such as a stricter traffic limiter at night.
+	Limiters  map[string]string `yaml:",omitempty" json:"limiters,omitempty"`
+	CLimiters map[string]string `yaml:"climiters,omitempty" json:"climiters,omitempty"`
+	RLimiters map[string]string `yaml:"rlimiters,omitempty" json:"rlimiters,omitempty"`
+}
+
+// ScheduleWindowConfig is a weekly window of a schedule.
+type ScheduleWindowConfig struct {
+	// Days are the days of the week of the window, such as mon-fri or sat,sun, default is every day.
+	Days string `yaml:",omitempty" json:"days,omitempty"`
+	// Start and End are the times of the day in the format of 15:04, End can be 24:00 for the end of the day.
+	// The window ends on the next day if End is not after Start, such as 22:00-07:00.
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// schedules are the schedules set by the configuration, it is nil if there is no schedule.
+var schedules atomic.Pointer[scheduleSet]
+
+// scheduleSet are the schedules with the components bound to them.
+type scheduleSet struct {
+	schedules  []*schedule
+	services   map[string][]*schedule
+	admissions map[string][]*schedule
+	bypasses   map[string][]*schedule
+	limiters   map[string][]limiterSwap
+	climiters  map[string][]limiterSwap
+	rlimiters  map[string][]limiterSwap
+	cancel     context.CancelFunc
+}
+
+// limiterSwap is the limiter used while the schedule is active.
+type limiterSwap struct {
+	schedule *schedule
+	limiter  string
+}
+
+// setSchedules parses the schedules and watches their states, they must be set before the components are built.
+// The components bound to the schedules must be in cfg.
+func setSchedules(cfgs []*ScheduleConfig, cfg *config.Config, log logger.Logger) error {
+	if len(cfgs) == 0 {
+		if old := schedules.Swap(nil); old != nil {
+			old.cancel()
+		}
+		return nil
+	}
+
+	set := &scheduleSet{
+		services:   make(map[string][]*schedule),
+		admissions: make(map[string][]*schedule),
+		bypasses:   make(map[string][]*schedule),
+		limiters:   make(map[string][]limiterSwap),
+		climiters:  make(map[string][]limiterSwap),
+		rlimiters:  make(map[string][]limiterSwap),
+	}
+	names := newComponentNames(cfg)
+	for _, sc := range cfgs {
+		if sc == nil {
+			continue
+		}
+		s, err := parseSchedule(sc)
+		if err != nil {
+			return err
+		}
+		if err := names.check(sc); err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrInvalidSchedule, sc.Name, err)
+		}
+		set.schedules = append(set.schedules, s)
+
+		for _, name := range sc.Services {
+			set.services[name] = append(set.services[name], s)
+		}
+		for _, name := range sc.Admissions {
+			set.admissions[name] = append(set.admissions[name], s)
+		}
+		for _, name := range sc.Bypasses {
+			set.bypasses[name] = append(set.bypasses[name], s)
+		}
+		for name, v := range sc.Limiters {
+			set.limiters[name] = append(set.limiters[name], limiterSwap{schedule: s, limiter: v})
+		}
+		for name, v := range sc.CLimiters {
+			set.climiters[name] = append(set.climiters[name], limiterSwap{schedule: s, limiter: v})
+		}
+		for name, v := range sc.RLimiters {
+			set.rlimiters[name] = append(set.rlimiters[name], limiterSwap{schedule: s, limiter: v})
+		}
+	}
+	for kind, swaps := range map[string]map[string][]limiterSwap{
+		"limiter":  set.limiters,
+		"climiter": set.climiters,
+		"rlimiter": set.rlimiters,
+	} {
+		if err := checkSwapCycle(swaps); err != nil {
+			return fmt.Errorf("%w: %s %v", ErrInvalidSchedule, kind, err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	set.cancel = cancel
+	if old := schedules.Swap(set); old != nil {
+		old.cancel()
+	}
+	go set.watch(ctx, log)
+
+	return nil
+}
+
+// componentNames are the names of the components in the config which can be bound to the schedules.
+type componentNames struct {
+	services   map[string]bool
+	admissions map[string]bool
+	bypasses   map[string]bool
+	limiters   map[string]bool
+	climiters  map[string]bool
+	rlimiters  map[string]bool
+}
+
+func newComponentNames(cfg *config.Config) *componentNames {
+	names := &componentNames{
+		services:   make(map[string]bool),
+		admissions: make(map[string]bool),
+		bypasses:   make(map[string]bool),
+		limiters:   make(map[string]bool),
+		climiters:  make(map[string]bool),
+		rlimiters:  make(map[string]bool),
+	}
+	if cfg == nil {
+		return names
+	}
+	for _, c := range cfg.Services {
+		if c != nil {
+			names.services[c.Name] = true
+		}
+	}
+	for _, c := range cfg.Admissions {
+		if c != nil {
+			names.admissions[c.Name] = true
+		}
+	}
+	for _, c := range cfg.Bypasses {
+		if c != nil {
+			names.bypasses[c.Name] = true
+		}
+	}
+	for _, c := range cfg.Limiters {
+		if c != nil {
+			names.limiters[c.Name] = true
+		}
+	}
+	for _, c := range cfg.CLimiters {
+		if c != nil {
+			names.climiters[c.Name] = true
+		}
+	}
+	for _, c := range cfg.RLimiters {
+		if c != nil {
+			names.rlimiters[c.Name] = true
+		}
+	}
+	return names
+}
+
+// check returns an error if a component bound to the schedule is not in the config.
+func (names *componentNames) check(cfg *ScheduleConfig) error {
+	for _, list := range []struct {
+		kind  string
+		names map[string]bool
+		refs  []string
+	}{
+		{"service", names.services, cfg.Services},
+		{"admission", names.admissions, cfg.Admissions},
+		{"bypass", names.bypasses, cfg.Bypasses},
+		{"limiter", names.limiters, mapRefs(cfg.Limiters)},
+		{"climiter", names.climiters, mapRefs(cfg.CLimiters)},
+		{"rlimiter", names.rlimiters, mapRefs(cfg.RLimiters)},
+	} {
+		for _, name := range list.refs {
+			if !list.names[name] {
+				return fmt.Errorf("%s %s not found", list.kind, name)
+			}
+		}
+	}
+	return nil
+}
+
+// mapRefs returns the keys and the values of the limiter swaps.
+func mapRefs(m map[string]string) (refs []string) {
+	for k, v := range m {
+		refs = append(refs, k, v)
+	}
+	return
+}
+
+// checkSwapCycle returns an error if a limiter is swapped back to itself through the swaps,
+// the windows of the schedules may overlap, so the swaps of all the schedules are followed.
+func checkSwapCycle(swaps map[string][]limiterSwap) error {
+	// the state of a limiter is 1 while its swaps are followed and 2 once they are done.
+	state := make(map[string]int)
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		path = append(path, name)
+		switch state[name] {
+		case 1:
+			return fmt.Errorf("swap cycle %s", strings.Join(path, " > "))
+		case 2:
+			return nil
+		}
+		state[name] = 1
+		for _, sw := range swaps[name] {
+			if err := visit(sw.limiter, path); err != nil {
+				return err
+			}
+		}
+		state[name] = 2
+		return nil
+	}
+
+	for name := range swaps {
+		if err := visit(name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseSchedule(cfg *ScheduleConfig) (*schedule, error) {
+	s := &schedule{
+		name: cfg.Name,
+		loc:  time.Local,
+	}
+	if cfg.Timezone != "" {
+		loc, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidSchedule, cfg.Name, err)
+		}
+		s.loc = loc
+	}
+	if len(cfg.Windows) == 0 {
+		return nil, fmt.Errorf("%w: %s: no window", ErrInvalidSchedule, cfg.Name)
+	}
+	for _, w := range cfg.Windows {
+		if w == nil {
+			continue
+		}
+		window, err := parseScheduleWindow(w)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidSchedule, cfg.Name, err)
+		}
+		s.windows = append(s.windows, window)
+	}
+	return s, nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func parseScheduleWindow(cfg *ScheduleWindowConfig) (w scheduleWindow, err error) {
+	if w.start, err = parseDayMinutes(cfg.Start); err != nil {
+		return
+	}
+	if w.end, err = parseDayMinutes(cfg.End); err != nil {
+		return
+	}
+	if w.start == 24*60 {
+		return w, fmt.Errorf("invalid start %s", cfg.Start)
+	}
+
+	days := strings.TrimSpace(strings.ToLower(cfg.Days))
+	if days == "" || days == "*" {
+		for i := range w.days {
+			w.days[i] = true
+		}
+		return
+	}
+	for _, s := range strings.Split(days, ",") {
+		from, to, isRange := strings.Cut(s, "-")
+		first, ok := parseWeekday(from)
+		last := first
+		if ok && isRange {
+			last, ok = parseWeekday(to)
+		}
+		if !ok {
+			return w, fmt.Errorf("invalid days %s", cfg.Days)
+		}
+		// the range wraps around the week, such as fri-mon.
+		for d := first; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return
+}
+
+// parseWeekday parses the day of the week by the name or its first three letters.
+func parseWeekday(s string) (time.Weekday, bool) {
+	s = strings.TrimSpace(s)
+	if len(s) < 3 {
+		return 0, false
+	}
+	d, ok := weekdays[s[:3]]
+	return d, ok
+}
+
+// parseDayMinutes parses the time of the day in the format of 15:04 to the minutes of the day.
+func parseDayMinutes(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+type schedule struct {
+	name    string
+	loc     *time.Location
+	windows []scheduleWindow
+}
+
+type scheduleWindow struct {
+	days [7]bool
+	// start and end are the minutes of the day.
+	start, end int
+}
+
+// active reports whether t is in one of the windows of the schedule.
+func (s *schedule) active(t time.Time) bool {
+	t = t.In(s.loc)
+	wd, m := t.Weekday(), t.Hour()*60+t.Minute()
+	for i := range s.windows {
+		if s.windows[i].contains(wd, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// next returns the time the state of the schedule changes after t, or the zero time if it never changes.
+func (s *schedule) next(t time.Time) time.Time {
+	state := s.active(t)
+	t = t.Truncate(time.Minute)
+	// the windows repeat every week.
+	for i := 0; i < 8*24*60; i++ {
+		t = t.Add(time.Minute)
+		if s.active(t) != state {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (w *scheduleWindow) contains(wd time.Weekday, m int) bool {
+	if w.start < w.end {
+		return w.days[wd] && m >= w.start && m < w.end
+	}
+	// the window crosses the midnight, it belongs to the day it starts.
+	return w.days[wd] && m >= w.start || w.days[(wd+6)%7] && m < w.end
+}
+
+func activeAny(schedules []*schedule, t time.Time) bool {
+	for _, s := range schedules {
+		if s.active(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch logs and publishes the changes of the states of the schedules, which are checked every minute.
+func (set *scheduleSet) watch(ctx context.Context, log logger.Logger) {
+	states := make([]bool, len(set.schedules))
+	now := time.Now()
+	for i, s := range set.schedules {
+		states[i] = s.active(now)
+		log.Infof("schedule %s is %s", s.name, scheduleState(states[i]))
+	}
+
+	for {
+		now := time.Now()
+		timer := time.NewTimer(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		select {
+		case now = <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+
+		for i, s := range set.schedules {
+			active := s.active(now)
+			if active == states[i] {
+				continue
+			}
+			states[i] = active
+			log.Infof("schedule %s is %s", s.name, scheduleState(active))
+			events.publish(eventScheduleChanged, map[string]any{
+				"schedule": s.name,
+				"active":   active,
+			})
+		}
+	}
+}
+
+func scheduleState(active bool) string {
+	if active {
+		return "active"
+	}
+	return "inactive"
+}
+
+// serviceOffSchedule reports whether the service is disabled by its schedules.
+func serviceOffSchedule(name string) bool {
+	set := schedules.Load()
+	if set == nil {
+		return false
+	}
+	ss := set.services[name]
+	return len(ss) > 0 && !activeAny(ss, time.Now())
+}
+
+type scheduleStatus struct {
+	Name     string `json:"name"`
+	Timezone string `json:"timezone"`
+	Active   bool   `json:"active"`
+	// Next is the time the state of the schedule changes, it is omitted if the state never changes.
+	Next *time.Time `json:"next,omitempty"`
+}
+
+func buildScheduleStatus() []scheduleStatus {
+	statuses := []scheduleStatus{}
+	set := schedules.Load()
+	if set == nil {
+		return statuses
+	}
+
+	now := time.Now()
+	for _, s := range set.schedules {
+		st := scheduleStatus{
+			Name:     s.name,
+			Timezone: s.loc.String(),
+			Active:   s.active(now),
+		}
+		if next := s.next(now); !next.IsZero() {
+			next = next.In(s.loc)
+			st.Next = &next
+		}
+		statuses = append(statuses, st)
+	}
+	return statuses
+}
+
+// The wrappers of the components bound to the schedules, they are built before the components are registered.
+
+func scheduleAdmission(name string, adm admission.Admission) admission.Admission {
+	if set := schedules.Load(); set != nil && len(set.admissions[name]) > 0 {
+		return &scheduledAdmission{Admission: adm, schedules: set.admissions[name]}
+	}
+	return adm
+}
+
+func scheduleBypass(name string, bp bypass.Bypass) bypass.Bypass {
+	if set := schedules.Load(); set != nil && len(set.bypasses[name]) > 0 {
+		return &scheduledBypass{Bypass: bp, schedules: set.bypasses[name]}
+	}
+	return bp
+}
+
+func scheduleTrafficLimiter(name string, l traffic.TrafficLimiter) traffic.TrafficLimiter {
+	if set := schedules.Load(); set != nil && len(set.limiters[name]) > 0 {
+		return &scheduledTrafficLimiter{TrafficLimiter: l, swaps: set.limiters[name]}
+	}
+	return l
+}
+
+func scheduleConnLimiter(name string, l conn.ConnLimiter) conn.ConnLimiter {
+	if set := schedules.Load(); set != nil && len(set.climiters[name]) > 0 {
+		return &scheduledConnLimiter{ConnLimiter: l, swaps: set.climiters[name]}
+	}
+	return l
+}
+
+func scheduleRateLimiter(name string, l rate.RateLimiter) rate.RateLimiter {
+	if set := schedules.Load(); set != nil && len(set.rlimiters[name]) > 0 {
+		return &scheduledRateLimiter{RateLimiter: l, swaps: set.rlimiters[name]}
+	}
+	return l
+}
+
+// swapped returns the limiter of the first active schedule of the swaps.
+func swapped(swaps []limiterSwap) (string, bool) {
+	now := time.Now()
+	for _, sw := range swaps {
+		if sw.schedule.active(now) {
+			return sw.limiter, true
+		}
+	}
+	return "", false
+}
+
+func closeComponent(v any) error {
+	if c, ok := v.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// scheduledAdmission admits all the clients while its schedules are inactive.
+type scheduledAdmission struct {
+	admission.Admission
+	schedules []*schedule
+}
+
+func (p *scheduledAdmission) Admit(ctx context.Context, addr string, opts ...admission.Option) bool {
+	if !activeAny(p.schedules, time.Now()) {
+		return true
+	}
+	return p.Admission.Admit(ctx, addr, opts...)
+}
+
+func (p *scheduledAdmission) Close() error {
+	return closeComponent(p.Admission)
+}
+
+// scheduledBypass bypasses no address while its schedules are inactive.
+type scheduledBypass struct {
+	bypass.Bypass
+	schedules []*schedule
+}
+
+func (bp *scheduledBypass) Contains(ctx context.Context, network, addr string, opts ...bypass.Option) bool {
+	if !activeAny(bp.schedules, time.Now()) {
+		return false
+	}
+	return bp.Bypass.Contains(ctx, network, addr, opts...)
+}
+
+func (bp *scheduledBypass) Close() error {
+	return closeComponent(bp.Bypass)
+}
+
+// scheduledTrafficLimiter is replaced by the limiter of the active schedule.
+type scheduledTrafficLimiter struct {
+	traffic.TrafficLimiter
+	swaps []limiterSwap
+}
+
+func (l *scheduledTrafficLimiter) In(ctx context.Context, key string, opts ...traffic.Option) traffic.Limiter {
+	if name, ok := swapped(l.swaps); ok {
+		return registry.TrafficLimiterRegistry().Get(name).In(ctx, key, opts...)
+	}
+	return l.TrafficLimiter.In(ctx, key, opts...)
+}
+
+func (l *scheduledTrafficLimiter) Out(ctx context.Context, key string, opts ...traffic.Option) traffic.Limiter {
+	if name, ok := swapped(l.swaps); ok {
+		return registry.TrafficLimiterRegistry().Get(name).Out(ctx, key, opts...)
+	}
+	return l.TrafficLimiter.Out(ctx, key, opts...)
+}
+
+func (l *scheduledTrafficLimiter) Close() error {
+	return closeComponent(l.TrafficLimiter)
+}
+
+// scheduledConnLimiter is replaced by the limiter of the active schedule.
+type scheduledConnLimiter struct {
+	conn.ConnLimiter
+	swaps []limiterSwap
+}
+
+func (l *scheduledConnLimiter) Limiter(key string) conn.Limiter {
+	if name, ok := swapped(l.swaps); ok {
+		return registry.ConnLimiterRegistry().Get(name).Limiter(key)
+	}
+	return l.ConnLimiter.Limiter(key)
+}
+
+func (l *scheduledConnLimiter) Close() error {
+	return closeComponent(l.ConnLimiter)
+}
+
+// scheduledRateLimiter is replaced by the limiter of the active schedule.
+type scheduledRateLimiter struct {
+	rate.RateLimiter
+	swaps []limiterSwap
+}
+
+func (l *scheduledRateLimiter) Limiter(key string) rate.Limiter {
+	if name, ok := swapped(l.swaps); ok {
+		return registry.RateLimiterRegistry().Get(name).Limiter(key)
+	}
+	return l.RateLimiter.Limiter(key)
+}
+
+func (l *scheduledRateLimiter) Close() error {
+	return closeComponent(l.RateLimiter)
+}
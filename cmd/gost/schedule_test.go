@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleWindowContains(t *testing.T) {
+	tests := []struct {
+		name   string
+		window ScheduleWindowConfig
+		day    time.Weekday
+		time   string
+		want   bool
+	}{
+		{name: "in window", window: ScheduleWindowConfig{Days: "mon-fri", Start: "09:00", End: "17:00"}, day: time.Monday, time: "09:00", want: true},
+		{name: "end is excluded", window: ScheduleWindowConfig{Days: "mon-fri", Start: "09:00", End: "17:00"}, day: time.Monday, time: "17:00"},
+		{name: "other day", window: ScheduleWindowConfig{Days: "mon-fri", Start: "09:00", End: "17:00"}, day: time.Saturday, time: "10:00"},
+		{name: "end of the day", window: ScheduleWindowConfig{Start: "20:00", End: "24:00"}, day: time.Sunday, time: "23:59", want: true},
+		{name: "midnight crossing before midnight", window: ScheduleWindowConfig{Days: "fri", Start: "22:00", End: "07:00"}, day: time.Friday, time: "23:30", want: true},
+		{name: "midnight crossing after midnight", window: ScheduleWindowConfig{Days: "fri", Start: "22:00", End: "07:00"}, day: time.Saturday, time: "06:59", want: true},
+		{name: "midnight crossing after the end", window: ScheduleWindowConfig{Days: "fri", Start: "22:00", End: "07:00"}, day: time.Saturday, time: "07:00"},
+		// the window belongs to the day it starts, friday morning is the end of the window of thursday.
+		{name: "midnight crossing morning of the day", window: ScheduleWindowConfig{Days: "fri", Start: "22:00", End: "07:00"}, day: time.Friday, time: "06:00"},
+		{name: "wrap-around weekdays", window: ScheduleWindowConfig{Days: "fri-mon", Start: "10:00", End: "12:00"}, day: time.Sunday, time: "11:00", want: true},
+		{name: "wrap-around weekdays last day", window: ScheduleWindowConfig{Days: "fri-mon", Start: "10:00", End: "12:00"}, day: time.Monday, time: "11:00", want: true},
+		{name: "outside wrap-around weekdays", window: ScheduleWindowConfig{Days: "fri-mon", Start: "10:00", End: "12:00"}, day: time.Wednesday, time: "11:00"},
+		{name: "wrap-around weekdays crossing midnight", window: ScheduleWindowConfig{Days: "sat-sun", Start: "23:00", End: "01:00"}, day: time.Monday, time: "00:30", want: true},
+		{name: "same start and end is a whole day", window: ScheduleWindowConfig{Days: "sun", Start: "08:00", End: "08:00"}, day: time.Monday, time: "07:59", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseScheduleWindow(&tt.window)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m, err := parseDayMinutes(tt.time)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := w.contains(tt.day, m); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	// 2024-01-01 is a monday.
+	date := func(day int, clock string) time.Time {
+		c, err := time.Parse("15:04:05", clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return time.Date(2024, 1, day, c.Hour(), c.Minute(), c.Second(), 0, time.UTC)
+	}
+
+	tests := []struct {
+		name    string
+		windows []*ScheduleWindowConfig
+		t       time.Time
+		want    time.Time
+	}{
+		{
+			name:    "end of the window",
+			windows: []*ScheduleWindowConfig{{Days: "mon-fri", Start: "09:00", End: "17:00"}},
+			t:       date(1, "10:30:45"),
+			want:    date(1, "17:00:00"),
+		},
+		{
+			name:    "start of the window on the next week day",
+			windows: []*ScheduleWindowConfig{{Days: "mon-fri", Start: "09:00", End: "17:00"}},
+			t:       date(5, "17:30:00"),
+			want:    date(8, "09:00:00"),
+		},
+		{
+			name:    "end of the window after midnight",
+			windows: []*ScheduleWindowConfig{{Days: "sat", Start: "22:00", End: "02:00"}},
+			t:       date(6, "23:00:00"),
+			want:    date(7, "02:00:00"),
+		},
+		{
+			name: "adjacent windows",
+			windows: []*ScheduleWindowConfig{
+				{Start: "08:00", End: "12:00"},
+				{Start: "12:00", End: "18:00"},
+			},
+			t:    date(2, "09:00:00"),
+			want: date(2, "18:00:00"),
+		},
+		{
+			name:    "always active",
+			windows: []*ScheduleWindowConfig{{Start: "00:00", End: "24:00"}},
+			t:       date(3, "12:00:00"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := parseSchedule(&ScheduleConfig{Name: "next", Timezone: "UTC", Windows: tt.windows})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.next(tt.t); !got.Equal(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-gost/core/bypass"
+	"github.com/go-gost/core/chain"
+	"github.com/go-gost/core/hop"
+	"github.com/go-gost/core/logger"
+	mdutil "github.com/go-gost/core/metadata/util"
+	"github.com/go-gost/core/selector"
+	"github.com/go-gost/x/config"
+	bypass_parser "github.com/go-gost/x/config/parsing/bypass"
+	hop_parser "github.com/go-gost/x/config/parsing/hop"
+	ctxvalue "github.com/go-gost/x/ctx"
+	xs "github.com/go-gost/x/selector"
+)
+
+// The node selector strategies in addition to the strategies of go-gost/x.
+const (
+	// strategyLeastConn selects the node with the least active connections.
+	strategyLeastConn = "leastconn"
+	// strategyLatency selects the node with the lowest EWMA of the dial latency.
+	strategyLatency = "latency"
+	// strategyP2C selects the less loaded one of two random nodes,
+	// the load is the active connections weighted by the latency.
+	strategyP2C = "p2c"
+	// strategyCHash selects the node by the consistent hash of the client IP.
+	strategyCHash = "chash"
+	// strategyCHashHost selects the node by the consistent hash of the target host.
+	strategyCHashHost = "chash-host"
+)
+
+// latencyDecay is the weight of the previous EWMA of the latency on each new sample.
+const latencyDecay = 0.8
+
+// parseNodeStrategy returns the strategy of the name,
+// or nil for the strategies handled by go-gost/x.
+func parseNodeStrategy(name string) selector.Strategy[*chain.Node] {
+	switch strings.ToLower(name) {
+	case strategyLeastConn, "least_conn", "leastconns":
+		return &leastConnStrategy{}
+	case strategyLatency, "ewma":
+		return &latencyStrategy{}
+	case strategyP2C:
+		return &p2cStrategy{r: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	case strategyCHash, "chash-client":
+		return &chashStrategy{host: false}
+	case strategyCHashHost:
+		return &chashStrategy{host: true}
+	}
+	return nil
+}
+
+// parseNodeSelector returns the selector of the config if the strategy is added by parseNodeStrategy,
+// or the circuit breakers of the nodes are enabled, which are filtered by the selector.
+func parseNodeSelector(cfg *config.SelectorConfig, breaker bool) selector.Selector[*chain.Node] {
+	if cfg == nil {
+		cfg = &config.SelectorConfig{
+			MaxFails:    xs.DefaultMaxFails,
+			FailTimeout: xs.DefaultFailTimeout,
+		}
+	}
+	strategy := parseNodeStrategy(cfg.Strategy)
+	if strategy == nil {
+		if !breaker {
+			return nil
+		}
+		switch cfg.Strategy {
+		case "random", "rand":
+			strategy = xs.RandomStrategy[*chain.Node]()
+		case "fifo", "ha":
+			strategy = xs.FIFOStrategy[*chain.Node]()
+		case "hash":
+			strategy = xs.HashStrategy[*chain.Node]()
+		default:
+			strategy = xs.RoundRobinStrategy[*chain.Node]()
+		}
+	}
+
+	var filters []selector.Filter[*chain.Node]
+	if breaker {
+		filters = append(filters, circuitFilter{})
+	}
+	filters = append(filters,
+		xs.FailFilter[*chain.Node](cfg.MaxFails, cfg.FailTimeout),
+		xs.BackupFilter[*chain.Node](),
+	)
+	return xs.NewSelector(strategy, filters...)
+}
+
+// parseHop parses the hop by the hop parser of go-gost/x, the hop is wrapped if the selector strategy
+// is not known to go-gost/x or the circuit breakers of the nodes are enabled.
+func parseHop(cfg *config.HopConfig, log logger.Logger) (hop.Hop, error) {
+	h, err := hop_parser.ParseHop(cfg, log)
+	if err != nil || h == nil || cfg.Plugin != nil {
+		return h, err
+	}
+
+	var breaker bool
+	for _, node := range cfg.Nodes {
+		if node != nil && hasCircuitBreaker(node.Metadata) {
+			breaker = true
+		}
+	}
+	sel := parseNodeSelector(cfg.Selector, breaker)
+	if sel == nil {
+		return h, nil
+	}
+	return &strategyHop{
+		Hop:      h,
+		selector: sel,
+		bypass:   bypass.BypassGroup(bypass_parser.List(cfg.Bypass, cfg.Bypasses...)...),
+		logger: log.WithFields(map[string]any{
+			"kind": "hop",
+			"hop":  cfg.Name,
+		}),
+	}, nil
+}
+
+// strategyHop is a hop selecting the nodes by a strategy added by parseNodeStrategy or with the circuit breakers,
+// the nodes are filtered in the same way as the hop of go-gost/x before the selection.
+type strategyHop struct {
+	hop.Hop
+	selector selector.Selector[*chain.Node]
+	bypass   bypass.Bypass
+	logger   logger.Logger
+}
+
+func (h *strategyHop) Nodes() []*chain.Node {
+	return hopNodes(h.Hop)
+}
+
+func (h *strategyHop) Select(ctx context.Context, opts ...hop.SelectOption) *chain.Node {
+	var options hop.SelectOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	if h.bypass != nil &&
+		h.bypass.Contains(ctx, options.Network, options.Addr, bypass.WithHostOpton(options.Host)) {
+		return nil
+	}
+
+	filters := h.filterByHost(options.Host, h.Nodes()...)
+	filters = h.filterByProtocol(options.Protocol, filters...)
+	filters = h.filterByPath(options.Path, filters...)
+
+	var nodes []*chain.Node
+	for _, node := range filters {
+		if node == nil {
+			continue
+		}
+		if node.Options().Bypass != nil &&
+			node.Options().Bypass.Contains(ctx, options.Network, options.Addr, bypass.WithHostOpton(options.Host)) {
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	ctx = contextWithSelectOptions(ctx, &options)
+	node := h.selector.Select(ctx, nodes...)
+	if node != nil {
+		if b := breakerOf(node); b != nil {
+			b.acquire(time.Now())
+		}
+		if rec := connRecordFromContext(ctx); rec != nil {
+			rec.useNode(node)
+		}
+	}
+	return node
+}
+
+func (h *strategyHop) Close() error {
+	if closer, ok := h.Hop.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// filterByHost, filterByProtocol and filterByPath are the node filters of the hop of go-gost/x.
+
+func (h *strategyHop) filterByHost(host string, nodes ...*chain.Node) (filters []*chain.Node) {
+	if host == "" || len(nodes) == 0 {
+		return nodes
+	}
+
+	if v, _, _ := net.SplitHostPort(host); v != "" {
+		host = v
+	}
+	h.logger.Debugf("filter by host: %s", host)
+
+	found := false
+	for _, node := range nodes {
+		if node == nil {
+			continue
+		}
+		vhost := node.Options().Host
+		if vhost == "" { // backup node
+			if !found {
+				filters = append(filters, node)
+			}
+			continue
+		}
+
+		if vhost == host ||
+			vhost[0] == '.' && strings.HasSuffix(host, vhost[1:]) {
+			if !found { // clear all backup nodes when matched node found
+				filters = nil
+			}
+			filters = append(filters, node)
+			found = true
+		}
+	}
+	return
+}
+
+func (h *strategyHop) filterByProtocol(protocol string, nodes ...*chain.Node) (filters []*chain.Node) {
+	if protocol == "" || len(nodes) == 0 {
+		return nodes
+	}
+
+	h.logger.Debugf("filter by protocol: %s", protocol)
+	found := false
+	for _, node := range nodes {
+		if node == nil {
+			continue
+		}
+
+		if node.Options().Protocol == "" {
+			if !found {
+				filters = append(filters, node)
+			}
+			continue
+		}
+
+		if node.Options().Protocol == protocol {
+			if !found {
+				filters = nil
+			}
+			filters = append(filters, node)
+			found = true
+		}
+	}
+	return
+}
+
+func (h *strategyHop) filterByPath(path string, nodes ...*chain.Node) (filters []*chain.Node) {
+	if path == "" || len(nodes) == 0 {
+		return nodes
+	}
+
+	h.logger.Debugf("filter by path: %s", path)
+
+	nodes = append([]*chain.Node{}, nodes...)
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return len(nodes[i].Options().Path) > len(nodes[j].Options().Path)
+	})
+
+	found := false
+	for _, node := range nodes {
+		if node.Options().Path == "" {
+			if !found {
+				filters = append(filters, node)
+			}
+			continue
+		}
+
+		if strings.HasPrefix(path, node.Options().Path) {
+			if !found {
+				filters = nil
+			}
+			filters = append(filters, node)
+			break
+		}
+	}
+	return
+}
+
+// forwardHop is the hop of the forwarder of a service, the selector is looked up in the config on each selection,
+// as the service is added to the config after it is created, and the config may be updated by the API.
+type forwardHop struct {
+	hop.Hop
+	service string
+	logger  logger.Logger
+	// cfg is the config of the service the selector is parsed from.
+	cfg *config.ServiceConfig
+	sel *strategyHop
+	mu  sync.Mutex
+}
+
+func (h *forwardHop) Nodes() []*chain.Node {
+	return hopNodes(h.Hop)
+}
+
+func (h *forwardHop) Select(ctx context.Context, opts ...hop.SelectOption) *chain.Node {
+	if sel := h.selector(); sel != nil {
+		return sel.Select(ctx, opts...)
+	}
+	return h.Hop.Select(ctx, opts...)
+}
+
+// selector returns the selector of the forwarder in the current config of the service,
+// the selector is parsed again once the config of the service is replaced.
+func (h *forwardHop) selector() *strategyHop {
+	var cfg *config.ServiceConfig
+	for _, svc := range config.Global().Services {
+		if svc != nil && svc.Name == h.service {
+			cfg = svc
+			break
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if cfg == h.cfg {
+		return h.sel
+	}
+	h.cfg, h.sel = cfg, nil
+	if cfg == nil || cfg.Forwarder == nil {
+		return nil
+	}
+
+	var breaker bool
+	for _, node := range cfg.Forwarder.Nodes {
+		if node != nil && hasCircuitBreaker(node.Metadata) {
+			breaker = true
+		}
+	}
+	if sel := parseNodeSelector(cfg.Forwarder.Selector, breaker); sel != nil {
+		h.sel = &strategyHop{Hop: h.Hop, selector: sel, logger: h.logger}
+	}
+	return h.sel
+}
+
+type selectOptionsKey struct{}
+
+func contextWithSelectOptions(ctx context.Context, opts *hop.SelectOptions) context.Context {
+	return context.WithValue(ctx, selectOptionsKey{}, opts)
+}
+
+func selectOptionsFromContext(ctx context.Context) *hop.SelectOptions {
+	v, _ := ctx.Value(selectOptionsKey{}).(*hop.SelectOptions)
+	if v == nil {
+		return &hop.SelectOptions{}
+	}
+	return v
+}
+
+// nodeLoad is the load of a node measured by the strategies,
+// the copies of a node share the load by the marker.
+type nodeLoad struct {
+	// active is the number of the active connections using the node.
+	active atomic.Int64
+	// latency is the EWMA of the dial latency in nanoseconds, 0 if not measured yet.
+	latency atomic.Int64
+}
+
+// nodeLoads are the loads of the nodes by the node marker.
+var nodeLoads sync.Map
+
+func nodeLoadOf(node *chain.Node) *nodeLoad {
+	marker := node.Marker()
+	if marker == nil {
+		return &nodeLoad{}
+	}
+	if v, ok := nodeLoads.Load(marker); ok {
+		return v.(*nodeLoad)
+	}
+	v, _ := nodeLoads.LoadOrStore(marker, &nodeLoad{})
+	return v.(*nodeLoad)
+}
+
+// observeNodeLatency adds a sample of the dial latency of the node.
+func observeNodeLatency(node *chain.Node, d time.Duration) {
+	if node == nil || d <= 0 {
+		return
+	}
+	load := nodeLoadOf(node)
+	for {
+		old := load.latency.Load()
+		v := int64(d)
+		if old > 0 {
+			v = int64(latencyDecay*float64(old) + (1-latencyDecay)*float64(d))
+		}
+		if load.latency.CompareAndSwap(old, v) {
+			return
+		}
+	}
+}
+
+func nodeWeight(node *chain.Node) float64 {
+	if w := mdutil.GetInt(node.Metadata(), "weight"); w > 0 {
+		return float64(w)
+	}
+	return 1
+}
+
+type leastConnStrategy struct {
+	counter atomic.Uint64
+}
+
+// Apply selects the node with the least active connections per weight,
+// the ties are broken in round-robin.
+func (s *leastConnStrategy) Apply(ctx context.Context, vs ...*chain.Node) (v *chain.Node) {
+	if len(vs) == 0 {
+		return
+	}
+	offset := int(s.counter.Add(1) % uint64(len(vs)))
+	min := math.MaxFloat64
+	for i := range vs {
+		node := vs[(offset+i)%len(vs)]
+		if n := float64(nodeLoadOf(node).active.Load()) / nodeWeight(node); n < min {
+			v, min = node, n
+		}
+	}
+	return
+}
+
+type latencyStrategy struct {
+	counter atomic.Uint64
+}
+
+// Apply selects the node with the lowest latency,
+// the nodes not measured yet are selected first in round-robin.
+func (s *latencyStrategy) Apply(ctx context.Context, vs ...*chain.Node) (v *chain.Node) {
+	if len(vs) == 0 {
+		return
+	}
+	offset := int(s.counter.Add(1) % uint64(len(vs)))
+	min := int64(math.MaxInt64)
+	for i := range vs {
+		node := vs[(offset+i)%len(vs)]
+		if n := nodeLoadOf(node).latency.Load(); n < min {
+			v, min = node, n
+		}
+	}
+	return
+}
+
+type p2cStrategy struct {
+	r  *rand.Rand
+	mu sync.Mutex
+}
+
+// Apply selects the node with the lower cost of two random nodes,
+// the cost is the latency multiplied by the active connections per weight.
+func (s *p2cStrategy) Apply(ctx context.Context, vs ...*chain.Node) *chain.Node {
+	switch len(vs) {
+	case 0:
+		return nil
+	case 1:
+		return vs[0]
+	}
+
+	s.mu.Lock()
+	i := s.r.Intn(len(vs))
+	j := s.r.Intn(len(vs) - 1)
+	s.mu.Unlock()
+	if j >= i {
+		j++
+	}
+
+	if p2cCost(vs[j]) < p2cCost(vs[i]) {
+		return vs[j]
+	}
+	return vs[i]
+}
+
+func p2cCost(node *chain.Node) float64 {
+	load := nodeLoadOf(node)
+	return float64(load.latency.Load()) * float64(load.active.Load()+1) / nodeWeight(node)
+}
+
+type chashStrategy struct {
+	// host is whether the key of the hash is the target host instead of the client IP.
+	host bool
+}
+
+// Apply selects the node by the rendezvous hash of the key, the node with the highest
+// weighted score of the key is selected, so only the keys of the nodes removed are moved.
+// The client IP and the target host are not available for the health checks, which select the first node.
+func (s *chashStrategy) Apply(ctx context.Context, vs ...*chain.Node) (v *chain.Node) {
+	if len(vs) == 0 {
+		return
+	}
+	key := s.key(ctx)
+	if key == "" {
+		return vs[0]
+	}
+
+	max := math.Inf(-1)
+	for _, node := range vs {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(node.Name))
+		h.Write([]byte{0})
+		h.Write([]byte(node.Addr))
+		// the hash is mapped to (0, 1) for the weighted score.
+		u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+		if score := -nodeWeight(node) / math.Log(u); score > max {
+			v, max = node, score
+		}
+	}
+	return
+}
+
+func (s *chashStrategy) key(ctx context.Context) string {
+	if s.host {
+		opts := selectOptionsFromContext(ctx)
+		addr := opts.Host
+		if addr == "" {
+			addr = opts.Addr
+		}
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			return host
+		}
+		return addr
+	}
+
+	var client string
+	if addr := ctxvalue.ClientAddrFromContext(ctx); addr != "" {
+		client = string(addr)
+	} else if rec := connRecordFromContext(ctx); rec != nil {
+		client = rec.Client
+	}
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		return host
+	}
+	return client
+}
@@ -0,0 +1,848 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/go-gost/core/limiter/traffic"
+	"github.com/go-gost/core/logger"
+	"github.com/go-gost/x/config"
+	limiter_parser "github.com/go-gost/x/config/parsing/limiter"
+)
+
+const (
+	// shapePriorities is the number of the priorities of the shaped connections, 0 is the highest.
+	shapePriorities = 8
+	// shapeDefaultPriority is the priority of the connections not matched by a priority class.
+	shapeDefaultPriority = 4
+	// shapeFlowExpiration is the idle time after which the limiters of a connection are released.
+	shapeFlowExpiration = 15 * time.Second
+	// shapeClassExpiration is the idle time after which the buckets of a user or an IP are released.
+	shapeClassExpiration = time.Minute
+)
+
+const (
+	shapeIn = iota
+	shapeOut
+)
+
+// parseTrafficLimiter parses the traffic limiter as go-gost/x does. The limits in the extended format
+// of the hierarchical traffic shaping, in the config or in the file, are served by shapeLimiter.
+//
+// A limit is a line of KEY IN [OUT] [OPTION...]. The keys $ (the service), $$ (each connection),
+// IP and CIDR (each IP of the CIDR) are the keys of go-gost/x, the extended keys are:
+//
+//	user:NAME              the connections of the authenticated user, user:* is each user not listed.
+//	class:NAME             a priority class, the connections matching the options are given its priority.
+//
+// The options are:
+//
+//	min=IN[/OUT]           the guaranteed rates of a user or an IP, which is sent regardless of the priorities
+//	                       as long as the sum of the guaranteed rates is within the rate of the service.
+//	prio=N                 the priority 0 (the highest) to 7 of a class, the default priority is 4.
+//	ports=22,3389,8000-8080 the target ports of a class.
+//	size=64KB              the connections of a class which have transferred less than the size.
+//
+// The rates IN and OUT of a user or an IP are the ceilings it bursts to with the rate the others
+// leave unused. When the rate of the service is saturated, the connections are served in the order
+// of their priorities.
+func parseTrafficLimiter(cfg *config.LimiterConfig) traffic.TrafficLimiter {
+	if cfg == nil || cfg.Plugin != nil || cfg.Redis != nil || cfg.HTTP != nil {
+		return limiter_parser.ParseTrafficLimiter(cfg)
+	}
+
+	var path string
+	if cfg.File != nil {
+		path = cfg.File.Path
+	}
+	if !slices.ContainsFunc(cfg.Limits, isShapeLimit) && !shapeFile(path) {
+		return limiter_parser.ParseTrafficLimiter(cfg)
+	}
+
+	return newShapeLimiter(cfg.Limits, path, cfg.Reload,
+		logger.Default().WithFields(map[string]any{
+			"kind":    "limiter",
+			"limiter": cfg.Name,
+		}))
+}
+
+// isShapeLimit reports whether the limit is in the extended format.
+func isShapeLimit(s string) bool {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return false
+	}
+	if strings.HasPrefix(fields[0], "user:") || strings.HasPrefix(fields[0], "class:") {
+		return true
+	}
+	for _, v := range fields[1:] {
+		if strings.Contains(v, "=") {
+			return true
+		}
+	}
+	return false
+}
+
+// shapeFile reports whether the file of the limits has a limit in the extended format.
+func shapeFile(path string) bool {
+	if path == "" {
+		return false
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if isShapeLimit(stripComment(scanner.Text())) {
+			return true
+		}
+	}
+	return false
+}
+
+func stripComment(s string) string {
+	if n := strings.IndexByte(s, '#'); n >= 0 {
+		s = s[:n]
+	}
+	return strings.TrimSpace(s)
+}
+
+// shapeSpec is the rates of a user or an IP by direction.
+type shapeSpec struct {
+	ceil [2]int
+	min  [2]int
+}
+
+type shapeCIDR struct {
+	prefix netip.Prefix
+	spec   *shapeSpec
+}
+
+// shapeClass is a priority class of the connections.
+type shapeClass struct {
+	name  string
+	prio  int
+	ports [][2]int
+	size  int64
+}
+
+func (c *shapeClass) match(port int, bytes int64) bool {
+	if len(c.ports) > 0 && !slices.ContainsFunc(c.ports, func(r [2]int) bool {
+		return port >= r[0] && port <= r[1]
+	}) {
+		return false
+	}
+	return c.size <= 0 || bytes < c.size
+}
+
+// shapePolicy is the parsed limits of a shapeLimiter.
+type shapePolicy struct {
+	service [2]int
+	conn    [2]int
+	users   map[string]*shapeSpec
+	anyUser *shapeSpec
+	ips     map[netip.Addr]*shapeSpec
+	// cidrs are in the order of the prefix length from the longest.
+	cidrs   []shapeCIDR
+	classes []*shapeClass
+}
+
+func parseShapePolicy(limits []string, log logger.Logger) *shapePolicy {
+	p := &shapePolicy{
+		users: make(map[string]*shapeSpec),
+		ips:   make(map[netip.Addr]*shapeSpec),
+	}
+	for _, s := range limits {
+		if s = stripComment(s); s == "" {
+			continue
+		}
+		if err := p.add(s); err != nil {
+			log.Warnf("limit %q: %v", s, err)
+		}
+	}
+	slices.SortStableFunc(p.cidrs, func(a, b shapeCIDR) int {
+		return b.prefix.Bits() - a.prefix.Bits()
+	})
+	return p
+}
+
+func (p *shapePolicy) add(s string) error {
+	fields := strings.Fields(s)
+	key := fields[0]
+
+	var rates []int
+	opts := make(map[string]string)
+	for _, v := range fields[1:] {
+		if k, v, ok := strings.Cut(v, "="); ok {
+			opts[strings.ToLower(k)] = v
+			continue
+		}
+		n, err := parseShapeRate(v)
+		if err != nil {
+			return err
+		}
+		rates = append(rates, n)
+	}
+	if len(rates) > 2 {
+		return fmt.Errorf("too many rates")
+	}
+
+	if name, ok := strings.CutPrefix(key, "class:"); ok {
+		if len(rates) > 0 {
+			return fmt.Errorf("a class has no rates")
+		}
+		return p.addClass(name, opts)
+	}
+
+	var spec shapeSpec
+	copy(spec.ceil[:], rates)
+	for k, v := range opts {
+		switch k {
+		case "min":
+			in, out, ok := strings.Cut(v, "/")
+			var err error
+			if spec.min[shapeIn], err = parseShapeRate(in); err != nil {
+				return err
+			}
+			if ok {
+				if spec.min[shapeOut], err = parseShapeRate(out); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("unknown option %s", k)
+		}
+	}
+
+	switch key {
+	case "$":
+		p.service = spec.ceil
+		return nil
+	case "$$":
+		p.conn = spec.ceil
+		return nil
+	}
+	if user, ok := strings.CutPrefix(key, "user:"); ok {
+		if user == "*" {
+			p.anyUser = &spec
+		} else {
+			p.users[user] = &spec
+		}
+		return nil
+	}
+	if prefix, err := netip.ParsePrefix(key); err == nil {
+		p.cidrs = append(p.cidrs, shapeCIDR{prefix: prefix.Masked(), spec: &spec})
+		return nil
+	}
+	if ip, err := netip.ParseAddr(key); err == nil {
+		p.ips[ip.Unmap()] = &spec
+		return nil
+	}
+	return fmt.Errorf("invalid key %s", key)
+}
+
+func (p *shapePolicy) addClass(name string, opts map[string]string) error {
+	c := &shapeClass{name: name, prio: shapeDefaultPriority}
+	for k, v := range opts {
+		switch k {
+		case "prio":
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 || n >= shapePriorities {
+				return fmt.Errorf("invalid priority %s", v)
+			}
+			c.prio = n
+		case "ports":
+			for _, s := range strings.Split(v, ",") {
+				lo, hi, ok := strings.Cut(s, "-")
+				if !ok {
+					hi = lo
+				}
+				a, err1 := strconv.Atoi(lo)
+				b, err2 := strconv.Atoi(hi)
+				if err1 != nil || err2 != nil || a > b {
+					return fmt.Errorf("invalid ports %s", s)
+				}
+				c.ports = append(c.ports, [2]int{a, b})
+			}
+		case "size":
+			n, err := units.ParseBase2Bytes(v)
+			if err != nil {
+				return err
+			}
+			c.size = int64(n)
+		default:
+			return fmt.Errorf("unknown option %s", k)
+		}
+	}
+	p.classes = append(p.classes, c)
+	return nil
+}
+
+func parseShapeRate(s string) (int, error) {
+	n, err := units.ParseBase2Bytes(s)
+	if err != nil {
+		return 0, err
+	}
+	return int(max(n, 0)), nil
+}
+
+// specOf returns the key and the rates of the class of the user or the client IP, the user takes precedence.
+func (p *shapePolicy) specOf(user string, ip netip.Addr) (string, *shapeSpec) {
+	if user != "" {
+		if spec := p.users[user]; spec != nil {
+			return "user:" + user, spec
+		}
+		if p.anyUser != nil {
+			return "user:" + user, p.anyUser
+		}
+	}
+	if !ip.IsValid() {
+		return "", nil
+	}
+	if spec := p.ips[ip]; spec != nil {
+		return "ip:" + ip.String(), spec
+	}
+	for _, c := range p.cidrs {
+		if c.prefix.Contains(ip) {
+			return "ip:" + ip.String(), c.spec
+		}
+	}
+	return "", nil
+}
+
+func (p *shapePolicy) priority(port int, bytes int64) int {
+	for _, c := range p.classes {
+		if c.match(port, bytes) {
+			return c.prio
+		}
+	}
+	return shapeDefaultPriority
+}
+
+// limited reports whether the connections are limited in the direction.
+func (p *shapePolicy) limited(dir int) bool {
+	if p.service[dir] > 0 || p.conn[dir] > 0 {
+		return true
+	}
+	specs := []*shapeSpec{p.anyUser}
+	for _, v := range p.users {
+		specs = append(specs, v)
+	}
+	for _, v := range p.ips {
+		specs = append(specs, v)
+	}
+	for _, v := range p.cidrs {
+		specs = append(specs, v.spec)
+	}
+	return slices.ContainsFunc(specs, func(spec *shapeSpec) bool {
+		return spec != nil && (spec.ceil[dir] > 0 || spec.min[dir] > 0)
+	})
+}
+
+// shapeLimiter is the traffic limiter of the hierarchical traffic shaping. The rate of the service
+// is shared by the users and the IPs with their guaranteed rates and ceilings, and by the connections
+// in the order of their priorities.
+type shapeLimiter struct {
+	limits  []string
+	path    string
+	policy  atomic.Pointer[shapePolicy]
+	service [2]*shapeBucket
+	// nodes are the buckets of the users and the IPs.
+	nodes   map[string]*shapeNode
+	flows   map[string]*shapeFlow
+	modTime time.Time
+	size    int64
+	mu      sync.Mutex
+	cancel  context.CancelFunc
+	logger  logger.Logger
+}
+
+func newShapeLimiter(limits []string, path string, period time.Duration, log logger.Logger) *shapeLimiter {
+	if period < time.Second {
+		period = time.Second
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &shapeLimiter{
+		limits: limits,
+		path:   path,
+		nodes:  make(map[string]*shapeNode),
+		flows:  make(map[string]*shapeFlow),
+		cancel: cancel,
+		logger: log,
+	}
+	if err := l.reload(); err != nil {
+		log.Warnf("reload: %v", err)
+	}
+	if l.policy.Load() == nil {
+		l.apply(parseShapePolicy(limits, log))
+	}
+	go l.watch(ctx, period)
+
+	return l
+}
+
+// In obtains the input limiter of the client connection of the address key.
+func (l *shapeLimiter) In(ctx context.Context, key string, opts ...traffic.Option) traffic.Limiter {
+	return l.limiter(key, shapeIn)
+}
+
+// Out obtains the output limiter of the client connection of the address key.
+func (l *shapeLimiter) Out(ctx context.Context, key string, opts ...traffic.Option) traffic.Limiter {
+	return l.limiter(key, shapeOut)
+}
+
+func (l *shapeLimiter) limiter(key string, dir int) traffic.Limiter {
+	if !l.policy.Load().limited(dir) {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f := l.flows[key]
+	if f == nil {
+		f = &shapeFlow{shaper: l, client: key}
+		if host, _, err := net.SplitHostPort(key); err == nil {
+			f.ip, _ = netip.ParseAddr(host)
+			f.ip = f.ip.Unmap()
+		}
+		l.flows[key] = f
+	}
+	f.touch()
+	return &shapeFlowLimiter{flow: f, dir: dir}
+}
+
+func (l *shapeLimiter) Close() error {
+	l.cancel()
+	return nil
+}
+
+func (l *shapeLimiter) watch(ctx context.Context, period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := l.reload(); err != nil {
+				l.logger.Warnf("reload: %v", err)
+			}
+			l.expire(time.Now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reload re-reads the file of the limits if it has been modified since the last read.
+func (l *shapeLimiter) reload() error {
+	if l.path == "" {
+		return nil
+	}
+
+	fi, err := os.Stat(l.path)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	modified := !fi.ModTime().Equal(l.modTime) || fi.Size() != l.size
+	l.mu.Unlock()
+	if !modified {
+		return nil
+	}
+
+	f, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	limits, err := readShapeLimits(f)
+	if err != nil {
+		return err
+	}
+	l.logger.Debugf("load items %d", len(limits))
+
+	l.apply(parseShapePolicy(append(slices.Clone(l.limits), limits...), l.logger))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.modTime = fi.ModTime()
+	l.size = fi.Size()
+	return nil
+}
+
+func readShapeLimits(r io.Reader) (limits []string, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if s := stripComment(scanner.Text()); s != "" {
+			limits = append(limits, s)
+		}
+	}
+	return limits, scanner.Err()
+}
+
+// apply applies the policy, the buckets of the users and the IPs are created again by the new rates.
+func (l *shapeLimiter) apply(p *shapePolicy) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for dir := range l.service {
+		if l.service[dir] == nil {
+			l.service[dir] = newShapeBucket(p.service[dir])
+		} else {
+			l.service[dir].set(p.service[dir])
+		}
+	}
+	clear(l.nodes)
+	l.policy.Store(p)
+}
+
+// node returns the buckets of the user or the IP of the key.
+func (l *shapeLimiter) node(key string, spec *shapeSpec) *shapeNode {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := l.nodes[key]
+	if n == nil || n.spec != spec {
+		n = &shapeNode{spec: spec}
+		for dir := range n.ceil {
+			n.ceil[dir] = newShapeBucket(spec.ceil[dir])
+			if spec.min[dir] > 0 {
+				n.min[dir] = newShapeBucket(spec.min[dir])
+			}
+		}
+		l.nodes[key] = n
+	}
+	n.last = time.Now()
+	return n
+}
+
+// expire releases the flows and the nodes not used for a while.
+func (l *shapeLimiter) expire(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, f := range l.flows {
+		if now.Sub(time.Unix(0, f.last.Load())) > shapeFlowExpiration {
+			delete(l.flows, key)
+		}
+	}
+	for key, n := range l.nodes {
+		if now.Sub(n.last) > shapeClassExpiration {
+			delete(l.nodes, key)
+		}
+	}
+}
+
+// shapeNode is the buckets of a user or an IP.
+type shapeNode struct {
+	spec *shapeSpec
+	ceil [2]*shapeBucket
+	min  [2]*shapeBucket
+	last time.Time
+}
+
+// shapeFlow is the state of a client connection.
+type shapeFlow struct {
+	shaper *shapeLimiter
+	client string
+	ip     netip.Addr
+	rec    atomic.Pointer[connRecord]
+	// policy is the policy the buckets of the connection are created by.
+	policy *shapePolicy
+	conn   [2]*shapeBucket
+	bytes  atomic.Int64
+	last   atomic.Int64
+	mu     sync.Mutex
+}
+
+func (f *shapeFlow) touch() {
+	f.last.Store(time.Now().UnixNano())
+}
+
+// record returns the record of the connection in the connection table once the handler handles it.
+func (f *shapeFlow) record() *connRecord {
+	if rec := f.rec.Load(); rec != nil {
+		return rec
+	}
+	rec := connections.client(f.client)
+	if rec != nil {
+		f.rec.Store(rec)
+	}
+	return rec
+}
+
+// buckets returns the bucket of the connection and the buckets of the user or the IP of the connection,
+// with the priority of the connection.
+func (f *shapeFlow) buckets(dir int) (conn *shapeBucket, node *shapeNode, prio int) {
+	p := f.shaper.policy.Load()
+
+	f.mu.Lock()
+	if f.policy != p {
+		f.policy = p
+		for dir := range f.conn {
+			f.conn[dir] = nil
+			if p.conn[dir] > 0 {
+				f.conn[dir] = newShapeBucket(p.conn[dir])
+			}
+		}
+	}
+	conn = f.conn[dir]
+	f.mu.Unlock()
+
+	var user string
+	var port int
+	bytes := f.bytes.Load()
+	if rec := f.record(); rec != nil {
+		rec.mu.Lock()
+		user, port = rec.User, targetPort(rec.Target)
+		rec.mu.Unlock()
+		bytes = rec.bytesIn.Load() + rec.bytesOut.Load()
+	}
+	if key, spec := p.specOf(user, f.ip); spec != nil {
+		node = f.shaper.node(key, spec)
+	}
+	return conn, node, p.priority(port, bytes)
+}
+
+func targetPort(addr string) int {
+	_, port, _ := net.SplitHostPort(addr)
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+// shapeFlowLimiter is the limiter of a client connection in a direction.
+type shapeFlowLimiter struct {
+	flow *shapeFlow
+	dir  int
+}
+
+// Wait waits for the rates of the connection, the user or the IP, and the service in turn.
+// The bytes within the guaranteed rate of the user or the IP do not wait for the service,
+// they are taken from the rate of the service in advance of the other connections.
+func (l *shapeFlowLimiter) Wait(ctx context.Context, n int) int {
+	f := l.flow
+	f.touch()
+
+	conn, node, prio := f.buckets(l.dir)
+	service := f.shaper.service[l.dir]
+	var ceil, guaranteed *shapeBucket
+	if node != nil {
+		ceil, guaranteed = node.ceil[l.dir], node.min[l.dir]
+	}
+	for _, b := range []*shapeBucket{conn, ceil, service} {
+		if v := b.burst(); v > 0 && n > v {
+			n = v
+		}
+	}
+
+	conn.wait(ctx, prio, n)
+	if guaranteed.allow(n) {
+		ceil.take(n)
+		service.take(n)
+	} else {
+		ceil.wait(ctx, prio, n)
+		service.wait(ctx, prio, n)
+	}
+	f.bytes.Add(int64(n))
+	return n
+}
+
+// Limit returns the lowest rate of the connection, 0 if it is not limited.
+func (l *shapeFlowLimiter) Limit() int {
+	conn, node, _ := l.flow.buckets(l.dir)
+	buckets := []*shapeBucket{conn, l.flow.shaper.service[l.dir]}
+	if node != nil {
+		buckets = append(buckets, node.ceil[l.dir])
+	}
+	limit := 0
+	for _, b := range buckets {
+		if v := b.burst(); v > 0 && (limit == 0 || v < limit) {
+			limit = v
+		}
+	}
+	return limit
+}
+
+// Set does nothing, the rates are set by the limits.
+func (l *shapeFlowLimiter) Set(n int) {}
+
+func (l *shapeFlowLimiter) String() string {
+	return strconv.Itoa(l.Limit())
+}
+
+// shapeBucket is a token bucket of a rate per second and a burst of the rate. The waiters are served
+// in the order of their priorities, and in the order of arrival within a priority.
+// A nil bucket or a bucket of the rate 0 is unlimited.
+type shapeBucket struct {
+	rate    float64
+	tokens  float64
+	last    time.Time
+	waiters [shapePriorities][]*shapeWaiter
+	queued  int
+	timer   *time.Timer
+	mu      sync.Mutex
+}
+
+type shapeWaiter struct {
+	n     float64
+	ready chan struct{}
+}
+
+func newShapeBucket(rate int) *shapeBucket {
+	return &shapeBucket{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+func (b *shapeBucket) burst() int {
+	if b == nil {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return int(b.rate)
+}
+
+func (b *shapeBucket) set(rate int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	b.rate = float64(rate)
+	b.tokens = min(b.tokens, b.rate)
+	b.dispatch()
+}
+
+// wait waits until n tokens are taken by the priority.
+func (b *shapeBucket) wait(ctx context.Context, prio, n int) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	b.refill(time.Now())
+	if b.rate <= 0 {
+		b.mu.Unlock()
+		return
+	}
+	if b.queued == 0 && b.tokens >= float64(n) {
+		b.tokens -= float64(n)
+		b.mu.Unlock()
+		return
+	}
+	w := &shapeWaiter{n: float64(n), ready: make(chan struct{})}
+	b.waiters[prio] = append(b.waiters[prio], w)
+	b.queued++
+	b.dispatch()
+	b.mu.Unlock()
+
+	select {
+	case <-w.ready:
+	case <-ctx.Done():
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		if i := slices.Index(b.waiters[prio], w); i >= 0 {
+			b.waiters[prio] = slices.Delete(b.waiters[prio], i, i+1)
+			b.queued--
+			b.dispatch()
+		}
+	}
+}
+
+// take takes n tokens without waiting, the bucket owes at most a burst.
+func (b *shapeBucket) take(n int) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	if b.rate > 0 {
+		b.tokens = max(b.tokens-float64(n), -b.rate)
+	}
+}
+
+// allow takes n tokens if they are available, a nil bucket allows nothing.
+func (b *shapeBucket) allow(n int) bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	if b.rate <= 0 || b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+func (b *shapeBucket) refill(now time.Time) {
+	if d := now.Sub(b.last); d > 0 {
+		b.tokens = min(b.rate, b.tokens+d.Seconds()*b.rate)
+	}
+	b.last = now
+}
+
+// dispatch serves the waiters with the tokens, the waiters of the lower priorities
+// wait for the first waiter of the highest priority. b.mu must be held.
+func (b *shapeBucket) dispatch() {
+	b.refill(time.Now())
+	for prio := range b.waiters {
+		for len(b.waiters[prio]) > 0 {
+			w := b.waiters[prio][0]
+			if b.rate > 0 {
+				w.n = min(w.n, b.rate)
+				if b.tokens < w.n {
+					d := time.Duration((w.n - b.tokens) / b.rate * float64(time.Second))
+					if b.timer == nil {
+						b.timer = time.AfterFunc(d, b.onTimer)
+					} else {
+						b.timer.Reset(d)
+					}
+					return
+				}
+				b.tokens -= w.n
+			}
+			close(w.ready)
+			b.waiters[prio][0] = nil
+			b.waiters[prio] = b.waiters[prio][1:]
+			b.queued--
+		}
+	}
+}
+
+func (b *shapeBucket) onTimer() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.dispatch()
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-gost/core/chain"
+	"github.com/go-gost/core/hop"
+	"github.com/go-gost/x/config"
+	"github.com/go-gost/x/registry"
+	xservice "github.com/go-gost/x/service"
+)
+
+// The health of the nodes in the status.
+const (
+	nodeHealthy = "healthy"
+	nodeFailed  = "failed"
+	// nodeUnknown is the node which has not been used by any route since the start.
+	nodeUnknown = "unknown"
+)
+
+// routeNodes are the nodes used by the routes of the chains, by the chain and node name.
+// Without the active health check, the health of a node is only known after it is used.
+var routeNodes sync.Map
+
+type routeNodeKey struct {
+	chain string
+	node  string
+}
+
+// trackNodes records the nodes used by a route of the chain.
+func trackNodes(chainName string, nodes []*chain.Node) {
+	for _, node := range nodes {
+		routeNodes.Store(routeNodeKey{chain: chainName, node: node.Name}, node)
+	}
+}
+
+// apiStatus is the response of the status API, the runtime state of the components in the config.
+type apiStatus struct {
+	Time     time.Time       `json:"time"`
+	Services []serviceStatus `json:"services"`
+	Chains   []chainStatus   `json:"chains"`
+	Hops     []hopStatus     `json:"hops"`
+}
+
+type serviceStatus struct {
+	Name     string `json:"name"`
+	Addr     string `json:"addr"`
+	Handler  string `json:"handler,omitempty"`
+	Listener string `json:"listener,omitempty"`
+	// State is the state of the service, running, ready, failed or closed,
+	// it is empty if the service failed to be created.
+	State string `json:"state"`
+	// Paused is whether the service is paused by the API.
+	Paused bool `json:"paused,omitempty"`
+	// OffSchedule is whether the service is disabled by its schedules.
+	OffSchedule bool `json:"offSchedule,omitempty"`
+	// Forwarder is the nodes of the forwarder of the service.
+	Forwarder []nodeStatus `json:"forwarder,omitempty"`
+	serviceTraffic
+}
+
+type chainStatus struct {
+	Name string      `json:"name"`
+	Hops []hopStatus `json:"hops"`
+}
+
+type hopStatus struct {
+	Name     string                 `json:"name"`
+	Selector *config.SelectorConfig `json:"selector,omitempty"`
+	Nodes    []nodeStatus           `json:"nodes"`
+}
+
+type nodeStatus struct {
+	Name   string `json:"name"`
+	Addr   string `json:"addr"`
+	Health string `json:"health"`
+	// Fails is the number of the continuous failures of the node.
+	Fails    int64      `json:"fails,omitempty"`
+	FailTime *time.Time `json:"failTime,omitempty"`
+	// Check is the state of the active health check of the node.
+	Check *nodeHealth `json:"check,omitempty"`
+	// Circuit is the state of the circuit breaker of the node.
+	Circuit *circuitStatus `json:"circuit,omitempty"`
+}
+
+func buildStatus(cfg *config.Config) *apiStatus {
+	status := &apiStatus{
+		Time:     time.Now(),
+		Services: []serviceStatus{},
+		Chains:   []chainStatus{},
+		Hops:     []hopStatus{},
+	}
+	if cfg == nil {
+		return status
+	}
+
+	traffic := connections.traffic()
+	for _, c := range cfg.Services {
+		if c == nil {
+			continue
+		}
+		st := serviceStatus{
+			Name:           c.Name,
+			Addr:           c.Addr,
+			Paused:         servicePaused(c.Name),
+			OffSchedule:    serviceOffSchedule(c.Name),
+			serviceTraffic: traffic[c.Name],
+		}
+		if c.Handler != nil {
+			st.Handler = c.Handler.Type
+		}
+		if c.Listener != nil {
+			st.Listener = c.Listener.Type
+		}
+		if c.Forwarder != nil {
+			st.Forwarder = buildForwarderStatus(c.Name, c.Forwarder)
+		}
+		if svc := registry.ServiceRegistry().Get(c.Name); svc != nil {
+			st.Addr = svc.Addr().String()
+			st.State = string(xservice.StateReady)
+			if s, ok := svc.(interface{ Status() *xservice.Status }); ok {
+				st.State = string(s.Status().State())
+			}
+		}
+		status.Services = append(status.Services, st)
+	}
+
+	for _, c := range cfg.Chains {
+		if c == nil {
+			continue
+		}
+		st := chainStatus{Name: c.Name, Hops: []hopStatus{}}
+		for _, h := range c.Hops {
+			if h == nil {
+				continue
+			}
+			if len(h.Nodes) == 0 && h.Plugin == nil {
+				// the hop is a reference to a hop in the hop registry.
+				for _, hc := range cfg.Hops {
+					if hc != nil && hc.Name == h.Name {
+						h = hc
+						break
+					}
+				}
+			}
+			st.Hops = append(st.Hops, buildHopStatus(c.Name, h))
+		}
+		status.Chains = append(status.Chains, st)
+	}
+
+	for _, h := range cfg.Hops {
+		if h != nil {
+			status.Hops = append(status.Hops, buildHopStatus("", h))
+		}
+	}
+
+	return status
+}
+
+func buildHopStatus(chainName string, cfg *config.HopConfig) hopStatus {
+	nodes := map[string]*chain.Node{}
+	if nl, ok := registry.HopRegistry().Get(cfg.Name).(hop.NodeList); ok {
+		for _, node := range nl.Nodes() {
+			nodes[node.Name] = node
+		}
+	}
+	if c := registeredChain(chainName); c != nil {
+		for _, h := range c.hops {
+			if h.name != cfg.Name {
+				continue
+			}
+			for _, node := range hopNodes(h.Hop) {
+				nodes[node.Name] = node
+			}
+		}
+	}
+
+	st := hopStatus{
+		Name:     cfg.Name,
+		Selector: cfg.Selector,
+		Nodes:    []nodeStatus{},
+	}
+	for _, c := range cfg.Nodes {
+		if c == nil {
+			continue
+		}
+		ns := nodeStatus{
+			Name:   c.Name,
+			Addr:   c.Addr,
+			Health: nodeUnknown,
+		}
+
+		node := nodes[c.Name]
+		if node == nil && chainName != "" {
+			if v, ok := routeNodes.Load(routeNodeKey{chain: chainName, node: c.Name}); ok {
+				node = v.(*chain.Node)
+			}
+		}
+		if chainName != "" {
+			ns.Check = healthOf(healthKey{chain: chainName, hop: cfg.Name, node: c.Name})
+		}
+		setNodeHealth(&ns, node)
+		st.Nodes = append(st.Nodes, ns)
+	}
+	return st
+}
+
+func buildForwarderStatus(service string, cfg *config.ForwarderConfig) []nodeStatus {
+	nodes := map[string]*chain.Node{}
+	if c := healthChecks.forwarder(service); c != nil {
+		if hops, ok := c.hops(); ok {
+			for _, h := range hops {
+				for _, node := range h.nodes {
+					nodes[node.Name] = node
+				}
+			}
+		}
+	}
+
+	var st []nodeStatus
+	for _, c := range cfg.Nodes {
+		if c == nil {
+			continue
+		}
+		ns := nodeStatus{
+			Name:   c.Name,
+			Addr:   c.Addr,
+			Health: nodeUnknown,
+			Check:  healthOf(healthKey{service: service, node: c.Name}),
+		}
+		setNodeHealth(&ns, nodes[c.Name])
+		st = append(st, ns)
+	}
+	return st
+}
+
+// setNodeHealth sets the health of the node by the fail marks, the active health check and the circuit breaker.
+func setNodeHealth(ns *nodeStatus, node *chain.Node) {
+	if b := breakerOf(node); b != nil {
+		ns.Circuit = b.status()
+		defer func() {
+			if ns.Circuit.State == circuitOpen {
+				ns.Health = nodeEjected
+			}
+		}()
+	}
+	if node != nil && node.Marker() != nil {
+		if fails := node.Marker().Count(); fails > 0 {
+			t := node.Marker().Time()
+			ns.Health, ns.Fails, ns.FailTime = nodeFailed, fails, &t
+		} else if nodeUsed(node) {
+			ns.Health = nodeHealthy
+		}
+	}
+	if ns.Check == nil {
+		return
+	}
+	switch ns.Check.State {
+	case nodeUnhealthy:
+		ns.Health = nodeUnhealthy
+	case nodeHealthy:
+		if ns.Fails == 0 {
+			ns.Health = nodeHealthy
+		}
+	}
+}
+
+// nodeUsed reports whether the node has been used by a route of any chain.
+func nodeUsed(node *chain.Node) (used bool) {
+	routeNodes.Range(func(_, v any) bool {
+		if v.(*chain.Node).Marker() == node.Marker() {
+			used = true
+		}
+		return !used
+	})
+	return
+}
@@ -0,0 +1,1380 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	mdutil "github.com/go-gost/core/metadata/util"
+	"github.com/go-gost/x/config"
+	"github.com/go-gost/x/limiter/conn"
+	"github.com/go-gost/x/limiter/traffic"
+	mdx "github.com/go-gost/x/metadata"
+)
+
+var (
+	// service URL query parameters interpreted by buildConfigFromCmd and buildServiceConfig.
+	serviceCmdParams = []string{
+		"auth", "certFile", "cert", "keyFile", "key", "caFile", "ca",
+		"authFile", "retries", "admission", "bypass", "resolver", "hosts",
+		"limiter.in", "limiter.out", "limiter.conn.in", "limiter.conn.out",
+		"climiter", "rlimiter",
+		"auther", "limiter", "observer", "admissions", "bypasses", "recorder", "recorder.record",
+	}
+	// node URL query parameters interpreted by buildConfigFromCmd and buildNodeConfig.
+	nodeCmdParams = []string{
+		"auth", "authFile", "certFile", "cert", "keyFile", "key", "caFile", "ca",
+		"secure", "serverName",
+		"bypass", "bypasses", "resolver", "hosts", "interface", "so_mark",
+		"limiter.in", "limiter.out", "limiter.conn.in", "limiter.conn.out",
+		"recorder", "recorder.record",
+	}
+	// node metadata keys converted to the node-<index>.<option> parameters.
+	nodeMetadataKeys = append([]string{"weight", "backup", "maxFails", "failTimeout"}, hopNodeKeys...)
+	// selector parameters parsed by parseSelector.
+	selectorCmdParams = []string{
+		"strategy", "maxFails", "max_fails", "failTimeout", "fail_timeout",
+	}
+)
+
+// cmdBuilder renders a config.Config into the command line arguments
+// which are parsed back by buildConfigFromCmd into an equivalent config.
+type cmdBuilder struct {
+	cfg *config.Config
+	ext *ExtConfig
+	// referenced components, used to report the unreferenced ones.
+	used map[string]bool
+	// parts of the config that can not be expressed on the command line.
+	unsupported []string
+}
+
+// buildCmdFromConfig converts cfg and the extended configuration ext to the -L/-F/-api/-metrics/-D
+// command line arguments. The returned unsupported list describes every part of cfg which is lost in the conversion.
+func buildCmdFromConfig(cfg *config.Config, ext *ExtConfig) (args []string, unsupported []string) {
+	if cfg == nil {
+		return
+	}
+	if ext == nil {
+		ext = &ExtConfig{}
+	}
+
+	b := &cmdBuilder{
+		cfg:  cfg,
+		ext:  ext,
+		used: make(map[string]bool),
+	}
+
+	chainCfg := b.chain()
+
+	for _, svc := range cfg.Services {
+		if svc == nil {
+			continue
+		}
+		if s := b.service(svc, chainCfg); s != "" {
+			args = append(args, "-L", s)
+		}
+	}
+
+	if chainCfg != nil {
+		for _, hop := range chainCfg.Hops {
+			if hop == nil {
+				continue
+			}
+			if s := b.hop(hop); s != "" {
+				args = append(args, "-F", s)
+			}
+		}
+	}
+
+	args = append(args, b.global()...)
+
+	b.unused()
+	if ext.Tracing != nil {
+		b.report("tracing")
+	}
+	if ext.Metrics != nil && ext.Metrics.Push != nil {
+		b.report("metrics.push")
+	}
+
+	return args, b.unsupported
+}
+
+func (b *cmdBuilder) report(format string, a ...any) {
+	b.unsupported = append(b.unsupported, fmt.Sprintf(format, a...))
+}
+
+// chain finds the only chain which can be used by the services.
+func (b *cmdBuilder) chain() *config.ChainConfig {
+	var name string
+	for _, svc := range b.cfg.Services {
+		if svc == nil {
+			continue
+		}
+		if v := serviceChain(svc); v != "" {
+			name = v
+			break
+		}
+	}
+
+	var chainCfg *config.ChainConfig
+	for _, c := range b.cfg.Chains {
+		if c == nil {
+			continue
+		}
+		if name == "" || c.Name == name {
+			chainCfg = c
+			break
+		}
+	}
+	if chainCfg == nil {
+		if name != "" {
+			b.report("chain %s: not found", name)
+		}
+		return nil
+	}
+
+	b.used["chain/"+chainCfg.Name] = true
+	if len(chainCfg.Metadata) > 0 {
+		b.report("chain %s: metadata", chainCfg.Name)
+	}
+	return chainCfg
+}
+
+func serviceChain(svc *config.ServiceConfig) string {
+	if svc.Listener != nil && (svc.Listener.Type == "rtcp" || svc.Listener.Type == "rudp") {
+		return svc.Listener.Chain
+	}
+	if svc.Handler != nil {
+		return svc.Handler.Chain
+	}
+	return ""
+}
+
+func (b *cmdBuilder) service(svc *config.ServiceConfig, chainCfg *config.ChainConfig) string {
+	prefix := fmt.Sprintf("service %s", svc.Name)
+
+	handlerCfg := svc.Handler
+	if handlerCfg == nil {
+		handlerCfg = &config.HandlerConfig{}
+	}
+	listenerCfg := svc.Listener
+	if listenerCfg == nil {
+		listenerCfg = &config.ListenerConfig{}
+	}
+	handler := strings.TrimSpace(handlerCfg.Type)
+	if handler == "" {
+		handler = "auto"
+	}
+	listener := strings.TrimSpace(listenerCfg.Type)
+	if listener == "" {
+		listener = "tcp"
+	}
+
+	var chainName string
+	if chainCfg != nil {
+		chainName = chainCfg.Name
+	}
+	if v := serviceChain(svc); v != chainName {
+		if v == "" {
+			b.report("%s: chain %s would be applied to this service", prefix, chainName)
+		} else {
+			b.report("%s: chain %s, only one chain is supported", prefix, v)
+		}
+	}
+	if listener == "rtcp" || listener == "rudp" {
+		if handlerCfg.Chain != "" {
+			b.report("%s: handler.chain", prefix)
+		}
+	} else if listenerCfg.Chain != "" {
+		b.report("%s: listener.chain", prefix)
+	}
+	if handlerCfg.ChainGroup != nil {
+		b.report("%s: handler.chainGroup", prefix)
+	}
+	if listenerCfg.ChainGroup != nil {
+		b.report("%s: listener.chainGroup", prefix)
+	}
+
+	forward := svc.Forwarder != nil && len(svc.Forwarder.Nodes) > 0
+
+	scheme := handler + "+" + listener
+	for _, s := range []string{handler, listener, scheme} {
+		if h, ln := parseServiceScheme(s, forward); h == handler && ln == listener {
+			scheme = s
+			break
+		}
+	}
+	if h, ln := parseServiceScheme(scheme, forward); h != handler || ln != listener {
+		b.report("%s: handler %s with listener %s", prefix, handler, listener)
+	}
+
+	u := &url.URL{
+		Scheme: scheme,
+		Host:   svc.Addr,
+	}
+
+	auth := handlerCfg.Auth
+	if listener == "ssh" || listener == "sshd" {
+		auth = listenerCfg.Auth
+		if handlerCfg.Auth != nil {
+			b.report("%s: handler.auth", prefix)
+		}
+	} else if listenerCfg.Auth != nil {
+		b.report("%s: listener.auth", prefix)
+	}
+	if auth != nil {
+		u.User = userinfo(auth)
+	}
+
+	auther := handlerCfg.Auther
+	if listener == "ssh" || listener == "sshd" {
+		auther = listenerCfg.Auther
+		if handlerCfg.Auther != "" {
+			b.report("%s: handler.auther", prefix)
+		}
+	} else if listenerCfg.Auther != "" {
+		b.report("%s: listener.auther", prefix)
+	}
+	var authFile string
+	if auther != "" {
+		if auth != nil {
+			b.report("%s: auth with auther %s", prefix, auther)
+		}
+		authFile = b.authFile(prefix, auther)
+	}
+	if len(handlerCfg.Authers) > 0 {
+		b.report("%s: handler.authers", prefix)
+	}
+	if len(listenerCfg.Authers) > 0 {
+		b.report("%s: listener.authers", prefix)
+	}
+	if handlerCfg.TLS != nil {
+		b.report("%s: handler.tls", prefix)
+	}
+	if handlerCfg.Limiter != "" {
+		b.report("%s: handler.limiter", prefix)
+	}
+	if handlerCfg.Observer != "" {
+		b.report("%s: handler.observer", prefix)
+	}
+	if svc.Interface != "" {
+		b.report("%s: interface, use metadata.interface instead", prefix)
+	}
+	if svc.SockOpts != nil {
+		b.report("%s: sockopts, use metadata.so_mark instead", prefix)
+	}
+	if svc.Logger != "" || len(svc.Loggers) > 0 {
+		b.report("%s: logger", prefix)
+	}
+	if svc.Observer != "" {
+		b.report("%s: observer", prefix)
+	}
+	if len(svc.Recorders) > 0 {
+		b.report("%s: recorders", prefix)
+	}
+	if len(svc.Admissions) > 0 {
+		b.report("%s: admissions", prefix)
+	}
+	if len(svc.Bypasses) > 0 {
+		b.report("%s: bypasses", prefix)
+	}
+
+	reserved := serviceCmdParams
+	if forward {
+		// the selector parameters are only parsed for the forwarder.
+		reserved = append(append([]string{}, reserved...), selectorCmdParams...)
+	}
+	md := b.metadata(prefix, reserved, map[string]map[string]any{
+		"handler.metadata":  handlerCfg.Metadata,
+		"listener.metadata": listenerCfg.Metadata,
+		"metadata":          svc.Metadata,
+	})
+	query := url.Values{}
+	for k, v := range md {
+		query.Set(k, v)
+	}
+	if authFile != "" {
+		query.Set("authFile", authFile)
+	}
+
+	if forward {
+		var addrs []string
+		var checks url.Values
+		for _, node := range svc.Forwarder.Nodes {
+			if node == nil {
+				continue
+			}
+			nc := b.forwardNode(prefix, node)
+			if checks == nil {
+				checks = nc
+			} else if !equalJSON(checks, nc) {
+				b.report("%s: forwarder node %s health check or circuit breaker differs from node %s", prefix, node.Name, svc.Forwarder.Nodes[0].Name)
+			}
+			addrs = append(addrs, node.Addr)
+		}
+		for k, v := range checks {
+			query[k] = v
+		}
+		u.Path = "/" + strings.Join(addrs, ",")
+
+		if svc.Forwarder.Name != "" {
+			b.report("%s: forwarder.name", prefix)
+		}
+		selectorQuery(query, svc.Forwarder.Selector)
+	} else if svc.Forwarder != nil {
+		b.report("%s: forwarder without nodes", prefix)
+	}
+
+	if tls := listenerCfg.TLS; tls != nil {
+		if tls.CertFile == "" {
+			b.report("%s: listener.tls without certFile", prefix)
+		} else {
+			query.Set("certFile", tls.CertFile)
+			if tls.KeyFile != "" {
+				query.Set("keyFile", tls.KeyFile)
+			}
+			if tls.CAFile != "" {
+				query.Set("caFile", tls.CAFile)
+			}
+		}
+		if tls.Secure || tls.ServerName != "" || tls.Options != nil ||
+			tls.Validity > 0 || tls.CommonName != "" || tls.Organization != "" {
+			b.report("%s: listener.tls options other than certFile, keyFile and caFile", prefix)
+		}
+	}
+
+	if handlerCfg.Retries > 0 {
+		query.Set("retries", strconv.Itoa(handlerCfg.Retries))
+	}
+	if svc.Admission != "" {
+		if v := b.admission(prefix, svc.Admission); v != "" {
+			query.Set("admission", v)
+		}
+	}
+	if svc.Bypass != "" {
+		if v := b.bypass(prefix, svc.Bypass); v != "" {
+			query.Set("bypass", v)
+		}
+	}
+	if svc.Resolver != "" {
+		if v, prefer := b.resolver(prefix, svc.Resolver); v != "" {
+			query.Set("resolver", v)
+			if prefer != md["prefer"] {
+				if md["prefer"] != "" {
+					b.report("%s: resolver %s prefer %s conflicts with metadata.prefer", prefix, svc.Resolver, prefer)
+				}
+				query.Set("prefer", prefer)
+			}
+		}
+	}
+	if svc.Hosts != "" {
+		if v := b.hosts(prefix, svc.Hosts); v != "" {
+			query.Set("hosts", v)
+		}
+	}
+	if svc.Limiter != "" {
+		b.limiter(prefix, svc.Limiter, query)
+	}
+	if svc.CLimiter != "" {
+		if v := b.simpleLimiter(prefix, "climiter", svc.CLimiter, b.cfg.CLimiters); v != "" {
+			if n, _ := strconv.Atoi(v); n > 0 {
+				query.Set("climiter", v)
+			} else {
+				b.report("%s: climiter %s limit %s", prefix, svc.CLimiter, v)
+			}
+		}
+	}
+	if svc.RLimiter != "" {
+		if v := b.simpleLimiter(prefix, "rlimiter", svc.RLimiter, b.cfg.RLimiters); v != "" {
+			if f, _ := strconv.ParseFloat(v, 64); f > 0 {
+				query.Set("rlimiter", v)
+			} else {
+				b.report("%s: rlimiter %s limit %s", prefix, svc.RLimiter, v)
+			}
+		}
+	}
+
+	u.RawQuery = encodeQuery(query)
+	return u.String()
+}
+
+// forwardNode checks the forwarder node can be expressed by its address,
+// it returns the health check and circuit breaker parameters in the node metadata.
+func (b *cmdBuilder) forwardNode(prefix string, node *config.ForwardNodeConfig) url.Values {
+	query := url.Values{}
+	cp := *node
+	cp.Name = ""
+	cp.Addr = ""
+	if cp.Metadata != nil {
+		md := make(map[string]any, len(cp.Metadata))
+		for k, v := range cp.Metadata {
+			md[k] = v
+		}
+		for k, v := range md {
+			if option := metadataKey(k, nodeCheckKeys); option != "" {
+				if s, ok := metadataValue(v); ok {
+					query.Set(option, s)
+					delete(md, k)
+				}
+			}
+		}
+		cp.Metadata = md
+		if len(md) == 0 {
+			cp.Metadata = nil
+		}
+	}
+	if !reflect.DeepEqual(cp, config.ForwardNodeConfig{}) {
+		b.report("%s: forwarder node %s options other than addr", prefix, node.Name)
+	}
+	if strings.Contains(node.Addr, ",") {
+		b.report("%s: forwarder node %s address %s", prefix, node.Name, node.Addr)
+	}
+	return query
+}
+
+func (b *cmdBuilder) hop(hop *config.HopConfig) string {
+	prefix := fmt.Sprintf("hop %s", hop.Name)
+
+	if len(hop.Nodes) == 0 {
+		b.report("%s: hop without inline nodes", prefix)
+		return ""
+	}
+	if hop.Plugin != nil || hop.File != nil || hop.Redis != nil || hop.HTTP != nil || hop.Reload > 0 {
+		b.report("%s: plugin and loaders", prefix)
+	}
+	if len(hop.Bypasses) > 0 {
+		b.report("%s: bypasses", prefix)
+	}
+
+	nodePrefix := fmt.Sprintf("%s: node", prefix)
+
+	var tmpl *config.NodeConfig
+	var auth *config.AuthConfig
+	var limits url.Values
+	var addrs []string
+	nodeQuery := url.Values{}
+	limiters := map[string]bool{}
+	for _, node := range hop.Nodes {
+		if node == nil {
+			continue
+		}
+		if strings.Contains(node.Addr, ",") {
+			b.report("%s: node %s address %s", prefix, node.Name, node.Addr)
+		}
+		key := fmt.Sprintf("node-%d.", len(addrs))
+		addrs = append(addrs, node.Addr)
+
+		cp := b.nodeOptions(prefix, hop, node, key, nodeQuery)
+		nodeAuth := b.nodeAuth(nodePrefix, cp)
+		nodeLimits := b.nodeLimiters(prefix, node.Name, cp, limiters)
+		if tmpl == nil {
+			tmpl = cp
+			auth = nodeAuth
+			limits = nodeLimits
+			continue
+		}
+		if !equalJSON(limits, nodeLimits) {
+			b.report("%s: node %s limiters differ from node %s", prefix, node.Name, hop.Nodes[0].Name)
+		}
+		if !equalJSON(tmpl, cp) {
+			b.report("%s: node %s differs from node %s in options other than the per-node options", prefix, node.Name, hop.Nodes[0].Name)
+		}
+		if !equalJSON(auth, nodeAuth) {
+			if nodeAuth == nil {
+				b.report("%s: node %s without auth", prefix, node.Name)
+			} else {
+				nodeQuery.Set(key+"auth", base64.StdEncoding.EncodeToString(
+					[]byte(nodeAuth.Username+":"+nodeAuth.Password)))
+			}
+		}
+	}
+	if tmpl == nil {
+		return ""
+	}
+	hopNodeQuery(nodeQuery, len(addrs))
+
+	if tmpl.Host != "" || tmpl.Network != "" || tmpl.Protocol != "" || tmpl.Path != "" {
+		b.report("%s host, network, protocol and path", nodePrefix)
+	}
+	if len(tmpl.Bypasses) > 0 {
+		b.report("%s bypasses", nodePrefix)
+	}
+	if tmpl.Resolver != "" || tmpl.Hosts != "" {
+		b.report("%s resolver and hosts", nodePrefix)
+	}
+	if tmpl.HTTP != nil || tmpl.TLS != nil || tmpl.Auth != nil {
+		b.report("%s http, tls and auth", nodePrefix)
+	}
+
+	connectorCfg := tmpl.Connector
+	dialerCfg := tmpl.Dialer
+	connector := connectorCfg.Type
+	if connector == "" {
+		connector = "http"
+	}
+	dialer := dialerCfg.Type
+	if dialer == "" {
+		dialer = "tcp"
+	}
+
+	scheme := connector + "+" + dialer
+	if c, d := parseNodeScheme(connector); c == connector && d == dialer {
+		scheme = connector
+	}
+	if c, d := parseNodeScheme(scheme); c != connector || d != dialer {
+		b.report("%s: connector %s with dialer %s", prefix, connector, dialer)
+	}
+
+	u := &url.URL{
+		Scheme: scheme,
+		Host:   strings.Join(addrs, ","),
+	}
+	if auth != nil {
+		u.User = userinfo(auth)
+	}
+	if connectorCfg.TLS != nil {
+		b.report("%s connector.tls", nodePrefix)
+	}
+
+	md := b.metadata(nodePrefix, append(append([]string{}, nodeCmdParams...), selectorCmdParams...), map[string]map[string]any{
+		"connector.metadata": connectorCfg.Metadata,
+		"dialer.metadata":    dialerCfg.Metadata,
+	})
+	query := nodeQuery
+	for k, v := range md {
+		if strings.HasPrefix(k, "node-") {
+			b.report("%s metadata.%s is a command line parameter", nodePrefix, k)
+			continue
+		}
+		query.Set(k, v)
+	}
+	for k, v := range limits {
+		query[k] = v
+	}
+
+	if tls := dialerCfg.TLS; tls != nil {
+		if tls.CertFile != "" {
+			query.Set("certFile", tls.CertFile)
+		}
+		if tls.KeyFile != "" {
+			query.Set("keyFile", tls.KeyFile)
+		}
+		if tls.CAFile != "" {
+			query.Set("caFile", tls.CAFile)
+		}
+		if tls.Secure {
+			query.Set("secure", "true")
+		}
+		if tls.ServerName != "" && tls.ServerName != u.Hostname() {
+			query.Set("serverName", tls.ServerName)
+		}
+		if tls.Options != nil || tls.Validity > 0 || tls.CommonName != "" || tls.Organization != "" {
+			b.report("%s dialer.tls options", nodePrefix)
+		}
+	}
+
+	selectorQuery(query, hop.Selector)
+
+	if hop.Bypass != "" {
+		if v := b.bypass(prefix, hop.Bypass); v != "" {
+			query.Set("bypass", v)
+		}
+	}
+	if hop.Resolver != "" {
+		if v, prefer := b.resolver(prefix, hop.Resolver); v != "" {
+			query.Set("resolver", v)
+			if prefer != "" {
+				b.report("%s: resolver %s prefer", prefix, hop.Resolver)
+			}
+		}
+	}
+	if hop.Hosts != "" {
+		if v := b.hosts(prefix, hop.Hosts); v != "" {
+			query.Set("hosts", v)
+		}
+	}
+	if hop.Interface != "" {
+		query.Set("interface", hop.Interface)
+	}
+	if hop.SockOpts != nil {
+		if hop.SockOpts.Mark > 0 {
+			query.Set("so_mark", strconv.Itoa(hop.SockOpts.Mark))
+		} else {
+			b.report("%s: sockopts without mark", prefix)
+		}
+	}
+
+	u.RawQuery = encodeQuery(query)
+	return u.String()
+}
+
+// hopNodeQuery replaces the node-<index>.<option> parameters of the options set for all n nodes
+// with the same value by the parameter of the hop, which the hop parser sets for all nodes.
+func hopNodeQuery(query url.Values, n int) {
+	for _, option := range hopNodeKeys {
+		v, ok := query["node-0."+option]
+		if !ok {
+			continue
+		}
+		same := true
+		for i := 1; i < n && same; i++ {
+			same = slices.Equal(query[fmt.Sprintf("node-%d.%s", i, option)], v)
+		}
+		if !same {
+			continue
+		}
+		for i := 0; i < n; i++ {
+			query.Del(fmt.Sprintf("node-%d.%s", i, option))
+		}
+		query[option] = v
+	}
+}
+
+// nodeOptions converts the per-node options of the node to the node-<index>.<option> parameters.
+// It returns a copy of node without name, address and the converted options,
+// the options inherited from the hop by the hop parser are also removed.
+func (b *cmdBuilder) nodeOptions(prefix string, hop *config.HopConfig, node *config.NodeConfig, key string, query url.Values) *config.NodeConfig {
+	cp := *node
+	cp.Name = ""
+	cp.Addr = ""
+	if cp.Resolver == hop.Resolver {
+		cp.Resolver = ""
+	}
+	if cp.Hosts == hop.Hosts {
+		cp.Hosts = ""
+	}
+	if cp.Interface == hop.Interface {
+		cp.Interface = ""
+	}
+	if reflect.DeepEqual(cp.SockOpts, hop.SockOpts) {
+		cp.SockOpts = nil
+	}
+
+	if cp.Interface != "" {
+		query.Set(key+"interface", cp.Interface)
+		cp.Interface = ""
+	}
+	if cp.SockOpts != nil {
+		if cp.SockOpts.Mark > 0 {
+			query.Set(key+"so_mark", strconv.Itoa(cp.SockOpts.Mark))
+		} else {
+			b.report("%s: node %s sockopts without mark", prefix, node.Name)
+		}
+		cp.SockOpts = nil
+	}
+	if cp.Bypass != "" {
+		if v := b.bypass(prefix, cp.Bypass); v != "" {
+			query.Set(key+"bypass", v)
+		}
+		cp.Bypass = ""
+	}
+	for k, v := range cp.Metadata {
+		// the metadata keys are case-insensitive.
+		if option := metadataKey(k, nodeMetadataKeys); option != "" {
+			if s, ok := metadataValue(v); ok {
+				query.Set(key+option, s)
+				continue
+			}
+		}
+		b.report("%s: node %s metadata.%s", prefix, node.Name, k)
+	}
+	cp.Metadata = nil
+
+	if cp.Connector == nil {
+		cp.Connector = &config.ConnectorConfig{}
+	}
+	if cp.Dialer == nil {
+		cp.Dialer = &config.DialerConfig{}
+	}
+	return &cp
+}
+
+// nodeLimiters converts the traffic and connection limiters in the dialer metadata of the node
+// to the limiter.* and climiter parameters, and removes the limiters and recorders from the node,
+// which must be a copy returned by nodeAuth. The limiters of a hop must not be shared by its nodes,
+// as buildConfigFromCmd creates the limiters for each node.
+func (b *cmdBuilder) nodeLimiters(prefix string, name string, node *config.NodeConfig, seen map[string]bool) url.Values {
+	query := url.Values{}
+	md := mdx.NewMetadata(node.Dialer.Metadata)
+
+	if v := mdutil.GetString(md, mdKeyLimiter); v != "" {
+		if seen["limiter/"+v] {
+			b.report("%s: limiter %s shared by nodes", prefix, v)
+		}
+		seen["limiter/"+v] = true
+		b.limiter(prefix, v, query)
+	}
+	if v := mdutil.GetString(md, mdKeyCLimiter); v != "" {
+		if seen["climiter/"+v] {
+			b.report("%s: climiter %s shared by nodes", prefix, v)
+		}
+		seen["climiter/"+v] = true
+		if limit := b.simpleLimiter(prefix, "climiter", v, b.cfg.CLimiters); limit != "" {
+			if n, _ := strconv.Atoi(limit); n > 0 {
+				query.Set("climiter", limit)
+			} else {
+				b.report("%s: climiter %s limit %s", prefix, v, limit)
+			}
+		}
+	}
+	if md != nil && md.IsExists(mdKeyRecorders) {
+		b.report("%s: node %s recorders", prefix, name)
+	}
+
+	strip := func(m map[string]any) map[string]any {
+		if m == nil {
+			return nil
+		}
+		cp := make(map[string]any, len(m))
+		for k, v := range m {
+			switch k {
+			case mdKeyLimiter, mdKeyCLimiter, mdKeyRecorders:
+			default:
+				cp[k] = v
+			}
+		}
+		return cp
+	}
+	node.Connector.Metadata = strip(node.Connector.Metadata)
+	node.Dialer.Metadata = strip(node.Dialer.Metadata)
+
+	return query
+}
+
+// nodeAuth returns the auth of the node and removes it from the node,
+// which must be a copy returned by nodeOptions.
+func (b *cmdBuilder) nodeAuth(prefix string, node *config.NodeConfig) *config.AuthConfig {
+	connector := *node.Connector
+	dialer := *node.Dialer
+
+	auth := connector.Auth
+	if dialer.Type == "ssh" || dialer.Type == "sshd" {
+		auth = dialer.Auth
+		if connector.Auth != nil {
+			b.report("%s connector.auth", prefix)
+		}
+	} else if dialer.Auth != nil {
+		b.report("%s dialer.auth", prefix)
+	}
+
+	connector.Auth = nil
+	dialer.Auth = nil
+	node.Connector = &connector
+	node.Dialer = &dialer
+	return auth
+}
+
+func selectorQuery(query url.Values, sel *config.SelectorConfig) {
+	if sel == nil {
+		return
+	}
+	// the defaults are omitted, as parseSelector sets them.
+	if sel.Strategy != "" && sel.Strategy != "round" {
+		query.Set("strategy", sel.Strategy)
+	}
+	if sel.MaxFails > 1 {
+		query.Set("maxFails", strconv.Itoa(sel.MaxFails))
+	}
+	if sel.FailTimeout > 0 && sel.FailTimeout != 30*time.Second {
+		query.Set("failTimeout", sel.FailTimeout.String())
+	}
+}
+
+// metadata merges the metadata maps which share one query string on the command line.
+func (b *cmdBuilder) metadata(prefix string, reserved []string, mds map[string]map[string]any) map[string]string {
+	var names []string
+	for name := range mds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	m := map[string]string{}
+	owners := map[string][]string{}
+	for _, name := range names {
+		for k, v := range mds[name] {
+			s, ok := metadataValue(v)
+			if !ok {
+				b.report("%s: %s.%s value %v", prefix, name, k, v)
+				continue
+			}
+			if old, ok := m[k]; ok && old != s {
+				b.report("%s: %s.%s conflicts with %s.%s", prefix, name, k, owners[k][0], k)
+				continue
+			}
+			m[k] = s
+			owners[k] = append(owners[k], name)
+		}
+	}
+
+	for k := range m {
+		for _, p := range reserved {
+			if strings.EqualFold(k, p) {
+				b.report("%s: metadata.%s is a command line parameter", prefix, k)
+				delete(m, k)
+				break
+			}
+		}
+	}
+	for k := range m {
+		if len(owners[k]) < len(mds) {
+			b.report("%s: %s.%s would also be applied to the other metadata of %s",
+				prefix, owners[k][0], k, strings.Join(names, ", "))
+		}
+	}
+	return m
+}
+
+// metadataKey returns the key in keys equal to k under case-folding, or empty if none.
+func metadataKey(k string, keys []string) string {
+	for _, key := range keys {
+		if strings.EqualFold(k, key) {
+			return key
+		}
+	}
+	return ""
+}
+
+func metadataValue(v any) (string, bool) {
+	switch vv := v.(type) {
+	case string:
+		return vv, true
+	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return fmt.Sprint(vv), true
+	case time.Duration:
+		return vv.String(), true
+	case []string:
+		return strings.Join(vv, ","), true
+	case []any:
+		var ss []string
+		for _, e := range vv {
+			s, ok := metadataValue(e)
+			if !ok {
+				return "", false
+			}
+			ss = append(ss, s)
+		}
+		return strings.Join(ss, ","), true
+	}
+	return "", false
+}
+
+func (b *cmdBuilder) admission(prefix string, name string) string {
+	var admCfg *config.AdmissionConfig
+	for _, v := range b.cfg.Admissions {
+		if v != nil && v.Name == name {
+			admCfg = v
+			break
+		}
+	}
+	if admCfg == nil {
+		b.report("%s: admission %s not found", prefix, name)
+		return ""
+	}
+	b.used["admission/"+name] = true
+
+	if admCfg.Reverse || admCfg.Reload > 0 || admCfg.File != nil ||
+		admCfg.Redis != nil || admCfg.HTTP != nil || admCfg.Plugin != nil {
+		b.report("%s: admission %s options other than whitelist and matchers", prefix, name)
+	}
+	return b.matchers(prefix, "admission "+name, admCfg.Whitelist, admCfg.Matchers)
+}
+
+func (b *cmdBuilder) bypass(prefix string, name string) string {
+	var bypassCfg *config.BypassConfig
+	for _, v := range b.cfg.Bypasses {
+		if v != nil && v.Name == name {
+			bypassCfg = v
+			break
+		}
+	}
+	if bypassCfg == nil {
+		b.report("%s: bypass %s not found", prefix, name)
+		return ""
+	}
+	b.used["bypass/"+name] = true
+
+	if bypassCfg.Reverse || bypassCfg.Reload > 0 || bypassCfg.File != nil ||
+		bypassCfg.Redis != nil || bypassCfg.HTTP != nil || bypassCfg.Plugin != nil {
+		b.report("%s: bypass %s options other than whitelist and matchers", prefix, name)
+	}
+	return b.matchers(prefix, "bypass "+name, bypassCfg.Whitelist, bypassCfg.Matchers)
+}
+
+func (b *cmdBuilder) matchers(prefix string, name string, whitelist bool, matchers []string) string {
+	var ms []string
+	for _, m := range matchers {
+		if m == "" {
+			continue
+		}
+		if strings.Contains(m, ",") {
+			b.report("%s: %s matcher %s", prefix, name, m)
+			continue
+		}
+		ms = append(ms, m)
+	}
+	v := strings.Join(ms, ",")
+	if whitelist {
+		v = "~" + v
+	} else if strings.HasPrefix(v, "~") {
+		b.report("%s: %s matcher %s", prefix, name, ms[0])
+	}
+	if v == "" {
+		b.report("%s: %s without matchers", prefix, name)
+	}
+	return v
+}
+
+// resolver returns the nameserver list of the resolver and the shared prefer option of the nameservers.
+func (b *cmdBuilder) resolver(prefix string, name string) (string, string) {
+	var resolverCfg *config.ResolverConfig
+	for _, v := range b.cfg.Resolvers {
+		if v != nil && v.Name == name {
+			resolverCfg = v
+			break
+		}
+	}
+	if resolverCfg == nil {
+		b.report("%s: resolver %s not found", prefix, name)
+		return "", ""
+	}
+	b.used["resolver/"+name] = true
+
+	if resolverCfg.Plugin != nil {
+		b.report("%s: resolver %s plugin", prefix, name)
+	}
+
+	var addrs []string
+	var prefer string
+	mixed := false
+	for i, ns := range resolverCfg.Nameservers {
+		if ns == nil {
+			continue
+		}
+		if i == 0 {
+			prefer = ns.Prefer
+		} else if ns.Prefer != prefer && !mixed {
+			b.report("%s: resolver %s nameservers with different prefer", prefix, name)
+			mixed = true
+		}
+		if ns.Chain != "" || ns.ClientIP != "" || ns.Hostname != "" ||
+			ns.TTL > 0 || ns.Timeout > 0 || ns.Async || ns.Only != "" {
+			b.report("%s: resolver %s nameserver %s options other than addr and prefer", prefix, name, ns.Addr)
+		}
+		if ns.Addr == "" || strings.Contains(ns.Addr, ",") {
+			b.report("%s: resolver %s nameserver %s", prefix, name, ns.Addr)
+			continue
+		}
+		addrs = append(addrs, ns.Addr)
+	}
+	if len(addrs) == 0 {
+		b.report("%s: resolver %s without nameservers", prefix, name)
+	}
+	return strings.Join(addrs, ","), prefer
+}
+
+func (b *cmdBuilder) hosts(prefix string, name string) string {
+	var hostsCfg *config.HostsConfig
+	for _, v := range b.cfg.Hosts {
+		if v != nil && v.Name == name {
+			hostsCfg = v
+			break
+		}
+	}
+	if hostsCfg == nil {
+		b.report("%s: hosts %s not found", prefix, name)
+		return ""
+	}
+	b.used["hosts/"+name] = true
+
+	if hostsCfg.Reload > 0 || hostsCfg.File != nil || hostsCfg.Redis != nil ||
+		hostsCfg.HTTP != nil || hostsCfg.Plugin != nil {
+		b.report("%s: hosts %s options other than mappings", prefix, name)
+	}
+
+	var mappings []string
+	for _, m := range hostsCfg.Mappings {
+		if m == nil {
+			continue
+		}
+		if len(m.Aliases) > 0 {
+			b.report("%s: hosts %s mapping %s aliases", prefix, name, m.Hostname)
+		}
+		if m.Hostname == "" || strings.ContainsAny(m.Hostname, ":,") || strings.Contains(m.IP, ",") {
+			b.report("%s: hosts %s mapping %s %s", prefix, name, m.Hostname, m.IP)
+			continue
+		}
+		mappings = append(mappings, m.Hostname+":"+m.IP)
+	}
+	if len(mappings) == 0 {
+		b.report("%s: hosts %s without mappings", prefix, name)
+	}
+	return strings.Join(mappings, ",")
+}
+
+// authFile returns the path of the auth file if the auther only loads the users from the file.
+func (b *cmdBuilder) authFile(prefix string, name string) string {
+	var autherCfg *config.AutherConfig
+	for _, v := range b.cfg.Authers {
+		if v != nil && v.Name == name {
+			autherCfg = v
+			break
+		}
+	}
+	if autherCfg == nil {
+		b.report("%s: auther %s not found", prefix, name)
+		return ""
+	}
+	if autherCfg.File == nil || autherCfg.File.Path == "" || len(autherCfg.Auths) > 0 || autherCfg.Reload > 0 ||
+		autherCfg.Redis != nil || autherCfg.HTTP != nil || autherCfg.Plugin != nil {
+		b.report("%s: auther %s options other than file", prefix, name)
+		return ""
+	}
+	b.used["auther/"+name] = true
+
+	return autherCfg.File.Path
+}
+
+// limiter converts the global and per-connection limits of the traffic limiter to the limiter.* parameters.
+func (b *cmdBuilder) limiter(prefix string, name string, query url.Values) {
+	var limiterCfg *config.LimiterConfig
+	for _, v := range b.cfg.Limiters {
+		if v != nil && v.Name == name {
+			limiterCfg = v
+			break
+		}
+	}
+	if limiterCfg == nil {
+		b.report("%s: limiter %s not found", prefix, name)
+		return
+	}
+	b.used["limiter/"+name] = true
+
+	if limiterCfg.Reload > 0 || limiterCfg.File != nil || limiterCfg.Redis != nil ||
+		limiterCfg.HTTP != nil || limiterCfg.Plugin != nil {
+		b.report("%s: limiter %s options other than limits", prefix, name)
+	}
+
+	for _, limit := range limiterCfg.Limits {
+		// keep the position of the empty rate generated by buildConfigFromCmd.
+		ss := strings.Split(limit, " ")
+		if len(ss) != 3 {
+			ss = strings.Fields(limit)
+		}
+		if len(ss) < 2 || len(ss) > 3 {
+			b.report("%s: limiter %s limit %s", prefix, name, limit)
+			continue
+		}
+		var in, out string
+		in = ss[1]
+		if len(ss) == 3 {
+			out = ss[2]
+		}
+
+		switch ss[0] {
+		case traffic.GlobalLimitKey:
+			if in != "" {
+				query.Set("limiter.in", in)
+			}
+			if out != "" {
+				query.Set("limiter.out", out)
+			}
+		case traffic.ConnLimitKey:
+			if in != "" {
+				query.Set("limiter.conn.in", in)
+			}
+			if out != "" {
+				query.Set("limiter.conn.out", out)
+			}
+		default:
+			b.report("%s: limiter %s limit %s", prefix, name, limit)
+		}
+	}
+}
+
+// simpleLimiter returns the global limit value of the connection or request rate limiter.
+func (b *cmdBuilder) simpleLimiter(prefix string, kind string, name string, limiters []*config.LimiterConfig) string {
+	var limiterCfg *config.LimiterConfig
+	for _, v := range limiters {
+		if v != nil && v.Name == name {
+			limiterCfg = v
+			break
+		}
+	}
+	if limiterCfg == nil {
+		b.report("%s: %s %s not found", prefix, kind, name)
+		return ""
+	}
+	b.used[kind+"/"+name] = true
+
+	if limiterCfg.Reload > 0 || limiterCfg.File != nil || limiterCfg.Redis != nil ||
+		limiterCfg.HTTP != nil || limiterCfg.Plugin != nil {
+		b.report("%s: %s %s options other than limits", prefix, kind, name)
+	}
+
+	var v string
+	for _, limit := range limiterCfg.Limits {
+		ss := strings.Fields(limit)
+		if len(ss) != 2 || ss[0] != conn.GlobalLimitKey || v != "" {
+			b.report("%s: %s %s limit %s", prefix, kind, name, limit)
+			continue
+		}
+		v = ss[1]
+	}
+	return v
+}
+
+// global converts the top level API, metrics and log settings.
+func (b *cmdBuilder) global() (args []string) {
+	cfg := b.cfg
+
+	if cfg.API != nil {
+		query := url.Values{}
+		if cfg.API.PathPrefix != "" {
+			query.Set("pathPrefix", cfg.API.PathPrefix)
+		}
+		if cfg.API.AccessLog {
+			query.Set("accesslog", "true")
+		}
+		if cfg.API.Auther != "" {
+			if cfg.API.Auth != nil {
+				b.report("api: auth with auther %s", cfg.API.Auther)
+			}
+			if v := b.authFile("api", cfg.API.Auther); v != "" {
+				query.Set("authFile", v)
+			}
+		}
+		args = append(args, "-api", addrCmd(cfg.API.Addr, cfg.API.Auth, query))
+	}
+
+	if cfg.Metrics != nil {
+		query := url.Values{}
+		if cfg.Metrics.Path != "" {
+			query.Set("path", cfg.Metrics.Path)
+		}
+		if cfg.Metrics.Auther != "" {
+			if cfg.Metrics.Auth != nil {
+				b.report("metrics: auth with auther %s", cfg.Metrics.Auther)
+			}
+			if v := b.authFile("metrics", cfg.Metrics.Auther); v != "" {
+				query.Set("authFile", v)
+			}
+		}
+		if m := b.ext.Metrics; m != nil {
+			if m.UserMetrics {
+				query.Set("userMetrics", "true")
+			}
+			if m.MaxLabelValues != 0 {
+				query.Set("maxLabelValues", strconv.Itoa(m.MaxLabelValues))
+			}
+		}
+		args = append(args, "-metrics", addrCmd(cfg.Metrics.Addr, cfg.Metrics.Auth, query))
+	}
+
+	if cfg.Log != nil {
+		if cfg.Log.Level == "debug" {
+			args = append(args, "-D")
+		} else if cfg.Log.Level != "" {
+			b.report("log: level %s", cfg.Log.Level)
+		}
+		if cfg.Log.Output != "" || cfg.Log.Format != "" || cfg.Log.Rotation != nil {
+			b.report("log: options other than level")
+		}
+	}
+
+	if cfg.TLS != nil {
+		b.report("tls")
+	}
+	if cfg.Profiling != nil {
+		b.report("profiling")
+	}
+
+	return
+}
+
+// unused reports the components which are not referenced by the converted services and chain.
+func (b *cmdBuilder) unused() {
+	cfg := b.cfg
+	for _, v := range cfg.Chains {
+		if v != nil && !b.used["chain/"+v.Name] {
+			b.report("chain %s: only one chain is supported", v.Name)
+		}
+	}
+	for _, v := range cfg.Admissions {
+		if v != nil && !b.used["admission/"+v.Name] {
+			b.report("admission %s: not referenced by a service", v.Name)
+		}
+	}
+	for _, v := range cfg.Bypasses {
+		if v != nil && !b.used["bypass/"+v.Name] {
+			b.report("bypass %s: not referenced by a service or hop", v.Name)
+		}
+	}
+	for _, v := range cfg.Resolvers {
+		if v != nil && !b.used["resolver/"+v.Name] {
+			b.report("resolver %s: not referenced by a service or hop", v.Name)
+		}
+	}
+	for _, v := range cfg.Hosts {
+		if v != nil && !b.used["hosts/"+v.Name] {
+			b.report("hosts %s: not referenced by a service or hop", v.Name)
+		}
+	}
+	for _, v := range cfg.Limiters {
+		if v != nil && !b.used["limiter/"+v.Name] {
+			b.report("limiter %s: not referenced by a service", v.Name)
+		}
+	}
+	for _, v := range cfg.CLimiters {
+		if v != nil && !b.used["climiter/"+v.Name] {
+			b.report("climiter %s: not referenced by a service", v.Name)
+		}
+	}
+	for _, v := range cfg.RLimiters {
+		if v != nil && !b.used["rlimiter/"+v.Name] {
+			b.report("rlimiter %s: not referenced by a service", v.Name)
+		}
+	}
+
+	for _, v := range cfg.Hops {
+		if v != nil {
+			b.report("hop %s: named hops", v.Name)
+		}
+	}
+	for _, v := range cfg.Authers {
+		if v != nil && !b.used["auther/"+v.Name] {
+			b.report("auther %s: named authers", v.Name)
+		}
+	}
+	for _, v := range cfg.Ingresses {
+		if v != nil {
+			b.report("ingress %s: ingresses", v.Name)
+		}
+	}
+	for _, v := range cfg.Routers {
+		if v != nil {
+			b.report("router %s: routers", v.Name)
+		}
+	}
+	for _, v := range cfg.SDs {
+		if v != nil {
+			b.report("sd %s: service discovery", v.Name)
+		}
+	}
+	for _, v := range cfg.Recorders {
+		if v != nil {
+			b.report("recorder %s: recorders", v.Name)
+		}
+	}
+	for _, v := range cfg.Observers {
+		if v != nil {
+			b.report("observer %s: observers", v.Name)
+		}
+	}
+	for _, v := range cfg.Loggers {
+		if v != nil {
+			b.report("logger %s: loggers", v.Name)
+		}
+	}
+}
+
+func userinfo(auth *config.AuthConfig) *url.Userinfo {
+	if auth.Password == "" {
+		return url.User(auth.Username)
+	}
+	return url.UserPassword(auth.Username, auth.Password)
+}
+
+// addrCmd formats the address parameter of the -api and -metrics options.
+func addrCmd(addr string, auth *config.AuthConfig, query url.Values) string {
+	s := addr
+	if auth != nil {
+		s = userinfo(auth).String() + "@" + addr
+	}
+	if len(query) > 0 {
+		s += "?" + encodeQuery(query)
+	}
+	if _, _, err := net.SplitHostPort(addr); err == nil && s != addr {
+		// make sure normCmd parses the userinfo and query correctly.
+		s = "auto://" + s
+	}
+	return s
+}
+
+var queryUnescaper = strings.NewReplacer("%2C", ",", "%3A", ":", "%2F", "/", "%40", "@", "%2A", "*")
+
+// encodeQuery encodes the query sorted by key like url.Values.Encode,
+// but keeps the list separators and addresses readable.
+func encodeQuery(query url.Values) string {
+	return queryUnescaper.Replace(query.Encode())
+}
+
+func equalJSON(a, b any) bool {
+	v1, _ := json.Marshal(a)
+	v2, _ := json.Marshal(b)
+	return string(v1) == string(v2)
+}
+
+// shellQuote quotes s for POSIX shells if needed.
+func shellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+			strings.ContainsRune("-_./:@,+=%", r))
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// configCmd implements the "gost config" subcommand.
+func configCmd(args []string) int {
+	if len(args) == 0 || args[0] != "to-cmd" {
+		fmt.Fprintln(os.Stderr, "usage: gost config to-cmd -C <file>")
+		return 2
+	}
+
+	var file string
+	fs := flag.NewFlagSet("config to-cmd", flag.ContinueOnError)
+	fs.StringVar(&file, "C", "", "configuration file")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	cfg, err := readConfig(file)
+	if err == nil && file == "" {
+		err = cfg.Load()
+	}
+	var ext *ExtConfig
+	if err == nil {
+		ext, err = readExtConfig(file)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	args, unsupported := buildCmdFromConfig(cfg, ext)
+
+	ss := []string{"gost"}
+	for _, arg := range args {
+		ss = append(ss, shellQuote(arg))
+	}
+	fmt.Fprintln(os.Stdout, strings.Join(ss, " "))
+
+	for _, s := range unsupported {
+		fmt.Fprintln(os.Stderr, "unsupported:", s)
+	}
+	if len(unsupported) > 0 {
+		return 1
+	}
+	return 0
+}
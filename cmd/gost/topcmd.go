@@ -0,0 +1,819 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+)
+
+const (
+	// topLogSize is the number of the latest log entries and events kept by gost top.
+	topLogSize = 200
+	// topErrorLines is the max number of the lines of the recent errors.
+	topErrorLines = 5
+)
+
+// The ANSI escape sequences used by gost top.
+const (
+	ansiReset     = "\x1b[0m"
+	ansiBold      = "\x1b[1m"
+	ansiDim       = "\x1b[2m"
+	ansiReverse   = "\x1b[7m"
+	ansiRed       = "\x1b[31m"
+	ansiYellow    = "\x1b[33m"
+	ansiClearLine = "\x1b[K"
+)
+
+// topErrorEvents are the event types shown in the recent errors.
+var topErrorEvents = map[string]bool{
+	eventServiceFailed:     true,
+	eventNodeFailed:        true,
+	eventNodeCircuit:       true,
+	eventAuthFailed:        true,
+	eventAdmissionRejected: true,
+	eventLimiterThrottled:  true,
+}
+
+// topCmd shows a terminal dashboard of a running gost by the API, it works in any terminal
+// supporting the ANSI escape sequences, including the SSH sessions.
+func topCmd(args []string) int {
+	var (
+		addr     string
+		interval time.Duration
+	)
+	fs := flag.NewFlagSet("top", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: gost top [-api addr] [-interval duration]")
+		fs.PrintDefaults()
+		fmt.Fprintln(fs.Output(), "\nkeys: tab switch pane, up/down or k/j select, p pause/resume service,")
+		fmt.Fprintln(fs.Output(), "      f filter connections by service, x kill connection, r refresh, q quit")
+	}
+	fs.StringVar(&addr, "api", os.Getenv("GOST_API"), "api service address, [user:pass@]host:port[?pathPrefix=/api]")
+	fs.DurationVar(&interval, "interval", 2*time.Second, "refresh interval")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if interval <= 0 {
+		interval = 2 * time.Second
+	}
+
+	c, err := newAPIClient(addr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	// fail fast on the wrong address or credentials before taking over the terminal.
+	var status apiStatus
+	if err := c.do(http.MethodGet, "/status", nil, &status); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		fmt.Fprintln(os.Stderr, "top: stdin is not a terminal")
+		return 1
+	}
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "top:", err)
+		return 1
+	}
+	defer term.Restore(fd, state)
+
+	// the alternate screen without the cursor.
+	fmt.Fprint(os.Stdout, "\x1b[?1049h\x1b[?25l")
+	defer fmt.Fprint(os.Stdout, "\x1b[?25h\x1b[?1049l")
+
+	t := &topView{
+		client:   c,
+		addr:     c.url.Host + c.url.Path,
+		interval: interval,
+		notify:   make(chan struct{}, 1),
+	}
+	t.run()
+	return 0
+}
+
+const (
+	topPaneServices = iota
+	topPaneConns
+)
+
+type topView struct {
+	client   *apiClient
+	addr     string
+	interval time.Duration
+
+	status     *apiStatus
+	prevStatus *apiStatus
+	conns      []connInfo
+	logs       []logEntry
+	lastLogID  uint64
+	err        error
+
+	pane    int
+	svcSel  int
+	connSel int
+	// filter is the service the connections are filtered by.
+	filter string
+	// confirm is the ID of the connection to be killed once confirmed.
+	confirm string
+	message string
+
+	// events are received by the event stream in the background.
+	events []*event
+	notify chan struct{}
+	mu     sync.Mutex
+}
+
+func (t *topView) run() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go t.streamEvents(ctx)
+
+	keys := make(chan []byte)
+	go func() {
+		buf := make([]byte, 32)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(keys)
+				return
+			}
+			keys <- append([]byte{}, buf[:n]...)
+		}
+	}()
+
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	// the size of the terminal is polled, as SIGWINCH is not available on all platforms.
+	resize := time.NewTicker(250 * time.Millisecond)
+	defer resize.Stop()
+
+	t.refresh()
+	w, h := t.draw()
+	for {
+		select {
+		case b, ok := <-keys:
+			if !ok || !t.handleKeys(b) {
+				return
+			}
+		case <-ticker.C:
+			t.refresh()
+		case <-t.notify:
+		case <-resize.C:
+			if w1, h1 := termSize(); w1 == w && h1 == h {
+				continue
+			}
+		}
+		w, h = t.draw()
+	}
+}
+
+// handleKeys handles the input, it returns false to quit.
+func (t *topView) handleKeys(b []byte) bool {
+	for i := 0; i < len(b); i++ {
+		key := string(b[i])
+		if b[i] == 0x1b && i+2 < len(b) && b[i+1] == '[' {
+			switch b[i+2] {
+			case 'A':
+				key = "up"
+			case 'B':
+				key = "down"
+			}
+			i += 2
+		}
+
+		if t.confirm != "" {
+			if key == "y" || key == "Y" {
+				t.kill(t.confirm)
+			} else {
+				t.message = "canceled"
+			}
+			t.confirm = ""
+			continue
+		}
+
+		switch key {
+		case "q", "Q", "\x03":
+			return false
+		case "\t":
+			t.pane = (t.pane + 1) % 2
+		case "up", "k":
+			t.move(-1)
+		case "down", "j":
+			t.move(1)
+		case "r":
+			t.refresh()
+		case "p":
+			if svc := t.selectedService(); svc != nil {
+				t.pause(svc.Name, !svc.Paused)
+			}
+		case "f":
+			if t.filter != "" {
+				t.filter = ""
+			} else if svc := t.selectedService(); svc != nil {
+				t.filter = svc.Name
+			}
+			t.connSel = 0
+			t.refresh()
+		case "x":
+			if t.pane == topPaneConns && t.connSel < len(t.conns) {
+				t.confirm = t.conns[t.connSel].ID
+			}
+		}
+	}
+	return true
+}
+
+func (t *topView) move(d int) {
+	if t.pane == topPaneServices {
+		n := 0
+		if t.status != nil {
+			n = len(t.status.Services)
+		}
+		t.svcSel = clamp(t.svcSel+d, 0, n-1)
+	} else {
+		t.connSel = clamp(t.connSel+d, 0, len(t.conns)-1)
+	}
+}
+
+func (t *topView) selectedService() *serviceStatus {
+	if t.status == nil || t.svcSel >= len(t.status.Services) {
+		return nil
+	}
+	return &t.status.Services[t.svcSel]
+}
+
+func (t *topView) pause(service string, pause bool) {
+	action := "resume"
+	if pause {
+		action = "pause"
+	}
+	if err := t.client.do(http.MethodPost, "/services/"+url.PathEscape(service)+"/"+action, nil, nil); err != nil {
+		t.message = err.Error()
+		return
+	}
+	t.message = fmt.Sprintf("service %s %sd", service, action)
+	t.refresh()
+}
+
+func (t *topView) kill(id string) {
+	if err := t.client.do(http.MethodDelete, "/conns/"+url.PathEscape(id), nil, nil); err != nil {
+		t.message = err.Error()
+		return
+	}
+	t.message = fmt.Sprintf("connection %s closed", id)
+	t.refresh()
+}
+
+func (t *topView) refresh() {
+	var status apiStatus
+	if t.err = t.client.do(http.MethodGet, "/status", nil, &status); t.err != nil {
+		return
+	}
+	t.prevStatus, t.status = t.status, &status
+	t.svcSel = clamp(t.svcSel, 0, len(status.Services)-1)
+
+	query := url.Values{}
+	if t.filter != "" {
+		query.Set("service", t.filter)
+	}
+	var list connList
+	if t.err = t.client.do(http.MethodGet, "/conns", query, &list); t.err != nil {
+		return
+	}
+	t.conns = list.Conns
+	t.connSel = clamp(t.connSel, 0, len(t.conns)-1)
+
+	var logs logList
+	query = url.Values{
+		"after": []string{strconv.FormatUint(t.lastLogID, 10)},
+		"n":     []string{strconv.Itoa(topLogSize)},
+	}
+	if t.err = t.client.do(http.MethodGet, "/logs", query, &logs); t.err != nil {
+		return
+	}
+	if n := len(logs.Logs); n > 0 {
+		t.lastLogID = logs.Logs[n-1].ID
+		t.logs = append(t.logs, logs.Logs...)
+		if len(t.logs) > topLogSize {
+			t.logs = t.logs[len(t.logs)-topLogSize:]
+		}
+	}
+}
+
+// streamEvents receives the events from the event stream until ctx is done, it reconnects on errors.
+func (t *topView) streamEvents(ctx context.Context) {
+	var lastID uint64
+	for {
+		query := url.Values{}
+		if lastID > 0 {
+			query.Set("lastEventId", strconv.FormatUint(lastID, 10))
+		}
+		resp, err := t.client.stream(ctx, "/events", query, nil)
+		if err == nil {
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+				if !ok {
+					continue
+				}
+				var e event
+				if json.Unmarshal([]byte(data), &e) != nil {
+					continue
+				}
+				lastID = e.ID
+
+				t.mu.Lock()
+				t.events = append(t.events, &e)
+				if len(t.events) > topLogSize {
+					t.events = t.events[len(t.events)-topLogSize:]
+				}
+				t.mu.Unlock()
+
+				select {
+				case t.notify <- struct{}{}:
+				default:
+				}
+			}
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(2 * time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// draw draws the screen, it returns the size of the terminal.
+func (t *topView) draw() (int, int) {
+	w, h := termSize()
+
+	var services, chains, conns, errs, logs []string
+	var svcStyles, connStyles, chainStyles, errStyles, logStyles []string
+
+	var totalIn, totalOut float64
+	var totalConns int
+	if t.status != nil {
+		rows := [][]string{}
+		for _, s := range t.status.Services {
+			state := orDash(s.State)
+			if s.Paused {
+				state = "paused"
+			}
+			in, out := t.rate(s)
+			totalIn += in
+			totalOut += out
+			totalConns += s.Conns
+			rows = append(rows, []string{
+				s.Name, state, s.Addr, s.Handler + "/" + s.Listener, strconv.Itoa(s.Conns),
+				formatRate(in), formatRate(out), formatBytes(s.BytesIn), formatBytes(s.BytesOut),
+			})
+			switch {
+			case s.Paused:
+				svcStyles = append(svcStyles, ansiYellow)
+			case s.State == "ready" || s.State == "running":
+				svcStyles = append(svcStyles, "")
+			default:
+				svcStyles = append(svcStyles, ansiRed)
+			}
+		}
+		services = formatTable([]string{"NAME", "STATE", "ADDR", "HANDLER", "CONNS", "IN/s", "OUT/s", "IN", "OUT"},
+			rows, map[int]bool{4: true, 5: true, 6: true, 7: true, 8: true})
+
+		chains, chainStyles = t.chainLines()
+	}
+
+	{
+		rows := [][]string{}
+		for _, c := range t.conns {
+			route := "-"
+			if c.Chain != "" {
+				route = c.Chain + ":" + strings.Join(c.Nodes, ">")
+			}
+			rows = append(rows, []string{
+				c.ID, c.Service, c.Client, orDash(c.User), orDash(c.Target), route,
+				time.Since(c.StartTime).Truncate(time.Second).String(), formatBytes(c.BytesIn), formatBytes(c.BytesOut),
+			})
+		}
+		conns = formatTable([]string{"ID", "SERVICE", "CLIENT", "USER", "TARGET", "ROUTE", "AGE", "IN", "OUT"},
+			rows, map[int]bool{6: true, 7: true, 8: true})
+	}
+
+	errs, errStyles = t.errorLines()
+	for _, e := range t.logs {
+		line, level := formatLogEntry(e.Entry)
+		logs = append(logs, line)
+		logStyles = append(logStyles, levelStyle(level))
+	}
+
+	// the heights of the sections, the connections and the log take the rest.
+	avail := h - 2
+	if t.err != nil {
+		avail--
+	}
+	svcH := min(len(services)+1, max(3, avail/4))
+	chainH := min(max(len(chains), 1)+1, max(2, avail/6))
+	errH := min(max(len(errs), 1), topErrorLines) + 1
+	rest := max(avail-svcH-chainH-errH, 0)
+	logMin := min(len(logs)+1, 4)
+	connH := min(len(conns)+1, max(3, rest-logMin))
+	logH := max(rest-connH, 0)
+
+	var out []string
+	style := func(s, line string) string {
+		return s + fit(line, w) + ansiReset
+	}
+
+	header := fmt.Sprintf(" gost top  %s  %s   services %d  conns %d  in %s  out %s",
+		t.addr, time.Now().Format("15:04:05"), len(servicesOf(t.status)), totalConns, formatRate(totalIn), formatRate(totalOut))
+	out = append(out, style(ansiReverse+ansiBold, pad(header, w)))
+	if t.err != nil {
+		out = append(out, style(ansiRed, "error: "+t.err.Error()))
+	}
+
+	// services
+	out = append(out, t.title("SERVICES", t.pane == topPaneServices, w))
+	if len(services) > 0 {
+		out = append(out, style(ansiDim, services[0]))
+		out = append(out, t.rows(services[1:], svcStyles, t.svcSel, t.pane == topPaneServices, svcH-2, w)...)
+	}
+	out = fill(out, 1+boolInt(t.err != nil)+svcH)
+
+	// chains
+	out = append(out, t.title("CHAINS", false, w))
+	if len(chains) == 0 {
+		chains, chainStyles = []string{"none"}, []string{ansiDim}
+	}
+	for i := 0; i < len(chains) && i < chainH-1; i++ {
+		out = append(out, style(chainStyles[i], chains[i]))
+	}
+	out = fill(out, 1+boolInt(t.err != nil)+svcH+chainH)
+
+	// connections
+	title := fmt.Sprintf("CONNECTIONS (%d)", len(t.conns))
+	if t.filter != "" {
+		title += " service=" + t.filter
+	}
+	out = append(out, t.title(title, t.pane == topPaneConns, w))
+	if connH > 1 && len(conns) > 0 {
+		out = append(out, style(ansiDim, conns[0]))
+		out = append(out, t.rows(conns[1:], connStyles, t.connSel, t.pane == topPaneConns, connH-2, w)...)
+	}
+	out = fill(out, 1+boolInt(t.err != nil)+svcH+chainH+connH)
+
+	// recent errors
+	out = append(out, t.title("ERRORS", false, w))
+	if len(errs) == 0 {
+		errs, errStyles = []string{"none"}, []string{ansiDim}
+	}
+	errs, errStyles = tail(errs, errH-1), tail(errStyles, errH-1)
+	for i := range errs {
+		out = append(out, style(errStyles[i], errs[i]))
+	}
+	out = fill(out, 1+boolInt(t.err != nil)+svcH+chainH+connH+errH)
+
+	// log tail
+	if logH > 0 {
+		out = append(out, t.title("LOG", false, w))
+		logs, logStyles = tail(logs, logH-1), tail(logStyles, logH-1)
+		for i := range logs {
+			out = append(out, style(logStyles[i], logs[i]))
+		}
+	}
+	out = fill(out, h-1)
+	if len(out) > h-1 {
+		out = out[:h-1]
+	}
+
+	// footer
+	footer := " tab pane  ↑↓ select  p pause/resume  f filter  x kill  r refresh  q quit"
+	switch {
+	case t.confirm != "":
+		footer = fmt.Sprintf(" kill connection %s? [y/N]", t.confirm)
+	case t.message != "":
+		footer = " " + t.message
+		t.message = ""
+	}
+	out = append(out, style(ansiReverse, pad(footer, w)))
+
+	var sb strings.Builder
+	sb.WriteString("\x1b[H")
+	for i, line := range out {
+		sb.WriteString(line)
+		sb.WriteString(ansiClearLine)
+		if i < len(out)-1 {
+			sb.WriteString("\r\n")
+		}
+	}
+	sb.WriteString("\x1b[J")
+	os.Stdout.WriteString(sb.String())
+
+	return w, h
+}
+
+func (t *topView) title(s string, focused bool, w int) string {
+	if focused {
+		s = "▸ " + s
+	} else {
+		s = "  " + s
+	}
+	return ansiBold + fit(s, w) + ansiReset
+}
+
+// rows returns at most n rows scrolled to the selected row.
+func (t *topView) rows(rows []string, styles []string, sel int, focused bool, n, w int) (out []string) {
+	if n <= 0 {
+		return nil
+	}
+	start := 0
+	if sel >= n {
+		start = sel - n + 1
+	}
+	for i := start; i < len(rows) && i < start+n; i++ {
+		s := ""
+		if i < len(styles) {
+			s = styles[i]
+		}
+		if focused && i == sel {
+			s += ansiReverse
+		}
+		out = append(out, s+fit(pad(rows[i], w), w)+ansiReset)
+	}
+	return
+}
+
+// rate returns the input and output bytes per second of the service since the last refresh.
+func (t *topView) rate(s serviceStatus) (float64, float64) {
+	if t.prevStatus == nil {
+		return 0, 0
+	}
+	dt := t.status.Time.Sub(t.prevStatus.Time).Seconds()
+	for _, p := range t.prevStatus.Services {
+		if p.Name != s.Name || dt <= 0 || s.BytesIn < p.BytesIn || s.BytesOut < p.BytesOut {
+			continue
+		}
+		return float64(s.BytesIn-p.BytesIn) / dt, float64(s.BytesOut-p.BytesOut) / dt
+	}
+	return 0, 0
+}
+
+// chainLines returns a line for each hop of the chains and the hops not in any chain,
+// with the selector and the health of the nodes.
+func (t *topView) chainLines() (lines []string, styles []string) {
+	inChain := map[string]bool{}
+	add := func(name string, h hopStatus) {
+		var sb strings.Builder
+		fmt.Fprintf(&sb, " %s › %s", name, orDash(h.Name))
+		if sel := h.Selector; sel != nil {
+			fmt.Fprintf(&sb, " [%s maxFails=%d failTimeout=%s]", orDash(sel.Strategy), sel.MaxFails, sel.FailTimeout)
+		}
+		style := ""
+		for _, n := range h.Nodes {
+			mark := "?"
+			switch n.Health {
+			case nodeHealthy:
+				mark = "●"
+			case nodeFailed, nodeUnhealthy, nodeEjected:
+				mark = "✗"
+				style = ansiRed
+			}
+			fmt.Fprintf(&sb, "  %s %s %s", mark, n.Name, n.Addr)
+			if n.Fails > 0 {
+				fmt.Fprintf(&sb, " (%d)", n.Fails)
+			}
+		}
+		lines = append(lines, sb.String())
+		styles = append(styles, style)
+	}
+
+	for _, c := range t.status.Chains {
+		for _, h := range c.Hops {
+			inChain[h.Name] = true
+			add(c.Name, h)
+		}
+	}
+	for _, h := range t.status.Hops {
+		if !inChain[h.Name] {
+			add("-", h)
+		}
+	}
+	return
+}
+
+// errorLines returns the recent failure events and the warning and error logs in the order of time.
+func (t *topView) errorLines() (lines []string, styles []string) {
+	type item struct {
+		time  time.Time
+		line  string
+		style string
+	}
+	var items []item
+
+	t.mu.Lock()
+	for _, e := range t.events {
+		if !topErrorEvents[e.Type] {
+			continue
+		}
+		keys := make([]string, 0, len(e.Data))
+		for k := range e.Data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "%s %s", e.Time.Local().Format("15:04:05"), e.Type)
+		for _, k := range keys {
+			fmt.Fprintf(&sb, " %s=%v", k, e.Data[k])
+		}
+		items = append(items, item{time: e.Time, line: sb.String(), style: ansiYellow})
+	}
+	t.mu.Unlock()
+
+	for _, e := range t.logs {
+		var v struct {
+			Time  time.Time `json:"time"`
+			Level string    `json:"level"`
+		}
+		json.Unmarshal(e.Entry, &v)
+		if s := levelStyle(v.Level); s == ansiRed || s == ansiYellow {
+			line, _ := formatLogEntry(e.Entry)
+			items = append(items, item{time: v.Time, line: line, style: s})
+		}
+	}
+
+	sort.SliceStable(items, func(i, j int) bool { return items[i].time.Before(items[j].time) })
+	for _, it := range items {
+		lines = append(lines, it.line)
+		styles = append(styles, it.style)
+	}
+	return
+}
+
+// formatLogEntry formats the JSON log entry as time, level, message and the other fields.
+func formatLogEntry(entry json.RawMessage) (string, string) {
+	var m map[string]any
+	if err := json.Unmarshal(entry, &m); err != nil {
+		return string(entry), ""
+	}
+
+	level, _ := m["level"].(string)
+	msg, _ := m["msg"].(string)
+	ts := ""
+	if s, ok := m["time"].(string); ok {
+		if v, err := time.Parse(time.RFC3339Nano, s); err == nil {
+			ts = v.Local().Format("15:04:05")
+		}
+	}
+	delete(m, "level")
+	delete(m, "msg")
+	delete(m, "time")
+
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s %-5.5s %s", ts, strings.ToUpper(level), msg)
+	for _, k := range keys {
+		fmt.Fprintf(&sb, " %s=%v", k, m[k])
+	}
+	return sb.String(), level
+}
+
+func levelStyle(level string) string {
+	switch level {
+	case "error", "fatal", "panic":
+		return ansiRed
+	case "warning", "warn":
+		return ansiYellow
+	case "debug", "trace":
+		return ansiDim
+	default:
+		return ""
+	}
+}
+
+// formatTable formats the rows in the aligned columns, the first line is the header.
+func formatTable(header []string, rows [][]string, right map[int]bool) []string {
+	const maxWidth = 32
+
+	widths := make([]int, len(header))
+	for i, s := range header {
+		widths[i] = len([]rune(s))
+	}
+	for _, row := range rows {
+		for i, s := range row {
+			widths[i] = min(max(widths[i], len([]rune(s))), maxWidth)
+		}
+	}
+
+	format := func(row []string) string {
+		var sb strings.Builder
+		sb.WriteByte(' ')
+		for i, s := range row {
+			s = fit(s, widths[i])
+			n := widths[i] - len([]rune(s))
+			if right[i] {
+				sb.WriteString(strings.Repeat(" ", n))
+				sb.WriteString(s)
+			} else {
+				sb.WriteString(s)
+				sb.WriteString(strings.Repeat(" ", n))
+			}
+			sb.WriteString("  ")
+		}
+		return strings.TrimRight(sb.String(), " ")
+	}
+
+	lines := []string{format(header)}
+	for _, row := range rows {
+		lines = append(lines, format(row))
+	}
+	return lines
+}
+
+// fit truncates s to w runes.
+func fit(s string, w int) string {
+	r := []rune(s)
+	if len(r) <= w {
+		return s
+	}
+	if w <= 0 {
+		return ""
+	}
+	return string(r[:w-1]) + "…"
+}
+
+// pad pads s with spaces to w runes.
+func pad(s string, w int) string {
+	if n := w - len([]rune(s)); n > 0 {
+		return s + strings.Repeat(" ", n)
+	}
+	return s
+}
+
+// fill appends the empty lines to n lines.
+func fill(lines []string, n int) []string {
+	for len(lines) < n {
+		lines = append(lines, "")
+	}
+	return lines
+}
+
+func tail[T any](s []T, n int) []T {
+	if n <= 0 {
+		return nil
+	}
+	if len(s) > n {
+		return s[len(s)-n:]
+	}
+	return s
+}
+
+func clamp(v, lo, hi int) int {
+	return max(lo, min(v, hi))
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func servicesOf(status *apiStatus) []serviceStatus {
+	if status == nil {
+		return nil
+	}
+	return status.Services
+}
+
+func formatRate(v float64) string {
+	return formatBytes(int64(v)) + "/s"
+}
+
+func termSize() (int, int) {
+	w, h, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || w <= 0 || h <= 0 {
+		return 80, 24
+	}
+	return w, h
+}
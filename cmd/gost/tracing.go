@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-gost/core/connector"
+	"github.com/go-gost/core/metrics"
+	"github.com/go-gost/core/resolver"
+	xmetrics "github.com/go-gost/x/metrics"
+	"github.com/go-gost/x/registry"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracingConfig is the configuration of the OpenTelemetry tracing,
+// the spans are exported to an OTLP/HTTP endpoint.
+type TracingConfig struct {
+	// Endpoint is the host:port or the URL of the OTLP/HTTP traces endpoint,
+	// e.g. localhost:4318 or https://collector:4318/v1/traces.
+	Endpoint string `yaml:",omitempty" json:"endpoint,omitempty"`
+	// Insecure uses plain HTTP for the host:port endpoint.
+	Insecure bool              `yaml:",omitempty" json:"insecure,omitempty"`
+	Headers  map[string]string `yaml:",omitempty" json:"headers,omitempty"`
+	// ServiceName is the service.name of the spans, default is gost.
+	ServiceName string `yaml:"serviceName,omitempty" json:"serviceName,omitempty"`
+	// SampleRatio is the ratio of the sampled traces in (0, 1], default is 1.
+	SampleRatio float64       `yaml:"sampleRatio,omitempty" json:"sampleRatio,omitempty"`
+	Timeout     time.Duration `yaml:",omitempty" json:"timeout,omitempty"`
+}
+
+const (
+	tracerName = "github.com/go-gost/gost"
+)
+
+var (
+	tracer = otel.Tracer(tracerName)
+)
+
+func init() {
+	for name, newConnector := range registry.ConnectorRegistry().GetAll() {
+		registry.ConnectorRegistry().Unregister(name)
+		registry.ConnectorRegistry().Register(name, wrapConnector(name, newConnector))
+	}
+}
+
+// initTracing sets up the global tracer provider which exports the spans to the OTLP endpoint.
+// The returned function flushes the pending spans and shuts down the provider.
+func initTracing(cfg *TracingConfig) (func(context.Context) error, error) {
+	var opts []otlptracehttp.Option
+	if strings.Contains(cfg.Endpoint, "://") {
+		opts = append(opts, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+	} else if cfg.Endpoint != "" {
+		opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+	}
+	if len(cfg.Headers) > 0 {
+		opts = append(opts, otlptracehttp.WithHeaders(cfg.Headers))
+	}
+	if cfg.Timeout > 0 {
+		opts = append(opts, otlptracehttp.WithTimeout(cfg.Timeout))
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("tracing: %w", err)
+	}
+
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = "gost"
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(serviceName),
+		semconv.ServiceVersion(version),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("tracing: %w", err)
+	}
+
+	sampler := sdktrace.AlwaysSample()
+	if cfg.SampleRatio > 0 && cfg.SampleRatio < 1 {
+		sampler = sdktrace.TraceIDRatioBased(cfg.SampleRatio)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	// the global tracer only delegates to the first provider set.
+	tracer = tp.Tracer(tracerName)
+
+	return tp.Shutdown, nil
+}
+
+// endSpan records the error if any and ends the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// wrapConnector wraps the connectors created by newConnector with the connect and handshake spans.
+func wrapConnector(kind string, newConnector registry.NewConnector) registry.NewConnector {
+	return func(opts ...connector.Option) connector.Connector {
+		return &tracingConnector{
+			Connector: newConnector(opts...),
+			kind:      kind,
+		}
+	}
+}
+
+type tracingConnector struct {
+	connector.Connector
+	kind string
+}
+
+func (c *tracingConnector) Connect(ctx context.Context, conn net.Conn, network, address string, opts ...connector.ConnectOption) (cc net.Conn, err error) {
+	ctx, span := tracer.Start(ctx, "connect "+c.kind,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("gost.connector", c.kind),
+			attribute.String("network.transport", network),
+			attribute.String("server.address", address),
+		))
+	defer func() {
+		if err != nil {
+			observeHandshakeError("connector", c.kind, err)
+		}
+		endSpan(span, err)
+	}()
+
+	return c.Connector.Connect(ctx, conn, network, address, opts...)
+}
+
+func (c *tracingConnector) Handshake(ctx context.Context, conn net.Conn) (cc net.Conn, err error) {
+	hs, ok := c.Connector.(connector.Handshaker)
+	if !ok {
+		return conn, nil
+	}
+
+	ctx, span := tracer.Start(ctx, "handshake "+c.kind,
+		trace.WithAttributes(attribute.String("gost.connector", c.kind)))
+	defer func() {
+		if err != nil {
+			observeHandshakeError("connector", c.kind, err)
+		}
+		endSpan(span, err)
+	}()
+
+	return hs.Handshake(ctx, conn)
+}
+
+func (c *tracingConnector) Bind(ctx context.Context, conn net.Conn, network, address string, opts ...connector.BindOption) (ln net.Listener, err error) {
+	binder, ok := c.Connector.(connector.Binder)
+	if !ok {
+		return nil, connector.ErrBindUnsupported
+	}
+
+	ctx, span := tracer.Start(ctx, "bind "+c.kind,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("gost.connector", c.kind),
+			attribute.String("network.transport", network),
+			attribute.String("server.address", address),
+		))
+	defer func() { endSpan(span, err) }()
+
+	return binder.Bind(ctx, conn, network, address, opts...)
+}
+
+// tracingResolver is a resolver with a span per resolution.
+type tracingResolver struct {
+	resolver.Resolver
+	name string
+}
+
+func (r *tracingResolver) Resolve(ctx context.Context, network, host string, opts ...resolver.Option) (ips []net.IP, err error) {
+	ctx, span := tracer.Start(ctx, "resolve "+r.name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("gost.resolver", r.name),
+			attribute.String("network.type", network),
+			attribute.String("server.address", host),
+		))
+	start := time.Now()
+	defer func() {
+		if v := xmetrics.GetObserver(metricResolverDurationObserver,
+			metrics.Labels{"resolver": r.name}); v != nil {
+			v.Observe(time.Since(start).Seconds())
+		}
+		span.SetAttributes(attribute.Int("gost.resolver.ips", len(ips)))
+		endSpan(span, err)
+	}()
+
+	return r.Resolver.Resolve(ctx, network, host, opts...)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-gost/x/config"
+	"github.com/go-gost/x/registry"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// serveConfig serves the services of cfg in process, the services are closed
+// and the services and chains are unregistered when the test ends.
+func serveConfig(t *testing.T, cfg *config.Config) {
+	t.Helper()
+
+	services := buildService(cfg)
+	for _, svc := range services {
+		go svc.Serve()
+	}
+	t.Cleanup(func() {
+		for i, svc := range services {
+			svc.Close()
+			registry.ServiceRegistry().Unregister(cfg.Services[i].Name)
+		}
+		for _, c := range cfg.Chains {
+			registry.ChainRegistry().Unregister(c.Name)
+		}
+	})
+}
+
+// serviceAddr returns the listening address of the registered service.
+func serviceAddr(t *testing.T, name string) string {
+	t.Helper()
+
+	svc := registry.ServiceRegistry().Get(name)
+	if svc == nil {
+		t.Fatalf("service %s not found", name)
+	}
+	return svc.Addr().String()
+}
+
+// waitFor waits up to 5 seconds for cond to be true.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+	}
+}
+
+// httpServiceConfig is the service config of an HTTP proxy on a random local port.
+func httpServiceConfig(name, chain string) *config.ServiceConfig {
+	return &config.ServiceConfig{
+		Name: name,
+		Addr: "127.0.0.1:0",
+		Handler: &config.HandlerConfig{
+			Type:  "http",
+			Chain: chain,
+		},
+		Listener: &config.ListenerConfig{
+			Type: "tcp",
+		},
+	}
+}
+
+// otlpReceiver is an OTLP/HTTP traces endpoint which collects the names of the received spans.
+type otlpReceiver struct {
+	spans []string
+	mu    sync.Mutex
+}
+
+func (r *otlpReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	b, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var msg coltracepb.ExportTraceServiceRequest
+	if err := proto.Unmarshal(b, &msg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r.mu.Lock()
+	for _, rs := range msg.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			for _, span := range ss.Spans {
+				r.spans = append(r.spans, span.Name)
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	b, _ = proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+	w.Write(b)
+}
+
+func TestTracing(t *testing.T) {
+	receiver := &otlpReceiver{}
+	collector := httptest.NewServer(receiver)
+	defer collector.Close()
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer target.Close()
+
+	shutdown, err := initTracing(&TracingConfig{
+		Endpoint: collector.URL + "/v1/traces",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serveConfig(t, &config.Config{
+		Services: []*config.ServiceConfig{httpServiceConfig("tracing-upstream", "")},
+	})
+	serveConfig(t, &config.Config{
+		Services: []*config.ServiceConfig{httpServiceConfig("tracing-proxy", "tracing-chain")},
+		Chains: []*config.ChainConfig{{
+			Name: "tracing-chain",
+			Hops: []*config.HopConfig{{
+				Name: "tracing-hop",
+				Nodes: []*config.NodeConfig{{
+					Name:      "tracing-node",
+					Addr:      serviceAddr(t, "tracing-upstream"),
+					Connector: &config.ConnectorConfig{Type: "http"},
+					Dialer:    &config.DialerConfig{Type: "tcp"},
+				}},
+			}},
+		}},
+	})
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: serviceAddr(t, "tracing-proxy")}),
+		},
+	}
+	resp, err := client.Get(target.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "ok" {
+		t.Fatalf("got response %q", b)
+	}
+	client.CloseIdleConnections()
+
+	// the spans are ended when the proxied connections are closed, the accept span is the last one.
+	tp := otel.GetTracerProvider().(*sdktrace.TracerProvider)
+	waitFor(t, func() bool {
+		tp.ForceFlush(context.Background())
+		receiver.mu.Lock()
+		defer receiver.mu.Unlock()
+		return slices.Contains(receiver.spans, "accept")
+	})
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	for _, name := range []string{"accept", "handle http", "route tracing-chain", "dial tcp", "connect http"} {
+		if !slices.Contains(receiver.spans, name) {
+			t.Errorf("span %q not received, got %q", name, receiver.spans)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+'use strict';
+
+// The APIs are relative to the UI, which is served at {pathPrefix}/ui/.
+const api = '..';
+
+const refreshInterval = 2000;
+const maxEvents = 200;
+
+// The components of the config API, by the key in the config.
+const kinds = [
+  'services', 'chains', 'hops', 'authers', 'admissions', 'bypasses', 'resolvers', 'hosts',
+  'ingresses', 'routers', 'sds', 'observers', 'limiters', 'climiters', 'rlimiters',
+];
+
+const $ = (sel) => document.querySelector(sel);
+
+function el(tag, attrs, ...children) {
+  const e = document.createElement(tag);
+  for (const [k, v] of Object.entries(attrs || {})) {
+    if (k === 'class') {
+      e.className = v;
+    } else if (k.startsWith('on')) {
+      e.addEventListener(k.slice(2), v);
+    } else {
+      e.setAttribute(k, v);
+    }
+  }
+  for (const c of children) {
+    if (c !== null && c !== undefined) {
+      e.append(c instanceof Node ? c : String(c));
+    }
+  }
+  return e;
+}
+
+function badge(state) {
+  const s = state || 'absent';
+  return el('span', { class: 'badge ' + s }, s);
+}
+
+function formatBytes(n) {
+  const units = ['B', 'KiB', 'MiB', 'GiB', 'TiB', 'PiB'];
+  let i = 0;
+  while (n >= 1024 && i < units.length - 1) {
+    n /= 1024;
+    i++;
+  }
+  return (i === 0 ? n : n.toFixed(1)) + units[i];
+}
+
+function formatAge(start) {
+  let s = Math.max(0, Math.floor((Date.now() - new Date(start).getTime()) / 1000));
+  const h = Math.floor(s / 3600);
+  const m = Math.floor((s % 3600) / 60);
+  s %= 60;
+  return (h ? h + 'h' : '') + (h || m ? m + 'm' : '') + s + 's';
+}
+
+function showError(err) {
+  const e = $('#error');
+  e.textContent = err ? String(err.message || err) : '';
+  e.hidden = !err;
+}
+
+async function request(method, path, body) {
+  const opts = { method, headers: {} };
+  if (body !== undefined) {
+    opts.headers['Content-Type'] = 'application/json';
+    opts.body = JSON.stringify(body);
+  }
+  const resp = await fetch(api + path, opts);
+  const text = await resp.text();
+  let data;
+  try {
+    data = text ? JSON.parse(text) : null;
+  } catch (e) {
+    data = null;
+  }
+  if (!resp.ok) {
+    throw new Error((data && data.msg) || resp.status + ' ' + resp.statusText);
+  }
+  return data;
+}
+
+// tabs
+
+let currentTab = '';
+
+function showTab() {
+  const tab = location.hash.slice(1) || 'status';
+  if (!document.getElementById('tab-' + tab)) {
+    return;
+  }
+  currentTab = tab;
+  document.querySelectorAll('.tab').forEach((e) => { e.hidden = e.id !== 'tab-' + tab; });
+  document.querySelectorAll('nav a').forEach((e) => e.classList.toggle('active', e.dataset.tab === tab));
+  refresh();
+  if (tab === 'config') {
+    loadConfig();
+  }
+}
+
+// status
+
+let lastStatus = null;
+
+function rate(svc, key, now) {
+  if (!lastStatus) {
+    return '-';
+  }
+  const prev = lastStatus.services.find((s) => s.name === svc.name);
+  const dt = (new Date(now.time) - new Date(lastStatus.time)) / 1000;
+  if (!prev || dt <= 0 || svc[key] < prev[key]) {
+    return '-';
+  }
+  return formatBytes((svc[key] - prev[key]) / dt);
+}
+
+function nodeTitle(n) {
+  const lines = [];
+  if (n.failTime) {
+    lines.push('failed at ' + new Date(n.failTime).toLocaleString());
+  }
+  if (n.check && n.check.time) {
+    lines.push(n.check.type + ' check ' + n.check.state + ' at ' + new Date(n.check.time).toLocaleString() +
+      (n.check.error ? ': ' + n.check.error : ' in ' + n.check.latencyMs + 'ms'));
+  }
+  if (n.circuit) {
+    lines.push('circuit ' + n.circuit.state + ', ' + n.circuit.errorPercent + '% failed and ' +
+      n.circuit.slowPercent + '% slow of ' + n.circuit.requests + ' requests');
+  }
+  return lines.join('\n');
+}
+
+function renderHop(hop) {
+  return el('div', { class: 'hop' },
+    el('strong', null, hop.name || '-'),
+    ...hop.nodes.map((n) => el('div', { class: 'node', title: nodeTitle(n) },
+      el('span', null, n.name, ' ', el('span', { class: 'muted' }, n.addr)),
+      el('span', null, badge(n.health), n.fails ? ' ×' + n.fails : ''))),
+    hop.nodes.length ? null : el('div', { class: 'muted' }, 'no nodes'));
+}
+
+function renderStatus(st) {
+  const tbody = $('#services tbody');
+  tbody.replaceChildren(...st.services.map((s) => el('tr', null,
+    el('td', null, s.name),
+    el('td', null, s.addr),
+    el('td', null, s.handler || '-'),
+    el('td', null, s.listener || '-'),
+    el('td', null, badge(s.paused ? 'paused' : s.state)),
+    el('td', { class: 'num' }, s.conns),
+    el('td', { class: 'num' }, rate(s, 'bytesIn', st)),
+    el('td', { class: 'num' }, rate(s, 'bytesOut', st)),
+    el('td', { class: 'num' }, formatBytes(s.bytesIn)),
+    el('td', { class: 'num' }, formatBytes(s.bytesOut)),
+    el('td', null, el('button', {
+      onclick: () => request('POST', '/services/' + encodeURIComponent(s.name) + (s.paused ? '/resume' : '/pause'))
+        .then(refresh).catch(showError),
+    }, s.paused ? 'Resume' : 'Pause')))));
+  if (!st.services.length) {
+    tbody.append(el('tr', null, el('td', { colspan: 11, class: 'muted' }, 'no services')));
+  }
+
+  const chains = $('#chains');
+  chains.replaceChildren(...st.chains.map((c) => {
+    const hops = [];
+    c.hops.forEach((h, i) => {
+      if (i > 0) {
+        hops.push(el('span', { class: 'arrow' }, '→'));
+      }
+      hops.push(renderHop(h));
+    });
+    return el('div', { class: 'card' }, el('h3', null, c.name), el('div', { class: 'hops' }, ...hops));
+  }));
+  if (!st.chains.length) {
+    chains.append(el('p', { class: 'muted' }, 'no chains'));
+  }
+  st.services.filter((s) => s.forwarder).forEach((s) => {
+    chains.append(el('div', { class: 'card' }, el('h3', null, s.name, el('span', { class: 'muted' }, ' forwarder')),
+      el('div', { class: 'hops' }, renderHop({ name: 'forwarder', nodes: s.forwarder }))));
+  });
+
+  const hops = $('#hops');
+  hops.replaceChildren(el('div', { class: 'hops' }, ...st.hops.map(renderHop)));
+  if (!st.hops.length) {
+    hops.replaceChildren(el('p', { class: 'muted' }, 'no hops'));
+  }
+
+  lastStatus = st;
+}
+
+// connections
+
+function renderConns(list) {
+  $('#conns-count').textContent = '(' + list.count + ')';
+  $('#conns tbody').replaceChildren(...list.conns.map((c) => el('tr', null,
+    el('td', null, c.id),
+    el('td', null, c.service),
+    el('td', null, c.handler),
+    el('td', null, c.client),
+    el('td', null, c.user || '-'),
+    el('td', null, c.target || '-'),
+    el('td', null, c.chain ? c.chain + ':' + (c.nodes || []).join('>') : '-'),
+    el('td', { class: 'num' }, formatAge(c.startTime)),
+    el('td', { class: 'num' }, formatBytes(c.bytesIn)),
+    el('td', { class: 'num' }, formatBytes(c.bytesOut)),
+    el('td', null, el('button', {
+      class: 'danger',
+      onclick: () => request('DELETE', '/conns/' + encodeURIComponent(c.id)).then(refresh).catch(showError),
+    }, 'Kill')))));
+}
+
+async function refresh() {
+  try {
+    if (currentTab === 'status') {
+      renderStatus(await request('GET', '/status'));
+    } else if (currentTab === 'conns') {
+      renderConns(await request('GET', '/conns'));
+    } else {
+      return;
+    }
+    $('#updated').textContent = 'updated ' + new Date().toLocaleTimeString();
+    showError(null);
+  } catch (e) {
+    showError(e);
+  }
+}
+
+// config
+
+let config = {};
+let selected = null;
+
+// loadConfig loads the config, the editor is kept if only the list is updated.
+async function loadConfig(listOnly) {
+  try {
+    config = await request('GET', '/config') || {};
+    renderItems(listOnly);
+    showError(null);
+  } catch (e) {
+    showError(e);
+  }
+}
+
+function renderItems(listOnly) {
+  const kind = $('#kind').value;
+  const items = config[kind] || [];
+  if (selected && !items.some((item) => item.name === selected)) {
+    selected = null;
+  }
+  $('#items').replaceChildren(...items.map((item) => el('li', {
+    class: item.name === selected ? 'active' : '',
+    onclick: () => {
+      selected = item.name;
+      delete $('#item-name').dataset.new;
+      renderItems();
+    },
+  }, item.name)));
+  if (listOnly) {
+    return;
+  }
+
+  const item = items.find((i) => i.name === selected);
+  if (item) {
+    const data = Object.assign({}, item);
+    delete data.status;
+    $('#item-name').textContent = kind + '/' + item.name;
+    $('#item-json').value = JSON.stringify(data, null, 2);
+  } else if (selected === null && $('#item-name').dataset.new !== kind) {
+    $('#item-name').textContent = '';
+    $('#item-json').value = '';
+  }
+  $('#delete').disabled = !item;
+  $('#apply').disabled = !item && $('#item-name').dataset.new !== kind;
+}
+
+function newItem() {
+  const kind = $('#kind').value;
+  selected = null;
+  $('#item-name').dataset.new = kind;
+  $('#item-name').textContent = 'new ' + kind.replace(/s$/, '');
+  $('#item-json').value = JSON.stringify({ name: '' }, null, 2);
+  renderItems();
+}
+
+async function applyItem() {
+  const kind = $('#kind').value;
+  let data;
+  try {
+    data = JSON.parse($('#item-json').value);
+  } catch (e) {
+    showError('invalid JSON: ' + e.message);
+    return;
+  }
+  try {
+    if (selected) {
+      await request('PUT', '/config/' + kind + '/' + encodeURIComponent(selected), data);
+    } else {
+      await request('POST', '/config/' + kind, data);
+      selected = data.name;
+    }
+    delete $('#item-name').dataset.new;
+    await loadConfig();
+  } catch (e) {
+    showError(e);
+  }
+}
+
+async function deleteItem() {
+  const kind = $('#kind').value;
+  if (!selected || !confirm('Delete ' + kind + '/' + selected + '?')) {
+    return;
+  }
+  try {
+    await request('DELETE', '/config/' + kind + '/' + encodeURIComponent(selected));
+    selected = null;
+    await loadConfig();
+  } catch (e) {
+    showError(e);
+  }
+}
+
+async function persistConfig() {
+  if (!confirm('Save the running config to gost.yaml in the working directory of gost?')) {
+    return;
+  }
+  try {
+    await request('POST', '/config?format=yaml');
+    showError(null);
+  } catch (e) {
+    showError(e);
+  }
+}
+
+// events
+
+function onEvent(msg) {
+  const e = JSON.parse(msg.data);
+  const tbody = $('#events tbody');
+  tbody.prepend(el('tr', null,
+    el('td', null, new Date(e.time).toLocaleTimeString()),
+    el('td', null, e.type),
+    el('td', null, Object.entries(e.data || {}).map(([k, v]) => k + '=' + v).join(' '))));
+  while (tbody.children.length > maxEvents) {
+    tbody.lastChild.remove();
+  }
+  if (currentTab === 'status' && /^(service|node)\./.test(e.type)) {
+    refresh();
+  }
+  if (currentTab === 'config' && e.type === 'config.applied') {
+    loadConfig(true);
+  }
+}
+
+// the events are sent with the event types as the SSE event names.
+function listenEvents() {
+  const types = [
+    'service.started', 'service.failed', 'service.restarted', 'service.stopped',
+    'service.paused', 'service.resumed',
+    'node.failed', 'node.recovered', 'node.health', 'node.circuit', 'config.applied', 'auth.failed',
+    'admission.rejected', 'limiter.throttled',
+  ];
+  const source = new EventSource(api + '/events');
+  source.onopen = () => { $('#events-state').textContent = 'connected'; };
+  source.onerror = () => { $('#events-state').textContent = 'reconnecting'; };
+  for (const t of types) {
+    source.addEventListener(t, onEvent);
+  }
+}
+
+function init() {
+  const kind = $('#kind');
+  kind.replaceChildren(...kinds.map((k) => el('option', { value: k }, k)));
+  kind.addEventListener('change', () => { selected = null; renderItems(); });
+  $('#new').addEventListener('click', newItem);
+  $('#apply').addEventListener('click', applyItem);
+  $('#delete').addEventListener('click', deleteItem);
+  $('#persist').addEventListener('click', persistConfig);
+
+  window.addEventListener('hashchange', showTab);
+  showTab();
+  listenEvents();
+  setInterval(refresh, refreshInterval);
+}
+
+init();